@@ -0,0 +1,71 @@
+package portmapping
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// Arg is a named SOAP action argument
+type Arg struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// argList collects every element of an action response
+type argList []Arg
+
+func (l *argList) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			var value string
+			if err := d.DecodeElement(&value, &t); err != nil {
+				return err
+			}
+			*l = append(*l, Arg{Name: t.Name.Local, Value: strings.TrimSpace(value)})
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// PerformAction runs any action of the service at sc and returns the
+// response arguments in document order. It is meant for vendor actions this
+// package has no method for.
+func PerformAction(ctx context.Context, sc *soap.SOAPClient, urn string, action string, args []Arg) ([]Arg, error) {
+	// soap encodes the string fields of a struct in order, so build one
+	// with a field per argument
+	fields := make([]reflect.StructField, len(args))
+	for i, a := range args {
+		if a.Name == "" {
+			return nil, fmt.Errorf("argument %d has no name", i+1)
+		}
+		fields[i] = reflect.StructField{
+			Name: fmt.Sprintf("Arg%d", i),
+			Type: reflect.TypeOf(""),
+			Tag:  reflect.StructTag(fmt.Sprintf("soap:%q", a.Name)),
+		}
+	}
+
+	in := reflect.New(reflect.StructOf(fields)).Elem()
+	for i, a := range args {
+		in.Field(i).SetString(a.Value)
+	}
+
+	var out argList
+	if err := sc.PerformActionCtx(ctx, urn, action, in.Addr().Interface(), &out); err != nil {
+		return nil, upnpError(action, err)
+	}
+
+	return out, nil
+}
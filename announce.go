@@ -0,0 +1,164 @@
+package portmapping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+)
+
+// announceAddrs are the groups NAT-PMP and PCP servers multicast their
+// restart and external address change announcements to
+var announceAddrs = []struct{ network, addr string }{
+	{"udp4", "224.0.0.1:5350"},
+	{"udp6", "[ff02::1]:5350"},
+}
+
+// Announcement is an unsolicited message of a NAT-PMP or PCP gateway, sent
+// when it restarts or, for NAT-PMP, when its external address changes. The
+// gateway may have lost its mappings.
+type Announcement struct {
+	Protocol string
+	Gateway  net.IP
+	// Epoch is the seconds since the gateway started or lost its mappings
+	Epoch uint32
+	// ExternalIP is only announced by NAT-PMP
+	ExternalIP net.IP
+}
+
+// ListenAnnouncements calls fn with every announcement of gateway until ctx
+// is done. An empty gateway accepts announcements of any sender.
+func ListenAnnouncements(ctx context.Context, gateway string, fn func(Announcement)) error {
+	var from net.IP
+	if gateway != "" {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", gateway)
+		if err != nil {
+			return err
+		}
+		from = ips[0]
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var conns []*net.UDPConn
+	for _, a := range announceAddrs {
+		addr, err := net.ResolveUDPAddr(a.network, a.addr)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenMulticastUDP(a.network, nil, addr)
+		if err != nil {
+			slog.Debug("joining announcement group", "group", a.addr, "err", err)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return errors.New("can't join any NAT-PMP/PCP announcement group")
+	}
+
+	go func() {
+		<-ctx.Done()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	anns := make(chan Announcement)
+	errc := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn *net.UDPConn) {
+			buf := make([]byte, 1100)
+			for {
+				n, src, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					errc <- err
+					return
+				}
+				if from != nil && !from.Equal(src.IP) {
+					continue
+				}
+
+				a, ok := parseAnnouncement(buf[:n])
+				if !ok {
+					continue
+				}
+				a.Gateway = src.IP
+				select {
+				case anns <- a:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(conn)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		case a := <-anns:
+			slog.Debug("gateway announcement", "protocol", a.Protocol, "gateway", a.Gateway, "epoch", a.Epoch)
+			fn(a)
+		}
+	}
+}
+
+// parseAnnouncement decodes a NAT-PMP external address or PCP ANNOUNCE
+// response
+func parseAnnouncement(b []byte) (Announcement, bool) {
+	switch {
+	case len(b) >= 12 && b[0] == natpmpVersion && b[1] == natpmpOpExternal|0x80 && binary.BigEndian.Uint16(b[2:]) == 0:
+		return Announcement{
+			Protocol:   "NAT-PMP",
+			Epoch:      binary.BigEndian.Uint32(b[4:]),
+			ExternalIP: net.IPv4(b[8], b[9], b[10], b[11]),
+		}, true
+	case len(b) >= pcpHeaderSize && b[0] == pcpVersion && b[1] == pcpOpAnnounce|0x80 && b[3] == 0:
+		return Announcement{
+			Protocol: "PCP",
+			Epoch:    binary.BigEndian.Uint32(b[8:]),
+		}, true
+	}
+	return Announcement{}, false
+}
+
+// announcer is implemented by mappers whose gateway multicasts announcements
+type announcer interface {
+	gatewayAddr() string
+}
+
+func (c *NATPMPClient) gatewayAddr() string { return c.gateway }
+
+func (c *PCPClient) gatewayAddr() string { return c.gateway }
+
+// announcements returns a channel signalled on every announcement of the
+// gateway of m, nil if m has none
+func announcements(ctx context.Context, m PortMapper) <-chan struct{} {
+	a, ok := m.(announcer)
+	if !ok {
+		return nil
+	}
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		err := ListenAnnouncements(ctx, a.gatewayAddr(), func(Announcement) {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		})
+		if ctx.Err() == nil {
+			slog.Warn("listening for gateway announcements", "gateway", a.gatewayAddr(), "err", err)
+		}
+	}()
+
+	return ch
+}
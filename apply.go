@@ -0,0 +1,88 @@
+package portmapping
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// EntryAdder is a PortMapper able to add mappings limited to a remote host
+// or disabled, like UPnP clients
+type EntryAdder interface {
+	AddPortMappingEntry(ctx context.Context, pme *PortMappingEntry) error
+}
+
+// Entry returns the mapping r creates
+func (r *MappingRequest) Entry() (*PortMappingEntry, error) {
+	pme, err := newPortMappingEntry(r.ExternalPort, r.Protocol, r.InternalPort, r.InternalClient, r.Description, uint32(r.Lease/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	pme.NewRemoteHost = r.RemoteHost
+	if r.Disabled {
+		pme.NewEnabled, _ = soap.MarshalBoolean(false)
+	}
+	return pme, nil
+}
+
+// PlanMappings returns the changes turning the current mappings into the
+// desired ones ordered by key. Current mappings missing from desired are
+// only removed when prune is set.
+func PlanMappings(current, desired []*PortMappingEntry, prune bool) []MappingChange {
+	var plan []MappingChange
+	for _, c := range DiffMappings(current, desired) {
+		if c.Kind == MappingRemoved && !prune {
+			continue
+		}
+		plan = append(plan, c)
+	}
+
+	return plan
+}
+
+// ApplyChanges performs the changes on m in order. Changed mappings are
+// deleted before their new entry is added, as some devices refuse to
+// overwrite a mapping of another internal client.
+func ApplyChanges(ctx context.Context, m PortMapper, changes []MappingChange) error {
+	for _, c := range changes {
+		if c.Old != nil {
+			if err := deleteEntry(ctx, m, c.Old); err != nil {
+				return err
+			}
+		}
+		if c.New != nil {
+			if err := addEntry(ctx, m, c.New); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func deleteEntry(ctx context.Context, m PortMapper, pme *PortMappingEntry) error {
+	ext, err := soap.UnmarshalUi2(pme.NewExternalPort)
+	if err != nil {
+		return fmt.Errorf("external port %q: %w", pme.NewExternalPort, err)
+	}
+
+	return m.DeletePortMapping(ctx, pme.NewRemoteHost, ext, pme.NewProtocol)
+}
+
+func addEntry(ctx context.Context, m PortMapper, pme *PortMappingEntry) error {
+	mapping, err := pme.Mapping()
+	if err != nil {
+		return err
+	}
+	if mapping.RemoteHost != nil || !mapping.Enabled {
+		ea, ok := m.(EntryAdder)
+		if !ok {
+			return fmt.Errorf("%s: mappings limited to a remote host or disabled: %w", m, ErrNotSupported)
+		}
+		return ea.AddPortMappingEntry(ctx, mapping.Entry())
+	}
+
+	return m.AddPortMapping(ctx, mapping.ExternalPort, mapping.Protocol, mapping.InternalPort, mapping.InternalClient.String(), mapping.Description, uint32(mapping.Lease/time.Second))
+}
@@ -0,0 +1,164 @@
+package portmapping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanMappings(t *testing.T) {
+	web := testEntry("80", "TCP", "web")
+	dns := testEntry("53", "UDP", "dns")
+	moved := with(web, func(p *PortMappingEntry) { p.NewInternalClient = "192.168.1.11" })
+
+	tests := []struct {
+		name             string
+		current, desired []*PortMappingEntry
+		prune            bool
+		want             []string
+	}{
+		{"in place", []*PortMappingEntry{web}, []*PortMappingEntry{web}, false, nil},
+		{"add", nil, []*PortMappingEntry{web}, false, []string{"added |80|TCP"}},
+		{"change", []*PortMappingEntry{web}, []*PortMappingEntry{moved}, false, []string{"changed |80|TCP"}},
+		{"undeclared kept", []*PortMappingEntry{web, dns}, []*PortMappingEntry{web}, false, nil},
+		{"undeclared pruned", []*PortMappingEntry{web, dns}, []*PortMappingEntry{web}, true, []string{"removed |53|UDP"}},
+		{"prune all", []*PortMappingEntry{web, dns}, nil, true, []string{"removed |53|UDP", "removed |80|TCP"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := changeKinds(PlanMappings(tt.current, tt.desired, tt.prune))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingMapper is a PortMapper recording the mutating calls
+type recordingMapper struct {
+	PortMapper
+	calls []string
+}
+
+func (m *recordingMapper) String() string { return "recorder" }
+
+func (m *recordingMapper) AddPortMapping(ctx context.Context, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) error {
+	m.calls = append(m.calls, fmt.Sprintf("add %d/%s %s:%d %q %d", externalPort, protocol, internalClient, internalPort, description, leaseDuration))
+	return nil
+}
+
+func (m *recordingMapper) DeletePortMapping(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error {
+	m.calls = append(m.calls, fmt.Sprintf("delete %q %d/%s", remoteHost, externalPort, protocol))
+	return nil
+}
+
+// entryMapper is a recordingMapper able to add any entry
+type entryMapper struct {
+	recordingMapper
+}
+
+func (m *entryMapper) AddPortMappingEntry(ctx context.Context, pme *PortMappingEntry) error {
+	m.calls = append(m.calls, fmt.Sprintf("add entry %s enabled=%s", pme.Key(), pme.NewEnabled))
+	return nil
+}
+
+func TestApplyChanges(t *testing.T) {
+	web := testEntry("80", "TCP", "web")
+	moved := with(web, func(p *PortMappingEntry) { p.NewInternalClient = "192.168.1.11" })
+	dns := testEntry("53", "UDP", "dns")
+
+	m := &recordingMapper{}
+	changes := []MappingChange{
+		{Kind: MappingChanged, Old: web, New: moved},
+		{Kind: MappingRemoved, Old: dns},
+		{Kind: MappingAdded, New: testEntry("443", "TCP", "tls")},
+	}
+	if err := ApplyChanges(context.Background(), m, changes); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`delete "" 80/TCP`,
+		`add 80/TCP 192.168.1.11:80 "web" 0`,
+		`delete "" 53/UDP`,
+		`add 443/TCP 192.168.1.10:443 "tls" 0`,
+	}
+	if !reflect.DeepEqual(m.calls, want) {
+		t.Errorf("got %q, want %q", m.calls, want)
+	}
+}
+
+func TestApplyChangesEntries(t *testing.T) {
+	limited := with(testEntry("80", "TCP", "web"), func(p *PortMappingEntry) { p.NewRemoteHost = "198.51.100.4" })
+	disabled := with(testEntry("53", "UDP", "dns"), func(p *PortMappingEntry) { p.NewEnabled = "0" })
+
+	tests := []struct {
+		name string
+		pme  *PortMappingEntry
+		want string
+	}{
+		{"remote host", limited, "add entry 198.51.100.4|80|TCP enabled=1"},
+		{"disabled", disabled, "add entry |53|UDP enabled=0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := []MappingChange{{Kind: MappingAdded, New: tt.pme}}
+
+			err := ApplyChanges(context.Background(), &recordingMapper{}, changes)
+			if !errors.Is(err, ErrNotSupported) {
+				t.Errorf("got %v without AddPortMappingEntry, want ErrNotSupported", err)
+			}
+
+			m := &entryMapper{}
+			if err := ApplyChanges(context.Background(), m, changes); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m.calls, []string{tt.want}) {
+				t.Errorf("got %q, want %q", m.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestMappingRequestEntry(t *testing.T) {
+	tests := []struct {
+		name string
+		req  MappingRequest
+		want Mapping
+	}{
+		{
+			"defaults",
+			MappingRequest{ExternalPort: 80, Protocol: "TCP", InternalPort: 8080, InternalClient: "192.168.1.10", Description: "web"},
+			Mapping{ExternalPort: 80, Protocol: "TCP", InternalPort: 8080, InternalClient: net.ParseIP("192.168.1.10"), Enabled: true, Description: "web"},
+		},
+		{
+			"lease in seconds",
+			MappingRequest{ExternalPort: 53, Protocol: "UDP", InternalPort: 53, InternalClient: "192.168.1.10", Lease: 90*time.Second + 500*time.Millisecond},
+			Mapping{ExternalPort: 53, Protocol: "UDP", InternalPort: 53, InternalClient: net.ParseIP("192.168.1.10"), Enabled: true, Lease: 90 * time.Second},
+		},
+		{
+			"remote host and disabled",
+			MappingRequest{RemoteHost: "198.51.100.4", ExternalPort: 22, Protocol: "TCP", InternalPort: 22, InternalClient: "192.168.1.10", Disabled: true},
+			Mapping{RemoteHost: net.ParseIP("198.51.100.4"), ExternalPort: 22, Protocol: "TCP", InternalPort: 22, InternalClient: net.ParseIP("192.168.1.10")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pme, err := tt.req.Entry()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := pme.Mapping()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package portmapping
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// RebootFunc receives a responder that rebooted or changed its
+// description, old is how it answered before
+type RebootFunc func(old, new Responder)
+
+// rebooted reports whether new is a different boot or configuration of
+// old. Devices without BOOTID.UPNP.ORG are compared by location, which
+// usually gets a new port when the daemon restarts.
+func rebooted(old, new Responder) bool {
+	if old.BootID != "" && new.BootID != "" && old.BootID != new.BootID {
+		return true
+	}
+	if old.ConfigID != new.ConfigID {
+		return true
+	}
+	return old.Location.String() != new.Location.String()
+}
+
+// WatchReboots searches host every interval and calls fn for every known
+// device answering with another BOOTID.UPNP.ORG, CONFIGID.UPNP.ORG or
+// location than before, until ctx is done. Devices are told apart by USN.
+// Failed searches, common while a device reboots, are only logged.
+func WatchReboots(ctx context.Context, host string, port string, opts *SearchOptions, interval time.Duration, fn RebootFunc) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	known := make(map[string]Responder)
+	for {
+		responders, err := SearchResponders(ctx, host, port, opts)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			slog.Debug("searching for reboots", "err", err)
+		}
+
+		for _, r := range responders {
+			key := r.USN
+			if key == "" {
+				key = r.Location.String()
+			}
+			old, ok := known[key]
+			known[key] = r
+			if ok && rebooted(old, r) {
+				slog.Info("device rebooted", "usn", r.USN, "boot_id", r.BootID, "config_id", r.ConfigID, "location", r.Location)
+				fn(old, r)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/huin/goupnp"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// actionArgs is a repeatable Name=Value flag
+type actionArgs []portmapping.Arg
+
+func (a *actionArgs) String() string {
+	var s []string
+	for _, arg := range *a {
+		s = append(s, arg.Name+"="+arg.Value)
+	}
+	return strings.Join(s, ",")
+}
+
+func (a *actionArgs) Set(v string) error {
+	name, value, found := strings.Cut(v, "=")
+	if !found || name == "" {
+		return errors.New("argument must be Name=Value")
+	}
+
+	*a = append(*a, portmapping.Arg{Name: name, Value: value})
+	return nil
+}
+
+func runAction(args []string) error {
+	var (
+		target  targetFlags
+		urn     string
+		action  string
+		in      actionArgs
+		jsonOut bool
+	)
+
+	fs := newFlagSet("action")
+	target.register(fs)
+	fs.StringVar(&urn, "urn", "", "Service type to call, e.g. urn:schemas-upnp-org:service:WANIPConnection:1")
+	fs.StringVar(&action, "action", "", "Action to perform, e.g. GetStatusInfo")
+	fs.Var(&in, "arg", "Action argument as Name=Value, may be repeated in the order the action expects")
+	fs.BoolVar(&jsonOut, "json", false, "Print the response arguments as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if urn == "" || action == "" {
+		return errors.New("-urn and -action are required")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	locs, err := target.locations(ctx)
+	if err != nil {
+		return err
+	}
+
+	var srv *goupnp.Service
+	for _, loc := range locs {
+		root, err := portmapping.DeviceByURL(ctx, loc)
+		if err != nil {
+			return err
+		}
+		if found := root.Device.FindService(urn); len(found) > 0 {
+			srv = found[0]
+			break
+		}
+	}
+	if srv == nil {
+		return fmt.Errorf("no device exposes %s", urn)
+	}
+
+	sc := srv.NewSOAPClient()
+	if target.trace {
+		portmapping.TraceSOAP(sc, os.Stderr)
+	}
+
+	out, err := portmapping.PerformAction(ctx, sc, urn, action, in)
+	if err != nil {
+		return err
+	}
+
+	if jsonOut {
+		return json.NewEncoder(os.Stdout).Encode(out)
+	}
+	for _, a := range out {
+		fmt.Printf("%s\t%s\n", a.Name, a.Value)
+	}
+	return nil
+}
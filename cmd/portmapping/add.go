@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+func runAdd(args []string) error {
+	var (
+		target  targetFlags
+		m       mappingFlags
+		anyPort bool
+		retries int
+		dry     bool
+		verify  bool
+		check   verifyFlags
+	)
+
+	fs := newFlagSet("add")
+	target.register(fs)
+	m.register(fs)
+	registerDryRun(fs, &dry)
+	fs.BoolVar(&anyPort, "any", false, "Let a WANIPConnection:2 device pick another external port if -ext is taken")
+	fs.IntVar(&retries, "retry-ports", 0, "On a conflict try up to this many following external ports, or let a WANIPConnection:2 device pick one")
+	fs.BoolVar(&verify, "verify", false, "Check the mapping from outside with -check-url once added")
+	check.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if verify {
+		if err := check.validate(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	if err := m.validate(!target.selfOnly()); err != nil {
+		return err
+	}
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+	c = withDryRun(c, dry)
+
+	requested := m.extPort
+	if uc, ok := c.(anyPortMapper); ok && anyPort {
+		reserved, err := uc.AddAnyPortMapping(ctx, uint16(m.extPort), m.proto, uint16(m.intPort), m.client, m.desc, uint32(m.lease))
+		if err != nil {
+			return err
+		}
+		m.extPort = uint(reserved)
+	} else if retries > 0 {
+		req := m.request()
+		assigned, err := req.AddResolvingConflicts(ctx, c, retries)
+		if err != nil {
+			return err
+		}
+		m.extPort = uint(assigned)
+	} else if err := c.AddPortMapping(ctx, uint16(m.extPort), m.proto, uint16(m.intPort), m.client, m.desc, uint32(m.lease)); err != nil {
+		return err
+	}
+
+	if dry {
+		return nil
+	}
+	if m.extPort != requested {
+		slog.Warn("external port was taken, the device assigned another", "requested", requested, "assigned", m.extPort)
+	}
+	slog.Info("added mapping", "protocol", m.proto, "external_port", m.extPort, "internal_client", m.client, "internal_port", m.intPort)
+
+	if !verify {
+		return nil
+	}
+	ext, err := c.ExternalIP(ctx)
+	if err != nil {
+		return fmt.Errorf("getting external IP: %w", err)
+	}
+	req := m.request()
+	pme, err := req.Entry()
+	if err != nil {
+		return err
+	}
+	rec := check.verify(ctx, ext, pme)
+	rec.Device = c.String()
+	return printReach([]reachRecord{rec}, false)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// config is the desired state read by apply and import and written by
+// export
+type config struct {
+	Mappings []configMapping `yaml:"mappings" json:"mappings"`
+
+	// verbatim keeps the descriptions as written, import -verbatim
+	// restores those of other hosts
+	verbatim bool
+	// owner tags the descriptions, the tag of this host if it is empty
+	owner string
+}
+
+// tag returns the tag of the host the mappings of cfg are added for
+func (cfg *config) tag() string {
+	if cfg.owner != "" {
+		return cfg.owner
+	}
+	return ownerTag()
+}
+
+// configMapping is a desired mapping, zero fields use the same defaults as
+// the add flags
+type configMapping struct {
+	RemoteHost     string `yaml:"remote_host,omitempty" json:"remote_host,omitempty"`
+	ExternalPort   uint16 `yaml:"external_port" json:"external_port"`
+	InternalPort   uint16 `yaml:"internal_port,omitempty" json:"internal_port,omitempty"`
+	Protocol       string `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	InternalClient string `yaml:"internal_client,omitempty" json:"internal_client,omitempty"`
+	Description    string `yaml:"description,omitempty" json:"description,omitempty"`
+	Lease          uint32 `yaml:"lease,omitempty" json:"lease,omitempty"`
+	// Enabled is true when unset
+	Enabled *bool `yaml:"enabled,omitempty" json:"enabled,omitempty"`
+}
+
+// key identifies the mapping like portmapping.PortMappingEntry.Key, proto
+// is the protocol of the mapping upper cased
+func (cm *configMapping) key(proto string) string {
+	return fmt.Sprintf("%s|%d|%s", cm.RemoteHost, cm.ExternalPort, proto)
+}
+
+func readConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &cfg, nil
+}
+
+// requests validates the config and returns its mappings, client is used
+// for mappings without an internal client
+func (cfg *config) requests(client string) ([]portmapping.MappingRequest, error) {
+	seen := make(map[string]bool)
+	var reqs []portmapping.MappingRequest
+
+	for i, cm := range cfg.Mappings {
+		r := portmapping.MappingRequest{
+			RemoteHost:     cm.RemoteHost,
+			ExternalPort:   cm.ExternalPort,
+			Protocol:       strings.ToUpper(cm.Protocol),
+			InternalPort:   cm.InternalPort,
+			InternalClient: cm.InternalClient,
+			Description:    cm.Description,
+			Lease:          time.Duration(cm.Lease) * time.Second,
+			Disabled:       cm.Enabled != nil && !*cm.Enabled,
+		}
+		if r.ExternalPort == 0 {
+			return nil, fmt.Errorf("mapping %d: external_port is required", i+1)
+		}
+		if r.Protocol == "" {
+			r.Protocol = "TCP"
+		}
+		if r.Protocol != "TCP" && r.Protocol != "UDP" {
+			return nil, fmt.Errorf("mapping %d: protocol must be TCP or UDP", i+1)
+		}
+		if r.InternalPort == 0 {
+			r.InternalPort = r.ExternalPort
+		}
+		if r.InternalClient == "" {
+			r.InternalClient = client
+		}
+		if r.InternalClient == "" {
+			return nil, fmt.Errorf("mapping %d: internal_client is required", i+1)
+		}
+		if net.ParseIP(r.InternalClient) == nil {
+			return nil, fmt.Errorf("mapping %d: internal_client must be an IP address", i+1)
+		}
+		if r.RemoteHost != "" && net.ParseIP(r.RemoteHost) == nil {
+			return nil, fmt.Errorf("mapping %d: remote_host must be an IP address", i+1)
+		}
+		switch {
+		case cfg.verbatim:
+		case r.Description == "":
+			r.Description = tagDescriptionAs(cfg.tag(), legacyDescription)
+		default:
+			r.Description = tagDescriptionAs(cfg.tag(), r.Description)
+		}
+
+		key := cm.key(r.Protocol)
+		if seen[key] {
+			name := fmt.Sprintf("%d/%s", r.ExternalPort, r.Protocol)
+			if r.RemoteHost != "" {
+				name += " from " + r.RemoteHost
+			}
+			return nil, fmt.Errorf("mapping %d: %s is declared twice", i+1, name)
+		}
+		seen[key] = true
+
+		reqs = append(reqs, r)
+	}
+
+	return reqs, nil
+}
+
+func runApply(args []string) error {
+	var (
+		target targetFlags
+		prune  bool
+		dry    bool
+	)
+
+	fs := newFlagSet("apply")
+	target.register(fs)
+	fs.BoolVar(&prune, "prune", false, "Delete the mappings of the device that the config does not declare")
+	registerDryRun(fs, &dry)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s apply [flags] [config.yaml]\n\nWithout a config file the mappings of the settings file are applied.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errors.New("a single config file is required")
+	}
+
+	cfg := &config{Mappings: defaults.Mappings}
+	if fs.NArg() == 1 {
+		var err error
+		if cfg, err = readConfig(fs.Arg(0)); err != nil {
+			return err
+		}
+	} else if len(cfg.Mappings) == 0 {
+		return errors.New("a config file is required when the settings file has no mappings")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	return reconcile(ctx, c, cfg, prune, dry)
+}
+
+// desired returns the mappings of cfg as entries, client is used for
+// mappings without an internal client
+func (cfg *config) desired(client string) ([]*portmapping.PortMappingEntry, error) {
+	reqs, err := cfg.requests(client)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := make([]*portmapping.PortMappingEntry, 0, len(reqs))
+	for _, r := range reqs {
+		pme, err := r.Entry()
+		if err != nil {
+			return nil, err
+		}
+		desired = append(desired, pme)
+	}
+	return desired, nil
+}
+
+// plan returns the changes apply makes to the current mappings for the
+// desired ones of cfg, deleting undeclared mappings if prune is set
+func (cfg *config) plan(current, desired []*portmapping.PortMappingEntry, prune bool) []portmapping.MappingChange {
+	if !cfg.verbatim {
+		desired = keepUntagged(current, desired, cfg.tag())
+	}
+	return portmapping.PlanMappings(current, desired, prune)
+}
+
+// reconcile makes the mappings of c match cfg and prints the plan
+func reconcile(ctx context.Context, c portmapping.PortMapper, cfg *config, prune bool, dry bool) error {
+	// Mappings without a client point at this host
+	var client string
+	if uc, ok := c.(*portmapping.Client); ok {
+		if ip, err := uc.LocalIP(); err == nil {
+			client = ip.String()
+		}
+	}
+
+	desired, err := cfg.desired(client)
+	if err != nil {
+		return err
+	}
+
+	// NAT-PMP and PCP can't list, so every mapping is added again
+	current, err := c.ListMappings(ctx)
+	if errors.Is(err, portmapping.ErrNotSupported) && !prune {
+		current, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	plan := cfg.plan(current, desired, prune)
+	if len(plan) == 0 {
+		fmt.Println("no changes")
+		return nil
+	}
+	for _, ch := range plan {
+		fmt.Println(changeSymbol(ch.Kind), describeChange(ch))
+	}
+
+	if err := portmapping.ApplyChanges(ctx, withDryRun(c, dry), plan); err != nil {
+		return err
+	}
+
+	if dry {
+		return nil
+	}
+	slog.Info("applied changes", "count", len(plan))
+	return nil
+}
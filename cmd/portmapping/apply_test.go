@@ -0,0 +1,219 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func TestConfigRequests(t *testing.T) {
+	off := false
+	tests := []struct {
+		name     string
+		mappings []configMapping
+		verbatim bool
+		want     []portmapping.MappingRequest
+		wantErr  string
+	}{
+		{
+			name:     "defaults",
+			mappings: []configMapping{{ExternalPort: 80}},
+			want:     []portmapping.MappingRequest{{ExternalPort: 80, Protocol: "TCP", InternalPort: 80, InternalClient: "192.168.1.10", Description: "pm:test:portmapping"}},
+		},
+		{
+			name:     "everything",
+			mappings: []configMapping{{RemoteHost: "198.51.100.4", ExternalPort: 53, InternalPort: 5353, Protocol: "udp", InternalClient: "192.168.1.11", Description: "dns", Lease: 60, Enabled: &off}},
+			want:     []portmapping.MappingRequest{{RemoteHost: "198.51.100.4", ExternalPort: 53, Protocol: "UDP", InternalPort: 5353, InternalClient: "192.168.1.11", Description: "pm:test:dns", Lease: time.Minute, Disabled: true}},
+		},
+		{
+			name:     "tagged already",
+			mappings: []configMapping{{ExternalPort: 80, Description: "pm:nas:web"}},
+			want:     []portmapping.MappingRequest{{ExternalPort: 80, Protocol: "TCP", InternalPort: 80, InternalClient: "192.168.1.10", Description: "pm:nas:web"}},
+		},
+		{
+			name:     "verbatim",
+			mappings: []configMapping{{ExternalPort: 80, Description: "web"}, {ExternalPort: 81}},
+			verbatim: true,
+			want: []portmapping.MappingRequest{
+				{ExternalPort: 80, Protocol: "TCP", InternalPort: 80, InternalClient: "192.168.1.10", Description: "web"},
+				{ExternalPort: 81, Protocol: "TCP", InternalPort: 81, InternalClient: "192.168.1.10"},
+			},
+		},
+		{
+			name:     "same port from several remote hosts",
+			mappings: []configMapping{{ExternalPort: 22}, {ExternalPort: 22, RemoteHost: "198.51.100.4"}, {ExternalPort: 22, Protocol: "UDP"}},
+			verbatim: true,
+			want: []portmapping.MappingRequest{
+				{ExternalPort: 22, Protocol: "TCP", InternalPort: 22, InternalClient: "192.168.1.10"},
+				{RemoteHost: "198.51.100.4", ExternalPort: 22, Protocol: "TCP", InternalPort: 22, InternalClient: "192.168.1.10"},
+				{ExternalPort: 22, Protocol: "UDP", InternalPort: 22, InternalClient: "192.168.1.10"},
+			},
+		},
+		{name: "no port", mappings: []configMapping{{}}, wantErr: "mapping 1: external_port is required"},
+		{name: "bad protocol", mappings: []configMapping{{ExternalPort: 80, Protocol: "sctp"}}, wantErr: "mapping 1: protocol must be TCP or UDP"},
+		{name: "bad client", mappings: []configMapping{{ExternalPort: 80, InternalClient: "nas"}}, wantErr: "mapping 1: internal_client must be an IP address"},
+		{name: "bad remote host", mappings: []configMapping{{ExternalPort: 80, RemoteHost: "example.com"}}, wantErr: "mapping 1: remote_host must be an IP address"},
+		{name: "twice", mappings: []configMapping{{ExternalPort: 80}, {ExternalPort: 80, Protocol: "tcp"}}, wantErr: "mapping 2: 80/TCP is declared twice"},
+		{
+			name:     "twice from a remote host",
+			mappings: []configMapping{{ExternalPort: 80, RemoteHost: "198.51.100.4"}, {ExternalPort: 80, RemoteHost: "198.51.100.4"}},
+			wantErr:  "mapping 2: 80/TCP from 198.51.100.4 is declared twice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config{Mappings: tt.mappings, verbatim: tt.verbatim, owner: "pm:test:"}
+			got, err := cfg.requests("192.168.1.10")
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigRequestsNoClient(t *testing.T) {
+	cfg := &config{Mappings: []configMapping{{ExternalPort: 80}}, owner: "pm:test:"}
+	if _, err := cfg.requests(""); err == nil || err.Error() != "mapping 1: internal_client is required" {
+		t.Errorf("got %v, want the client required", err)
+	}
+}
+
+// entries returns the mappings of cm as the device lists them
+func entries(t *testing.T, cm ...configMapping) []*portmapping.PortMappingEntry {
+	t.Helper()
+	pmes, err := (&config{Mappings: cm, verbatim: true}).desired("192.168.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pmes
+}
+
+// changes returns the plan as apply prints it
+func changes(plan []portmapping.MappingChange) []string {
+	var out []string
+	for _, ch := range plan {
+		out = append(out, changeSymbol(ch.Kind)+" "+describeChange(ch))
+	}
+	return out
+}
+
+func TestConfigPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  []configMapping
+		desired  []configMapping
+		verbatim bool
+		prune    bool
+		want     []string
+	}{
+		{
+			name:    "in place",
+			current: []configMapping{{ExternalPort: 80, Description: "pm:test:web"}},
+			desired: []configMapping{{ExternalPort: 80, Description: "web"}},
+		},
+		{
+			name:    "untagged left alone",
+			current: []configMapping{{ExternalPort: 80, Description: "web"}, {ExternalPort: 81, Description: "portmapping"}},
+			desired: []configMapping{{ExternalPort: 80, Description: "web"}, {ExternalPort: 81}},
+		},
+		{
+			name:    "untagged of another client changed",
+			current: []configMapping{{ExternalPort: 80, Description: "web", InternalClient: "192.168.1.11"}},
+			desired: []configMapping{{ExternalPort: 80, Description: "web"}},
+			want:    []string{`~ TCP 80 -> 192.168.1.11:80 "web" => TCP 80 -> 192.168.1.10:80 "web"`},
+		},
+		{
+			name:    "other description tagged",
+			current: []configMapping{{ExternalPort: 80, Description: "qBittorrent"}},
+			desired: []configMapping{{ExternalPort: 80, Description: "web"}},
+			want:    []string{`~ TCP 80 -> 192.168.1.10:80 "qBittorrent" => TCP 80 -> 192.168.1.10:80 "pm:test:web"`},
+		},
+		{
+			name:     "verbatim",
+			current:  []configMapping{{ExternalPort: 80, Description: "pm:test:web"}},
+			desired:  []configMapping{{ExternalPort: 80, Description: "web"}},
+			verbatim: true,
+			want:     []string{`~ TCP 80 -> 192.168.1.10:80 "pm:test:web" => TCP 80 -> 192.168.1.10:80 "web"`},
+		},
+		{
+			name:    "added tagged",
+			desired: []configMapping{{ExternalPort: 80, Description: "web", RemoteHost: "198.51.100.4"}},
+			want:    []string{`+ TCP 80 -> 192.168.1.10:80 "pm:test:web" from 198.51.100.4`},
+		},
+		{
+			name:    "disabled",
+			current: []configMapping{{ExternalPort: 80, Description: "pm:test:web"}},
+			desired: []configMapping{{ExternalPort: 80, Description: "web", Enabled: new(bool)}},
+			want:    []string{`~ TCP 80 -> 192.168.1.10:80 "pm:test:web" => TCP 80 -> 192.168.1.10:80 "pm:test:web" disabled`},
+		},
+		{
+			name:    "undeclared kept",
+			current: []configMapping{{ExternalPort: 22, Description: "ssh"}},
+		},
+		{
+			name:    "undeclared pruned",
+			current: []configMapping{{ExternalPort: 22, Description: "ssh"}},
+			prune:   true,
+			want:    []string{`- TCP 22 -> 192.168.1.10:22 "ssh"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config{Mappings: tt.desired, verbatim: tt.verbatim, owner: "pm:test:"}
+			desired, err := cfg.desired("192.168.1.10")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := changes(cfg.plan(entries(t, tt.current...), desired, tt.prune))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportConfig(t *testing.T) {
+	off := false
+	mappings := entries(t,
+		configMapping{ExternalPort: 80, Description: "web", Lease: 3599},
+		configMapping{ExternalPort: 53, Protocol: "UDP", Description: "dns", Lease: 61},
+		configMapping{ExternalPort: 22, RemoteHost: "198.51.100.4", Description: "ssh", Enabled: &off},
+	)
+	configured := []configMapping{{ExternalPort: 80, Lease: 7200}}
+
+	cfg, err := exportConfig(mappings, configured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []configMapping{
+		{ExternalPort: 80, InternalPort: 80, Protocol: "TCP", InternalClient: "192.168.1.10", Description: "web", Lease: 7200},
+		{ExternalPort: 53, InternalPort: 53, Protocol: "UDP", InternalClient: "192.168.1.10", Description: "dns", Lease: 120},
+		{RemoteHost: "198.51.100.4", ExternalPort: 22, InternalPort: 22, Protocol: "TCP", InternalClient: "192.168.1.10", Description: "ssh", Enabled: &off},
+	}
+	if !reflect.DeepEqual(cfg.Mappings, want) {
+		t.Errorf("got %+v, want %+v", cfg.Mappings, want)
+	}
+
+	// Imported verbatim the export plans no change
+	cfg.verbatim = true
+	desired, err := cfg.desired("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan := cfg.plan(mappings, desired, true); len(plan) != 0 {
+		t.Errorf("import plans %s", strings.Join(changes(plan), ", "))
+	}
+}
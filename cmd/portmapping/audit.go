@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// exitViolations is the exit code of audit when a mapping breaks a rule of
+// at least the -fail-on severity
+const exitViolations = 3
+
+// errViolations is returned by audit to exit with exitViolations
+var errViolations = errors.New("policy violations found")
+
+// severity ranks the rules of a policy
+type severity int
+
+const (
+	severityInfo severity = iota
+	severityLow
+	severityMedium
+	severityHigh
+	severityCritical
+)
+
+var severityNames = []string{"info", "low", "medium", "high", "critical"}
+
+func (s severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return strconv.Itoa(int(s))
+	}
+	return severityNames[s]
+}
+
+func (s severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func parseSeverity(s string) (severity, error) {
+	for i, name := range severityNames {
+		if strings.EqualFold(s, name) {
+			return severity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity %q, want one of %s", s, strings.Join(severityNames, ", "))
+}
+
+// servicePorts are the names accepted in the port lists of rules
+var servicePorts = map[string]string{
+	"ftp":      "21",
+	"ssh":      "22",
+	"telnet":   "23",
+	"smtp":     "25",
+	"netbios":  "137-139",
+	"smb":      "445",
+	"mssql":    "1433",
+	"mysql":    "3306",
+	"rdp":      "3389",
+	"postgres": "5432",
+	"vnc":      "5900-5903",
+	"redis":    "6379",
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	from, to uint16
+}
+
+// parsePortRanges parses ports like 80, 1-1023 or rdp
+func parsePortRanges(specs []string) ([]portRange, error) {
+	var ranges []portRange
+	for _, spec := range specs {
+		if p, ok := servicePorts[strings.ToLower(spec)]; ok {
+			spec = p
+		}
+
+		from, to, found := strings.Cut(spec, "-")
+		if !found {
+			to = from
+		}
+		lo, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", spec)
+		}
+		hi, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil || hi < lo {
+			return nil, fmt.Errorf("invalid port range %q", spec)
+		}
+		ranges = append(ranges, portRange{uint16(lo), uint16(hi)})
+	}
+	return ranges, nil
+}
+
+func inRanges(ranges []portRange, port string) bool {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		if uint16(p) >= r.from && uint16(p) <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func inNetworks(nets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// policy is the set of rules audit checks the mappings against
+type policy struct {
+	Rules []*policyRule `yaml:"rules" json:"rules"`
+}
+
+// policyRule is violated by the mappings matching all of its conditions.
+// A rule needs at least one condition.
+type policyRule struct {
+	Name        string `yaml:"name" json:"name"`
+	Severity    string `yaml:"severity,omitempty" json:"severity,omitempty"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+
+	// Ports and InternalPorts hold ports, ranges like 1-1023 and names
+	// like rdp
+	Ports          []string `yaml:"ports,omitempty" json:"ports,omitempty"`
+	InternalPorts  []string `yaml:"internal_ports,omitempty" json:"internal_ports,omitempty"`
+	Protocol       string   `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	ClientsOutside []string `yaml:"clients_outside,omitempty" json:"clients_outside,omitempty"`
+	ClientsInside  []string `yaml:"clients_inside,omitempty" json:"clients_inside,omitempty"`
+	Permanent      bool     `yaml:"permanent,omitempty" json:"permanent,omitempty"`
+	AnyRemoteHost  bool     `yaml:"any_remote_host,omitempty" json:"any_remote_host,omitempty"`
+	// UPnProxy matches mappings that look injected into a compromised
+	// router, LAN lists the networks of internal clients besides the
+	// private ranges
+	UPnProxy bool     `yaml:"upnproxy,omitempty" json:"upnproxy,omitempty"`
+	LAN      []string `yaml:"lan,omitempty" json:"lan,omitempty"`
+
+	severity      severity
+	ports         []portRange
+	internalPorts []portRange
+	outside       []*net.IPNet
+	inside        []*net.IPNet
+	proxy         portmapping.ProxyCheck
+}
+
+// builtinPolicy is audited without a -policy file
+var builtinPolicy = policy{Rules: []*policyRule{
+	{Name: "upnproxy", Severity: "critical", Description: "Looks injected to relay traffic through the router, which is likely compromised",
+		UPnProxy: true},
+	{Name: "remote-access-exposed", Severity: "critical", Description: "Remote access or file sharing reachable from the internet",
+		Ports: []string{"telnet", "netbios", "smb", "rdp", "vnc"}},
+	{Name: "database-exposed", Severity: "high", Description: "Database reachable from the internet",
+		Ports: []string{"mssql", "mysql", "postgres", "redis"}},
+	{Name: "privileged-port", Severity: "medium", Description: "External port below 1024",
+		Ports: []string{"1-1023"}},
+	{Name: "permanent-lease", Severity: "low", Description: "Mapping never expires",
+		Permanent: true},
+}}
+
+func readPolicy(path string) (*policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p policy
+	if err := yaml.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := p.compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// loadPolicy returns the policy of path, the builtin one if empty
+func loadPolicy(path string) (*policy, error) {
+	if path != "" {
+		return readPolicy(path)
+	}
+	p := builtinPolicy
+	return &p, p.compile()
+}
+
+// compile validates the rules and parses their conditions
+func (p *policy) compile() error {
+	if len(p.Rules) == 0 {
+		return errors.New("no rules")
+	}
+
+	for i, r := range p.Rules {
+		if r.Name == "" {
+			r.Name = "rule-" + strconv.Itoa(i+1)
+		}
+		fail := func(err error) error { return fmt.Errorf("rule %s: %w", r.Name, err) }
+
+		var err error
+		if r.severity, err = parseSeverity(r.Severity); err != nil {
+			if r.Severity != "" {
+				return fail(err)
+			}
+			r.severity = severityMedium
+		}
+		if r.ports, err = parsePortRanges(r.Ports); err != nil {
+			return fail(err)
+		}
+		if r.internalPorts, err = parsePortRanges(r.InternalPorts); err != nil {
+			return fail(err)
+		}
+		if r.outside, err = parseNetworks(r.ClientsOutside); err != nil {
+			return fail(err)
+		}
+		if r.inside, err = parseNetworks(r.ClientsInside); err != nil {
+			return fail(err)
+		}
+		if r.proxy.LAN, err = parseNetworks(r.LAN); err != nil {
+			return fail(err)
+		}
+		switch strings.ToUpper(r.Protocol) {
+		case "", "TCP", "UDP":
+		default:
+			return fail(fmt.Errorf("unknown protocol %q", r.Protocol))
+		}
+
+		if len(r.ports)+len(r.internalPorts)+len(r.outside)+len(r.inside) == 0 && r.Protocol == "" && !r.Permanent && !r.AnyRemoteHost && !r.UPnProxy {
+			return fail(errors.New("no conditions"))
+		}
+	}
+	return nil
+}
+
+// match reports whether pme meets every condition of the rule
+func (r *policyRule) match(pme *portmapping.PortMappingEntry) bool {
+	switch {
+	case r.ports != nil && !inRanges(r.ports, pme.NewExternalPort):
+		return false
+	case r.internalPorts != nil && !inRanges(r.internalPorts, pme.NewInternalPort):
+		return false
+	case r.Protocol != "" && !strings.EqualFold(r.Protocol, pme.NewProtocol):
+		return false
+	case r.outside != nil && inNetworks(r.outside, pme.NewInternalClient):
+		return false
+	case r.inside != nil && !inNetworks(r.inside, pme.NewInternalClient):
+		return false
+	case r.Permanent && pme.NewLeaseDuration != "" && pme.NewLeaseDuration != "0":
+		return false
+	case r.AnyRemoteHost && pme.NewRemoteHost != "":
+		return false
+	case r.UPnProxy && r.proxy.Reason(pme) == "":
+		return false
+	}
+	return true
+}
+
+// violation is a mapping breaking a rule
+type violation struct {
+	Severity    severity                      `json:"severity"`
+	Rule        string                        `json:"rule"`
+	Description string                        `json:"description,omitempty"`
+	Reason      string                        `json:"reason,omitempty"`
+	Device      string                        `json:"device"`
+	Mapping     *portmapping.PortMappingEntry `json:"mapping"`
+}
+
+// audit returns the violations of the mappings in snap, the most severe
+// first
+func (p *policy) audit(snap *snapshot) []violation {
+	var out []violation
+	for _, svc := range snap.Services {
+		for _, pme := range svc.Mappings {
+			for _, r := range p.Rules {
+				if !r.match(pme) {
+					continue
+				}
+				v := violation{Severity: r.severity, Rule: r.Name, Description: r.Description, Device: svc.Device, Mapping: pme}
+				if r.UPnProxy {
+					v.Reason = r.proxy.Reason(pme)
+				}
+				out = append(out, v)
+			}
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Severity > out[j].Severity })
+	return out
+}
+
+func runAudit(args []string) error {
+	var (
+		target     targetFlags
+		policyPath string
+		dbPath     string
+		at         string
+		failOn     string
+		jsonOut    bool
+	)
+
+	fs := newFlagSet("audit")
+	target.register(fs)
+	fs.StringVar(&policyPath, "policy", "", "YAML policy of rules to check (default the builtin rules)")
+	registerHistory(fs, &dbPath)
+	fs.StringVar(&at, "at", "", "With -db, audit the mappings recorded at this time instead of the latest")
+	fs.StringVar(&failOn, "fail-on", "low", "Exit with 3 when a violation has at least this severity")
+	fs.BoolVar(&jsonOut, "json", false, "Print violations as newline delimited JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	threshold, err := parseSeverity(failOn)
+	if err != nil {
+		return err
+	}
+	if at != "" && dbPath == "" {
+		return errors.New("-at needs -db")
+	}
+
+	p, err := loadPolicy(policyPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	var snap *snapshot
+	if dbPath != "" {
+		t := time.Now()
+		if at != "" {
+			if t, err = parseHistoryTime(at); err != nil {
+				return err
+			}
+		}
+
+		h, err := openHistory(dbPath)
+		if err != nil {
+			return err
+		}
+		defer h.Close()
+
+		if snap, err = h.snapshotAt(ctx, t); err != nil {
+			return err
+		}
+	} else {
+		mappers, err := target.mappers(ctx)
+		if err != nil {
+			return err
+		}
+		lists := portmapping.ListAllMappings(ctx, mappers, 4)
+		for _, l := range lists {
+			if l.Err != nil {
+				return fmt.Errorf("%s: %w", l.Mapper, l.Err)
+			}
+		}
+		snap = newSnapshot(lists)
+	}
+
+	violations := p.audit(snap)
+	if err := printViolations(violations, jsonOut); err != nil {
+		return err
+	}
+
+	for _, v := range violations {
+		if v.Severity >= threshold {
+			return errViolations
+		}
+	}
+	return nil
+}
+
+func printViolations(violations []violation, jsonOut bool) error {
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		for _, v := range violations {
+			if err := enc.Encode(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(violations) == 0 {
+		fmt.Println("No violations")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEVERITY\tRULE\tDEVICE\tMAPPING\tDESCRIPTION")
+	for _, v := range violations {
+		desc := v.Description
+		if v.Reason != "" {
+			desc += ": " + v.Reason
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", strings.ToUpper(v.Severity.String()), v.Rule, v.Device, describeMapping(v.Mapping), desc)
+	}
+	return tw.Flush()
+}
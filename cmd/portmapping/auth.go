@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// permission is what a credential may do with the API
+type permission int
+
+const (
+	permRead permission = iota + 1
+	permWrite
+)
+
+func parsePermission(s string) (permission, error) {
+	switch s {
+	case "read", "ro":
+		return permRead, nil
+	case "write", "rw":
+		return permWrite, nil
+	}
+	return 0, fmt.Errorf("unknown permission %q, want read or write", s)
+}
+
+// credential is a bearer token or a basic auth user and password
+type credential struct {
+	user   string
+	secret string
+	perm   permission
+}
+
+// authenticator checks the credentials of API requests. Reads need the read
+// permission, everything changing the gateway the write permission.
+type authenticator struct {
+	tokens []credential
+	users  []credential
+}
+
+// readAuthFile reads one credential per line:
+//
+//	token <secret> read|write
+//	basic <user> <password> read|write
+//
+// Empty lines and lines starting with # are ignored.
+func readAuthFile(path string) (*authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &authenticator{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		var (
+			c   credential
+			err error
+		)
+		switch {
+		case fields[0] == "token" && len(fields) == 3:
+			c.secret = fields[1]
+			c.perm, err = parsePermission(fields[2])
+			a.tokens = append(a.tokens, c)
+		case fields[0] == "basic" && len(fields) == 4:
+			c.user, c.secret = fields[1], fields[2]
+			c.perm, err = parsePermission(fields[3])
+			a.users = append(a.users, c)
+		default:
+			err = errors.New("want token <secret> <permission> or basic <user> <password> <permission>")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(a.tokens)+len(a.users) == 0 {
+		return nil, fmt.Errorf("%s: no credentials", path)
+	}
+
+	return a, nil
+}
+
+// permission returns what the credentials of r allow, zero if none match
+func (a *authenticator) permission(r *http.Request) permission {
+	// Requests for an absolute URL, those of a proxy client like the one
+	// of -agent, carry the credentials of the proxy
+	if r.URL.IsAbs() {
+		r = &http.Request{Method: r.Method, URL: r.URL, Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	// EventSource can't send headers, the web UI passes its token to the
+	// event stream in the URL
+	if !ok && r.Method == http.MethodGet && r.URL.Path == "/events" {
+		token = r.URL.Query().Get("access_token")
+		ok = token != ""
+	}
+	if ok {
+		for _, c := range a.tokens {
+			if equalSecret(token, c.secret) == 1 {
+				return c.perm
+			}
+		}
+		return 0
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		for _, c := range a.users {
+			// Both are compared so the time doesn't tell valid users apart
+			if equalSecret(user, c.user)&equalSecret(pass, c.secret) == 1 {
+				return c.perm
+			}
+		}
+	}
+
+	return 0
+}
+
+func equalSecret(given, want string) int {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(want))
+}
+
+// wrap rejects requests without the permission their method needs
+func (a *authenticator) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		need := permWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			need = permRead
+		}
+
+		perm := a.permission(r)
+		switch {
+		case perm == 0:
+			if len(a.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="portmapping", charset="UTF-8"`)
+			}
+			writeError(w, http.StatusUnauthorized, errors.New("authentication required"))
+		case perm < need:
+			writeError(w, http.StatusForbidden, errors.New("credential is read-only"))
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// isLoopback reports whether the listen address only accepts local
+// connections
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// exportConfig returns the mappings as a config that import recreates.
+// Devices report the lease left, so the lease of a mapping is the one
+// configured declares for it, else what is left rounded up to the minute.
+func exportConfig(mappings []*portmapping.PortMappingEntry, configured []configMapping) (*config, error) {
+	cfg := &config{Mappings: []configMapping{}}
+
+	leases := make(map[string]uint32)
+	for _, cm := range configured {
+		proto := strings.ToUpper(cm.Protocol)
+		if proto == "" {
+			proto = "TCP"
+		}
+		leases[cm.key(proto)] = cm.Lease
+	}
+
+	for _, pme := range mappings {
+		m, err := pme.Mapping()
+		if err != nil {
+			return nil, err
+		}
+
+		cm := configMapping{
+			RemoteHost:     pme.NewRemoteHost,
+			ExternalPort:   m.ExternalPort,
+			InternalPort:   m.InternalPort,
+			Protocol:       m.Protocol,
+			InternalClient: m.InternalClient.String(),
+			Description:    m.Description,
+		}
+		if !m.Enabled {
+			cm.Enabled = new(bool)
+		}
+		lease, ok := leases[cm.key(m.Protocol)]
+		if !ok {
+			lease = uint32((m.Lease + time.Minute - 1) / time.Minute * 60)
+		}
+		cm.Lease = lease
+
+		cfg.Mappings = append(cfg.Mappings, cm)
+	}
+
+	return cfg, nil
+}
+
+func runExport(args []string) error {
+	var (
+		target     targetFlags
+		format     string
+		file       string
+		configFile string
+	)
+
+	fs := newFlagSet("export")
+	target.register(fs)
+	fs.StringVar(&format, "format", "", "Output format: yaml or json (defaults to the -o extension, else yaml)")
+	fs.StringVar(&file, "o", "", "Write to this file instead of stdout")
+	fs.StringVar(&configFile, "config", "", "Config the leases of the mappings are taken from (defaults to the mappings of the settings file), other leases are the time left rounded up to the minute")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	configured := defaults.Mappings
+	if configFile != "" {
+		cfg, err := readConfig(configFile)
+		if err != nil {
+			return err
+		}
+		configured = cfg.Mappings
+	}
+
+	if format == "" {
+		format = "yaml"
+		if filepath.Ext(file) == ".json" {
+			format = "json"
+		}
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	mappings, err := c.ListMappings(ctx)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := exportConfig(mappings, configured)
+	if err != nil {
+		return err
+	}
+
+	var b []byte
+	switch format {
+	case "yaml":
+		b, err = yaml.Marshal(cfg)
+	case "json":
+		b, err = json.MarshalIndent(cfg, "", "  ")
+		b = append(b, '\n')
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if file == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	if err := os.WriteFile(file, b, 0o644); err != nil {
+		return err
+	}
+
+	slog.Info("exported mappings", "count", len(cfg.Mappings), "file", file)
+	return nil
+}
+
+func runImport(args []string) error {
+	var (
+		target   targetFlags
+		dry      bool
+		verbatim bool
+	)
+
+	fs := newFlagSet("import")
+	target.register(fs)
+	registerDryRun(fs, &dry)
+	fs.BoolVar(&verbatim, "verbatim", false, "Restore the descriptions as written, like those of mappings of other hosts, instead of tagging them as added by this host")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [flags] backup.yaml\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("a single backup file is required")
+	}
+
+	cfg, err := readConfig(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	cfg.verbatim = verbatim
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	// Mappings already on the device are left alone
+	return reconcile(ctx, c, cfg, false, dry)
+}
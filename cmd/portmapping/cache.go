@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// locationCache remembers the devices a search found, so later commands
+// can skip the SSDP wait
+type locationCache struct {
+	Entries []cacheEntry `json:"entries"`
+}
+
+// cacheEntry is the result of the search for a target. GatewayMAC is the
+// hardware address of the gateway at the time, a different one means
+// another network and invalidates the entry.
+type cacheEntry struct {
+	Target     string         `json:"target"`
+	GatewayMAC string         `json:"gateway_mac,omitempty"`
+	Devices    []cachedDevice `json:"devices"`
+	Updated    time.Time      `json:"updated"`
+}
+
+// cachedDevice is a description URL, the UDN of the device found there and
+// the interface it was found on. Expires is when its SSDP answer runs out,
+// the location is searched again after it.
+type cachedDevice struct {
+	Location  string    `json:"location"`
+	UDN       string    `json:"udn"`
+	Interface string    `json:"interface,omitempty"`
+	Expires   time.Time `json:"expires,omitempty"`
+}
+
+// cachePath returns the cache file, $XDG_CACHE_HOME/portmapping on Linux
+func cachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "portmapping", "locations.json"), nil
+}
+
+func readCache() (*locationCache, error) {
+	path, err := cachePath()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &locationCache{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lc locationCache
+	if err := json.Unmarshal(b, &lc); err != nil {
+		return nil, err
+	}
+	return &lc, nil
+}
+
+func (lc *locationCache) write() error {
+	path, err := cachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(lc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+func (lc *locationCache) lookup(target string) *cacheEntry {
+	for i := range lc.Entries {
+		if lc.Entries[i].Target == target {
+			return &lc.Entries[i]
+		}
+	}
+	return nil
+}
+
+func (lc *locationCache) store(e cacheEntry) {
+	if old := lc.lookup(e.Target); old != nil {
+		*old = e
+		return
+	}
+	lc.Entries = append(lc.Entries, e)
+}
+
+// cacheKey identifies the search of the target, searches from another
+// interface or address or for other targets may find other devices
+func (t *targetFlags) cacheKey(host string) string {
+	key := net.JoinHostPort(host, t.port)
+	if source.Interface != "" {
+		key += " interface=" + source.Interface
+	}
+	if source.IP != nil {
+		key += " source=" + source.IP.String()
+	}
+	if len(t.search.SearchTargets) > 0 {
+		sts := append([]string(nil), t.search.SearchTargets...)
+		sort.Strings(sts)
+		key += " st=" + strings.Join(sts, ",")
+	}
+	return key
+}
+
+// gatewayMAC returns the hardware address of the gateway of host, empty
+// when it is unknown
+func gatewayMAC(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() || ip.IsMulticast() {
+		gw, err := portmapping.DefaultGateway()
+		if err != nil {
+			return ""
+		}
+		ip = gw
+	}
+
+	mac, err := portmapping.NeighborMAC(ip)
+	if err != nil {
+		return ""
+	}
+	return mac.String()
+}
+
+// cachedClients returns the clients of the devices the last search for host
+// found, nil when there are none or one of them changed
+func (t *targetFlags) cachedClients(ctx context.Context, host string) []*portmapping.Client {
+	// The locations of an agent's LAN are of no use here
+	if t.rediscover || relay != nil {
+		return nil
+	}
+
+	lc, err := readCache()
+	if err != nil {
+		slog.Debug("reading location cache", "err", err)
+		return nil
+	}
+	e := lc.lookup(t.cacheKey(host))
+	if e == nil || len(e.Devices) == 0 {
+		return nil
+	}
+	if e.GatewayMAC != "" && e.GatewayMAC != gatewayMAC(host) {
+		slog.Debug("gateway changed, ignoring cached locations", "target", e.Target)
+		return nil
+	}
+
+	var clients []*portmapping.Client
+	for _, d := range e.Devices {
+		if !d.Expires.IsZero() && time.Now().After(d.Expires) {
+			slog.Debug("cached location expired", "location", d.Location, "expires", d.Expires)
+			return nil
+		}
+		loc, err := url.Parse(d.Location)
+		if err != nil {
+			return nil
+		}
+		cs, err := portmapping.NewClientsByURL(ctx, loc)
+		if err != nil {
+			slog.Debug("cached location is stale", "location", d.Location, "err", err)
+			return nil
+		}
+		if cs[0].RootDevice.Device.UDN != d.UDN {
+			slog.Debug("cached location has another device", "location", d.Location, "udn", cs[0].RootDevice.Device.UDN)
+			return nil
+		}
+		for _, c := range cs {
+			c.Interface, c.Expires = d.Interface, d.Expires
+		}
+		clients = append(clients, cs...)
+	}
+
+	slog.Debug("using cached locations", "target", e.Target)
+	return clients
+}
+
+// cacheClients remembers the devices of clients as the result of the
+// search for host
+func (t *targetFlags) cacheClients(host string, clients []*portmapping.Client) {
+	if relay != nil {
+		return
+	}
+	e := cacheEntry{
+		Target:     t.cacheKey(host),
+		GatewayMAC: gatewayMAC(host),
+		Updated:    time.Now().UTC(),
+	}
+	seen := make(map[string]bool)
+	for _, c := range clients {
+		if c.Location == nil || seen[c.Location.String()] {
+			continue
+		}
+		seen[c.Location.String()] = true
+		e.Devices = append(e.Devices, cachedDevice{Location: c.Location.String(), UDN: c.RootDevice.Device.UDN, Interface: c.Interface, Expires: c.Expires})
+	}
+	if len(e.Devices) == 0 {
+		return
+	}
+
+	lc, err := readCache()
+	if err != nil {
+		lc = &locationCache{}
+	}
+	lc.store(e)
+	if err := lc.write(); err != nil {
+		slog.Debug("writing location cache", "err", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func runDelete(args []string) error {
+	var (
+		target targetFlags
+		m      mappingFlags
+		dry    bool
+		all    bool
+		filter portmapping.MappingFilter
+	)
+
+	fs := newFlagSet("delete")
+	target.register(fs)
+	m.registerKey(fs)
+	registerDryRun(fs, &dry)
+	fs.BoolVar(&all, "all", false, "Delete every mapping, or every one matching the filters")
+	registerFilter(fs, &filter)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := validateFilter(&filter); err != nil {
+		return err
+	}
+
+	bulk := all || !filter.Empty()
+	if bulk && m.extPort != 0 {
+		return errors.New("-ext can't be combined with -all or the filters")
+	}
+	if !bulk {
+		if err := m.validateKey(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+	c = withDryRun(c, dry)
+
+	if bulk {
+		return deleteMatching(ctx, c, &filter, dry)
+	}
+
+	if err := c.DeletePortMapping(ctx, m.remote, uint16(m.extPort), m.proto); err != nil {
+		return err
+	}
+
+	if dry {
+		return nil
+	}
+	slog.Info("deleted mapping", "protocol", m.proto, "external_port", m.extPort)
+	return nil
+}
+
+// deleteMatching deletes every mapping of c matching filter
+func deleteMatching(ctx context.Context, c portmapping.PortMapper, filter *portmapping.MappingFilter, dry bool) error {
+	mappings, err := c.ListMappings(ctx)
+	if err != nil {
+		return err
+	}
+
+	var changes []portmapping.MappingChange
+	for _, pme := range portmapping.FilterMappings(mappings, filter) {
+		changes = append(changes, portmapping.MappingChange{Kind: portmapping.MappingRemoved, Old: pme})
+	}
+
+	if err := portmapping.ApplyChanges(ctx, c, changes); err != nil {
+		return err
+	}
+
+	if dry {
+		return nil
+	}
+	slog.Info("deleted mappings", "count", len(changes), "of", len(mappings))
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func runDetect(args []string) error {
+	var (
+		target  targetFlags
+		jsonOut bool
+	)
+
+	fs := newFlagSet("detect")
+	target.register(fs)
+	fs.BoolVar(&jsonOut, "json", false, "Print the results as newline delimited JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	host, err := target.searchHost()
+	if err != nil {
+		return err
+	}
+
+	results := portmapping.Probe(ctx, host, target.port, &target.search)
+
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range results {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, r := range results {
+		state, detail := "disabled", r.Error
+		if r.Enabled {
+			state, detail = "enabled", r.Detail
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Protocol, state, strings.Join(r.Versions, " "), detail)
+	}
+
+	return tw.Flush()
+}
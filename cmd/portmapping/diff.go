@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// snapshot is the mapping table saved by list -save
+type snapshot struct {
+	Time     string            `json:"time"`
+	Services []snapshotService `json:"services"`
+}
+
+type snapshotService struct {
+	Device   string                          `json:"device"`
+	Mappings []*portmapping.PortMappingEntry `json:"mappings"`
+	Error    string                          `json:"error,omitempty"`
+}
+
+func newSnapshot(lists []*portmapping.MappingList) *snapshot {
+	s := &snapshot{Time: time.Now().Format(time.RFC3339)}
+	for _, l := range lists {
+		svc := snapshotService{Device: l.Mapper.String(), Mappings: l.Mappings}
+		if l.Err != nil {
+			svc.Error = l.Err.Error()
+		}
+		s.Services = append(s.Services, svc)
+	}
+	return s
+}
+
+func (s *snapshot) save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+func readSnapshot(path string) (*snapshot, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// devices returns the mappings by device and the devices in order
+func (s *snapshot) devices() (map[string][]*portmapping.PortMappingEntry, []string) {
+	byDevice := make(map[string][]*portmapping.PortMappingEntry)
+	var order []string
+	for _, svc := range s.Services {
+		if _, ok := byDevice[svc.Device]; !ok {
+			order = append(order, svc.Device)
+		}
+		byDevice[svc.Device] = append(byDevice[svc.Device], svc.Mappings...)
+	}
+	return byDevice, order
+}
+
+func runDiff(args []string) error {
+	var (
+		jsonOut bool
+		dbPath  string
+	)
+
+	fs := newFlagSet("diff")
+	fs.BoolVar(&jsonOut, "json", false, "Print changes as newline delimited JSON")
+	registerHistory(fs, &dbPath)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [flags] old.json new.json\n       %s diff -db portmapping.db old-time [new-time]\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var older, newer *snapshot
+	if dbPath != "" {
+		var err error
+		if older, newer, err = historySnapshots(dbPath, fs.Args()); err != nil {
+			return err
+		}
+	} else {
+		if fs.NArg() != 2 {
+			return errors.New("two snapshot files are required")
+		}
+
+		var err error
+		if older, err = readSnapshot(fs.Arg(0)); err != nil {
+			return err
+		}
+		if newer, err = readSnapshot(fs.Arg(1)); err != nil {
+			return err
+		}
+	}
+
+	before, oldOrder := older.devices()
+	after, newOrder := newer.devices()
+
+	devices := newOrder
+	for _, d := range oldOrder {
+		if _, ok := after[d]; !ok {
+			devices = append(devices, d)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, d := range devices {
+		changes := portmapping.DiffMappings(before[d], after[d])
+		if len(changes) == 0 {
+			continue
+		}
+
+		if !jsonOut {
+			fmt.Println(d)
+		}
+		for _, c := range changes {
+			if jsonOut {
+				if err := enc.Encode(changeRecord{Type: "change", Time: newer.Time, Device: d, MappingChange: c}); err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Printf("  %s %s\n", changeSymbol(c.Kind), describeChange(c))
+		}
+	}
+
+	return nil
+}
+
+// historySnapshots returns the recorded mappings at the times of args, the
+// newer one defaulting to now
+func historySnapshots(path string, args []string) (*snapshot, *snapshot, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, nil, errors.New("one or two times are required with -db")
+	}
+
+	times := []time.Time{{}, time.Now()}
+	for i, arg := range args {
+		t, err := parseHistoryTime(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		times[i] = t
+	}
+
+	h, err := openHistory(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer h.Close()
+
+	ctx := context.Background()
+	older, err := h.snapshotAt(ctx, times[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	newer, err := h.snapshotAt(ctx, times[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return older, newer, nil
+}
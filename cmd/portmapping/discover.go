@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func runDiscover(args []string) error {
+	var (
+		target targetFlags
+		output outputFlags
+		xmlDir string
+	)
+
+	fs := newFlagSet("discover")
+	target.register(fs)
+	output.register(fs)
+	registerSaveXML(fs, &xmlDir)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	out, closeOut, err := output.printer()
+	if err != nil {
+		return err
+	}
+	defer closeOut()
+
+	mappers, err := target.mappers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if xmlDir != "" {
+		var locs []*url.URL
+		for _, m := range mappers {
+			if c, ok := m.(*portmapping.Client); ok && c.Location != nil {
+				locs = append(locs, c.Location)
+			}
+		}
+		saveXML(ctx, locs, xmlDir)
+	}
+
+	for _, c := range mappers {
+		if inv, ok := out.(inventoryPrinter); ok {
+			if err := inv.inventory(c); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := out.device(c, nil); err != nil {
+			return err
+		}
+	}
+
+	return out.flush()
+}
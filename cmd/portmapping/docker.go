@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// Labels of the containers docker maps the published ports of, and
+// annotations of the Services kubernetes maps
+const (
+	// enableLabel opts a container or Service in
+	enableLabel = "portmapping.enable"
+	// portsLabel lists the ports to map, like "80,443,53/udp", all of them
+	// if it is missing
+	portsLabel = "portmapping.ports"
+	// descLabel is the description of the mappings, "docker NAME" or
+	// "k8s NAMESPACE/NAME" if it is missing
+	descLabel = "portmapping.description"
+)
+
+// dockerClient talks to the Docker Engine API
+type dockerClient struct {
+	http *http.Client
+	base string
+}
+
+// dockerContainer is a container of /containers/json
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		IP          string `json:"IP"`
+		PrivatePort uint16 `json:"PrivatePort"`
+		PublicPort  uint16 `json:"PublicPort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+}
+
+// dockerEvent is a message of /events
+type dockerEvent struct {
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+}
+
+// newDockerClient returns a client of the daemon at host, a unix:// socket
+// or a tcp:// address like those of DOCKER_HOST
+func newDockerClient(host string) (*dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("-docker-host: %w", err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		var dialer net.Dialer
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", u.Path)
+			},
+		}
+		return &dockerClient{http: &http.Client{Transport: tr}, base: "http://docker"}, nil
+	case "tcp", "http":
+		return &dockerClient{http: &http.Client{}, base: "http://" + u.Host}, nil
+	}
+	return nil, fmt.Errorf("-docker-host: unsupported scheme %q, want unix or tcp", u.Scheme)
+}
+
+func (d *dockerClient) get(ctx context.Context, path string, filters map[string][]string) (*http.Response, error) {
+	f, err := json.Marshal(filters)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.base+path+"?"+url.Values{"filters": {string(f)}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("docker %s: got HTTP %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// containers returns the running containers that opted in
+func (d *dockerClient) containers(ctx context.Context) ([]dockerContainer, error) {
+	resp, err := d.get(ctx, "/containers/json", map[string][]string{"label": {enableLabel + "=true"}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var cs []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&cs); err != nil {
+		return nil, fmt.Errorf("docker /containers/json: %w", err)
+	}
+	return cs, nil
+}
+
+// events calls fn for every start and stop of a container that opted in
+// until ctx is done or the stream breaks
+func (d *dockerClient) events(ctx context.Context, fn func(dockerEvent)) error {
+	resp, err := d.get(ctx, "/events", map[string][]string{
+		"type":  {"container"},
+		"event": {"start", "die"},
+		"label": {enableLabel + "=true"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev dockerEvent
+		if err := dec.Decode(&ev); err != nil {
+			return err
+		}
+		fn(ev)
+	}
+}
+
+// name returns the name of c without its leading slash
+func (c *dockerContainer) name() string {
+	if len(c.Names) == 0 {
+		return c.ID[:min(12, len(c.ID))]
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// requests returns the mappings of the published ports of c. Ports only
+// published on a loopback address can't be reached from the gateway and
+// are skipped.
+func (c *dockerContainer) requests(client string, lease time.Duration) ([]portmapping.MappingRequest, error) {
+	only, err := parsePortFilter(c.Labels[portsLabel])
+	if err != nil {
+		return nil, fmt.Errorf("%s: label %s: %w", c.name(), portsLabel, err)
+	}
+
+	desc := c.Labels[descLabel]
+	if desc == "" {
+		desc = "docker " + c.name()
+	}
+	desc = tagDescription(desc)
+
+	var reqs []portmapping.MappingRequest
+	seen := make(map[string]bool)
+	for _, p := range c.Ports {
+		key := fmt.Sprintf("%d/%s", p.PublicPort, p.Type)
+		if ip := net.ParseIP(p.IP); p.PublicPort == 0 || (ip != nil && ip.IsLoopback()) || seen[key] {
+			continue
+		}
+		if !only.match("", p.Type, p.PublicPort, p.PrivatePort) {
+			continue
+		}
+		if p.Type != "tcp" && p.Type != "udp" {
+			continue
+		}
+		seen[key] = true
+
+		reqs = append(reqs, portmapping.MappingRequest{
+			ExternalPort:   p.PublicPort,
+			Protocol:       strings.ToUpper(p.Type),
+			InternalPort:   p.PublicPort,
+			InternalClient: client,
+			Description:    desc,
+			Lease:          lease,
+		})
+	}
+	return reqs, nil
+}
+
+func runDocker(args []string) error {
+	var (
+		target   targetFlags
+		host     string
+		client   string
+		lease    time.Duration
+		interval time.Duration
+		hook     webhook
+		keep     bool
+	)
+
+	dockerHost := os.Getenv("DOCKER_HOST")
+	if dockerHost == "" {
+		dockerHost = "unix:///var/run/docker.sock"
+	}
+
+	fs := newFlagSet("docker")
+	target.register(fs)
+	fs.StringVar(&host, "docker-host", dockerHost, "Docker daemon to watch, a unix:// socket or a tcp:// address")
+	fs.StringVar(&client, "client", "", "Internal client address (defaults to the address the gateway reaches this host at)")
+	fs.DurationVar(&lease, "lease", time.Hour, "Lease of the mappings, renewed once half of it is gone (0 is permanent)")
+	fs.DurationVar(&interval, "interval", time.Minute, "How often the containers and the mappings are checked")
+	hook.register(fs)
+	registerKeep(fs, &keep)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s docker [flags]\n\nMaps the published ports of the running containers labelled %s=true while they run.\nThe %s label picks some of them, like \"80,443,53/udp\", and %s sets the description.\n", os.Args[0], enableLabel, portsLabel, descLabel)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+
+	d, err := newDockerClient(host)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	if client == "" {
+		if client, err = localClient(c); err != nil {
+			return err
+		}
+	}
+
+	list := func(ctx context.Context) (desiredMappings, error) {
+		cs, err := d.containers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		desired := make(desiredMappings)
+		for _, ct := range cs {
+			reqs, err := ct.requests(client, lease)
+			if err != nil {
+				slog.Warn("mapping container", "container", ct.name(), "err", err)
+				continue
+			}
+			for _, r := range reqs {
+				desired.add(r, ct.name())
+			}
+		}
+		return desired, nil
+	}
+	watch := func(ctx context.Context, notify func()) error {
+		return d.events(ctx, func(ev dockerEvent) {
+			slog.Debug("container event", "action", ev.Action, "container", ev.Actor.Attributes["name"])
+			notify()
+		})
+	}
+
+	sd := startDaemon(ctx, "mapping containers on "+c.String(), interval)
+	newKeptMappings(c, interval, &hook, keep).run(ctx, sd, list, watch)
+	return nil
+}
+
+// portFilter are the ports of a label or annotation like "80,443,53/udp",
+// nil if it is empty, which picks every port. Entries that aren't numbers
+// are port names.
+type portFilter map[string]bool
+
+func parsePortFilter(v string) (portFilter, error) {
+	if v == "" {
+		return nil, nil
+	}
+	f := make(portFilter)
+	for _, p := range strings.Split(v, ",") {
+		port, proto, _ := strings.Cut(strings.TrimSpace(p), "/")
+		if proto == "" {
+			proto = "tcp"
+		}
+		proto = strings.ToLower(proto)
+		if proto != "tcp" && proto != "udp" {
+			return nil, fmt.Errorf("invalid protocol in %q", p)
+		}
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			if port == "" || strings.ContainsAny(port, " :") {
+				return nil, fmt.Errorf("invalid port %q", p)
+			}
+			f[port] = true
+			continue
+		}
+		f[port+"/"+proto] = true
+	}
+	return f, nil
+}
+
+// match tells whether the filter picks the port named name, empty if it
+// has none, of any of the numbers
+func (f portFilter) match(name, proto string, ports ...uint16) bool {
+	if f == nil || (name != "" && f[name]) {
+		return true
+	}
+	for _, n := range ports {
+		if n != 0 && f[fmt.Sprintf("%d/%s", n, strings.ToLower(proto))] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func registerDryRun(fs *flag.FlagSet, dryRun *bool) {
+	fs.BoolVar(dryRun, "dry-run", false, "Print the actions that would be performed on the device instead of performing them")
+}
+
+// dryRun is a PortMapper printing the mutating actions instead of
+// performing them, reads go to the wrapped mapper
+type dryRun struct {
+	portmapping.PortMapper
+}
+
+func (d dryRun) AddPortMapping(ctx context.Context, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) error {
+	d.action("AddPortMapping", "", externalPort, protocol, internalPort, internalClient, description, leaseDuration)
+	return nil
+}
+
+func (d dryRun) DeletePortMapping(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error {
+	fmt.Printf("%s: DeletePortMapping NewRemoteHost=%q NewExternalPort=%d NewProtocol=%s\n", d.PortMapper, remoteHost, externalPort, protocol)
+	return nil
+}
+
+func (d dryRun) action(name string, remoteHost string, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) {
+	fmt.Printf("%s: %s NewRemoteHost=%q NewExternalPort=%d NewProtocol=%s NewInternalPort=%d NewInternalClient=%s NewEnabled=1 NewPortMappingDescription=%q NewLeaseDuration=%d\n",
+		d.PortMapper, name, remoteHost, externalPort, protocol, internalPort, internalClient, description, leaseDuration)
+}
+
+// dryRunAny is a dryRun of a UPnP client that may pick another port
+type dryRunAny struct {
+	dryRun
+	c *portmapping.Client
+}
+
+func (d dryRunAny) AddAnyPortMapping(ctx context.Context, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) (uint16, error) {
+	if !d.c.IsV2() {
+		return 0, portmapping.ErrNotSupported
+	}
+	d.action("AddAnyPortMapping", "", externalPort, protocol, internalPort, internalClient, description, leaseDuration)
+	return externalPort, nil
+}
+
+func (d dryRunAny) AddPortMappingEntry(ctx context.Context, pme *portmapping.PortMappingEntry) error {
+	fmt.Printf("%s: AddPortMapping NewRemoteHost=%q NewExternalPort=%s NewProtocol=%s NewInternalPort=%s NewInternalClient=%s NewEnabled=%s NewPortMappingDescription=%q NewLeaseDuration=%s\n",
+		d.PortMapper, pme.NewRemoteHost, pme.NewExternalPort, pme.NewProtocol, pme.NewInternalPort, pme.NewInternalClient, pme.NewEnabled, pme.NewPortMappingDescription, pme.NewLeaseDuration)
+	return nil
+}
+
+// withDryRun wraps m in a dry run when enabled
+func withDryRun(m portmapping.PortMapper, enabled bool) portmapping.PortMapper {
+	if !enabled {
+		return m
+	}
+	if c, ok := m.(*portmapping.Client); ok {
+		return dryRunAny{dryRun{m}, c}
+	}
+	return dryRun{m}
+}
+
+// anyPortMapper is implemented by mappers that can pick another external port
+type anyPortMapper interface {
+	AddAnyPortMapping(ctx context.Context, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) (uint16, error)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// resolveTimeout bounds the reverse DNS lookup of a client
+const resolveTimeout = 2 * time.Second
+
+// clientInfo tells who the internal client of a mapping is
+type clientInfo struct {
+	Hostname string `json:"hostname,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	Vendor   string `json:"vendor,omitempty"`
+}
+
+// hostInfo tells where a remote host or external address is
+type hostInfo struct {
+	Hostname string `json:"hostname,omitempty"`
+	portmapping.GeoInfo
+}
+
+// clientResolver looks up internal clients by reverse DNS and in the ARP
+// cache with resolve, and remote hosts in the geo databases and by reverse
+// DNS, once per address. Its methods may be called on a nil resolver,
+// which finds nothing.
+type clientResolver struct {
+	resolve bool
+	oui     portmapping.OUI
+	geo     []*portmapping.GeoDB
+
+	mu      sync.Mutex
+	clients map[string]*clientInfo
+	hosts   map[string]*hostInfo
+}
+
+// newClientResolver returns a resolver naming vendors from the OUI
+// registry at ouiPath, the built-in list if it is empty, and locating
+// remote hosts with the MaxMind DBs at geoPaths
+func newClientResolver(resolve bool, ouiPath string, geoPaths []string) (*clientResolver, error) {
+	r := &clientResolver{
+		resolve: resolve,
+		oui:     portmapping.DefaultOUI,
+		clients: make(map[string]*clientInfo),
+		hosts:   make(map[string]*hostInfo),
+	}
+
+	for _, path := range geoPaths {
+		db, err := portmapping.OpenGeoDB(path)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("opened geo database", "path", path, "type", db.Type)
+		r.geo = append(r.geo, db)
+	}
+
+	if ouiPath == "" {
+		return r, nil
+	}
+
+	f, err := os.Open(ouiPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if r.oui, err = portmapping.ParseOUI(f); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lookup returns what is known of client, nil if nothing is
+func (r *clientResolver) lookup(client string) *clientInfo {
+	if r == nil || !r.resolve {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info, ok := r.clients[client]
+	if !ok {
+		info = r.resolveClient(client)
+		r.clients[client] = info
+	}
+	return info
+}
+
+// resolveClient looks client up. The ARP cache is of this host, it is skipped
+// when talking to the devices through an agent.
+func (r *clientResolver) resolveClient(client string) *clientInfo {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return nil
+	}
+
+	info := &clientInfo{Hostname: reverseDNS(client)}
+
+	if relay == nil {
+		if mac, err := portmapping.NeighborMAC(ip); err == nil {
+			info.MAC = mac.String()
+			info.Vendor = r.oui.Vendor(mac)
+		}
+	}
+
+	if *info == (clientInfo{}) {
+		return nil
+	}
+	return info
+}
+
+// remote returns what is known of a remote host or external address, nil
+// for wildcards and when nothing is
+func (r *clientResolver) remote(host string) *hostInfo {
+	if r == nil || (!r.resolve && len(r.geo) == 0) {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info, ok := r.hosts[host]
+	if !ok {
+		info = &hostInfo{GeoInfo: portmapping.Geo(r.geo, ip)}
+		if r.resolve {
+			info.Hostname = reverseDNS(host)
+		}
+		if *info == (hostInfo{}) {
+			info = nil
+		}
+		r.hosts[host] = info
+	}
+	return info
+}
+
+// summary is the summary of a device, with what is known of its external
+// address
+func (r *clientResolver) summary(m portmapping.PortMapper, externalIP net.IP) string {
+	s := summary(m, externalIP)
+	if externalIP == nil {
+		return s
+	}
+	if info := r.remote(externalIP.String()); info != nil {
+		s += " (" + info.String() + ")"
+	}
+	return s
+}
+
+// reverseDNS returns the first name of addr, empty if it has none
+func reverseDNS(addr string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	names, err := net.DefaultResolver.LookupAddr(ctx, addr)
+	if err != nil {
+		slog.Debug("reverse DNS lookup", "addr", addr, "err", err)
+		return ""
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// String describes info, like "US, AS15169 GOOGLE, dns.google"
+func (info *hostInfo) String() string {
+	var parts []string
+	if info.Country != "" {
+		parts = append(parts, info.Country)
+	}
+	if info.ASN != 0 {
+		as := fmt.Sprintf("AS%d", info.ASN)
+		if info.Organization != "" {
+			as += " " + info.Organization
+		}
+		parts = append(parts, as)
+	}
+	if info.Hostname != "" {
+		parts = append(parts, info.Hostname)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// fields returns the hostname, country and autonomous system of info, "-"
+// for each unknown one
+func (info *hostInfo) fields() []string {
+	fields := []string{"-", "-", "-"}
+	if info == nil {
+		return fields
+	}
+	if info.Hostname != "" {
+		fields[0] = info.Hostname
+	}
+	if info.Country != "" {
+		fields[1] = info.Country
+	}
+	if info.ASN != 0 {
+		fields[2] = fmt.Sprintf("AS%d %s", info.ASN, info.Organization)
+	}
+	return fields
+}
+
+// fields returns the hostname, MAC address and vendor of info, "-" for
+// each unknown one
+func (info *clientInfo) fields() []string {
+	fields := []string{"-", "-", "-"}
+	if info == nil {
+		return fields
+	}
+	for i, v := range []string{info.Hostname, info.MAC, info.Vendor} {
+		if v != "" {
+			fields[i] = v
+		}
+	}
+	return fields
+}
+
+// String describes info on a line of the log output
+func (info *clientInfo) String() string {
+	var parts []string
+	for _, v := range []string{info.Hostname, info.MAC, info.Vendor} {
+		if v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
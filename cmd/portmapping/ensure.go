@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func runEnsure(args []string) error {
+	var (
+		target   targetFlags
+		tcp, udp portPairs
+		client   string
+		desc     string
+		lease    time.Duration
+		interval time.Duration
+		hook     webhook
+		keep     bool
+	)
+
+	fs := newFlagSet("ensure")
+	target.register(fs)
+	fs.Var(&tcp, "tcp", "TCP mapping as ext[:int], may be repeated")
+	fs.Var(&udp, "udp", "UDP mapping as ext[:int], may be repeated")
+	fs.StringVar(&client, "client", "", "Internal client address (defaults to the address the gateway reaches this host at)")
+	fs.StringVar(&desc, "desc", "portmapping", "Description of the mappings, tagged with the pm:<hostname>: owner prefix")
+	fs.DurationVar(&lease, "lease", 0, "Lease of the mappings, renewed once half of it is gone (0 is permanent)")
+	fs.DurationVar(&interval, "interval", time.Minute, "How often the mappings are checked")
+	hook.register(fs)
+	registerKeep(fs, &keep)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(tcp)+len(udp) == 0 {
+		return errors.New("at least one -tcp or -udp mapping is required")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	if client == "" {
+		if client, err = localClient(c); err != nil {
+			return err
+		}
+	}
+
+	reqs := pairRequests(tcp, udp, client, desc, lease)
+	sd := startDaemon(ctx, fmt.Sprintf("ensuring %d mappings on %s", len(reqs), c), interval)
+
+	// A reload restarts the checks, so they run right away
+	for reload := true; reload; {
+		ectx, stop := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		for _, r := range reqs {
+			wg.Add(1)
+			go func(r portmapping.MappingRequest) {
+				defer wg.Done()
+
+				report := reportEnsure(ectx, c, r, &hook)
+				err := portmapping.EnsureMapping(ectx, c, r, interval, func(change *portmapping.MappingChange, err error) {
+					sd.alive()
+					report(change, err)
+				})
+				if err != nil && !errors.Is(err, ectx.Err()) {
+					slog.Error("ensuring mapping", "protocol", r.Protocol, "external_port", r.ExternalPort, "err", err)
+				}
+			}(r)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		reload = false
+		select {
+		case <-ctx.Done():
+		case <-done:
+		case <-sd.reload:
+			slog.Info("got SIGHUP, checking the mappings now")
+			reloadSettings()
+			reload = true
+		}
+		stop()
+		<-done
+	}
+
+	if !keep {
+		unmap(c, reqs)
+	}
+	return nil
+}
+
+// reportEnsure returns the callback of EnsureMapping logging the checks of
+// r. The first check adds what is missing, later repairs are alerted.
+func reportEnsure(ctx context.Context, c portmapping.PortMapper, r portmapping.MappingRequest, hook *webhook) func(*portmapping.MappingChange, error) {
+	first := true
+	return func(change *portmapping.MappingChange, err error) {
+		defer func() { first = false }()
+		switch {
+		case err != nil:
+			slog.Warn("checking mapping", "protocol", r.Protocol, "external_port", r.ExternalPort, "err", err)
+			return
+		case change == nil:
+			if first {
+				slog.Info("mapping in place", "protocol", r.Protocol, "external_port", r.ExternalPort, "internal_client", r.InternalClient, "internal_port", r.InternalPort)
+			}
+			return
+		case first && change.Kind == portmapping.MappingAdded:
+			slog.Info("added mapping", "mapping", describeChange(*change))
+			return
+		}
+		slog.Warn("repaired mapping", "change", string(change.Kind), "mapping", describeChange(*change))
+		if err := hook.send(ctx, c.String(), []portmapping.MappingChange{*change}); err != nil {
+			slog.Warn("sending webhook", "device", c.String(), "err", err)
+		}
+	}
+}
+
+// keptMapping is a mapping ensured in the background
+type keptMapping struct {
+	req  portmapping.MappingRequest
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// keptMappings ensure the mappings of what comes and goes on this host,
+// like the published ports of containers, adding them when it appears and
+// deleting them when it is gone
+type keptMappings struct {
+	c        portmapping.PortMapper
+	interval time.Duration
+	hook     *webhook
+	// keep leaves the mappings in place once ctx is done
+	keep   bool
+	mapped map[string]*keptMapping
+}
+
+// desiredMappings are the mappings wanted, keyed by external port and
+// protocol
+type desiredMappings map[string]portmapping.MappingRequest
+
+// add wants r for owner, unless another one wants its port already
+func (d desiredMappings) add(r portmapping.MappingRequest, owner string) {
+	key := fmt.Sprintf("%d/%s", r.ExternalPort, r.Protocol)
+	if _, ok := d[key]; ok {
+		slog.Warn("port wanted twice, keeping the first", "protocol", r.Protocol, "external_port", r.ExternalPort, "owner", owner)
+		return
+	}
+	d[key] = r
+}
+
+func newKeptMappings(c portmapping.PortMapper, interval time.Duration, hook *webhook, keep bool) *keptMappings {
+	return &keptMappings{c: c, interval: interval, hook: hook, keep: keep, mapped: make(map[string]*keptMapping)}
+}
+
+// run keeps the mappings list returns until ctx is done, listing them every
+// interval, whenever watch calls its notify and on reloads. watch is
+// restarted when it returns, an interval later if it failed. The mappings
+// are deleted once ctx is done, unless keep is set.
+func (k *keptMappings) run(ctx context.Context, sd *daemon, list func(context.Context) (desiredMappings, error), watch func(ctx context.Context, notify func()) error) {
+	defer k.close()
+
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		for {
+			err := watch(ctx, notify)
+			if ctx.Err() != nil {
+				return
+			}
+			wait := time.Second
+			if err != nil {
+				slog.Warn("watching for changes, polling until it works again", "err", err)
+				wait = k.interval
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	for {
+		if desired, err := list(ctx); err != nil {
+			slog.Warn("listing the mappings wanted", "err", err)
+		} else {
+			k.update(ctx, desired)
+		}
+		sd.alive()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changed:
+		case <-sd.reload:
+			slog.Info("got SIGHUP, listing the mappings wanted again")
+			reloadSettings()
+		}
+	}
+}
+
+// update starts ensuring the desired mappings and deletes the others
+func (k *keptMappings) update(ctx context.Context, desired desiredMappings) {
+	for key, m := range k.mapped {
+		if r, ok := desired[key]; !ok || r != m.req {
+			k.remove(key)
+		}
+	}
+
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := k.mapped[key]; !ok {
+			k.mapped[key] = k.start(ctx, desired[key])
+		}
+	}
+}
+
+// start ensures the mapping of r in the background
+func (k *keptMappings) start(ctx context.Context, r portmapping.MappingRequest) *keptMapping {
+	ctx, stop := context.WithCancel(ctx)
+	m := &keptMapping{req: r, stop: stop, done: make(chan struct{})}
+
+	go func() {
+		defer close(m.done)
+		err := portmapping.EnsureMapping(ctx, k.c, r, k.interval, reportEnsure(ctx, k.c, r, k.hook))
+		if err != nil && !errors.Is(err, ctx.Err()) {
+			slog.Error("ensuring mapping", "protocol", r.Protocol, "external_port", r.ExternalPort, "err", err)
+		}
+	}()
+	return m
+}
+
+// remove stops ensuring the mapping at key and deletes it, unless it was
+// taken over meanwhile
+func (k *keptMappings) remove(key string) {
+	m := k.mapped[key]
+	delete(k.mapped, key)
+	m.stop()
+	<-m.done
+
+	unmap(k.c, []portmapping.MappingRequest{m.req})
+}
+
+// close stops ensuring the mappings and deletes them, unless keep is set
+func (k *keptMappings) close() {
+	for key, m := range k.mapped {
+		if !k.keep {
+			k.remove(key)
+			continue
+		}
+		m.stop()
+		<-m.done
+	}
+}
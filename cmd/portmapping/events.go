@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// sseKeepAlive is how often an idle event stream gets a comment, so proxies
+// don't close it
+const sseKeepAlive = 30 * time.Second
+
+// sseEvent is a server-sent event ready to write
+type sseEvent struct {
+	name string
+	data []byte
+}
+
+// hub fans events out to the connected /events clients. Clients too slow
+// to keep up miss events rather than blocking the others.
+type hub struct {
+	mu   sync.Mutex
+	subs map[chan sseEvent]struct{}
+}
+
+func (h *hub) subscribe() chan sseEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[chan sseEvent]struct{})
+	}
+	ch := make(chan sseEvent, 64)
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *hub) unsubscribe(ch chan sseEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, ch)
+}
+
+func (h *hub) publish(name string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Warn("encoding event", "event", name, "err", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- sseEvent{name: name, data: data}:
+		default:
+			slog.Debug("dropping event for a slow client", "event", name)
+		}
+	}
+}
+
+// events streams discovery results and mapping changes as server-sent
+// events. The current devices are sent first.
+func (s *server) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	ch := s.hub.subscribe()
+	defer s.hub.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	devices, err := json.Marshal(describeAll(r.Context(), s.snapshot()))
+	if err != nil {
+		return
+	}
+	writeSSE(w, sseEvent{name: "discovery", data: devices})
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			writeSSE(w, ev)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, ev sseEvent) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, ev.data)
+}
+
+// watch publishes the mapping changes of mappers until ctx is done
+func (s *server) watch(ctx context.Context, mappers []portmapping.PortMapper) {
+	for _, m := range mappers {
+		// Only UPnP can list mappings
+		if _, ok := m.(*portmapping.Client); !ok {
+			continue
+		}
+		go func(m portmapping.PortMapper) {
+			portmapping.Watch(ctx, m, s.interval, func(entries []*portmapping.PortMappingEntry, changes []portmapping.MappingChange, err error) {
+				if err != nil {
+					slog.Debug("listing mappings", "device", m.String(), "err", err)
+					return
+				}
+
+				now := time.Now().Format(time.RFC3339)
+				for _, c := range changes {
+					s.hub.publish("mapping", changeRecord{Type: "change", Time: now, Device: m.String(), MappingChange: c})
+				}
+			})
+		}(m)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// metrics renders the Prometheus text exposition format
+type metrics struct {
+	buf    bytes.Buffer
+	family map[string]bool
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metrics) add(name, typ, help string, value float64, labels ...string) {
+	if m.family == nil {
+		m.family = make(map[string]bool)
+	}
+	if !m.family[name] {
+		fmt.Fprintf(&m.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		m.family[name] = true
+	}
+
+	m.buf.WriteString(name)
+	if len(labels) > 0 {
+		m.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&m.buf, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		m.buf.WriteByte('}')
+	}
+	fmt.Fprintf(&m.buf, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// scrapeMetrics collects the metrics of every mapper. Families are written
+// in one block each as the exposition format requires.
+func scrapeMetrics(ctx context.Context, mappers []portmapping.PortMapper, traffic bool) []byte {
+	type scrape struct {
+		name     string
+		up       bool
+		duration time.Duration
+		ip       string
+		entries  []*portmapping.PortMappingEntry
+		link     *portmapping.LinkProperties
+		counters *portmapping.TrafficCounters
+	}
+
+	scrapes := make([]scrape, len(mappers))
+	var wg sync.WaitGroup
+	for i, m := range mappers {
+		wg.Add(1)
+		go func(i int, m portmapping.PortMapper) {
+			defer wg.Done()
+
+			start := time.Now()
+			s := scrape{name: m.String()}
+			if ip, err := m.ExternalIP(ctx); err == nil {
+				s.ip = ip.String()
+			}
+			entries, err := m.ListMappings(ctx)
+			if err != nil && !errors.Is(err, portmapping.ErrNotSupported) {
+				slog.Warn("listing mappings", "device", m.String(), "err", err)
+			}
+			s.up = err == nil || errors.Is(err, portmapping.ErrNotSupported)
+			s.entries = entries
+			if c, ok := m.(*portmapping.Client); ok && traffic {
+				s.link, s.counters = scrapeTraffic(ctx, c)
+			}
+			s.duration = time.Since(start)
+			scrapes[i] = s
+		}(i, m)
+	}
+	wg.Wait()
+
+	var mt metrics
+	for _, s := range scrapes {
+		up := 0.0
+		if s.up {
+			up = 1
+		}
+		mt.add("portmapping_up", "gauge", "Whether the last scrape of the gateway succeeded.", up, "device", s.name)
+	}
+	for _, s := range scrapes {
+		mt.add("portmapping_scrape_duration_seconds", "gauge", "Duration of the last scrape of the gateway.", s.duration.Seconds(), "device", s.name)
+	}
+	for _, s := range scrapes {
+		if s.ip != "" {
+			mt.add("portmapping_external_ip_info", "gauge", "External IP address reported by the gateway.", 1, "device", s.name, "external_ip", s.ip)
+		}
+	}
+	for _, s := range scrapes {
+		counts := make(map[string]int)
+		for _, pme := range s.entries {
+			counts[strings.ToUpper(pme.NewProtocol)]++
+		}
+		protos := make([]string, 0, len(counts))
+		for p := range counts {
+			protos = append(protos, p)
+		}
+		sort.Strings(protos)
+		for _, p := range protos {
+			mt.add("portmapping_mappings", "gauge", "Number of port mappings by protocol.", float64(counts[p]), "device", s.name, "protocol", p)
+		}
+	}
+	for _, s := range scrapes {
+		for _, pme := range s.entries {
+			lease, err := strconv.ParseFloat(pme.NewLeaseDuration, 64)
+			if err != nil {
+				continue
+			}
+			mt.add("portmapping_mapping_lease_seconds", "gauge", "Remaining lease of a port mapping, 0 is permanent.", lease,
+				"device", s.name,
+				"protocol", strings.ToUpper(pme.NewProtocol),
+				"external_port", pme.NewExternalPort,
+				"internal_client", pme.NewInternalClient,
+				"internal_port", pme.NewInternalPort,
+				"description", pme.NewPortMappingDescription,
+			)
+		}
+	}
+
+	for _, s := range scrapes {
+		if s.link == nil {
+			continue
+		}
+		mt.add("portmapping_link_max_bitrate", "gauge", "Maximum bit rate of the physical WAN link.", float64(s.link.UpstreamMaxBitRate), "device", s.name, "direction", "up")
+		mt.add("portmapping_link_max_bitrate", "gauge", "Maximum bit rate of the physical WAN link.", float64(s.link.DownstreamMaxBitRate), "device", s.name, "direction", "down")
+	}
+	for _, s := range scrapes {
+		if s.counters != nil {
+			mt.add("portmapping_wan_bytes_total", "counter", "Bytes sent and received on the WAN interface.", float64(s.counters.BytesSent), "device", s.name, "direction", "sent")
+			mt.add("portmapping_wan_bytes_total", "counter", "Bytes sent and received on the WAN interface.", float64(s.counters.BytesReceived), "device", s.name, "direction", "received")
+		}
+	}
+	for _, s := range scrapes {
+		if s.counters != nil {
+			mt.add("portmapping_wan_packets_total", "counter", "Packets sent and received on the WAN interface.", float64(s.counters.PacketsSent), "device", s.name, "direction", "sent")
+			mt.add("portmapping_wan_packets_total", "counter", "Packets sent and received on the WAN interface.", float64(s.counters.PacketsReceived), "device", s.name, "direction", "received")
+		}
+	}
+
+	return mt.buf.Bytes()
+}
+
+// scrapeTraffic returns the link properties and counters of c, nil for the
+// ones the device doesn't provide
+func scrapeTraffic(ctx context.Context, c *portmapping.Client) (*portmapping.LinkProperties, *portmapping.TrafficCounters) {
+	link, err := c.LinkProperties(ctx)
+	if err != nil {
+		slog.Debug("reading link properties", "device", c.String(), "err", err)
+	}
+	counters, err := c.TrafficCounters(ctx)
+	if err != nil {
+		slog.Debug("reading traffic counters", "device", c.String(), "err", err)
+	}
+	return link, counters
+}
+
+func runExporter(args []string) error {
+	var (
+		target   targetFlags
+		listen   string
+		interval time.Duration
+		traffic  bool
+	)
+
+	fs := newFlagSet("exporter")
+	target.register(fs)
+	fs.StringVar(&listen, "listen", ":9135", "Listen address of the metrics endpoint")
+	fs.DurationVar(&interval, "interval", 30*time.Second, "How often the gateway is scraped")
+	fs.BoolVar(&traffic, "traffic", false, "Also export the WAN link bit rates and traffic counters")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	mappers, err := target.mappers(ctx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu     sync.RWMutex
+		latest = scrapeMetrics(ctx, mappers, traffic)
+	)
+	sd := startDaemon(ctx, "serving metrics on "+listen, interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-sd.reload:
+				slog.Info("got SIGHUP, scraping the gateway now")
+				reloadSettings()
+			}
+
+			m := scrapeMetrics(ctx, mappers, traffic)
+			mu.Lock()
+			latest = m
+			mu.Unlock()
+			sd.alive()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		mu.RLock()
+		defer mu.RUnlock()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(latest)
+	})
+
+	srv := &http.Server{Addr: listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("serving metrics", "url", listen+"/metrics")
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
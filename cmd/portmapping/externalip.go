@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func runExternalIP(args []string) error {
+	var (
+		target     targetFlags
+		stun       bool
+		stunServer string
+		upstream   bool
+	)
+
+	fs := newFlagSet("external-ip")
+	target.register(fs)
+	fs.BoolVar(&stun, "stun", false, "Cross-check the address with the one a STUN server sees, to find CGNAT or double NAT")
+	fs.StringVar(&stunServer, "stun-server", portmapping.DefaultSTUNServer, "STUN server of -stun")
+	fs.BoolVar(&upstream, "upstream", false, "When the external IP is private or CGNAT, look for a port mapping service in front of the gateway")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+
+	ip, err := c.ExternalIP(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(ip)
+	kind := warnNAT(c, ip)
+
+	if upstream && kind != portmapping.NATNone {
+		mappers := portmapping.DiscoverUpstream(ctx, ip, target.port, &target.search)
+		if len(mappers) == 0 {
+			slog.Warn("no port mapping service found in front of the gateway, ask whoever runs the upstream NAT to forward the ports", "candidates", portmapping.UpstreamCandidates(ip))
+		}
+		for _, m := range mappers {
+			upstreamIP := externalIP(ctx, m)
+			slog.Info("found upstream gateway, mappings have to be added on it too", "device", m.String(), "external_ip", upstreamIP)
+			if upstreamIP != nil {
+				fmt.Println(upstreamIP)
+			}
+		}
+	}
+
+	if stun {
+		return crossCheckSTUN(ctx, ip, stunServer)
+	}
+	return nil
+}
+
+// warnNAT warns when the external address of m shows another NAT in front
+// of it, the usual reason forwards don't work
+func warnNAT(m portmapping.PortMapper, ip net.IP) portmapping.NATKind {
+	kind := portmapping.ClassifyExternalIP(ip)
+	switch kind {
+	case portmapping.NATCarrierGrade:
+		slog.Warn("external IP is in the CGNAT range 100.64.0.0/10, the ISP's NAT keeps mappings of this gateway unreachable from the internet",
+			"device", m.String(), "external_ip", ip)
+	case portmapping.NATDouble:
+		slog.Warn("external IP is private, another router in front of this gateway (double NAT) keeps its mappings unreachable from the internet",
+			"device", m.String(), "external_ip", ip)
+	}
+	return kind
+}
+
+// crossCheckSTUN warns when the public address seen by the STUN server is
+// not the external address of the gateway. Another NAT is then in front of
+// the gateway and its mappings are not reachable from the internet.
+func crossCheckSTUN(ctx context.Context, external net.IP, server string) error {
+	public, _, err := portmapping.STUNAddress(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	if public.Equal(external) {
+		slog.Info("STUN server sees the external address of the gateway", "server", server, "address", public)
+		return nil
+	}
+	slog.Warn("STUN server sees another public address, the gateway is behind CGNAT or a double NAT and its mappings are not reachable from the internet",
+		"server", server, "public", public, "gateway_external", external)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// registerFilter adds the flags selecting the mappings list and delete
+// work on
+func registerFilter(fs *flag.FlagSet, f *portmapping.MappingFilter) {
+	fs.StringVar(&f.Protocol, "protocol", "", "Only mappings of this protocol")
+	fs.StringVar(&f.InternalClient, "internal-client", "", "Only mappings to this internal client")
+	fs.Func("external-port", "Only the mappings of this external port", func(v string) error {
+		p, err := strconv.ParseUint(v, 10, 16)
+		if err != nil || p == 0 {
+			return errors.New("not a valid port")
+		}
+		f.ExternalPort = uint16(p)
+		return nil
+	})
+	fs.StringVar(&f.DescriptionMatch, "desc-match", "", "Only mappings with a description matching this shell pattern")
+	fs.StringVar(&f.DescriptionContains, "description-contains", "", "Only mappings with a description containing this text")
+	fs.BoolFunc("mine", "Only mappings this host added, those with a description tagged "+ownerTag(), func(v string) error {
+		mine, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		f.DescriptionPrefix = ""
+		if mine {
+			f.DescriptionPrefix = ownerTag()
+		}
+		return nil
+	})
+	fs.BoolVar(&f.EnabledOnly, "enabled-only", false, "Only enabled mappings")
+	fs.DurationVar(&f.ExpiringWithin, "expiring-within", 0, "Only mappings whose lease runs out within this duration, like 1h")
+}
+
+func validateFilter(f *portmapping.MappingFilter) error {
+	_, err := path.Match(f.DescriptionMatch, "")
+	return err
+}
+
+// orderFlags select the order of the mappings printed
+type orderFlags struct {
+	sort  string
+	group bool
+}
+
+func (o *orderFlags) register(fs *flag.FlagSet) {
+	fs.Func("sort", "Sort the mappings of a device by "+strings.Join(portmapping.SortKeys, ", "), func(v string) error {
+		if err := portmapping.SortMappings(nil, v); err != nil {
+			return errors.New("want one of " + strings.Join(portmapping.SortKeys, ", "))
+		}
+		o.sort = v
+		return nil
+	})
+	fs.Func("group-by", "Group the mappings of a device by internal-client", func(v string) error {
+		if v != "internal-client" {
+			return errors.New("only internal-client is supported")
+		}
+		o.group = true
+		return nil
+	})
+}
+
+// apply sorts mappings
+func (o *orderFlags) apply(mappings []*portmapping.PortMappingEntry) {
+	if o.sort != "" {
+		portmapping.SortMappings(mappings, o.sort)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// fingerprintRecord is a device and what it runs
+type fingerprintRecord struct {
+	Device   string `json:"device"`
+	Location string `json:"location"`
+	*portmapping.Fingerprint
+}
+
+func runFingerprint(args []string) error {
+	var (
+		target  targetFlags
+		jsonOut bool
+	)
+
+	fs := newFlagSet("fingerprint")
+	target.register(fs)
+	fs.BoolVar(&jsonOut, "json", false, "Print the fingerprints as newline delimited JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if target.selfOnly() {
+		return errors.New("fingerprinting needs the UPnP description, it can't be used with -natpmp or -pcp")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	// The SSDP SERVER header of each location, the description's Server
+	// header is used when it's unknown
+	servers := make(map[string]string)
+	var locations []*url.URL
+	if target.location != "" {
+		loc, err := url.Parse(target.location)
+		if err != nil {
+			return err
+		}
+		locations = append(locations, loc)
+	} else {
+		host, err := target.searchHost()
+		if err != nil {
+			return err
+		}
+		responders, err := portmapping.SearchResponders(ctx, host, target.port, &target.search)
+		if err != nil {
+			return err
+		}
+		for _, r := range responders {
+			locations = append(locations, r.Location)
+			servers[r.Location.String()] = r.Server
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, loc := range locations {
+		clients, err := portmapping.NewClientsByURL(ctx, loc)
+		if err != nil {
+			slog.Warn("fetching description", "location", loc, "err", err)
+			continue
+		}
+
+		server := servers[loc.String()]
+		if server == "" {
+			if server, err = portmapping.DescriptionServer(ctx, loc); err != nil {
+				slog.Warn("fetching Server header", "location", loc, "err", err)
+			}
+		}
+
+		rec := fingerprintRecord{Device: loc.Host, Location: loc.String()}
+		var info *portmapping.DeviceInfo
+		if len(clients) > 0 {
+			info = clients[0].DeviceInfo()
+			rec.Device = info.FriendlyName
+		}
+		rec.Fingerprint = portmapping.FingerprintDevice(server, info)
+
+		if jsonOut {
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+			continue
+		}
+		printFingerprint(rec)
+	}
+
+	return nil
+}
+
+func printFingerprint(rec fingerprintRecord) {
+	fp := rec.Fingerprint
+	fmt.Printf("%s (%s)\n", rec.Device, rec.Location)
+	if fp.Server != "" {
+		fmt.Printf("  server:   %s\n", fp.Server)
+	}
+	if fp.Stack != "" {
+		fmt.Printf("  stack:    %s\n", strings.TrimSpace(fp.Stack+" "+fp.StackVersion))
+	}
+	if fp.OS != "" {
+		fmt.Printf("  os:       %s\n", fp.OS)
+	}
+	if model := strings.TrimSpace(fp.Manufacturer + " " + fp.Model); model != "" {
+		fmt.Printf("  model:    %s\n", model)
+	}
+	if fp.Firmware != "" {
+		fmt.Printf("  firmware: %s\n", fp.Firmware)
+	}
+	for _, v := range fp.Vulnerabilities {
+		fixed := "every version"
+		if v.FixedIn != "" {
+			fixed = "fixed in " + v.FixedIn
+		}
+		fmt.Printf("  %s %s (%s): %s\n", strings.ToUpper(v.Severity), v.ID, fixed, v.Summary)
+	}
+	if fp.Stack != "" && fp.StackVersion == "" && len(fp.Vulnerabilities) == 0 {
+		fmt.Println("  no stack version, known vulnerabilities can't be matched")
+	}
+}
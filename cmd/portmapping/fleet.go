@@ -0,0 +1,780 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// fleetReport is the inventory an agent sends for its site
+type fleetReport struct {
+	Agent    string            `json:"agent"`
+	LocalIP  string            `json:"local_ip,omitempty"`
+	Devices  []deviceRecord    `json:"devices"`
+	Services []snapshotService `json:"services"`
+	// Received is set by the server, the clocks of the sites can't be
+	// trusted
+	Received time.Time `json:"received"`
+}
+
+// fleetSite is what the server knows about a site. Config is its desired
+// state, applied to the first device of the site like apply does.
+type fleetSite struct {
+	Name   string       `json:"name"`
+	Report *fleetReport `json:"report,omitempty"`
+	Config *config      `json:"config,omitempty"`
+}
+
+// fleetSiteView is a site with its drift from the desired state
+type fleetSiteView struct {
+	fleetSite
+	Drift      []portmapping.MappingChange `json:"drift"`
+	DriftError string                      `json:"drift_error,omitempty"`
+}
+
+// fleetSummary is a row of the sites list
+type fleetSummary struct {
+	Name       string    `json:"name"`
+	Agent      string    `json:"agent,omitempty"`
+	LastReport time.Time `json:"last_report,omitempty"`
+	Devices    int       `json:"devices"`
+	Mappings   int       `json:"mappings"`
+	Errors     int       `json:"errors"`
+	Configured bool      `json:"configured"`
+	Drift      int       `json:"drift"`
+}
+
+// drift returns the changes apply without -prune would make to the first
+// device of the site, nil without a config or a report
+func (s *fleetSite) drift() ([]portmapping.MappingChange, error) {
+	if s.Config == nil || s.Report == nil || len(s.Report.Services) == 0 {
+		return nil, nil
+	}
+	svc := s.Report.Services[0]
+	if svc.Error != "" {
+		return nil, fmt.Errorf("%s: %s", svc.Device, svc.Error)
+	}
+
+	// The agent tags the mappings with its own host name
+	cfg := *s.Config
+	cfg.owner = hostTag(s.Report.Agent)
+	desired, err := cfg.desired(s.Report.LocalIP)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.plan(svc.Mappings, desired, false), nil
+}
+
+func (s *fleetSite) view() fleetSiteView {
+	v := fleetSiteView{fleetSite: *s}
+	drift, err := s.drift()
+	if err != nil {
+		v.DriftError = err.Error()
+	}
+	v.Drift = drift
+	return v
+}
+
+func (s *fleetSite) summary() fleetSummary {
+	sum := fleetSummary{Name: s.Name, Configured: s.Config != nil}
+	if r := s.Report; r != nil {
+		sum.Agent, sum.LastReport, sum.Devices = r.Agent, r.Received, len(r.Devices)
+		for _, svc := range r.Services {
+			sum.Mappings += len(svc.Mappings)
+			if svc.Error != "" {
+				sum.Errors++
+			}
+		}
+	}
+	drift, _ := s.drift()
+	sum.Drift = len(drift)
+	return sum
+}
+
+// siteNameRe limits site names to what is safe in URLs and file names
+var siteNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// fleetStore keeps the sites of the fleet server in memory and in the
+// state file
+type fleetStore struct {
+	path string
+
+	mu    sync.Mutex
+	sites map[string]*fleetSite
+}
+
+func openFleetStore(path string) (*fleetStore, error) {
+	st := &fleetStore{path: path, sites: make(map[string]*fleetSite)}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var sites []*fleetSite
+	if err := json.Unmarshal(b, &sites); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, s := range sites {
+		st.sites[s.Name] = s
+	}
+	return st, nil
+}
+
+// saveLocked writes the state file through a temporary file, so a crash
+// can't leave a truncated one
+func (st *fleetStore) saveLocked() error {
+	sites := make([]*fleetSite, 0, len(st.sites))
+	for _, name := range sortedSiteNames(st.sites) {
+		sites = append(sites, st.sites[name])
+	}
+	b, err := json.MarshalIndent(sites, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(st.path), 0o755); err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// update runs fn on the named site, creating it if needed, and saves the
+// state. The site is passed as a copy and replaces the stored one only if
+// fn succeeds.
+func (st *fleetStore) update(name string, fn func(s *fleetSite) error) (*fleetSite, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s := &fleetSite{Name: name}
+	if old, ok := st.sites[name]; ok {
+		*s = *old
+	}
+	if err := fn(s); err != nil {
+		return nil, err
+	}
+
+	st.sites[name] = s
+	if err := st.saveLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (st *fleetStore) get(name string) *fleetSite {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.sites[name]
+}
+
+func (st *fleetStore) list() []*fleetSite {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	out := make([]*fleetSite, 0, len(st.sites))
+	for _, name := range sortedSiteNames(st.sites) {
+		out = append(out, st.sites[name])
+	}
+	return out
+}
+
+func (st *fleetStore) delete(name string) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.sites[name]; !ok {
+		return false, nil
+	}
+	delete(st.sites, name)
+	return true, st.saveLocked()
+}
+
+func sortedSiteNames(sites map[string]*fleetSite) []string {
+	names := make([]string, 0, len(sites))
+	for name := range sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fleetServer is the central API agents report their sites to:
+//
+//	GET    /api/sites                  summaries of every site
+//	GET    /api/sites/<site>           inventory, config and drift of a site
+//	DELETE /api/sites/<site>           forget a site
+//	POST   /api/sites/<site>/report    store an inventory, answers the config
+//	GET    /api/sites/<site>/config    desired state of a site
+//	PUT    /api/sites/<site>/config    replace it, YAML or JSON
+//	DELETE /api/sites/<site>/config    stop managing the mappings of a site
+type fleetServer struct {
+	store *fleetStore
+}
+
+func (s *fleetServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sites", s.sites)
+	mux.HandleFunc("/api/sites/", s.site)
+	return mux
+}
+
+func (s *fleetServer) sites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	out := []fleetSummary{}
+	for _, site := range s.store.list() {
+		out = append(out, site.summary())
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *fleetServer) site(w http.ResponseWriter, r *http.Request) {
+	name, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/sites/"), "/")
+	if !siteNameRe.MatchString(name) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid site name %q", name))
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		site := s.store.get(name)
+		if site == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no site %q", name))
+			return
+		}
+		writeJSON(w, http.StatusOK, site.view())
+	case sub == "" && r.Method == http.MethodDelete:
+		ok, err := s.store.delete(name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no site %q", name))
+			return
+		}
+		slog.Info("deleted site", "site", name)
+		w.WriteHeader(http.StatusNoContent)
+	case sub == "report" && r.Method == http.MethodPost:
+		s.report(w, r, name)
+	case sub == "config":
+		s.config(w, r, name)
+	case sub == "" || sub == "report":
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// maxReportSize bounds the bodies agents and operators send
+const maxReportSize = 8 << 20
+
+func (s *fleetServer) report(w http.ResponseWriter, r *http.Request, name string) {
+	var rep fleetReport
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxReportSize)).Decode(&rep); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	rep.Received = time.Now().UTC()
+
+	site, err := s.store.update(name, func(site *fleetSite) error {
+		site.Report = &rep
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	v := site.view()
+	slog.Info("site reported", "site", name, "agent", rep.Agent, "devices", len(rep.Devices), "drift", len(v.Drift))
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *fleetServer) config(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		site := s.store.get(name)
+		if site == nil || site.Config == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no config for site %q", name))
+			return
+		}
+		writeJSON(w, http.StatusOK, site.Config)
+	case http.MethodPut:
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxReportSize))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		// JSON is YAML, so both are accepted
+		var cfg config
+		if err := yaml.Unmarshal(b, &cfg); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		// Mappings without a client are for the agent host, any address
+		// validates them here
+		if _, err := cfg.requests("0.0.0.0"); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		site, err := s.store.update(name, func(site *fleetSite) error {
+			site.Config = &cfg
+			return nil
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		slog.Info("set site config", "site", name, "mappings", len(cfg.Mappings))
+		writeJSON(w, http.StatusOK, site.view())
+	case http.MethodDelete:
+		if _, err := s.store.update(name, func(site *fleetSite) error {
+			site.Config = nil
+			return nil
+		}); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// fleetClient talks to the fleet server
+type fleetClient struct {
+	url   string
+	token string
+	hc    http.Client
+}
+
+func (c *fleetClient) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.url, "server", defaults.FleetURL, "URL of the fleet server")
+	fs.StringVar(&c.token, "token", defaults.FleetToken, "Bearer token of the fleet server")
+	c.hc.Timeout = 30 * time.Second
+}
+
+// do sends a request to path and decodes the JSON answer into out, if it
+// isn't nil
+func (c *fleetClient) do(ctx context.Context, method string, path string, contentType string, body []byte, out any) error {
+	if c.url == "" {
+		return errors.New("-server is required")
+	}
+	u, err := url.JoinPath(c.url, path)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr apiError
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("fleet server: %s", apiErr.Error)
+		}
+		return fmt.Errorf("fleet server: got HTTP %s", resp.Status)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func runFleet(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: fleet serve|report|sites|push [flags]")
+	}
+	action, args := args[0], args[1:]
+
+	switch action {
+	case "serve":
+		return runFleetServe(args)
+	case "report":
+		return runFleetReport(args)
+	case "sites":
+		return runFleetSites(args)
+	case "push":
+		return runFleetPush(args)
+	}
+	return fmt.Errorf("unknown fleet action %q", action)
+}
+
+func runFleetServe(args []string) error {
+	var (
+		listen   string
+		state    string
+		authFile string
+		noAuth   bool
+		tlsf     tlsFlags
+	)
+
+	fs := newFlagSet("fleet serve")
+	fs.StringVar(&listen, "listen", "localhost:9138", "Listen address of the fleet API")
+	fs.StringVar(&state, "state", "fleet.json", "File the sites are kept in")
+	fs.StringVar(&authFile, "auth", "", "File of the credentials allowed to use the API, like serve -auth. Agents need write to report.")
+	fs.BoolVar(&noAuth, "no-auth", false, "Allow serving without -auth on an address reachable from other hosts")
+	tlsf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var auth *authenticator
+	switch {
+	case authFile != "":
+		a, err := readAuthFile(authFile)
+		if err != nil {
+			return err
+		}
+		auth = a
+	case !noAuth && !isLoopback(listen):
+		return errors.New("-auth is required to listen on a non-loopback address, or pass -no-auth")
+	}
+
+	var tlsConfig *tls.Config
+	if tlsf.enabled() {
+		cfg, err := tlsf.config(listen)
+		if err != nil {
+			return err
+		}
+		tlsConfig = cfg
+	}
+
+	store, err := openFleetStore(state)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	handler := (&fleetServer{store: store}).handler()
+	if auth != nil {
+		handler = auth.wrap(handler)
+	}
+
+	srv := &http.Server{Addr: listen, Handler: handler, TLSConfig: tlsConfig}
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("serving fleet API", "url", scheme+"://"+listen+"/api/sites", "sites", len(store.list()))
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func runFleetReport(args []string) error {
+	var (
+		target   targetFlags
+		client   fleetClient
+		site     string
+		apply    bool
+		prune    bool
+		dry      bool
+		interval time.Duration
+		workers  int
+	)
+
+	fs := newFlagSet("fleet report")
+	target.register(fs)
+	client.register(fs)
+	fs.StringVar(&site, "site", defaults.Site, "Name of the site reported")
+	fs.BoolVar(&apply, "apply", false, "Reconcile the first device with the config of the site on the server")
+	fs.BoolVar(&prune, "prune", false, "With -apply, delete the mappings the config does not declare")
+	registerDryRun(fs, &dry)
+	fs.DurationVar(&interval, "interval", 0, "Report again at this interval until interrupted, 0 reports once")
+	fs.IntVar(&workers, "workers", 4, "How many devices are enumerated concurrently")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !siteNameRe.MatchString(site) {
+		return errors.New("-site is required and may only contain letters, digits, '.', '_' and '-'")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	for {
+		if err := fleetReportOnce(ctx, &target, &client, site, apply, prune, dry, workers); err != nil {
+			if interval <= 0 {
+				return err
+			}
+			slog.Warn("reporting site", "site", site, "err", err)
+		}
+		if interval <= 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// fleetReportOnce sends the inventory of the site and, with apply,
+// reconciles the first device with the config the server answers
+func fleetReportOnce(ctx context.Context, target *targetFlags, client *fleetClient, site string, apply, prune, dry bool, workers int) error {
+	mappers, err := target.mappers(ctx)
+	if err != nil {
+		return err
+	}
+
+	rep := fleetReport{Services: newSnapshot(portmapping.ListAllMappings(ctx, mappers, workers)).Services}
+	rep.Agent, _ = os.Hostname()
+	for _, m := range mappers {
+		rep.Devices = append(rep.Devices, describe(m, externalIP(ctx, m)))
+	}
+	// Mappings of the config without a client are for this host
+	if uc, ok := mappers[0].(*portmapping.Client); ok {
+		if ip, err := uc.LocalIP(); err == nil {
+			rep.LocalIP = ip.String()
+		}
+	}
+
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	var v fleetSiteView
+	if err := client.do(ctx, http.MethodPost, "/api/sites/"+site+"/report", "application/json", body, &v); err != nil {
+		return err
+	}
+	slog.Info("reported site", "site", site, "devices", len(rep.Devices), "drift", len(v.Drift))
+
+	if !apply {
+		return nil
+	}
+	if v.Config == nil {
+		slog.Info("site has no config, nothing to apply", "site", site)
+		return nil
+	}
+	if err := reconcile(ctx, mappers[0], v.Config, prune, dry); err != nil {
+		return err
+	}
+	if dry {
+		return nil
+	}
+
+	// Report again so the server sees the drift is gone
+	rep.Services = newSnapshot(portmapping.ListAllMappings(ctx, mappers, workers)).Services
+	if body, err = json.Marshal(rep); err != nil {
+		return err
+	}
+	return client.do(ctx, http.MethodPost, "/api/sites/"+site+"/report", "application/json", body, nil)
+}
+
+func runFleetSites(args []string) error {
+	var (
+		client  fleetClient
+		asJSON  bool
+		drifted bool
+	)
+
+	fs := newFlagSet("fleet sites")
+	client.register(fs)
+	fs.BoolVar(&asJSON, "json", false, "Print the sites as JSON lines")
+	fs.BoolVar(&drifted, "drift", false, "Print the drift of every site and exit with 3 if any site drifted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	var sites []fleetSummary
+	if err := client.do(ctx, http.MethodGet, "/api/sites", "", nil, &sites); err != nil {
+		return err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, s := range sites {
+			if err := enc.Encode(struct {
+				Type string `json:"type"`
+				fleetSummary
+			}{"site", s}); err != nil {
+				return err
+			}
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "SITE\tAGENT\tLAST REPORT\tDEVICES\tMAPPINGS\tERRORS\tDRIFT")
+		for _, s := range sites {
+			last, drift := "never", "-"
+			if !s.LastReport.IsZero() {
+				last = s.LastReport.Local().Format(time.DateTime)
+			}
+			if s.Configured {
+				drift = fmt.Sprint(s.Drift)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n", s.Name, s.Agent, last, s.Devices, s.Mappings, s.Errors, drift)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if !drifted {
+		return nil
+	}
+	var found bool
+	for _, s := range sites {
+		if s.Drift == 0 {
+			continue
+		}
+		found = true
+
+		var v fleetSiteView
+		if err := client.do(ctx, http.MethodGet, "/api/sites/"+s.Name, "", nil, &v); err != nil {
+			return err
+		}
+		if !asJSON {
+			fmt.Printf("\n%s:\n", s.Name)
+		}
+		for _, ch := range v.Drift {
+			if asJSON {
+				if err := json.NewEncoder(os.Stdout).Encode(struct {
+					Type string `json:"type"`
+					Site string `json:"site"`
+					portmapping.MappingChange
+				}{"drift", s.Name, ch}); err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Println(changeSymbol(ch.Kind), describeChange(ch))
+		}
+	}
+	if found {
+		return errViolations
+	}
+	return nil
+}
+
+func runFleetPush(args []string) error {
+	var (
+		client fleetClient
+		site   string
+		remove bool
+	)
+
+	fs := newFlagSet("fleet push")
+	client.register(fs)
+	fs.StringVar(&site, "site", "", "Name of the site the config is for")
+	fs.BoolVar(&remove, "delete", false, "Delete the config of the site instead, its mappings are no longer managed")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s fleet push -site <site> [flags] config.yaml\n\nThe agents of the site apply the config on their next report -apply.\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !siteNameRe.MatchString(site) {
+		return errors.New("-site is required and may only contain letters, digits, '.', '_' and '-'")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	if remove {
+		if fs.NArg() != 0 {
+			return errors.New("-delete takes no config file")
+		}
+		return client.do(ctx, http.MethodDelete, "/api/sites/"+site+"/config", "", nil, nil)
+	}
+	if fs.NArg() != 1 {
+		return errors.New("a single config file is required")
+	}
+
+	// Validated locally first for errors with the file name
+	cfg, err := readConfig(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if _, err := cfg.requests("0.0.0.0"); err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+	body, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	var v fleetSiteView
+	if err := client.do(ctx, http.MethodPut, "/api/sites/"+site+"/config", "application/json", body, &v); err != nil {
+		return err
+	}
+	if v.Report == nil {
+		fmt.Println("no report from the site yet")
+		return nil
+	}
+	if len(v.Drift) == 0 {
+		fmt.Println("no drift")
+		return nil
+	}
+	for _, ch := range v.Drift {
+		fmt.Println(changeSymbol(ch.Kind), describeChange(ch))
+	}
+	return nil
+}
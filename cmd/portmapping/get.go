@@ -0,0 +1,49 @@
+package main
+
+func runGet(args []string) error {
+	var (
+		target targetFlags
+		output outputFlags
+		m      mappingFlags
+	)
+
+	fs := newFlagSet("get")
+	target.register(fs)
+	output.register(fs)
+	m.registerKey(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	if err := m.validateKey(); err != nil {
+		return err
+	}
+
+	out, closeOut, err := output.printer()
+	if err != nil {
+		return err
+	}
+	defer closeOut()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+
+	pme, err := c.GetSpecificPortMappingEntry(ctx, m.remote, uint16(m.extPort), m.proto)
+	if err != nil {
+		return err
+	}
+
+	if err := out.device(c, externalIP(ctx, c)); err != nil {
+		return err
+	}
+	if err := out.mapping(c, pme); err != nil {
+		return err
+	}
+
+	return out.flush()
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// historySchema keeps every continuous sighting of a mapping as one row.
+// A mapping seen again after being gone, or with other values, gets a new
+// row.
+const historySchema = `
+CREATE TABLE IF NOT EXISTS snapshots (
+	device TEXT NOT NULL,
+	time   INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS snapshots_device_time ON snapshots (device, time);
+CREATE TABLE IF NOT EXISTS mappings (
+	device          TEXT NOT NULL,
+	remote_host     TEXT NOT NULL,
+	external_port   TEXT NOT NULL,
+	protocol        TEXT NOT NULL,
+	internal_port   TEXT NOT NULL,
+	internal_client TEXT NOT NULL,
+	enabled         TEXT NOT NULL,
+	description     TEXT NOT NULL,
+	lease_duration  TEXT NOT NULL,
+	first_seen      INTEGER NOT NULL,
+	last_seen       INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS mappings_seen ON mappings (first_seen, last_seen);
+`
+
+// history is the optional SQLite record of the observed mappings
+type history struct {
+	db *sql.DB
+}
+
+// historyRow is a mapping and the period it was seen in
+type historyRow struct {
+	Device string `json:"device"`
+	*portmapping.PortMappingEntry
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+func registerHistory(fs *flag.FlagSet, path *string) {
+	fs.StringVar(path, "db", "", "SQLite database recording every observed mapping with first and last seen times")
+}
+
+func openHistory(path string) (*history, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &history{db: db}, nil
+}
+
+func (h *history) Close() error {
+	return h.db.Close()
+}
+
+// record stores a snapshot of the mappings of device taken at t. Mappings
+// unchanged since the previous snapshot of the device extend their row.
+func (h *history) record(ctx context.Context, device string, entries []*portmapping.PortMappingEntry, t time.Time) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var prev sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `SELECT MAX(time) FROM snapshots WHERE device = ?`, device).Scan(&prev); err != nil {
+		return err
+	}
+
+	now := t.Unix()
+	for _, pme := range entries {
+		values := []any{device, pme.NewRemoteHost, pme.NewExternalPort, strings.ToUpper(pme.NewProtocol), pme.NewInternalPort, pme.NewInternalClient, pme.NewEnabled, pme.NewPortMappingDescription}
+
+		if prev.Valid {
+			res, err := tx.ExecContext(ctx, `UPDATE mappings SET last_seen = ?, lease_duration = ?
+				WHERE device = ? AND remote_host = ? AND external_port = ? AND protocol = ? AND internal_port = ?
+				AND internal_client = ? AND enabled = ? AND description = ? AND last_seen = ?`,
+				append(append([]any{now, pme.NewLeaseDuration}, values...), prev.Int64)...)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err == nil && n > 0 {
+				continue
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO mappings (device, remote_host, external_port, protocol, internal_port,
+			internal_client, enabled, description, lease_duration, first_seen, last_seen) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			append(values, pme.NewLeaseDuration, now, now)...); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO snapshots (device, time) VALUES (?, ?)`, device, now); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// recordLists stores the successful enumerations of lists
+func (h *history) recordLists(ctx context.Context, lists []*portmapping.MappingList) error {
+	now := time.Now()
+	for _, l := range lists {
+		if l.Err != nil {
+			continue
+		}
+		if err := h.record(ctx, l.Mapper.String(), l.Mappings, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// between returns the mappings seen at some point from since to until
+func (h *history) between(ctx context.Context, since, until time.Time) ([]historyRow, error) {
+	rows, err := h.db.QueryContext(ctx, `SELECT device, remote_host, external_port, protocol, internal_port, internal_client,
+		enabled, description, lease_duration, first_seen, last_seen FROM mappings
+		WHERE first_seen <= ? AND last_seen >= ? ORDER BY device, first_seen, protocol, external_port`,
+		until.Unix(), since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []historyRow
+	for rows.Next() {
+		var (
+			r           = historyRow{PortMappingEntry: &portmapping.PortMappingEntry{}}
+			first, last int64
+		)
+		if err := rows.Scan(&r.Device, &r.NewRemoteHost, &r.NewExternalPort, &r.NewProtocol, &r.NewInternalPort, &r.NewInternalClient,
+			&r.NewEnabled, &r.NewPortMappingDescription, &r.NewLeaseDuration, &first, &last); err != nil {
+			return nil, err
+		}
+		r.FirstSeen, r.LastSeen = time.Unix(first, 0), time.Unix(last, 0)
+		out = append(out, r)
+	}
+
+	return out, rows.Err()
+}
+
+// historyEvent is a mapping appearing or disappearing between two
+// snapshots of its device
+type historyEvent struct {
+	Time   time.Time                     `json:"time"`
+	Device string                        `json:"device"`
+	Kind   portmapping.ChangeKind        `json:"kind"`
+	Entry  *portmapping.PortMappingEntry `json:"mapping"`
+}
+
+// events returns the mappings added and removed from since to until. The
+// mappings of the first snapshot of a device don't count as added, and a
+// removal is dated by the first snapshot missing the mapping.
+func (h *history) events(ctx context.Context, since, until time.Time) ([]historyEvent, error) {
+	rows, err := h.db.QueryContext(ctx, `SELECT m.device, m.remote_host, m.external_port, m.protocol, m.internal_port, m.internal_client,
+		m.enabled, m.description, m.lease_duration, m.first_seen, m.last_seen, s.first,
+		(SELECT MIN(time) FROM snapshots n WHERE n.device = m.device AND n.time > m.last_seen)
+		FROM mappings m JOIN (SELECT device, MIN(time) AS first FROM snapshots GROUP BY device) s ON m.device = s.device
+		WHERE m.first_seen <= ?`, until.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []historyEvent
+	for rows.Next() {
+		var (
+			device             string
+			pme                portmapping.PortMappingEntry
+			first, last, start int64
+			gone               sql.NullInt64
+		)
+		if err := rows.Scan(&device, &pme.NewRemoteHost, &pme.NewExternalPort, &pme.NewProtocol, &pme.NewInternalPort, &pme.NewInternalClient,
+			&pme.NewEnabled, &pme.NewPortMappingDescription, &pme.NewLeaseDuration, &first, &last, &start, &gone); err != nil {
+			return nil, err
+		}
+
+		if t := time.Unix(first, 0); first > start && !t.Before(since) && !t.After(until) {
+			out = append(out, historyEvent{Time: t, Device: device, Kind: portmapping.MappingAdded, Entry: &pme})
+		}
+		if t := time.Unix(gone.Int64, 0); gone.Valid && !t.Before(since) && !t.After(until) {
+			out = append(out, historyEvent{Time: t, Device: device, Kind: portmapping.MappingRemoved, Entry: &pme})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	return out, nil
+}
+
+// snapshotAt returns the mappings of every device as seen by its last
+// snapshot not after t
+func (h *history) snapshotAt(ctx context.Context, t time.Time) (*snapshot, error) {
+	rows, err := h.db.QueryContext(ctx, `SELECT m.device, m.remote_host, m.external_port, m.protocol, m.internal_port, m.internal_client,
+		m.enabled, m.description, m.lease_duration FROM mappings m
+		JOIN (SELECT device, MAX(time) AS time FROM snapshots WHERE time <= ? GROUP BY device) s
+		ON m.device = s.device AND m.first_seen <= s.time AND m.last_seen >= s.time
+		ORDER BY m.device`, t.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snap := &snapshot{Time: t.Format(time.RFC3339)}
+	for rows.Next() {
+		var (
+			device string
+			pme    portmapping.PortMappingEntry
+		)
+		if err := rows.Scan(&device, &pme.NewRemoteHost, &pme.NewExternalPort, &pme.NewProtocol, &pme.NewInternalPort, &pme.NewInternalClient,
+			&pme.NewEnabled, &pme.NewPortMappingDescription, &pme.NewLeaseDuration); err != nil {
+			return nil, err
+		}
+		if n := len(snap.Services); n == 0 || snap.Services[n-1].Device != device {
+			snap.Services = append(snap.Services, snapshotService{Device: device})
+		}
+		svc := &snap.Services[len(snap.Services)-1]
+		svc.Mappings = append(svc.Mappings, &pme)
+	}
+
+	return snap, rows.Err()
+}
+
+// historyTimeLayouts are the accepted forms of times on the command line,
+// in local time unless they carry a zone
+var historyTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// parseHistoryTime parses a time or, like 36h, how long ago it was
+func parseHistoryTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range historyTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, want e.g. 2006-01-02, \"2006-01-02 15:04\" or a duration ago like 36h", s)
+}
+
+func runHistory(args []string) error {
+	var (
+		path    string
+		at      string
+		since   string
+		until   string
+		jsonOut bool
+	)
+
+	fs := newFlagSet("history")
+	registerHistory(fs, &path)
+	fs.StringVar(&at, "at", "", "Print the mappings that existed during this day, or at this time if it has one")
+	fs.StringVar(&since, "since", "", "Print the mappings seen after this time")
+	fs.StringVar(&until, "until", "", "Print the mappings seen before this time (default now)")
+	fs.BoolVar(&jsonOut, "json", false, "Print the mappings as newline delimited JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if path == "" {
+		return errors.New("-db is required")
+	}
+
+	var (
+		from = time.Unix(0, 0)
+		to   = time.Now()
+		err  error
+	)
+	switch {
+	case at != "" && (since != "" || until != ""):
+		return errors.New("-at can't be combined with -since or -until")
+	case at != "":
+		if from, err = parseHistoryTime(at); err != nil {
+			return err
+		}
+		to = from
+		if _, err := time.Parse("2006-01-02", at); err == nil {
+			to = from.AddDate(0, 0, 1).Add(-time.Second)
+		}
+	default:
+		if since != "" {
+			if from, err = parseHistoryTime(since); err != nil {
+				return err
+			}
+		}
+		if until != "" {
+			if to, err = parseHistoryTime(until); err != nil {
+				return err
+			}
+		}
+	}
+
+	h, err := openHistory(path)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	rows, err := h.between(ctx, from, to)
+	if err != nil {
+		return err
+	}
+
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range rows {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tPROTO\tEXTERNAL\tINTERNAL\tREMOTE HOST\tDESCRIPTION\tFIRST SEEN\tLAST SEEN")
+	for _, r := range rows {
+		remote := r.NewRemoteHost
+		if remote == "" {
+			remote = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s:%s\t%s\t%s\t%s\t%s\n", r.Device, r.NewProtocol, r.NewExternalPort, r.NewInternalClient, r.NewInternalPort,
+			remote, strconv.Quote(r.NewPortMappingDescription), r.FirstSeen.Format(time.DateTime), r.LastSeen.Format(time.DateTime))
+	}
+	return tw.Flush()
+}
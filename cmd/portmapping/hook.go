@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// hookTimeout bounds a run of the -on-change command
+const hookTimeout = 30 * time.Second
+
+// Events of the -on-change payload
+const (
+	hookMappings   = "mappings"
+	hookExternalIP = "external_ip"
+)
+
+// execHook runs a command on mapping and external IP changes
+type execHook struct {
+	path string
+}
+
+// hookPayload is written to the standard input of the command
+type hookPayload struct {
+	Event         string                      `json:"event"`
+	Device        string                      `json:"device"`
+	Time          string                      `json:"time"`
+	Changes       []portmapping.MappingChange `json:"changes,omitempty"`
+	OldExternalIP string                      `json:"old_external_ip,omitempty"`
+	ExternalIP    string                      `json:"external_ip,omitempty"`
+}
+
+func (h *execHook) register(fs *flag.FlagSet) {
+	fs.StringVar(&h.path, "on-change", "", "Command run when mappings or the external IP change, with a JSON payload on stdin and PORTMAPPING_EVENT, PORTMAPPING_DEVICE, PORTMAPPING_EXTERNAL_IP, PORTMAPPING_OLD_EXTERNAL_IP and PORTMAPPING_CHANGES set")
+}
+
+// mappings runs the command for changed mappings
+func (h *execHook) mappings(ctx context.Context, device string, changes []portmapping.MappingChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	return h.run(ctx, hookPayload{Event: hookMappings, Device: device, Changes: changes})
+}
+
+// externalIP runs the command for a changed external address
+func (h *execHook) externalIP(ctx context.Context, device string, old, new net.IP) error {
+	p := hookPayload{Event: hookExternalIP, Device: device, ExternalIP: new.String()}
+	if old != nil {
+		p.OldExternalIP = old.String()
+	}
+	return h.run(ctx, p)
+}
+
+func (h *execHook) run(ctx context.Context, p hookPayload) error {
+	if h.path == "" {
+		return nil
+	}
+
+	p.Time = time.Now().Format(time.RFC3339)
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.path)
+	cmd.Stdin = bytes.NewReader(append(body, '\n'))
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"PORTMAPPING_EVENT="+p.Event,
+		"PORTMAPPING_DEVICE="+p.Device,
+		"PORTMAPPING_EXTERNAL_IP="+p.ExternalIP,
+		"PORTMAPPING_OLD_EXTERNAL_IP="+p.OldExternalIP,
+		"PORTMAPPING_CHANGES="+strconv.Itoa(len(p.Changes)),
+	)
+	return cmd.Run()
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// serviceAccountDir holds the credentials of the pod
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient talks to the Kubernetes API server
+type kubeClient struct {
+	http *http.Client
+	base string
+	// tokenFile is read for every request, service account tokens are
+	// rotated
+	tokenFile string
+}
+
+// kubeService is a Service of /api/v1/services
+type kubeService struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		Type  string `json:"type"`
+		Ports []struct {
+			Name     string `json:"name"`
+			Protocol string `json:"protocol"`
+			Port     uint16 `json:"port"`
+			NodePort uint16 `json:"nodePort"`
+		} `json:"ports"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer struct {
+			Ingress []struct {
+				IP string `json:"ip"`
+			} `json:"ingress"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+// newKubeClient returns a client of the API server at api, trusting the
+// CAs of caFile if it isn't empty
+func newKubeClient(api, tokenFile, caFile string) (*kubeClient, error) {
+	if api == "" {
+		return nil, errors.New("-kube-api is required outside a cluster")
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no PEM certificate", caFile)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &kubeClient{http: &http.Client{Transport: tr}, base: strings.TrimSuffix(api, "/"), tokenFile: tokenFile}, nil
+}
+
+func (k *kubeClient) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Without a token file, like through kubectl proxy, requests go
+	// unauthenticated
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+		}
+	}
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("kubernetes %s: got HTTP %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// servicesPath returns the path of the Services of namespace, of every
+// namespace if it is empty
+func servicesPath(namespace string) string {
+	if namespace == "" {
+		return "/api/v1/services"
+	}
+	return "/api/v1/namespaces/" + namespace + "/services"
+}
+
+// services returns the NodePort and LoadBalancer Services that opted in
+func (k *kubeClient) services(ctx context.Context, namespace string) ([]kubeService, error) {
+	resp, err := k.get(ctx, servicesPath(namespace))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Items []kubeService `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("kubernetes services: %w", err)
+	}
+
+	var svcs []kubeService
+	for _, s := range list.Items {
+		if s.Metadata.Annotations[enableLabel] == "true" && (s.Spec.Type == "NodePort" || s.Spec.Type == "LoadBalancer") {
+			svcs = append(svcs, s)
+		}
+	}
+	return svcs, nil
+}
+
+// watch calls notify for every change of a Service until ctx is done or
+// the API server ends the watch, which it does every few minutes
+func (k *kubeClient) watch(ctx context.Context, namespace string, notify func()) error {
+	resp, err := k.get(ctx, servicesPath(namespace)+"?watch=true")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev struct {
+			Type string `json:"type"`
+		}
+		if err := dec.Decode(&ev); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if ev.Type == "ERROR" {
+			return errors.New("kubernetes watch of services ended with an error")
+		}
+		notify()
+	}
+}
+
+// name returns namespace/name of s
+func (s *kubeService) name() string {
+	return s.Metadata.Namespace + "/" + s.Metadata.Name
+}
+
+// requests returns the mappings of the ports of s. A LoadBalancer with an
+// IPv4 ingress address, like those of MetalLB, is mapped to it, other
+// Services to the node port on nodeIP.
+func (s *kubeService) requests(nodeIP string, lease time.Duration) ([]portmapping.MappingRequest, error) {
+	only, err := parsePortFilter(s.Metadata.Annotations[portsLabel])
+	if err != nil {
+		return nil, fmt.Errorf("%s: annotation %s: %w", s.name(), portsLabel, err)
+	}
+
+	desc := s.Metadata.Annotations[descLabel]
+	if desc == "" {
+		desc = "k8s " + s.name()
+	}
+	desc = tagDescription(desc)
+
+	var ingress string
+	if s.Spec.Type == "LoadBalancer" {
+		for _, in := range s.Status.LoadBalancer.Ingress {
+			if ip := net.ParseIP(in.IP); ip != nil && ip.To4() != nil {
+				ingress = in.IP
+				break
+			}
+		}
+	}
+
+	var reqs []portmapping.MappingRequest
+	for _, p := range s.Spec.Ports {
+		proto := strings.ToUpper(p.Protocol)
+		if proto == "" {
+			proto = "TCP"
+		}
+		if proto != "TCP" && proto != "UDP" {
+			continue
+		}
+		if !only.match(p.Name, proto, p.Port, p.NodePort) {
+			continue
+		}
+
+		r := portmapping.MappingRequest{
+			ExternalPort:   p.Port,
+			Protocol:       proto,
+			InternalPort:   p.NodePort,
+			InternalClient: nodeIP,
+			Description:    desc,
+			Lease:          lease,
+		}
+		if ingress != "" {
+			r.InternalClient, r.InternalPort = ingress, p.Port
+		}
+		// LoadBalancers may have no node ports
+		if r.InternalPort == 0 {
+			continue
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+func runKubernetes(args []string) error {
+	var (
+		target    targetFlags
+		api       string
+		tokenFile string
+		caFile    string
+		namespace string
+		nodeIP    string
+		lease     time.Duration
+		interval  time.Duration
+		hook      webhook
+		keep      bool
+	)
+
+	// In a pod the API server and its credentials come with the service
+	// account
+	var inCluster string
+	if host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"); host != "" && port != "" {
+		inCluster = "https://" + net.JoinHostPort(host, port)
+	}
+	defaultCA := serviceAccountDir + "/ca.crt"
+	if _, err := os.Stat(defaultCA); err != nil {
+		defaultCA = ""
+	}
+
+	fs := newFlagSet("kubernetes")
+	target.register(fs)
+	fs.StringVar(&api, "kube-api", inCluster, "URL of the Kubernetes API server, like that of kubectl proxy (defaults to the one of the cluster the pod runs in)")
+	fs.StringVar(&tokenFile, "kube-token-file", serviceAccountDir+"/token", "Bearer token of the API server, requests are unauthenticated if the file doesn't exist")
+	fs.StringVar(&caFile, "kube-ca", defaultCA, "PEM CA certificates of the API server")
+	fs.StringVar(&namespace, "namespace", "", "Namespace of the Services to map (defaults to every namespace)")
+	fs.StringVar(&nodeIP, "node-ip", os.Getenv("NODE_IP"), "Address of the node the node ports are mapped to (defaults to NODE_IP, then to the address the gateway reaches this host at)")
+	fs.DurationVar(&lease, "lease", time.Hour, "Lease of the mappings, renewed once half of it is gone (0 is permanent)")
+	fs.DurationVar(&interval, "interval", time.Minute, "How often the Services and the mappings are checked")
+	hook.register(fs)
+	registerKeep(fs, &keep)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: %s kubernetes [flags]
+
+Maps the ports of the NodePort and LoadBalancer Services annotated %s: "true"
+to the node, or to the ingress address of a LoadBalancer, while they exist.
+The %s annotation picks some of them by name or number, like "https,53/udp",
+and %s sets the description. The service account needs to get, list and
+watch services.
+`, os.Args[0], enableLabel, portsLabel, descLabel)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+
+	k, err := newKubeClient(api, tokenFile, caFile)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	if nodeIP == "" {
+		if nodeIP, err = localClient(c); err != nil {
+			return err
+		}
+	}
+
+	list := func(ctx context.Context) (desiredMappings, error) {
+		svcs, err := k.services(ctx, namespace)
+		if err != nil {
+			return nil, err
+		}
+		desired := make(desiredMappings)
+		for _, s := range svcs {
+			reqs, err := s.requests(nodeIP, lease)
+			if err != nil {
+				slog.Warn("mapping service", "service", s.name(), "err", err)
+				continue
+			}
+			for _, r := range reqs {
+				desired.add(r, s.name())
+			}
+		}
+		return desired, nil
+	}
+	watch := func(ctx context.Context, notify func()) error {
+		return k.watch(ctx, namespace, notify)
+	}
+
+	sd := startDaemon(ctx, "mapping services on "+c.String(), interval)
+	newKeptMappings(c, interval, &hook, keep).run(ctx, sd, list, watch)
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func runList(args []string) error {
+	var (
+		target  targetFlags
+		output  outputFlags
+		workers int
+		filter  portmapping.MappingFilter
+		order   orderFlags
+		save    string
+		dbPath  string
+		noProg  bool
+	)
+
+	fs := newFlagSet("list")
+	target.register(fs)
+	output.register(fs)
+	fs.IntVar(&workers, "workers", 4, "Number of services enumerated concurrently")
+	registerFilter(fs, &filter)
+	order.register(fs)
+	fs.StringVar(&save, "save", "", "Also save the mappings as a JSON snapshot for diff")
+	registerHistory(fs, &dbPath)
+	registerProgress(fs, &noProg)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := validateFilter(&filter); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	out, closeOut, err := output.printer()
+	if err != nil {
+		return err
+	}
+	defer closeOut()
+
+	mappers, err := target.mappers(ctx)
+	if err != nil {
+		return err
+	}
+
+	prog := startProgress("list", noProg)
+	defer prog.done()
+	prog.services(len(mappers))
+	lists := portmapping.ListAllMappingsProgress(ctx, mappers, workers, prog.enumerated)
+	prog.done()
+	if dbPath != "" {
+		if err := recordHistory(ctx, dbPath, lists); err != nil {
+			return err
+		}
+	}
+	for _, l := range lists {
+		l.Mappings = portmapping.FilterMappings(l.Mappings, &filter)
+		order.apply(l.Mappings)
+	}
+
+	if save != "" {
+		if err := newSnapshot(lists).save(save); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range lists {
+		if err := printMappings(ctx, out, l, order.group); err != nil {
+			return err
+		}
+	}
+
+	return out.flush()
+}
+
+// printMappings prints the device and mappings of l, with group under a
+// heading per internal client where the printer has them
+func printMappings(ctx context.Context, out printer, l *portmapping.MappingList, group bool) error {
+	if err := out.device(l.Mapper, externalIP(ctx, l.Mapper)); err != nil {
+		return err
+	}
+
+	if group {
+		for _, g := range portmapping.GroupMappings(l.Mappings) {
+			if gp, ok := out.(groupPrinter); ok {
+				if err := gp.group(g.InternalClient, len(g.Mappings)); err != nil {
+					return err
+				}
+			}
+			for _, pme := range g.Mappings {
+				if err := out.mapping(l.Mapper, pme); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		for _, pme := range l.Mappings {
+			if err := out.mapping(l.Mapper, pme); err != nil {
+				return err
+			}
+		}
+	}
+
+	var check portmapping.ProxyCheck
+	for _, f := range check.Check(l.Mappings) {
+		slog.Warn("LIKELY ROUTER COMPROMISE: mapping looks injected to proxy traffic (UPnProxy)", "device", l.Mapper.String(),
+			"mapping", describeMapping(f.Mapping), "reason", f.Reason)
+	}
+
+	return l.Err
+}
+
+// recordHistory stores the unfiltered enumerations in the history database
+func recordHistory(ctx context.Context, path string, lists []*portmapping.MappingList) error {
+	h, err := openHistory(path)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	return h.recordLists(ctx, lists)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// notifyRecord is an announcement in the -json output
+type notifyRecord struct {
+	Type string `json:"type"`
+	portmapping.Notification
+}
+
+// inventoryDevice is a device seen announcing itself
+type inventoryDevice struct {
+	Type      string    `json:"type"`
+	UDN       string    `json:"udn"`
+	From      string    `json:"from"`
+	Location  string    `json:"location,omitempty"`
+	Server    string    `json:"server,omitempty"`
+	Types     []string  `json:"types"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Expires is when the last alive announcement runs out
+	Expires time.Time `json:"expires,omitempty"`
+	Gone    bool      `json:"gone"`
+}
+
+// state is how the device looked at t
+func (d *inventoryDevice) state(t time.Time) string {
+	switch {
+	case d.Gone:
+		return "gone"
+	case !d.Expires.IsZero() && t.After(d.Expires):
+		return "expired"
+	}
+	return "alive"
+}
+
+// inventory builds the devices of the network from their announcements
+type inventory struct {
+	devices map[string]*inventoryDevice
+}
+
+// add records n and returns whether it was the first of its device
+func (inv *inventory) add(n portmapping.Notification) bool {
+	udn := n.UDN()
+	d, ok := inv.devices[udn]
+	if !ok {
+		d = &inventoryDevice{Type: "device", UDN: udn, FirstSeen: n.Time}
+		inv.devices[udn] = d
+	}
+	d.From, d.LastSeen = n.From.String(), n.Time
+	if n.Location != "" {
+		d.Location = n.Location
+	}
+	if n.Server != "" {
+		d.Server = n.Server
+	}
+
+	switch n.Kind {
+	case portmapping.NotifyByeBye:
+		d.Gone = true
+	default:
+		d.Gone = false
+		if n.MaxAge > 0 {
+			d.Expires = n.Time.Add(n.MaxAge)
+		}
+	}
+
+	// The uuid NT repeats the UDN and upnp:rootdevice says nothing new
+	if strings.HasPrefix(n.NT, "urn:") {
+		i := sort.SearchStrings(d.Types, n.NT)
+		if i == len(d.Types) || d.Types[i] != n.NT {
+			d.Types = append(d.Types, "")
+			copy(d.Types[i+1:], d.Types[i:])
+			d.Types[i] = n.NT
+		}
+	}
+	return !ok
+}
+
+func (inv *inventory) print(jsonOut bool) error {
+	devices := make([]*inventoryDevice, 0, len(inv.devices))
+	for _, d := range inv.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].FirstSeen.Before(devices[j].FirstSeen) })
+
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		for _, d := range devices {
+			if err := enc.Encode(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	now := time.Now()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATE\tFROM\tUDN\tFIRST SEEN\tLAST SEEN\tSERVER\tLOCATION")
+	for _, d := range devices {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.state(now), d.From, d.UDN,
+			d.FirstSeen.Format(time.DateTime), d.LastSeen.Format(time.DateTime), d.Server, d.Location)
+	}
+	return tw.Flush()
+}
+
+func runListen(args []string) error {
+	var (
+		jsonOut bool
+		quiet   bool
+	)
+
+	fs := newFlagSet("listen")
+	fs.BoolVar(&jsonOut, "json", false, "Print the announcements and the inventory as newline delimited JSON")
+	fs.BoolVar(&quiet, "q", false, "Only print the inventory when done, not every announcement")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	inv := &inventory{devices: make(map[string]*inventoryDevice)}
+	enc := json.NewEncoder(os.Stdout)
+	slog.Info("listening for SSDP announcements, interrupt or -timeout to stop")
+	err := portmapping.ListenNotify(ctx, func(n portmapping.Notification) {
+		if inv.add(n) {
+			slog.Info("new device", "udn", n.UDN(), "from", n.From, "server", n.Server)
+		}
+		switch {
+		case quiet:
+		case jsonOut:
+			enc.Encode(notifyRecord{Type: "notify", Notification: n})
+		default:
+			fmt.Printf("%s %-6s %s %s %s\n", n.Time.Format(time.RFC3339), n.Kind, n.From, n.USN, n.Location)
+		}
+	})
+	if ctx.Err() == nil {
+		return err
+	}
+
+	if !quiet && !jsonOut {
+		fmt.Println()
+	}
+	if len(inv.devices) == 0 {
+		slog.Info("no device announced itself")
+	}
+	return inv.print(jsonOut)
+}
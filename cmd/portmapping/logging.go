@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"math"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// logLevel is the level of the default logger, set by the -v, -vv and
+// -quiet flags of every command
+var logLevel slog.LevelVar
+
+func registerLogging(fs *flag.FlagSet) {
+	fs.BoolFunc("v", "Log debug details", func(string) error {
+		logLevel.Set(slog.LevelDebug)
+		return nil
+	})
+	fs.BoolFunc("vv", "Log debug details and raw protocol messages like SSDP headers", func(string) error {
+		logLevel.Set(portmapping.LevelTrace)
+		return nil
+	})
+	fs.BoolFunc("quiet", "Log nothing, only print the command output and failures", func(string) error {
+		logLevel.Set(slog.Level(math.MaxInt32))
+		return nil
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// exitNoSuchEntry is the exit code of get when the mapping does not exist
+const exitNoSuchEntry = 2
+
+// command is a portmapping subcommand with its own flag set
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []*command{
+	{"discover", "Locate gateways and print their WAN connection services", runDiscover},
+	{"detect", "Probe the gateway for UPnP, NAT-PMP and PCP and report which are enabled", runDetect},
+	{"fingerprint", "Identify the UPnP stack and model of the devices and match known vulnerabilities", runFingerprint},
+	{"listen", "Passively record SSDP announcements and print the devices seen, without sending anything", runListen},
+	{"rogue", "Look for spoofed SSDP answers claiming to be the gateway, exit with 3 if there are any", runRogue},
+	{"list", "Print the port mappings of every WAN connection service", runList},
+	{"add", "Add a port mapping", runAdd},
+	{"delete", "Delete a port mapping", runDelete},
+	{"apply", "Reconcile the mappings with a YAML config", runApply},
+	{"diff", "Compare two snapshots saved by list -save, or two times of a -db history", runDiff},
+	{"history", "Print the mappings recorded with -db over a period of time", runHistory},
+	{"audit", "Check the mappings against a security policy, exit with 3 on violations", runAudit},
+	{"stale", "Probe the internal clients and print, or -prune, the mappings of hosts that are gone", runStale},
+	{"verify", "Check from outside the gateway whether the mappings are reachable", runVerify},
+	{"wan-check", "Check from outside whether the gateway answers UPnP on its WAN side, exit with 3 if it does", runWANCheck},
+	{"report", "Write a Markdown or HTML audit report from a -db history", runReport},
+	{"export", "Back up the mappings to a YAML or JSON file", runExport},
+	{"import", "Recreate the mappings of an export", runImport},
+	{"renew", "Add a port mapping and keep renewing its lease", runRenew},
+	{"ensure", "Keep mappings in place, recreating them when they disappear or point elsewhere: ensure -tcp 443:443 -client host", runEnsure},
+	{"docker", "Map the published ports of the containers labelled portmapping.enable=true while they run", runDocker},
+	{"kubernetes", "Map the ports of the NodePort and LoadBalancer Services annotated portmapping.enable=true to the node", runKubernetes},
+	{"get", "Print a single port mapping, exit with 2 if there is none", runGet},
+	{"pinhole", "Manage IPv6 firewall pinholes: pinhole add|update|delete|timeout|status", runPinhole},
+	{"external-ip", "Print the external IP address of the gateway", runExternalIP},
+	{"status", "Print a summary of every WAN connection service", runStatus},
+	{"ddns", "Keep a DuckDNS, Cloudflare or dyndns2 name pointing at the external IP: ddns -ddns duckdns://TOKEN@name", runDDNS},
+	{"monitor", "Watch the mappings and print added, removed and changed ones", runMonitor},
+	{"exporter", "Serve Prometheus metrics about the gateway", runExporter},
+	{"serve", "Serve a REST API and web UI for the gateways and their mappings", runServe},
+	{"fleet", "Collect the inventories of many sites centrally and push their configs: fleet serve|report|sites|push", runFleet},
+	{"agent", "Serve the checks of verify and wan-check outside the gateway, or with -relay search and proxy a LAN for -agent", runAgent},
+	{"action", "Perform any SOAP action of a device service", runAction},
+	{"services", "Print every service and action the devices expose", runServices},
+	{"scan", "Search CIDR ranges for gateways and list their mappings", runScan},
+	{"with", "Map ports while a command runs: with -tcp 8080 -- command args", runWith},
+	{"systemd-unit", "Print an example systemd unit running a command: systemd-unit ensure -tcp 443", runSystemdUnit},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+func main() {
+	slog.SetDefault(slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: &logLevel})))
+
+	args := os.Args[1:]
+
+	// Keep the flag-only invocation of older versions listing mappings
+	name := "list"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		return
+	}
+
+	s, err := loadSettings()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "settings: %v\n", err)
+		os.Exit(1)
+	}
+	defaults = s
+	if err := setProxy(defaults.Proxy); err != nil {
+		fmt.Fprintf(os.Stderr, "settings: proxy: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+
+		err = c.run(args)
+		if errors.Is(err, portmapping.ErrNoSuchEntry) {
+			slog.Info(err.Error())
+			os.Exit(exitNoSuchEntry)
+		}
+		// The violations are already printed
+		if errors.Is(err, errViolations) {
+			os.Exit(exitViolations)
+		}
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		// Exit like the command run by with
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			os.Exit(exitErr.ExitCode())
+		}
+		// Failures are reported even with -quiet
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	usage()
+	os.Exit(1)
+}
+
+// timeout bounds the whole command, it is registered on every flag set
+var timeout time.Duration
+
+// newFlagSet returns a flag set for the named command that reports errors
+// instead of exiting
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.DurationVar(&timeout, "timeout", 0, "Abort the command after this long (0 is no limit)")
+	registerLogging(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [flags]\n", os.Args[0], name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// commandContext returns a context cancelled on interrupt or after -timeout,
+// with the relay of -agent or the HTTP client of -proxy
+func commandContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if source.IP != nil || source.Interface != "" {
+		ctx = portmapping.WithSource(ctx, source)
+	}
+	switch {
+	case relay != nil:
+		ctx = portmapping.WithRelay(ctx, relay)
+	case proxy != nil:
+		ctx = portmapping.WithHTTPClient(ctx, proxy)
+	}
+	if timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"math"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// mappingFlags describe the mapping add, delete and get work on
+type mappingFlags struct {
+	remote  string
+	extPort uint
+	intPort uint
+	client  string
+	proto   string
+	desc    string
+	lease   uint
+}
+
+func (m *mappingFlags) registerKey(fs *flag.FlagSet) {
+	fs.StringVar(&m.remote, "remote", "", "Remote host of the mapping (empty is any)")
+	fs.UintVar(&m.extPort, "ext", 0, "External port of the mapping")
+	fs.StringVar(&m.proto, "proto", "TCP", "Protocol of the mapping (TCP or UDP)")
+}
+
+func (m *mappingFlags) register(fs *flag.FlagSet) {
+	m.registerKey(fs)
+	fs.UintVar(&m.intPort, "int", 0, "Internal port of the mapping (defaults to the external port)")
+	fs.StringVar(&m.client, "client", "", "Internal client address of the mapping")
+	fs.StringVar(&m.desc, "desc", "portmapping", "Description of the mapping, tagged with the pm:<hostname>: owner prefix")
+	fs.UintVar(&m.lease, "lease", 0, "Lease duration of the mapping in seconds (0 is permanent)")
+}
+
+func (m *mappingFlags) validateKey() error {
+	if m.extPort == 0 || m.extPort > math.MaxUint16 {
+		return errors.New("a valid -ext port is required")
+	}
+	return nil
+}
+
+func (m *mappingFlags) validate(needClient bool) error {
+	if err := m.validateKey(); err != nil {
+		return err
+	}
+	if m.intPort == 0 {
+		m.intPort = m.extPort
+	}
+	if m.intPort > math.MaxUint16 {
+		return errors.New("-int is not a valid port")
+	}
+	if m.client == "" && needClient {
+		return errors.New("-client is required")
+	}
+	if m.lease > math.MaxUint32 {
+		return errors.New("-lease is too large")
+	}
+	m.desc = tagDescription(m.desc)
+	return nil
+}
+
+// request returns the validated flags as a mapping request
+func (m *mappingFlags) request() portmapping.MappingRequest {
+	return portmapping.MappingRequest{
+		ExternalPort:   uint16(m.extPort),
+		Protocol:       m.proto,
+		InternalPort:   uint16(m.intPort),
+		InternalClient: m.client,
+		Description:    m.desc,
+		Lease:          time.Duration(m.lease) * time.Second,
+	}
+}
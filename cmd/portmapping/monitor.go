@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+type changeRecord struct {
+	Type   string `json:"type"`
+	Time   string `json:"time"`
+	Device string `json:"device"`
+	portmapping.MappingChange
+}
+
+type externalIPRecord struct {
+	Type   string `json:"type"`
+	Time   string `json:"time"`
+	Device string `json:"device"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new"`
+}
+
+func runMonitor(args []string) error {
+	var (
+		target   targetFlags
+		interval time.Duration
+		jsonOut  bool
+		events   bool
+		listen   string
+		hook     webhook
+		onChange execHook
+		ddns     ddnsFlags
+		reboots  time.Duration
+		cfgPath  string
+		dbPath   string
+	)
+
+	fs := newFlagSet("monitor")
+	target.register(fs)
+	fs.DurationVar(&interval, "interval", time.Minute, "How often the mappings are enumerated")
+	fs.BoolVar(&jsonOut, "json", false, "Print changes as newline delimited JSON")
+	fs.BoolVar(&events, "events", false, "Subscribe to UPnP change notifications instead of polling")
+	fs.StringVar(&listen, "listen", ":0", "Listen address for UPnP event notifications")
+	fs.DurationVar(&reboots, "reboot-interval", 5*time.Minute, "How often the gateway is searched for a changed BOOTID/CONFIGID, which restarts the monitor (0 disables)")
+	fs.StringVar(&cfgPath, "config", "", "YAML config of mappings to apply at start, after every gateway reboot and read again on SIGHUP")
+	registerHistory(fs, &dbPath)
+	hook.register(fs)
+	onChange.register(fs)
+	ddns.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+	up, err := ddns.updater()
+	if err != nil {
+		return err
+	}
+
+	var cfg *config
+	if cfgPath != "" {
+		c, err := readConfig(cfgPath)
+		if err != nil {
+			return err
+		}
+		cfg = c
+	}
+
+	var hist *history
+	if dbPath != "" {
+		h, err := openHistory(dbPath)
+		if err != nil {
+			return err
+		}
+		defer h.Close()
+		hist = h
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	mappers, err := target.mappers(ctx)
+	if err != nil {
+		return err
+	}
+	sd := startDaemon(ctx, fmt.Sprintf("watching %d devices", len(mappers)), interval)
+
+	var (
+		mu  sync.Mutex
+		enc = json.NewEncoder(os.Stdout)
+	)
+	// watch reports the mapping changes of every mapper until ctx is done
+	watch := func(ctx context.Context, mappers []portmapping.PortMapper) {
+		var wg sync.WaitGroup
+		// The name points at the first gateway, the one mappings go through
+		if up != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				keepDDNS(ctx, up, mappers[0], interval, nil)
+			}()
+		}
+		for _, m := range mappers {
+			wg.Add(1)
+			go func(m portmapping.PortMapper) {
+				defer wg.Done()
+				report := func(entries []*portmapping.PortMappingEntry, changes []portmapping.MappingChange, err error) {
+					sd.alive()
+					mu.Lock()
+					switch {
+					case err != nil:
+						slog.Warn("listing mappings", "device", m.String(), "err", err)
+					case changes == nil:
+						slog.Info("watching mappings", "device", m.String(), "count", len(entries))
+					}
+					if err == nil && hist != nil {
+						if err := hist.record(ctx, m.String(), entries, time.Now()); err != nil {
+							slog.Warn("recording history", "device", m.String(), "err", err)
+						}
+					}
+
+					now := time.Now().Format(time.RFC3339)
+					for _, c := range changes {
+						if jsonOut {
+							enc.Encode(changeRecord{Type: "change", Time: now, Device: m.String(), MappingChange: c})
+							continue
+						}
+						fmt.Printf("%s %s %s\n", now, changeSymbol(c.Kind), describeChange(c))
+					}
+					mu.Unlock()
+
+					if err := hook.send(ctx, m.String(), changes); err != nil {
+						slog.Warn("sending webhook", "device", m.String(), "err", err)
+					}
+					if err := onChange.mappings(ctx, m.String(), changes); err != nil {
+						slog.Warn("running -on-change", "device", m.String(), "err", err)
+					}
+				}
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					// Events only call back on changes, the external IP is
+					// polled and tells the watchdog the watch goes on
+					portmapping.WatchExternalIP(ctx, progressMapper{m, sd}, interval, func(old, new net.IP, err error) {
+						switch {
+						case err != nil:
+							slog.Debug("getting external IP", "device", m.String(), "err", err)
+							return
+						case old == nil:
+							return
+						}
+
+						mu.Lock()
+						now := time.Now().Format(time.RFC3339)
+						if jsonOut {
+							enc.Encode(externalIPRecord{Type: "external_ip", Time: now, Device: m.String(), Old: old.String(), New: new.String()})
+						} else {
+							fmt.Printf("%s ~ external IP %s => %s\n", now, old, new)
+						}
+						mu.Unlock()
+
+						if err := onChange.externalIP(ctx, m.String(), old, new); err != nil {
+							slog.Warn("running -on-change", "device", m.String(), "err", err)
+						}
+					})
+				}()
+
+				if c, ok := m.(*portmapping.Client); ok && events {
+					err := portmapping.WatchEvents(ctx, c, listen, report)
+					if err == nil || ctx.Err() != nil {
+						return
+					}
+					slog.Warn("subscribing to events failed, polling instead", "device", m.String(), "err", err)
+				}
+				portmapping.Watch(ctx, m, interval, report)
+			}(m)
+		}
+		wg.Wait()
+	}
+
+	for {
+		if cfg != nil {
+			if err := reconcile(ctx, mappers[0], cfg, false, false); err != nil {
+				slog.Warn("applying config", "device", mappers[0].String(), "err", err)
+			}
+		}
+
+		wctx, stop := context.WithCancel(ctx)
+		rebooted := make(chan struct{}, 1)
+		if reboots > 0 && target.upnpSearch() {
+			host, err := target.searchHost()
+			if err != nil {
+				stop()
+				return err
+			}
+			go portmapping.WatchReboots(wctx, host, target.port, &target.search, reboots, func(old, new portmapping.Responder) {
+				select {
+				case rebooted <- struct{}{}:
+				default:
+				}
+			})
+		}
+
+		// The locations are searched again when their SSDP answers run out
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if exp := expiry(mappers); !exp.IsZero() && target.upnpSearch() {
+			timer = time.NewTimer(time.Until(exp))
+			expired = timer.C
+		}
+
+		done := make(chan struct{})
+		go func() {
+			watch(wctx, mappers)
+			close(done)
+		}()
+
+		reason := "gateway rebooted"
+		reload := false
+		select {
+		case <-rebooted:
+		case <-expired:
+			reason = "gateway announcement expired"
+		case <-sd.reload:
+			reload = true
+		case <-done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		stop()
+		<-done
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		// A reload keeps the devices and applies the config read again
+		if reload {
+			sd.reloading()
+			reloadSettings()
+			if cfgPath != "" {
+				c, err := readConfig(cfgPath)
+				if err != nil {
+					slog.Error("reloading config, keeping the previous one", "path", cfgPath, "err", err)
+				} else {
+					cfg = c
+				}
+			}
+			slog.Info("reloaded")
+			sd.ready(fmt.Sprintf("watching %d devices", len(mappers)))
+			continue
+		}
+
+		slog.Info(reason + ", discovering it again")
+		target.rediscover = true
+		for {
+			mappers, err = target.mappers(ctx)
+			if err == nil {
+				break
+			}
+			slog.Warn("discovering gateway again", "err", err)
+			sd.alive()
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(interval):
+			}
+		}
+	}
+}
+
+func changeSymbol(k portmapping.ChangeKind) string {
+	switch k {
+	case portmapping.MappingAdded:
+		return "+"
+	case portmapping.MappingRemoved:
+		return "-"
+	}
+	return "~"
+}
+
+func describeMapping(pme *portmapping.PortMappingEntry) string {
+	s := fmt.Sprintf("%s %s -> %s:%s %q", pme.NewProtocol, pme.NewExternalPort, pme.NewInternalClient, pme.NewInternalPort, pme.NewPortMappingDescription)
+	if pme.NewRemoteHost != "" {
+		s += " from " + pme.NewRemoteHost
+	}
+	if !pme.IsEnabled() {
+		s += " disabled"
+	}
+	return s
+}
+
+func describeChange(c portmapping.MappingChange) string {
+	switch c.Kind {
+	case portmapping.MappingAdded:
+		return describeMapping(c.New)
+	case portmapping.MappingRemoved:
+		return describeMapping(c.Old)
+	}
+	return describeMapping(c.Old) + " => " + describeMapping(c.New)
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// printer renders discovered devices and their mappings
+type printer interface {
+	device(m portmapping.PortMapper, externalIP net.IP) error
+	mapping(m portmapping.PortMapper, pme *portmapping.PortMappingEntry) error
+	flush() error
+}
+
+type deviceRecord struct {
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Service    string `json:"service"`
+	Location   string `json:"location,omitempty"`
+	ExternalIP string `json:"external_ip,omitempty"`
+	// ExternalIPInfo is set with -geoip and -resolve
+	ExternalIPInfo *hostInfo `json:"external_ip_info,omitempty"`
+	// Interface is the one a multicast search found the device on
+	Interface string `json:"interface,omitempty"`
+	// Expires is when the SSDP answer of the device runs out
+	Expires string `json:"expires,omitempty"`
+
+	Info *portmapping.DeviceInfo `json:"info,omitempty"`
+}
+
+type mappingRecord struct {
+	Type   string `json:"type"`
+	Device string `json:"device"`
+	// Location tells apart the devices of a scan, whose records interleave
+	Location string `json:"location,omitempty"`
+	*portmapping.PortMappingEntry
+	// Client is set with -resolve, Remote also with -geoip
+	Client *clientInfo `json:"client,omitempty"`
+	Remote *hostInfo   `json:"remote,omitempty"`
+	// Expires is when a finite lease runs out
+	Expires string `json:"expires,omitempty"`
+}
+
+func describe(m portmapping.PortMapper, externalIP net.IP) deviceRecord {
+	rec := deviceRecord{Type: "device", Name: m.String()}
+	if externalIP != nil {
+		rec.ExternalIP = externalIP.String()
+	}
+
+	switch c := m.(type) {
+	case *portmapping.Client:
+		rec.Name = c.RootDevice.Device.FriendlyName
+		rec.Service = c.Service.ServiceType
+		rec.Info = c.DeviceInfo()
+		rec.Interface = c.Interface
+		if !c.Expires.IsZero() {
+			rec.Expires = c.Expires.Format(time.RFC3339)
+		}
+		if c.Location != nil {
+			rec.Location = c.Location.String()
+		}
+	case *portmapping.NATPMPClient:
+		rec.Service = "NAT-PMP"
+	case *portmapping.PCPClient:
+		rec.Service = "PCP"
+	}
+
+	return rec
+}
+
+// summary returns a one line device description
+func summary(m portmapping.PortMapper, externalIP net.IP) string {
+	s := m.String()
+	if c, ok := m.(*portmapping.Client); ok && c.Interface != "" {
+		s += " :: on " + c.Interface
+	}
+	if externalIP == nil {
+		return s
+	}
+	return s + " :: external IP " + externalIP.String()
+}
+
+// outputFlags select how list results are rendered
+type outputFlags struct {
+	format string
+	json   bool
+	file   string
+	color  bool
+	// resolve enriches internal clients, naming vendors from oui, and
+	// remote hosts, located with geoip
+	resolve bool
+	oui     string
+	geoip   []string
+}
+
+func (o *outputFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.format, "format", defaults.Format, "Output format: table, log, json or csv")
+	fs.BoolVar(&o.json, "json", false, "Shorthand for -format json")
+	fs.StringVar(&o.file, "o", "", "Write the output to a file instead of stdout")
+	fs.BoolVar(&o.color, "color", false, "Colorize the table output")
+	fs.BoolVar(&o.resolve, "resolve", false, "Add the hostname, MAC address and vendor of internal clients from reverse DNS and the ARP cache")
+	fs.StringVar(&o.oui, "oui", "", "IEEE oui.txt or Wireshark manuf file naming the vendors of -resolve, a short built-in list if empty")
+	fs.Func("geoip", "MaxMind DB, like GeoLite2-Country.mmdb or GeoLite2-ASN.mmdb, adding the country and AS of remote hosts and the external IP (repeatable)", func(v string) error {
+		o.geoip = append(o.geoip, v)
+		return nil
+	})
+}
+
+// printer returns the selected printer and a function closing its output
+func (o *outputFlags) printer() (printer, func() error, error) {
+	if o.json {
+		o.format = "json"
+	}
+
+	var res *clientResolver
+	if o.resolve || o.oui != "" || len(o.geoip) > 0 {
+		var err error
+		if res, err = newClientResolver(o.resolve || o.oui != "", o.oui, o.geoip); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var (
+		w       io.Writer = os.Stdout
+		closeFn           = func() error { return nil }
+	)
+	if o.file != "" {
+		f, err := os.Create(o.file)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closeFn = f, f.Close
+	}
+
+	p, err := newPrinter(o.format, w, o.color, res)
+	if err != nil {
+		closeFn()
+		return nil, nil, err
+	}
+
+	return p, closeFn, nil
+}
+
+// newPrinter returns the printer for an output format, adding what res
+// knows of internal clients if it isn't nil
+func newPrinter(format string, w io.Writer, color bool, res *clientResolver) (printer, error) {
+	switch format {
+	case "", "table":
+		return newTablePrinter(w, color, res), nil
+	case "log":
+		return logPrinter{log.New(os.Stderr, "", log.LstdFlags), res}, nil
+	case "json":
+		return newJSONPrinter(w, res), nil
+	case "csv":
+		return newCSVPrinter(w, res), nil
+	}
+
+	return nil, fmt.Errorf("unknown output format %q", format)
+}
+
+// logPrinter keeps the plain log output. It has its own logger as the
+// default one follows the -v and -quiet levels.
+type logPrinter struct {
+	l   *log.Logger
+	res *clientResolver
+}
+
+func (p logPrinter) device(m portmapping.PortMapper, externalIP net.IP) error {
+	p.l.Println(p.res.summary(m, externalIP))
+	return nil
+}
+
+func (p logPrinter) mapping(m portmapping.PortMapper, pme *portmapping.PortMappingEntry) error {
+	line := fmt.Sprint(pme)
+	if expires, ok := pme.Expires(time.Now()); ok {
+		line += " :: expires " + expires.Format(time.DateTime)
+	}
+	if info := p.res.lookup(pme.NewInternalClient); info != nil {
+		line += " :: " + info.String()
+	}
+	if info := p.res.remote(pme.NewRemoteHost); info != nil {
+		line += " :: from " + info.String()
+	}
+	p.l.Println(line)
+	return nil
+}
+
+func (logPrinter) flush() error {
+	return nil
+}
+
+// jsonPrinter writes one JSON document per device and mapping
+type jsonPrinter struct {
+	enc *json.Encoder
+	res *clientResolver
+}
+
+func newJSONPrinter(w io.Writer, res *clientResolver) *jsonPrinter {
+	return &jsonPrinter{enc: json.NewEncoder(w), res: res}
+}
+
+func (p *jsonPrinter) device(m portmapping.PortMapper, externalIP net.IP) error {
+	rec := describe(m, externalIP)
+	if externalIP != nil {
+		rec.ExternalIPInfo = p.res.remote(externalIP.String())
+	}
+	return p.enc.Encode(rec)
+}
+
+func (p *jsonPrinter) mapping(m portmapping.PortMapper, pme *portmapping.PortMappingEntry) error {
+	rec := mappingRecord{
+		Type:             "mapping",
+		Device:           m.String(),
+		PortMappingEntry: pme,
+		Client:           p.res.lookup(pme.NewInternalClient),
+		Remote:           p.res.remote(pme.NewRemoteHost),
+	}
+	if expires, ok := pme.Expires(time.Now()); ok {
+		rec.Expires = expires.Format(time.RFC3339)
+	}
+	if c, ok := m.(*portmapping.Client); ok && c.Location != nil {
+		rec.Location = c.Location.String()
+	}
+	return p.enc.Encode(rec)
+}
+
+func (p *jsonPrinter) flush() error {
+	return nil
+}
+
+var csvHeader = []string{
+	"device",
+	"remote host",
+	"external port",
+	"protocol",
+	"internal port",
+	"internal client",
+	"enabled",
+	"description",
+	"lease",
+	"expires",
+}
+
+// clientHeader are the columns -resolve adds, remoteHeader those of
+// -resolve and -geoip
+var (
+	clientHeader = []string{"hostname", "mac", "vendor"}
+	remoteHeader = []string{"remote hostname", "remote country", "remote as"}
+)
+
+// csvPrinter writes the mapping table with a header row
+type csvPrinter struct {
+	w      *csv.Writer
+	header bool
+	res    *clientResolver
+}
+
+func newCSVPrinter(w io.Writer, res *clientResolver) *csvPrinter {
+	return &csvPrinter{w: csv.NewWriter(w), res: res}
+}
+
+// columns returns the header row
+func (p *csvPrinter) columns() []string {
+	if p.res == nil {
+		return csvHeader
+	}
+	columns := append([]string(nil), csvHeader...)
+	if p.res.resolve {
+		columns = append(columns, clientHeader...)
+	}
+	return append(columns, remoteHeader...)
+}
+
+func (p *csvPrinter) device(m portmapping.PortMapper, externalIP net.IP) error {
+	return nil
+}
+
+func (p *csvPrinter) mapping(m portmapping.PortMapper, pme *portmapping.PortMappingEntry) error {
+	if !p.header {
+		if err := p.w.Write(p.columns()); err != nil {
+			return err
+		}
+		p.header = true
+	}
+
+	row := []string{
+		m.String(),
+		pme.NewRemoteHost,
+		pme.NewExternalPort,
+		pme.NewProtocol,
+		pme.NewInternalPort,
+		pme.NewInternalClient,
+		pme.NewEnabled,
+		pme.NewPortMappingDescription,
+		pme.NewLeaseDuration,
+		"",
+	}
+	if expires, ok := pme.Expires(time.Now()); ok {
+		row[len(row)-1] = expires.Format(time.RFC3339)
+	}
+	if p.res != nil {
+		if p.res.resolve {
+			row = append(row, p.res.lookup(pme.NewInternalClient).fields()...)
+		}
+		row = append(row, p.res.remote(pme.NewRemoteHost).fields()...)
+	}
+	return p.w.Write(row)
+}
+
+func (p *csvPrinter) flush() error {
+	if !p.header {
+		if err := p.w.Write(p.columns()); err != nil {
+			return err
+		}
+	}
+
+	p.w.Flush()
+	return p.w.Error()
+}
+
+const (
+	ansiBold  = "\x1b[1m"
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiReset = "\x1b[0m"
+)
+
+var tableHeader = []string{
+	"PROTO",
+	"EXTERNAL",
+	"INTERNAL",
+	"REMOTE HOST",
+	"ENABLED",
+	"LEASE",
+	"EXPIRES",
+	"DESCRIPTION",
+}
+
+// tablePrinter writes an aligned table of mappings per device. Colors are
+// applied to whole lines after alignment so escape codes don't skew columns.
+type tablePrinter struct {
+	w        io.Writer
+	buf      bytes.Buffer
+	tw       *tabwriter.Writer
+	color    bool
+	disabled []bool
+	res      *clientResolver
+}
+
+func newTablePrinter(w io.Writer, color bool, res *clientResolver) *tablePrinter {
+	return &tablePrinter{w: w, color: color, res: res}
+}
+
+func (p *tablePrinter) paint(code, s string) string {
+	if !p.color {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+func (p *tablePrinter) device(m portmapping.PortMapper, externalIP net.IP) error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintln(p.w, p.paint(ansiBold, p.res.summary(m, externalIP))); err != nil {
+		return err
+	}
+
+	return p.table()
+}
+
+// table starts the table of a device or group
+func (p *tablePrinter) table() error {
+	p.buf.Reset()
+	p.tw = tabwriter.NewWriter(&p.buf, 0, 4, 2, ' ', 0)
+	p.disabled = p.disabled[:0]
+	header := tableHeader
+	if p.res != nil && p.res.resolve {
+		// Before the description, which may have spaces of its own
+		last := len(header) - 1
+		header = append(append(append([]string(nil), header[:last]...), "HOSTNAME", "MAC", "VENDOR"), header[last])
+	}
+	_, err := fmt.Fprintln(p.tw, strings.Join(header, "\t"))
+	return err
+}
+
+// groupPrinter is implemented by printers with a heading for the mappings
+// of an internal client printed with -group-by
+type groupPrinter interface {
+	group(internalClient string, mappings int) error
+}
+
+// group ends the table of the previous group, a device has none until its
+// first group
+func (p *tablePrinter) group(internalClient string, mappings int) error {
+	if len(p.disabled) > 0 {
+		if err := p.flush(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintln(p.w, p.paint(ansiBold, fmt.Sprintf("%s (%d mappings)", internalClient, mappings))); err != nil {
+		return err
+	}
+	return p.table()
+}
+
+func (p *tablePrinter) mapping(m portmapping.PortMapper, pme *portmapping.PortMappingEntry) error {
+	remote := pme.NewRemoteHost
+	if remote == "" {
+		remote = "*"
+	} else if info := p.res.remote(remote); info != nil {
+		remote += " (" + info.String() + ")"
+	}
+
+	enabled := "no"
+	if pme.IsEnabled() {
+		enabled = "yes"
+	}
+	p.disabled = append(p.disabled, enabled == "no")
+
+	client := ""
+	if p.res != nil && p.res.resolve {
+		client = strings.Join(p.res.lookup(pme.NewInternalClient).fields(), "\t") + "\t"
+	}
+
+	lease, expires := leaseColumns(pme, time.Now())
+	_, err := fmt.Fprintf(p.tw, "%s\t%s\t%s:%s\t%s\t%s\t%s\t%s\t%s%s\n",
+		pme.NewProtocol,
+		pme.NewExternalPort,
+		pme.NewInternalClient, pme.NewInternalPort,
+		remote,
+		enabled,
+		lease,
+		expires,
+		client,
+		pme.NewPortMappingDescription,
+	)
+	return err
+}
+
+// leaseColumns returns the time left of the lease of pme and when it runs
+// out if it was read at now
+func leaseColumns(pme *portmapping.PortMappingEntry, now time.Time) (string, string) {
+	expires, ok := pme.Expires(now)
+	if !ok {
+		if pme.NewLeaseDuration == "0" || pme.NewLeaseDuration == "" {
+			return "permanent", "-"
+		}
+		return pme.NewLeaseDuration, "-"
+	}
+	return expires.Sub(now).String(), expires.Format(time.DateTime)
+}
+
+func (p *tablePrinter) flush() error {
+	if p.tw == nil {
+		return nil
+	}
+	defer func() { p.tw = nil }()
+
+	if err := p.tw.Flush(); err != nil {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(p.buf.String(), "\n"), "\n")
+	for i, line := range lines {
+		switch {
+		case i == 0:
+			line = p.paint(ansiBold, line)
+		case p.disabled[i-1]:
+			line = p.paint(ansiRed, line)
+		default:
+			line = p.paint(ansiGreen, line)
+		}
+
+		if _, err := fmt.Fprintln(p.w, line); err != nil {
+			return err
+		}
+	}
+
+	if len(p.disabled) == 0 {
+		_, err := fmt.Fprintln(p.w, "(no mappings)")
+		return err
+	}
+
+	return nil
+}
+
+// inventoryPrinter is implemented by printers with their own rendering of
+// the device descriptions printed by discover
+type inventoryPrinter interface {
+	inventory(m portmapping.PortMapper) error
+}
+
+// inventory prints the device description of m
+func (p *tablePrinter) inventory(m portmapping.PortMapper) error {
+	if _, err := fmt.Fprintln(p.w, p.paint(ansiBold, m.String())); err != nil {
+		return err
+	}
+
+	c, ok := m.(*portmapping.Client)
+	if !ok {
+		return nil
+	}
+
+	info := c.DeviceInfo()
+	fields := []struct{ name, value string }{
+		{"manufacturer", info.Manufacturer},
+		{"model", info.ModelName},
+		{"model number", info.ModelNumber},
+		{"description", info.ModelDescription},
+		{"serial", info.SerialNumber},
+		{"UPC", info.UPC},
+		{"presentation", info.PresentationURL},
+		{"UDN", info.UDN},
+		{"interface", c.Interface},
+	}
+	if !c.Expires.IsZero() {
+		fields = append(fields, struct{ name, value string }{"expires", fmt.Sprintf("%s (in %s)", c.Expires.Format(time.DateTime), time.Until(c.Expires).Round(time.Second))})
+	}
+	if c.Location != nil {
+		fields = append(fields, struct{ name, value string }{"location", c.Location.String()})
+	}
+
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		if _, err := fmt.Fprintf(p.w, "  %-14s%s\n", f.name+":", f.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
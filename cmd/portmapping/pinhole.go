@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// pinholeFlags describe the pinhole add and timeout work on
+type pinholeFlags struct {
+	remote     string
+	remotePort uint
+	client     string
+	port       uint
+	proto      string
+}
+
+func (p *pinholeFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&p.remote, "remote", "", "Remote IPv6 host allowed in (empty is any)")
+	fs.UintVar(&p.remotePort, "remote-port", 0, "Remote port allowed in (0 is any)")
+	fs.StringVar(&p.client, "client", "", "Internal IPv6 client the pinhole opens to")
+	fs.UintVar(&p.port, "port", 0, "Internal port the pinhole opens to (0 is any)")
+	fs.StringVar(&p.proto, "proto", "TCP", "Protocol: TCP, UDP, an IANA protocol number or empty for any")
+}
+
+func (p *pinholeFlags) pinhole() (portmapping.Pinhole, error) {
+	if p.client == "" {
+		return portmapping.Pinhole{}, errors.New("-client is required")
+	}
+	if p.port > math.MaxUint16 || p.remotePort > math.MaxUint16 {
+		return portmapping.Pinhole{}, errors.New("not a valid port")
+	}
+
+	return portmapping.Pinhole{
+		RemoteHost:     p.remote,
+		RemotePort:     uint16(p.remotePort),
+		InternalClient: p.client,
+		InternalPort:   uint16(p.port),
+		Protocol:       p.proto,
+	}, nil
+}
+
+func runPinhole(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: pinhole add|update|delete|timeout|status [flags]")
+	}
+	action, args := args[0], args[1:]
+
+	var (
+		target targetFlags
+		ph     pinholeFlags
+		id     uint
+		lease  uint
+	)
+
+	fs := newFlagSet("pinhole " + action)
+	target.register(fs)
+	switch action {
+	case "add":
+		ph.register(fs)
+		fs.UintVar(&lease, "lease", 3600, "Lease of the pinhole in seconds")
+	case "update":
+		fs.UintVar(&id, "id", 0, "ID of the pinhole")
+		fs.UintVar(&lease, "lease", 3600, "New lease of the pinhole in seconds")
+	case "delete":
+		fs.UintVar(&id, "id", 0, "ID of the pinhole")
+	case "timeout":
+		ph.register(fs)
+	case "status":
+	default:
+		return fmt.Errorf("unknown pinhole action %q", action)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if id > math.MaxUint16 {
+		return errors.New("-id is not a valid pinhole ID")
+	}
+	if lease > math.MaxUint32 {
+		return errors.New("-lease is too large")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.pinholeClient(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	switch action {
+	case "add":
+		p, err := ph.pinhole()
+		if err != nil {
+			return err
+		}
+		uid, err := c.AddPinhole(ctx, p, uint32(lease))
+		if err != nil {
+			return err
+		}
+		fmt.Println(uid)
+	case "update":
+		return c.UpdatePinhole(ctx, uint16(id), uint32(lease))
+	case "delete":
+		return c.DeletePinhole(ctx, uint16(id))
+	case "timeout":
+		p, err := ph.pinhole()
+		if err != nil {
+			return err
+		}
+		secs, err := c.PinholeTimeout(ctx, p)
+		if err != nil {
+			return err
+		}
+		fmt.Println(secs)
+	case "status":
+		enabled, inbound, err := c.FirewallStatus(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(c)
+		fmt.Printf("  firewall:     %s\n", onOff(enabled))
+		fmt.Printf("  pinholes:     %s\n", onOff(inbound))
+	}
+
+	return nil
+}
+
+// pinholeClient returns the first IPv6 firewall control service of the target
+func (t *targetFlags) pinholeClient(ctx context.Context) (*portmapping.PinholeClient, error) {
+	locs, err := t.locations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, loc := range locs {
+		clients, err := portmapping.NewPinholeClientsByURL(ctx, loc)
+		if err != nil || len(clients) == 0 {
+			continue
+		}
+		if t.trace {
+			portmapping.TraceSOAP(clients[0].SOAPClient, os.Stderr)
+		}
+		return clients[0], nil
+	}
+
+	return nil, errors.New("no WANIPv6FirewallControl service found")
+}
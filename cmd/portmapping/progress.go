@@ -0,0 +1,238 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stderr is where logs go, it keeps the status line of a progress below
+// them on a terminal
+var stderr = &statusWriter{w: os.Stderr}
+
+// statusWriter writes through to w, redrawing the status line after every
+// write
+type statusWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	status string
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status != "" {
+		io.WriteString(s.w, "\r\033[K")
+	}
+	n, err := s.w.Write(p)
+	if s.status != "" {
+		io.WriteString(s.w, s.status)
+	}
+	return n, err
+}
+
+// setStatus replaces the status line, an empty one clears it
+func (s *statusWriter) setStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status == "" && status == "" {
+		return
+	}
+	io.WriteString(s.w, "\r\033[K"+status)
+	s.status = status
+}
+
+// isTerminal reports whether f is a character device like a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+const (
+	// progressRedraw is how often the status line of a terminal is drawn
+	progressRedraw = 200 * time.Millisecond
+	// progressLog is how often the status is logged when stderr isn't a
+	// terminal
+	progressLog = 10 * time.Second
+)
+
+func registerProgress(fs *flag.FlagSet, disabled *bool) {
+	fs.BoolVar(disabled, "no-progress", false, "Don't show the progress, a status line on a terminal and a log line every 10s otherwise")
+}
+
+// progress counts the work of a scan or long enumeration and shows it on
+// stderr until done is called. Its methods may be called concurrently and
+// on a nil progress.
+type progress struct {
+	label string
+	start time.Time
+
+	mu sync.Mutex
+	// hosts and hostsTotal count the hosts of the prefix scanned after
+	// the hostsBase of those before it
+	hosts      int
+	hostsTotal int
+	hostsBase  int
+	devices    int
+	// mappings and totals are per service of an enumeration, a total of
+	// -1 is unknown
+	mappings []int
+	totals   []int
+	// base counts the mappings of finished scan results
+	base int
+	errs int
+
+	stop chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// startProgress shows the progress of label unless disabled
+func startProgress(label string, disabled bool) *progress {
+	if disabled {
+		return nil
+	}
+
+	p := &progress{label: label, start: time.Now(), stop: make(chan struct{})}
+	tty := isTerminal(os.Stderr)
+	interval := progressLog
+	if tty {
+		interval = progressRedraw
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				if tty {
+					stderr.setStatus("")
+				}
+				return
+			case <-ticker.C:
+			}
+			if tty {
+				stderr.setStatus(p.line())
+			} else {
+				slog.Info("progress", "status", p.line())
+			}
+		}
+	}()
+	return p
+}
+
+// line returns the status line
+func (p *progress) line() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var parts []string
+	scan := p.hostsBase+p.hostsTotal > 0
+	if scan {
+		parts = append(parts, fmt.Sprintf("%d/%d hosts", p.hostsBase+p.hosts, p.hostsBase+p.hostsTotal))
+		parts = append(parts, fmt.Sprintf("%d devices", p.devices))
+	}
+
+	done, total := p.base, p.base
+	for i, n := range p.mappings {
+		done += n
+		if total >= 0 && p.totals[i] >= 0 {
+			total += p.totals[i]
+		} else {
+			total = -1
+		}
+	}
+	if total >= 0 && len(p.mappings) > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d mappings of %d services", done, total, p.devices))
+	} else if len(p.mappings) > 0 {
+		parts = append(parts, fmt.Sprintf("%d mappings of %d services", done, p.devices))
+	} else {
+		parts = append(parts, fmt.Sprintf("%d mappings", done))
+	}
+
+	if scan || p.errs > 0 {
+		parts = append(parts, fmt.Sprintf("%d errors", p.errs))
+	}
+	parts = append(parts, time.Since(p.start).Round(time.Second).String())
+	return p.label + ": " + strings.Join(parts, ", ")
+}
+
+// probed records the hosts probed of the prefix scanned, a
+// ScanOptions.Progress
+func (p *progress) probed(done, total int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hosts, p.hostsTotal = max(p.hosts, done), total
+}
+
+// nextPrefix adds the hosts of the prefix scanned to those done before the
+// next one
+func (p *progress) nextPrefix() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.hostsBase += p.hostsTotal
+	p.hosts, p.hostsTotal = 0, 0
+}
+
+// found records a device of a scan with its mappings and errors
+func (p *progress) found(devices, mappings, errs int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.devices += devices
+	p.base += mappings
+	p.errs += errs
+}
+
+// services starts counting the enumeration of n services
+func (p *progress) services(n int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.devices = n
+	p.mappings, p.totals = make([]int, n), make([]int, n)
+	for i := range p.totals {
+		p.totals[i] = -1
+	}
+}
+
+// enumerated records the entries read of service i, a callback of
+// ListAllMappingsProgress
+func (p *progress) enumerated(i, done, total int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mappings[i], p.totals[i] = done, total
+}
+
+// done stops showing the progress and clears the status line, it may be
+// called more than once
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() { close(p.stop) })
+	p.wg.Wait()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// relay is the agent of -agent, commandContext makes the library search
+// and talk HTTP through it
+var relay *portmapping.Relay
+
+// agentCommand is run on the host of an ssh:// agent, -agent-command
+var agentCommand string
+
+// setRelay makes SSDP searches, descriptions and SOAP actions go through
+// the agent at rawurl. An http:// agent is connected to, an ssh:// one is
+// started on its host for every connection.
+func setRelay(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http":
+		relay = portmapping.NewRelay(u, nil)
+	case "ssh":
+		if u.Host == "" {
+			return errors.New("want ssh://[user@]host[:port]")
+		}
+		dial := sshDial(u)
+		relay = portmapping.NewRelay(&url.URL{Scheme: "http", Host: "agent.invalid"}, dial)
+	default:
+		return fmt.Errorf("unsupported agent scheme %q, want http or ssh", u.Scheme)
+	}
+	slog.Debug("relaying through agent", "agent", u.Redacted())
+	return nil
+}
+
+// sshDial returns a dialer starting agentCommand over SSH on the host of u
+// and talking to it through the standard input and output of ssh
+func sshDial(u *url.URL) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		args := []string{"-T", "-o", "BatchMode=yes"}
+		if port := u.Port(); port != "" {
+			args = append(args, "-p", port)
+		}
+		dest := u.Hostname()
+		if u.User != nil {
+			dest = u.User.Username() + "@" + dest
+		}
+		args = append(args, dest, agentCommand)
+
+		// The connection outlives the dial, it is ended by Close
+		cmd := exec.Command("ssh", args...)
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		slog.Debug("started agent over ssh", "host", dest, "pid", cmd.Process.Pid)
+		return &pipeConn{Reader: stdout, WriteCloser: stdin, closer: func() error {
+			stdin.Close()
+			return cmd.Wait()
+		}}, nil
+	}
+}
+
+// pipeConn is a connection over a pair of pipes. Deadlines are ignored,
+// the requests over it are bounded by their contexts.
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+	closer func() error
+	once   sync.Once
+	err    error
+}
+
+func (c *pipeConn) Close() error {
+	c.once.Do(func() { c.err = c.closer() })
+	return c.err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr               { return pipeAddr{} }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "stdio" }
+
+// stdioListener accepts the single connection of the standard input and
+// output, an agent started over SSH serves it
+type stdioListener struct {
+	conn chan net.Conn
+	done chan struct{}
+}
+
+func newStdioListener() *stdioListener {
+	l := &stdioListener{conn: make(chan net.Conn, 1), done: make(chan struct{})}
+	l.conn <- &pipeConn{Reader: os.Stdin, WriteCloser: os.Stdout, closer: func() error {
+		close(l.done)
+		return nil
+	}}
+	return l
+}
+
+// Accept returns the connection and then blocks until it is closed
+func (l *stdioListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conn:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *stdioListener) Close() error { return nil }
+
+func (l *stdioListener) Addr() net.Addr { return pipeAddr{} }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func runRenew(args []string) error {
+	var (
+		target targetFlags
+		m      mappingFlags
+		keep   bool
+	)
+
+	fs := newFlagSet("renew")
+	target.register(fs)
+	m.register(fs)
+	registerKeep(fs, &keep)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if m.lease == 0 {
+		m.lease = 3600
+	}
+	if err := m.validate(!target.selfOnly()); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	req := m.request()
+	sd := startDaemon(ctx, fmt.Sprintf("renewing %s %d on %s", req.Protocol, req.ExternalPort, c), req.Lease/2)
+	err = portmapping.KeepMapping(ctx, c, req, func(err error) {
+		sd.alive()
+		if err != nil {
+			slog.Warn("renewing mapping", "protocol", req.Protocol, "external_port", req.ExternalPort, "err", err)
+			return
+		}
+		slog.Info("renewed mapping", "protocol", req.Protocol, "external_port", req.ExternalPort, "internal_client", req.InternalClient, "internal_port", req.InternalPort, "lease", req.Lease)
+	})
+	if !keep {
+		unmap(c, []portmapping.MappingRequest{req})
+	}
+	if errors.Is(err, ctx.Err()) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+//go:embed templates/report.md.tmpl templates/report.html.tmpl
+var reportTemplates embed.FS
+
+// report is what the report templates are rendered from
+type report struct {
+	Generated  time.Time
+	Since      time.Time
+	Until      time.Time
+	Current    *snapshot
+	Changes    []historyEvent
+	Exposure   []exposedHost
+	Violations []violation
+}
+
+// exposedHost is an internal client and the ports forwarded to it
+type exposedHost struct {
+	Client   string
+	Mappings []exposedMapping
+}
+
+type exposedMapping struct {
+	Device string
+	*portmapping.PortMappingEntry
+}
+
+// exposure groups the current mappings by internal client
+func (r *report) exposure() {
+	hosts := make(map[string]*exposedHost)
+	for _, svc := range r.Current.Services {
+		for _, pme := range svc.Mappings {
+			h, ok := hosts[pme.NewInternalClient]
+			if !ok {
+				h = &exposedHost{Client: pme.NewInternalClient}
+				hosts[pme.NewInternalClient] = h
+			}
+			h.Mappings = append(h.Mappings, exposedMapping{Device: svc.Device, PortMappingEntry: pme})
+		}
+	}
+
+	r.Exposure = r.Exposure[:0]
+	for _, h := range hosts {
+		r.Exposure = append(r.Exposure, *h)
+	}
+	// Most exposed first
+	sort.Slice(r.Exposure, func(i, j int) bool {
+		a, b := r.Exposure[i], r.Exposure[j]
+		if len(a.Mappings) != len(b.Mappings) {
+			return len(a.Mappings) > len(b.Mappings)
+		}
+		return a.Client < b.Client
+	})
+}
+
+var reportFuncs = map[string]any{
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+	"remote": func(host string) string {
+		if host == "" {
+			return "*"
+		}
+		return host
+	},
+	"lease": func(d string) string {
+		if d == "" || d == "0" {
+			return "permanent"
+		}
+		return d + "s"
+	},
+	"count": func(r *report) int {
+		n := 0
+		for _, svc := range r.Current.Services {
+			n += len(svc.Mappings)
+		}
+		return n
+	},
+	// md escapes what would break a Markdown table cell
+	"md": func(s string) string {
+		return strings.NewReplacer("|", `\|`, "\n", " ", "`", "\\`", "*", `\*`, "_", `\_`, "<", "&lt;").Replace(s)
+	},
+}
+
+// render writes the report in format, markdown or html
+func (r *report) render(w io.Writer, format string) error {
+	switch format {
+	case "markdown", "md":
+		t, err := template.New("report.md.tmpl").Funcs(reportFuncs).ParseFS(reportTemplates, "templates/report.md.tmpl")
+		if err != nil {
+			return err
+		}
+		return t.Execute(w, r)
+	case "html":
+		t, err := htmltemplate.New("report.html.tmpl").Funcs(reportFuncs).ParseFS(reportTemplates, "templates/report.html.tmpl")
+		if err != nil {
+			return err
+		}
+		return t.Execute(w, r)
+	}
+	return fmt.Errorf("unknown report format %q, want markdown or html", format)
+}
+
+func runReport(args []string) error {
+	var (
+		path   string
+		since  string
+		until  string
+		format string
+		out    string
+		pol    string
+	)
+
+	fs := newFlagSet("report")
+	registerHistory(fs, &path)
+	fs.StringVar(&since, "since", "168h", "Start of the reported period")
+	fs.StringVar(&until, "until", "", "End of the reported period, whose mappings are the current ones (default now)")
+	fs.StringVar(&format, "format", "markdown", "Report format: markdown or html")
+	fs.StringVar(&out, "o", "", "Write the report to a file instead of stdout")
+	fs.StringVar(&pol, "policy", "", "YAML policy the current mappings are audited with (default the builtin rules)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if path == "" {
+		return errors.New("-db is required")
+	}
+
+	r := &report{Generated: time.Now(), Until: time.Now()}
+	var err error
+	if r.Since, err = parseHistoryTime(since); err != nil {
+		return err
+	}
+	if until != "" {
+		if r.Until, err = parseHistoryTime(until); err != nil {
+			return err
+		}
+	}
+
+	p, err := loadPolicy(pol)
+	if err != nil {
+		return err
+	}
+
+	h, err := openHistory(path)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	if r.Current, err = h.snapshotAt(ctx, r.Until); err != nil {
+		return err
+	}
+	if r.Changes, err = h.events(ctx, r.Since, r.Until); err != nil {
+		return err
+	}
+	r.exposure()
+	r.Violations = p.audit(r.Current)
+
+	// Rendered first so a failing template doesn't leave a partial file
+	var buf bytes.Buffer
+	if err := r.render(&buf, format); err != nil {
+		return err
+	}
+	if out != "" {
+		return os.WriteFile(out, buf.Bytes(), 0o644)
+	}
+	_, err = os.Stdout.Write(buf.Bytes())
+	return err
+}
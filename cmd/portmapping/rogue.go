@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func runRogue(args []string) error {
+	var (
+		target  targetFlags
+		jsonOut bool
+	)
+
+	fs := newFlagSet("rogue")
+	target.register(fs)
+	fs.BoolVar(&jsonOut, "json", false, "Print the findings as newline delimited JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !target.upnpSearch() {
+		return errors.New("rogue responders are found with an SSDP search, it can't be used with -location, -natpmp or -pcp")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	host, err := target.searchHost()
+	if err != nil {
+		return err
+	}
+	answers, err := portmapping.SearchGatewayAnswers(ctx, host, target.port, &target.search)
+	if err != nil {
+		return err
+	}
+	findings := portmapping.CheckRogueResponders(answers)
+
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		for _, f := range findings {
+			if err := enc.Encode(f); err != nil {
+				return err
+			}
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "FROM\tINTERFACE\tLOCATION\tUSN\tSERVER")
+		for _, a := range answers {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", a.From, a.Interface, a.Location, a.UDN(), a.Server)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		if len(findings) == 0 {
+			fmt.Println("\nOK no sign of SSDP spoofing")
+		}
+		for _, f := range findings {
+			fmt.Printf("\nWARNING %s: %s\n", f.Kind, f.Detail)
+		}
+	}
+
+	if len(findings) > 0 {
+		return errViolations
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func runScan(args []string) error {
+	var (
+		output     outputFlags
+		opts       portmapping.ScanOptions
+		tcp        string
+		targets    string
+		noProgress bool
+	)
+
+	fs := newFlagSet("scan")
+	output.register(fs)
+	fs.IntVar(&opts.Workers, "workers", 32, "Number of hosts probed concurrently")
+	fs.IntVar(&opts.Rate, "rate", defaults.Rate, "Maximum probes started per second (0 is unlimited)")
+	fs.StringVar(&opts.Port, "p", ":1900", "SSDP Port")
+	registerSearch(fs, &opts.SearchOptions, 2*time.Second)
+	fs.StringVar(&tcp, "tcp", "", "Comma separated TCP ports; only hosts with one of them open are searched")
+	fs.StringVar(&targets, "targets", "", "File with one host or CIDR prefix per line, - reads stdin")
+	registerProgress(fs, &noProgress)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	prefixes := fs.Args()
+	if targets != "" {
+		lines, err := readTargets(targets)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, lines...)
+	}
+
+	if len(prefixes) == 0 {
+		return errors.New("at least one CIDR prefix or address is required")
+	}
+
+	if tcp != "" {
+		for _, s := range strings.Split(tcp, ",") {
+			p, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || p <= 0 || p > 65535 {
+				return errors.New("-tcp has an invalid port " + s)
+			}
+			opts.TCPPorts = append(opts.TCPPorts, p)
+		}
+	}
+
+	out, closeOut, err := output.printer()
+	if err != nil {
+		return err
+	}
+	defer closeOut()
+
+	// JSON records don't need grouping, they are written as they come
+	var stream *scanStream
+	if jp, ok := out.(*jsonPrinter); ok {
+		stream = &scanStream{ctx: ctx, out: jp}
+		opts.Events = stream.event
+	}
+
+	prog := startProgress("scan", noProgress)
+	defer prog.done()
+
+	sum := newScanSummary()
+	opts.Progress = func(done, total int) {
+		prog.probed(done, total)
+		sum.probed(done)
+	}
+	for _, prefix := range prefixes {
+		results, err := portmapping.Scan(ctx, prefix, &opts)
+		if err != nil {
+			return err
+		}
+
+		for r := range results {
+			prog.found(scanCounts(r))
+			sum.add(r)
+			if stream != nil {
+				warnScanResult(r)
+				if err := stream.error(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := printScanResult(ctx, out, r); err != nil {
+				return err
+			}
+		}
+		prog.nextPrefix()
+		sum.nextPrefix()
+	}
+	prog.done()
+
+	if err := out.flush(); err != nil {
+		return err
+	}
+	return printScanSummary(out, sum)
+}
+
+// scanSummary is the trailer of a scan
+type scanSummary struct {
+	Type string `json:"type"`
+	// Hosts were probed, Answered the SSDP search or TCP ports
+	Hosts    int `json:"hosts"`
+	Answered int `json:"answered"`
+	// Devices are the root devices found, Services their WAN connections
+	Devices   int            `json:"devices"`
+	Services  int            `json:"services"`
+	Mappings  int            `json:"mappings"`
+	Protocols map[string]int `json:"protocols"`
+	// Clients are the unique internal clients of the mappings
+	Clients int     `json:"internal_clients"`
+	Errors  int     `json:"errors"`
+	Elapsed float64 `json:"elapsed_seconds"`
+
+	start   time.Time
+	clients map[string]bool
+
+	// mu guards hosts, the probes of the prefix scanned reported from the
+	// scanning goroutines
+	mu    sync.Mutex
+	hosts int
+}
+
+func newScanSummary() *scanSummary {
+	return &scanSummary{Type: "summary", Protocols: map[string]int{}, start: time.Now(), clients: map[string]bool{}}
+}
+
+// probed records the hosts probed of the prefix scanned
+func (s *scanSummary) probed(done int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hosts = max(s.hosts, done)
+}
+
+// nextPrefix adds the hosts probed of the prefix scanned
+func (s *scanSummary) nextPrefix() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Hosts += s.hosts
+	s.hosts = 0
+}
+
+// add counts a result
+func (s *scanSummary) add(r *portmapping.ScanResult) {
+	s.Answered++
+	if r.Err != nil {
+		s.Errors++
+	}
+
+	devices := make(map[string]bool)
+	for _, svc := range r.Services {
+		devices[svc.Client.Location.String()] = true
+		s.Services++
+		if svc.Err != nil {
+			s.Errors++
+		}
+		for _, pme := range svc.Mappings {
+			s.Mappings++
+			s.Protocols[strings.ToUpper(pme.NewProtocol)]++
+			s.clients[pme.NewInternalClient] = true
+		}
+	}
+	s.Devices += len(devices)
+	s.Clients = len(s.clients)
+}
+
+// protocols returns the mappings by protocol, such as "TCP 12, UDP 3"
+func (s *scanSummary) protocols() string {
+	protos := make([]string, 0, len(s.Protocols))
+	for p := range s.Protocols {
+		protos = append(protos, p)
+	}
+	sort.Strings(protos)
+
+	for i, p := range protos {
+		protos[i] = fmt.Sprintf("%s %d", p, s.Protocols[p])
+	}
+	return strings.Join(protos, ", ")
+}
+
+// printScanSummary writes the summary after the results, a trailer record
+// of the JSON output and a few lines after the tables. Other formats log
+// it instead of breaking their rows.
+func printScanSummary(out printer, s *scanSummary) error {
+	elapsed := time.Since(s.start).Round(time.Millisecond)
+	s.Elapsed = elapsed.Seconds()
+
+	switch p := out.(type) {
+	case *jsonPrinter:
+		return p.enc.Encode(s)
+	case *tablePrinter:
+		w := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, p.paint(ansiBold, "Summary"))
+		fmt.Fprintf(w, "  hosts probed:\t%d (%d answered)\n", s.Hosts, s.Answered)
+		fmt.Fprintf(w, "  devices:\t%d (%d services)\n", s.Devices, s.Services)
+		fmt.Fprintf(w, "  mappings:\t%d\n", s.Mappings)
+		if len(s.Protocols) > 0 {
+			fmt.Fprintf(w, "  by protocol:\t%s\n", s.protocols())
+		}
+		fmt.Fprintf(w, "  internal clients:\t%d\n", s.Clients)
+		fmt.Fprintf(w, "  errors:\t%d\n", s.Errors)
+		fmt.Fprintf(w, "  elapsed:\t%s\n", elapsed)
+		return w.Flush()
+	}
+
+	slog.Info("scan done", "hosts", s.Hosts, "answered", s.Answered, "devices", s.Devices, "services", s.Services,
+		"mappings", s.Mappings, "protocols", s.protocols(), "internal_clients", s.Clients, "errors", s.Errors,
+		"elapsed", elapsed)
+	return nil
+}
+
+// readTargets returns the non-empty lines of path, or of stdin if path is
+// "-", skipping # comments
+func readTargets(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var targets []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			targets = append(targets, line)
+		}
+	}
+
+	return targets, scanner.Err()
+}
+
+// scanCounts returns the devices, mappings and errors of r
+func scanCounts(r *portmapping.ScanResult) (devices, mappings, errs int) {
+	if r.Err != nil {
+		return 0, 0, 1
+	}
+	for _, s := range r.Services {
+		devices++
+		mappings += len(s.Mappings)
+		if s.Err != nil {
+			errs++
+		}
+	}
+	return devices, mappings, errs
+}
+
+func printScanResult(ctx context.Context, out printer, r *portmapping.ScanResult) error {
+	for _, s := range r.Services {
+		if err := out.device(s.Client, externalIP(ctx, s.Client)); err != nil {
+			return err
+		}
+
+		for _, pme := range s.Mappings {
+			if err := out.mapping(s.Client, pme); err != nil {
+				return err
+			}
+		}
+	}
+
+	warnScanResult(r)
+	return nil
+}
+
+// warnScanResult logs the errors of r
+func warnScanResult(r *portmapping.ScanResult) {
+	if r.Err != nil {
+		slog.Warn("scanning host", "host", r.Host, "err", r.Err)
+		return
+	}
+
+	for _, s := range r.Services {
+		if s.Err != nil {
+			slog.Warn("listing mappings", "device", s.Client.String(), "err", s.Err)
+		}
+	}
+}
+
+// scanStream prints the events of a scan as they come, concurrently sent
+// by its hosts
+type scanStream struct {
+	ctx context.Context
+	out printer
+
+	mu  sync.Mutex
+	err error
+}
+
+func (s *scanStream) event(ev portmapping.ScanEvent) {
+	var ip net.IP
+	if ev.Mapping == nil {
+		ip = externalIP(s.ctx, ev.Client)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	if ev.Mapping == nil {
+		s.err = s.out.device(ev.Client, ip)
+	} else {
+		s.err = s.out.mapping(ev.Client, ev.Mapping)
+	}
+}
+
+// error returns the first error printing an event
+func (s *scanStream) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
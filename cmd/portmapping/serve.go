@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+//go:embed ui/index.html
+var indexHTML []byte
+
+// server is the REST API and web UI of the serve command. Devices are
+// addressed by their index in the discovered mappers.
+type server struct {
+	// searchMu serializes the searches of target
+	searchMu sync.Mutex
+	target   *targetFlags
+
+	// base bounds the mapping watchers, interval is their poll interval
+	base     context.Context
+	interval time.Duration
+	hub      hub
+
+	mu        sync.RWMutex
+	mappers   []portmapping.PortMapper
+	stopWatch context.CancelFunc
+}
+
+type apiDevice struct {
+	ID int `json:"id"`
+	deviceRecord
+}
+
+type apiMappings struct {
+	ID       int                             `json:"id"`
+	Device   string                          `json:"device"`
+	Mappings []*portmapping.PortMappingEntry `json:"mappings"`
+	Error    string                          `json:"error,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func runServe(args []string) error {
+	var (
+		target   targetFlags
+		listen   string
+		authFile string
+		noAuth   bool
+		tlsf     tlsFlags
+		interval time.Duration
+		hosts    []string
+	)
+
+	fs := newFlagSet("serve")
+	target.register(fs)
+	fs.StringVar(&listen, "listen", "localhost:9136", "Listen address of the API and web UI")
+	fs.StringVar(&authFile, "auth", "", "File of bearer tokens and basic auth users allowed to use the API, one \"token <secret> read|write\" or \"basic <user> <password> read|write\" per line")
+	fs.BoolVar(&noAuth, "no-auth", false, "Allow serving without -auth on an address reachable from other hosts")
+	tlsf.register(fs)
+	fs.DurationVar(&interval, "interval", 10*time.Second, "How often the mappings are enumerated for the /events stream")
+	fs.Func("allow-host", "Name the API and web UI may also be reached by, besides the -listen host, localhost and IP addresses (repeatable)", func(v string) error {
+		hosts = append(hosts, strings.ToLower(v))
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var auth *authenticator
+	switch {
+	case authFile != "":
+		a, err := readAuthFile(authFile)
+		if err != nil {
+			return err
+		}
+		auth = a
+	case !noAuth && !isLoopback(listen):
+		return errors.New("-auth is required to listen on a non-loopback address, or pass -no-auth")
+	}
+
+	var tlsConfig *tls.Config
+	if tlsf.enabled() {
+		cfg, err := tlsf.config(listen)
+		if err != nil {
+			return err
+		}
+		tlsConfig = cfg
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	if interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+
+	s := &server{target: &target, base: ctx, interval: interval}
+	if err := s.discover(ctx, false); err != nil {
+		return err
+	}
+
+	handler := s.handler()
+	if auth != nil {
+		handler = auth.wrap(handler)
+	}
+	handler = sameOrigin(listen, hosts, handler)
+
+	srv := &http.Server{Addr: listen, Handler: handler, TLSConfig: tlsConfig}
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("serving API and web UI", "url", scheme+"://"+listen+"/")
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.index)
+	mux.HandleFunc("/api/devices", s.devices)
+	mux.HandleFunc("/api/discover", s.rediscover)
+	mux.HandleFunc("/api/mappings", s.mappings)
+	mux.HandleFunc("/events", s.events)
+	return mux
+}
+
+// sameOrigin keeps other sites out of the API a browser can reach. The Host
+// must be the listen host, localhost, an IP address or one of allowed, so
+// DNS rebinding can't point a name of another site at the server, an Origin
+// must be the server itself, and changes must be JSON, which pages of other
+// origins can't send without a CORS preflight the server doesn't answer.
+func sameOrigin(listen string, allowed []string, next http.Handler) http.Handler {
+	listenHost, _, _ := net.SplitHostPort(listen)
+	hosts := map[string]bool{"localhost": true, strings.ToLower(listenHost): true}
+	for _, h := range allowed {
+		hosts[h] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		host = strings.ToLower(strings.Trim(host, "[]"))
+		if !hosts[host] && net.ParseIP(host) == nil {
+			writeError(w, http.StatusMisdirectedRequest, fmt.Errorf("host %q is not allowed, see -allow-host", host))
+			return
+		}
+
+		if origin := r.Header.Get("Origin"); origin != "" {
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			if u, err := url.Parse(origin); err != nil || u.Scheme != scheme || !strings.EqualFold(u.Host, r.Host) {
+				writeError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+				return
+			}
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("changes need Content-Type: application/json"))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// discover replaces the mappers with a new search of the target, skipping
+// the location cache when rediscover is set
+func (s *server) discover(ctx context.Context, rediscover bool) error {
+	s.searchMu.Lock()
+	s.target.rediscover = s.target.rediscover || rediscover
+	mappers, err := s.target.mappers(ctx)
+	s.searchMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	wctx, stop := context.WithCancel(s.base)
+	s.mu.Lock()
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+	s.mappers, s.stopWatch = mappers, stop
+	s.mu.Unlock()
+
+	s.watch(wctx, mappers)
+	if exp := expiry(mappers); !exp.IsZero() && s.target.upnpSearch() {
+		go s.expire(wctx, exp)
+	}
+	s.hub.publish("discovery", describeAll(ctx, mappers))
+	return nil
+}
+
+// expire discovers the target again at exp, when the SSDP answers of the
+// mappers run out, unless ctx is done first
+func (s *server) expire(ctx context.Context, exp time.Time) {
+	timer := time.NewTimer(time.Until(exp))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+	slog.Info("gateway announcement expired, discovering it again")
+	if err := s.discover(s.base, true); err != nil {
+		slog.Warn("discovering gateway again", "err", err)
+	}
+}
+
+// snapshot returns the current mappers
+func (s *server) snapshot() []portmapping.PortMapper {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mappers
+}
+
+// mapper returns the mapper selected by the device query parameter, the
+// first one by default
+func (s *server) mapper(r *http.Request) (portmapping.PortMapper, error) {
+	mappers := s.snapshot()
+
+	id := 0
+	if v := r.URL.Query().Get("device"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device %q", v)
+		}
+		id = n
+	}
+	if id < 0 || id >= len(mappers) {
+		return nil, fmt.Errorf("no device %d", id)
+	}
+
+	return mappers[id], nil
+}
+
+func (s *server) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(indexHTML)
+}
+
+func (s *server) devices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, describeAll(r.Context(), s.snapshot()))
+}
+
+func (s *server) rediscover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	if err := s.discover(r.Context(), true); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, describeAll(r.Context(), s.snapshot()))
+}
+
+func (s *server) mappings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listMappings(w, r)
+	case http.MethodPost:
+		s.addMapping(w, r)
+	case http.MethodDelete:
+		s.deleteMapping(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (s *server) listMappings(w http.ResponseWriter, r *http.Request) {
+	mappers := s.snapshot()
+	out := make([]apiMappings, len(mappers))
+
+	var wg sync.WaitGroup
+	for i, m := range mappers {
+		wg.Add(1)
+		go func(i int, m portmapping.PortMapper) {
+			defer wg.Done()
+			out[i] = apiMappings{ID: i, Device: m.String(), Mappings: []*portmapping.PortMappingEntry{}}
+			entries, err := m.ListMappings(r.Context())
+			if err != nil {
+				out[i].Error = err.Error()
+				return
+			}
+			out[i].Mappings = entries
+		}(i, m)
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) addMapping(w http.ResponseWriter, r *http.Request) {
+	m, err := s.mapper(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	var cm configMapping
+	if err := json.NewDecoder(r.Body).Decode(&cm); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var client string
+	if c, ok := m.(*portmapping.Client); ok {
+		if ip, err := c.LocalIP(); err == nil {
+			client = ip.String()
+		}
+	}
+	reqs, err := (&config{Mappings: []configMapping{cm}}).requests(client)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	req := reqs[0]
+	if err := req.Add(r.Context(), m); err != nil {
+		writeError(w, deviceStatus(err), err)
+		return
+	}
+	slog.Info("added mapping", "device", m.String(), "protocol", req.Protocol, "external_port", req.ExternalPort, "internal_client", req.InternalClient, "internal_port", req.InternalPort)
+
+	pme, err := req.Entry()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, pme)
+}
+
+func (s *server) deleteMapping(w http.ResponseWriter, r *http.Request) {
+	m, err := s.mapper(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	q := r.URL.Query()
+	port, err := strconv.ParseUint(q.Get("external_port"), 10, 16)
+	if err != nil || port == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("a valid external_port is required"))
+		return
+	}
+	proto := q.Get("protocol")
+	if proto == "" {
+		proto = "TCP"
+	}
+
+	if err := m.DeletePortMapping(r.Context(), q.Get("remote_host"), uint16(port), proto); err != nil {
+		writeError(w, deviceStatus(err), err)
+		return
+	}
+	slog.Info("deleted mapping", "device", m.String(), "protocol", proto, "external_port", port)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// describeAll returns the device records of mappers with their external IP
+func describeAll(ctx context.Context, mappers []portmapping.PortMapper) []apiDevice {
+	out := make([]apiDevice, len(mappers))
+
+	var wg sync.WaitGroup
+	for i, m := range mappers {
+		wg.Add(1)
+		go func(i int, m portmapping.PortMapper) {
+			defer wg.Done()
+			out[i] = apiDevice{ID: i, deviceRecord: describe(m, externalIP(ctx, m))}
+		}(i, m)
+	}
+	wg.Wait()
+
+	return out
+}
+
+// deviceStatus returns the HTTP status of a failed device action
+func deviceStatus(err error) int {
+	switch {
+	case errors.Is(err, portmapping.ErrNoSuchEntry), errors.Is(err, portmapping.ErrPortMappingNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, portmapping.ErrMappingConflict):
+		return http.StatusConflict
+	case errors.Is(err, portmapping.ErrInvalidArgs), errors.Is(err, portmapping.ErrNotSupported):
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("writing response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/scpd"
+	"github.com/ilyaglow/portmapping"
+)
+
+// serviceRecord is a service of the device tree and its actions
+type serviceRecord struct {
+	Device     string         `json:"device"`
+	Type       string         `json:"type"`
+	ID         string         `json:"id"`
+	ControlURL string         `json:"control_url"`
+	Actions    []actionRecord `json:"actions,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type actionRecord struct {
+	Name string           `json:"name"`
+	In   []argumentRecord `json:"in,omitempty"`
+	Out  []argumentRecord `json:"out,omitempty"`
+}
+
+type argumentRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// registerSaveXML adds the flag saving the raw description XML
+func registerSaveXML(fs *flag.FlagSet, dir *string) {
+	fs.StringVar(dir, "save-xml", "", "Write the raw device descriptions and SCPDs of the devices to this directory")
+}
+
+// saveXML writes the raw description and SCPDs of every location to dir
+func saveXML(ctx context.Context, locs []*url.URL, dir string) {
+	seen := make(map[string]bool)
+	for _, loc := range locs {
+		if seen[loc.String()] {
+			continue
+		}
+		seen[loc.String()] = true
+
+		paths, err := portmapping.SaveXML(ctx, loc, dir)
+		for _, p := range paths {
+			slog.Info("saved", "location", loc, "file", p)
+		}
+		if err != nil {
+			slog.Warn("saving description XML", "location", loc, "err", err)
+		}
+	}
+}
+
+func runServices(args []string) error {
+	var (
+		target  targetFlags
+		jsonOut bool
+		xmlDir  string
+	)
+
+	fs := newFlagSet("services")
+	target.register(fs)
+	fs.BoolVar(&jsonOut, "json", false, "Print the services as newline delimited JSON")
+	registerSaveXML(fs, &xmlDir)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	locs, err := target.locations(ctx)
+	if err != nil {
+		return err
+	}
+	if xmlDir != "" {
+		saveXML(ctx, locs, xmlDir)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, loc := range locs {
+		root, err := portmapping.DeviceByURL(ctx, loc)
+		if err != nil {
+			slog.Warn("reading device description", "location", loc, "err", err)
+			continue
+		}
+
+		var records []serviceRecord
+		root.Device.VisitDevices(func(d *goupnp.Device) {
+			for i := range d.Services {
+				srv := &d.Services[i]
+				rec := serviceRecord{
+					Device:     d.FriendlyName,
+					Type:       srv.ServiceType,
+					ID:         srv.ServiceId,
+					ControlURL: srv.ControlURL.Str,
+				}
+
+				doc, err := portmapping.RequestSCPD(ctx, srv)
+				if err != nil {
+					rec.Error = err.Error()
+				} else {
+					rec.Actions = actionRecords(doc)
+				}
+				records = append(records, rec)
+			}
+		})
+
+		if !jsonOut {
+			fmt.Println(root.Device.FriendlyName, "::", loc)
+		}
+		for _, rec := range records {
+			if jsonOut {
+				if err := enc.Encode(rec); err != nil {
+					return err
+				}
+				continue
+			}
+			printService(rec)
+		}
+	}
+
+	return nil
+}
+
+func actionRecords(doc *scpd.SCPD) []actionRecord {
+	doc.Clean()
+
+	var actions []actionRecord
+	for _, a := range doc.OrderedActions() {
+		rec := actionRecord{Name: a.Name}
+		for _, arg := range a.Arguments {
+			ar := argumentRecord{Name: arg.Name}
+			if v := doc.GetStateVariable(arg.RelatedStateVariable); v != nil {
+				ar.Type = v.DataType.Name
+			}
+			if arg.IsInput() {
+				rec.In = append(rec.In, ar)
+			} else {
+				rec.Out = append(rec.Out, ar)
+			}
+		}
+		actions = append(actions, rec)
+	}
+
+	return actions
+}
+
+func printService(rec serviceRecord) {
+	fmt.Printf("  %s (%s) on %s\n", rec.Type, rec.Device, rec.ControlURL)
+	if rec.Error != "" {
+		fmt.Printf("    SCPD: %s\n", rec.Error)
+		return
+	}
+
+	for _, a := range rec.Actions {
+		fmt.Printf("    %s(%s)", a.Name, formatArgs(a.In))
+		if len(a.Out) > 0 {
+			fmt.Printf(" -> (%s)", formatArgs(a.Out))
+		}
+		fmt.Println()
+	}
+}
+
+func formatArgs(args []argumentRecord) string {
+	s := make([]string, 0, len(args))
+	for _, a := range args {
+		if a.Type == "" {
+			s = append(s, a.Name)
+			continue
+		}
+		s = append(s, a.Name+" "+a.Type)
+	}
+	return strings.Join(s, ", ")
+}
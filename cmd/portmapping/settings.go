@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// settings are the defaults of the flags every command shares, read from
+// the settings file and overridden by PORTMAPPING_* variables
+type settings struct {
+	Host string `yaml:"host,omitempty" json:"host,omitempty"`
+	// Protocol is the preferred backend: upnp, natpmp or pcp
+	Protocol string `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	Format   string `yaml:"format,omitempty" json:"format,omitempty"`
+	// Rate is the default scan rate limit in probes per second
+	Rate int `yaml:"rate,omitempty" json:"rate,omitempty"`
+	// CheckURL is the service mappings are verified from outside with
+	CheckURL string `yaml:"check_url,omitempty" json:"check_url,omitempty"`
+	// Proxy is the default of -proxy
+	Proxy string `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	// FleetURL, FleetToken and Site are the defaults of fleet -server,
+	// -token and -site
+	FleetURL   string `yaml:"fleet_url,omitempty" json:"fleet_url,omitempty"`
+	FleetToken string `yaml:"fleet_token,omitempty" json:"fleet_token,omitempty"`
+	Site       string `yaml:"site,omitempty" json:"site,omitempty"`
+	// DDNS is the default of -ddns, kept here or in PORTMAPPING_DDNS so
+	// its token isn't on the command line
+	DDNS string `yaml:"ddns,omitempty" json:"ddns,omitempty"`
+	// Mappings are applied by apply when it is given no config file
+	Mappings []configMapping `yaml:"mappings,omitempty" json:"mappings,omitempty"`
+}
+
+// defaults is loaded by main before the command runs
+var defaults settings
+
+// settingsPath returns the settings file, PORTMAPPING_CONFIG or
+// config.yaml in the portmapping user config directory
+func settingsPath() (string, error) {
+	if path := os.Getenv("PORTMAPPING_CONFIG"); path != "" {
+		return path, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "portmapping", "config.yaml"), nil
+}
+
+// loadSettings reads the settings file, if there is one, and applies the
+// environment overrides
+func loadSettings() (settings, error) {
+	var s settings
+
+	path, err := settingsPath()
+	if err != nil {
+		return s, err
+	}
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && os.Getenv("PORTMAPPING_CONFIG") == "":
+	case err != nil:
+		return s, err
+	default:
+		if err := yaml.Unmarshal(b, &s); err != nil {
+			return s, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if v, ok := os.LookupEnv("PORTMAPPING_HOST"); ok {
+		s.Host = v
+	}
+	if v, ok := os.LookupEnv("PORTMAPPING_PROTOCOL"); ok {
+		s.Protocol = v
+	}
+	if v, ok := os.LookupEnv("PORTMAPPING_FORMAT"); ok {
+		s.Format = v
+	}
+	if v, ok := os.LookupEnv("PORTMAPPING_CHECK_URL"); ok {
+		s.CheckURL = v
+	}
+	if v, ok := os.LookupEnv("PORTMAPPING_PROXY"); ok {
+		s.Proxy = v
+	}
+	if v, ok := os.LookupEnv("PORTMAPPING_FLEET_URL"); ok {
+		s.FleetURL = v
+	}
+	if v, ok := os.LookupEnv("PORTMAPPING_FLEET_TOKEN"); ok {
+		s.FleetToken = v
+	}
+	if v, ok := os.LookupEnv("PORTMAPPING_SITE"); ok {
+		s.Site = v
+	}
+	if v, ok := os.LookupEnv("PORTMAPPING_DDNS"); ok {
+		s.DDNS = v
+	}
+	if v, ok := os.LookupEnv("PORTMAPPING_RATE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return s, fmt.Errorf("PORTMAPPING_RATE: %w", err)
+		}
+		s.Rate = n
+	}
+
+	switch s.Protocol {
+	case "", "upnp", "natpmp", "pcp":
+	default:
+		return s, fmt.Errorf("unknown protocol %q, want upnp, natpmp or pcp", s.Protocol)
+	}
+	if s.Format == "" {
+		s.Format = "table"
+	}
+
+	return s, nil
+}
+
+// reloadSettings reads the settings file again on SIGHUP, keeping the
+// previous settings when it fails. Flags already parsed keep their values.
+func reloadSettings() {
+	s, err := loadSettings()
+	if err != nil {
+		slog.Error("reloading settings, keeping the previous ones", "err", err)
+		return
+	}
+	if err := setProxy(s.Proxy); err != nil {
+		slog.Error("reloading settings, keeping the previous ones", "err", fmt.Errorf("proxy: %w", err))
+		return
+	}
+	defaults = s
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// livenessRecord is a mapping and the state of its internal client
+type livenessRecord struct {
+	Device string `json:"device"`
+	*portmapping.PortMappingEntry
+	portmapping.Liveness
+	Stale bool `json:"stale"`
+}
+
+func runStale(args []string) error {
+	var (
+		target  targetFlags
+		probe   time.Duration
+		workers int
+		prune   bool
+		dry     bool
+		all     bool
+		jsonOut bool
+		filter  portmapping.MappingFilter
+	)
+
+	fs := newFlagSet("stale")
+	target.register(fs)
+	fs.DurationVar(&probe, "probe-timeout", 2*time.Second, "How long an internal client is given to answer")
+	fs.IntVar(&workers, "workers", 16, "Number of internal clients probed concurrently")
+	fs.BoolVar(&prune, "prune", false, "Delete the stale mappings")
+	registerDryRun(fs, &dry)
+	fs.BoolVar(&all, "all", false, "Print every mapping instead of only the stale ones")
+	fs.BoolVar(&jsonOut, "json", false, "Print the mappings as newline delimited JSON")
+	registerFilter(fs, &filter)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := validateFilter(&filter); err != nil {
+		return err
+	}
+	if probe <= 0 || workers <= 0 {
+		return errors.New("-probe-timeout and -workers must be positive")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	mappings, err := c.ListMappings(ctx)
+	if err != nil {
+		return err
+	}
+	mappings = portmapping.FilterMappings(mappings, &filter)
+
+	records := make([]livenessRecord, len(mappings))
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, workers)
+	)
+	for i, pme := range mappings {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, pme *portmapping.PortMappingEntry) {
+			defer func() { <-sem; wg.Done() }()
+			l := portmapping.CheckLiveness(ctx, pme, probe)
+			records[i] = livenessRecord{Device: c.String(), PortMappingEntry: pme, Liveness: l, Stale: l.Stale()}
+		}(i, pme)
+	}
+	wg.Wait()
+
+	var stale []portmapping.MappingChange
+	for _, r := range records {
+		if r.Stale {
+			stale = append(stale, portmapping.MappingChange{Kind: portmapping.MappingRemoved, Old: r.PortMappingEntry})
+		}
+	}
+
+	if err := printLiveness(records, all, jsonOut); err != nil {
+		return err
+	}
+
+	if !prune || len(stale) == 0 {
+		return nil
+	}
+	if err := portmapping.ApplyChanges(ctx, withDryRun(c, dry), stale); err != nil {
+		return err
+	}
+	if !dry {
+		slog.Info("deleted stale mappings", "count", len(stale), "of", len(mappings))
+	}
+	return nil
+}
+
+func printLiveness(records []livenessRecord, all, jsonOut bool) error {
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range records {
+			if !all && !r.Stale {
+				continue
+			}
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATE\tMAPPING\tDETAIL")
+	for _, r := range records {
+		if !all && !r.Stale {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.State, describeMapping(r.PortMappingEntry), r.Detail)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+func runStatus(args []string) error {
+	var target targetFlags
+
+	fs := newFlagSet("status")
+	target.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	mappers, err := target.mappers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range mappers {
+		fmt.Println(c)
+
+		if ip, err := c.ExternalIP(ctx); err != nil {
+			fmt.Printf("  external IP:  %v\n", err)
+		} else {
+			fmt.Printf("  external IP:  %s\n", ip)
+		}
+
+		if uc, ok := c.(*portmapping.Client); ok {
+			printWANStatus(ctx, uc)
+
+			if n, err := uc.CountMappings(ctx); err == nil {
+				fmt.Printf("  mappings:     %d\n", n)
+				continue
+			}
+		}
+
+		if entries, err := c.ListMappings(ctx); err != nil {
+			fmt.Printf("  mappings:     %v\n", err)
+		} else {
+			fmt.Printf("  mappings:     %d\n", len(entries))
+		}
+	}
+
+	return nil
+}
+
+// printWANStatus prints the state of the WAN link of c
+func printWANStatus(ctx context.Context, c *portmapping.Client) {
+	if st, err := c.StatusInfo(ctx); err != nil {
+		fmt.Printf("  connection:   %v\n", err)
+	} else {
+		fmt.Printf("  connection:   %s, up %s\n", st.ConnectionStatus, st.Uptime)
+		if st.LastConnectionError != "" && st.LastConnectionError != "ERROR_NONE" {
+			fmt.Printf("  last error:   %s\n", st.LastConnectionError)
+		}
+	}
+
+	if typ, _, err := c.ConnectionTypeInfo(ctx); err != nil {
+		fmt.Printf("  type:         %v\n", err)
+	} else {
+		fmt.Printf("  type:         %s\n", typ)
+	}
+
+	if nat, rsip, err := c.NATRSIPStatus(ctx); err != nil {
+		fmt.Printf("  NAT:          %v\n", err)
+	} else {
+		fmt.Printf("  NAT:          %s, RSIP %s\n", onOff(nat), onOff(rsip))
+	}
+
+	if lp, err := c.LinkProperties(ctx); err == nil {
+		fmt.Printf("  link:         %s %s, %s up / %s down\n", lp.AccessType, lp.PhysicalLinkStatus, bitRate(lp.UpstreamMaxBitRate), bitRate(lp.DownstreamMaxBitRate))
+	}
+	if tc, err := c.TrafficCounters(ctx); err == nil {
+		fmt.Printf("  sent:         %d bytes, %d packets\n", tc.BytesSent, tc.PacketsSent)
+		fmt.Printf("  received:     %d bytes, %d packets\n", tc.BytesReceived, tc.PacketsReceived)
+	}
+}
+
+// bitRate formats bits per second with a decimal prefix
+func bitRate(bps uint32) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.1f Gbit/s", float64(bps)/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.1f Mbit/s", float64(bps)/1e6)
+	case bps >= 1e3:
+		return fmt.Sprintf("%.1f kbit/s", float64(bps)/1e3)
+	}
+	return fmt.Sprintf("%d bit/s", bps)
+}
+
+func onOff(b bool) string {
+	if b {
+		return "enabled"
+	}
+	return "disabled"
+}
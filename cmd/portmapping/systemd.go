@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// daemon tells systemd, when it runs the command with Type=notify, how a
+// long-running command is doing, pings its watchdog while the work loop of
+// the command makes progress and turns SIGHUP into reloads
+type daemon struct {
+	// reload receives SIGHUPs, commands with nothing to reload ignore them
+	reload <-chan struct{}
+	// progress is when the work loop last called alive, in Unix nanoseconds
+	progress atomic.Int64
+}
+
+// reloadCommands read the settings file again on SIGHUP and redo their
+// work, monitor also its -config, only their units get an ExecReload
+var reloadCommands = map[string]bool{"monitor": true, "ensure": true, "docker": true, "kubernetes": true, "exporter": true}
+
+// sdNotify sends state to the notification socket of systemd, it does
+// nothing when the command wasn't started by it
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// Abstract sockets start with a NUL byte
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notify sends state, logging failures
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		slog.Debug("notifying systemd", "state", state, "err", err)
+	}
+}
+
+// watchdogInterval returns how often the watchdog of WatchdogSec wants to
+// be pinged, 0 if it isn't enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// startDaemon reports the command ready with status, then forwards SIGHUPs
+// to reload until ctx is done. The watchdog is pinged as long as the work
+// loop, calling alive at least every period, did so lately.
+func startDaemon(ctx context.Context, status string, period time.Duration) *daemon {
+	notify("READY=1\nSTATUS=" + status)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reload := make(chan struct{}, 1)
+	d := &daemon{reload: reload}
+	d.alive()
+
+	go func() {
+		defer signal.Stop(hup)
+
+		var ping <-chan time.Time
+		interval := watchdogInterval()
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			ping = ticker.C
+		}
+
+		stalled := false
+		for {
+			select {
+			case <-ctx.Done():
+				notify("STOPPING=1")
+				return
+			case <-ping:
+				last := time.Unix(0, d.progress.Load())
+				if time.Since(last) > period+interval {
+					if !stalled {
+						slog.Error("work loop stalled, not pinging the watchdog", "last_progress", last)
+					}
+					stalled = true
+					continue
+				}
+				stalled = false
+				notify("WATCHDOG=1")
+			case <-hup:
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return d
+}
+
+// alive tells the watchdog the work loop made progress, d may be nil
+func (d *daemon) alive() {
+	if d != nil {
+		d.progress.Store(time.Now().UnixNano())
+	}
+}
+
+// progressMapper marks progress of d whenever m is asked for its external
+// IP, for work loops calling back only on changes
+type progressMapper struct {
+	portmapping.PortMapper
+	d *daemon
+}
+
+func (m progressMapper) ExternalIP(ctx context.Context) (net.IP, error) {
+	defer m.d.alive()
+	return m.PortMapper.ExternalIP(ctx)
+}
+
+// reloading reports a reload started, ready reports it done
+func (d *daemon) reloading() {
+	notify("RELOADING=1\nSTATUS=reloading")
+}
+
+func (d *daemon) ready(status string) {
+	notify("READY=1\nSTATUS=" + status)
+}
+
+// unitTemplate is the example unit, it runs the command as a dynamic user
+// with the settings under /etc/portmapping
+const unitTemplate = `[Unit]
+Description=%s
+Documentation=https://github.com/ilyaglow/portmapping
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s
+%sRestart=on-failure
+RestartSec=10s
+WatchdogSec=%d
+Environment=PORTMAPPING_CONFIG=/etc/portmapping/config.yaml
+DynamicUser=yes
+StateDirectory=portmapping
+ConfigurationDirectory=portmapping
+NoNewPrivileges=yes
+ProtectSystem=strict
+ProtectHome=yes
+PrivateTmp=yes
+RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// unitQuote quotes an argument of ExecStart when it needs it
+func unitQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\$%;") {
+		return arg
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$", "%", "%%")
+	return `"` + r.Replace(arg) + `"`
+}
+
+func runSystemdUnit(args []string) error {
+	var (
+		desc     string
+		watchdog time.Duration
+	)
+
+	fs := newFlagSet("systemd-unit")
+	fs.StringVar(&desc, "desc", "", "Description of the unit (defaults to portmapping and the command)")
+	fs.DurationVar(&watchdog, "watchdog", 5*time.Minute, "WatchdogSec of the unit, systemd restarts the command when it stops pinging for that long")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s systemd-unit [flags] [command [flags]]\n\nPrints an example unit running the command, monitor without one, like:\n\n  %s systemd-unit ensure -tcp 443 -client 192.168.1.10 > /etc/systemd/system/portmapping.service\n\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if watchdog < time.Second {
+		return errors.New("-watchdog must be at least a second")
+	}
+
+	cmd := fs.Args()
+	if len(cmd) == 0 {
+		cmd = []string{"monitor"}
+	}
+	if desc == "" {
+		desc = "portmapping " + cmd[0]
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	exec := []string{unitQuote(exe)}
+	for _, arg := range cmd {
+		exec = append(exec, unitQuote(arg))
+	}
+
+	var reload string
+	if reloadCommands[cmd[0]] {
+		reload = "ExecReload=/bin/kill -HUP $MAINPID\n"
+	}
+
+	fmt.Printf(unitTemplate, desc, strings.Join(exec, " "), reload, int(watchdog/time.Second))
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// tagPrefix starts the descriptions of the mappings the tool adds, which
+// read pm:<hostname>:<name>
+const tagPrefix = "pm:"
+
+// legacyDescription is the default description before mappings were
+// tagged, read as the tagged default so older mappings aren't changed
+const legacyDescription = "portmapping"
+
+// hostTag returns the prefix of the descriptions of the mappings host adds
+func hostTag(host string) string {
+	if host == "" {
+		host = "unknown"
+	}
+	// Descriptions are short on many devices, the domain is left out
+	host, _, _ = strings.Cut(host, ".")
+	return tagPrefix + strings.ReplaceAll(host, ":", "-") + ":"
+}
+
+// ownerTag returns the prefix of the descriptions of the mappings this host
+// adds, like "pm:nas:"
+var ownerTag = sync.OnceValue(func() string {
+	host, _ := os.Hostname()
+	return hostTag(host)
+})
+
+// tagDescription returns name tagged as added by this host, names tagged
+// already are kept
+func tagDescription(name string) string {
+	return tagDescriptionAs(ownerTag(), name)
+}
+
+// tagDescriptionAs returns name tagged with owner, names tagged already are
+// kept
+func tagDescriptionAs(owner, name string) string {
+	if strings.HasPrefix(name, tagPrefix) {
+		return name
+	}
+	return owner + name
+}
+
+// keepUntagged returns desired with the tag of owner left off the mappings
+// current has under the same description without it, like those of older
+// versions or of other apps, so they are neither changed nor taken over
+// only to tag them. Mappings being added are tagged.
+func keepUntagged(current, desired []*portmapping.PortMappingEntry, owner string) []*portmapping.PortMappingEntry {
+	untagged := make(map[string]string, len(current))
+	for _, pme := range current {
+		if !strings.HasPrefix(pme.NewPortMappingDescription, tagPrefix) {
+			untagged[pme.Key()] = pme.NewPortMappingDescription
+		}
+	}
+
+	out := make([]*portmapping.PortMappingEntry, len(desired))
+	for i, pme := range desired {
+		if desc, ok := untagged[pme.Key()]; ok && pme.NewPortMappingDescription == owner+desc {
+			kept := *pme
+			kept.NewPortMappingDescription = desc
+			pme = &kept
+		}
+		out[i] = pme
+	}
+	return out
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// targetFlags select the gateway a command talks to
+type targetFlags struct {
+	host       string
+	port       string
+	location   string
+	gateway    bool
+	ipv6       bool
+	natpmp     bool
+	pcp        bool
+	trace      bool
+	rediscover bool
+	tcpScan    bool
+	search     portmapping.SearchOptions
+	retry      portmapping.RetryPolicy
+}
+
+func (t *targetFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.host, "host", defaults.Host, "Host (empty searches the local network via multicast)")
+	fs.StringVar(&t.port, "p", ":1900", "SSDP Port")
+	fs.StringVar(&t.location, "location", "", "Device description URL to use instead of SSDP (usually something like http://ip:highportnum/rootDesc.xml)")
+	fs.StringVar(&t.location, "upnp", "", "Alias of -location")
+	fs.BoolVar(&t.gateway, "gateway", false, "Target the default gateway when -host is empty")
+	fs.BoolVar(&t.ipv6, "6", false, "Search the IPv6 SSDP multicast groups when -host is empty")
+	fs.BoolVar(&t.natpmp, "natpmp", defaults.Protocol == "natpmp", "Use NAT-PMP with -host as the gateway instead of UPnP")
+	fs.BoolVar(&t.pcp, "pcp", defaults.Protocol == "pcp", "Use PCP with -host as the gateway instead of UPnP")
+	fs.BoolVar(&t.rediscover, "rediscover", false, "Search for the gateway even if the location cache has it")
+	fs.BoolVar(&t.tcpScan, "tcp-scan", false, "When SSDP finds no UPnP device, look for a description on the common UPnP TCP ports of -host or the default gateway")
+	fs.BoolVar(&t.trace, "trace-soap", false, "Dump the HTTP requests and responses of every SOAP action to stderr")
+	fs.Func("agent", "Search and talk to devices through an agent inside their LAN: http://[user:password@]host:9137 of 'agent -relay' or ssh://[user@]host[:port] starting -agent-command there", setRelay)
+	fs.StringVar(&agentCommand, "agent-command", "portmapping agent -relay -stdio", "Command starting the agent of an ssh:// -agent")
+	fs.Func("proxy", "Fetch descriptions and send SOAP actions through this socks5://, socks5h:// or http:// proxy, SSDP isn't proxied so -location or an agent is needed", setProxy)
+	fs.Func("interface", "Search and talk to devices from the first IPv4 address of this interface, IPv6 searches only use its groups", setInterface)
+	fs.Func("source", "Search and talk to devices from this local address, for hosts whose default route isn't the audited network", setSource)
+	registerSearch(fs, &t.search, 5*time.Second)
+
+	t.retry = portmapping.DefaultRetryPolicy
+	t.retry.ActionTimeouts = make(map[string]time.Duration)
+	fs.DurationVar(&t.retry.Timeout, "soap-timeout", t.retry.Timeout, "How long a single SOAP request may take (0 is no limit)")
+	fs.IntVar(&t.retry.Retries, "soap-retries", t.retry.Retries, "How many times a SOAP request that got no answer is retried, with exponential backoff")
+	fs.DurationVar(&t.retry.Backoff, "soap-backoff", t.retry.Backoff, "Wait before the first SOAP retry, doubled for every further one")
+	fs.Func("action-timeout", "Timeout of a single SOAP action as Action=duration, like GetGenericPortMappingEntry=30s (repeatable)", func(v string) error {
+		action, d, ok := strings.Cut(v, "=")
+		if !ok || action == "" {
+			return fmt.Errorf("want Action=duration, got %q", v)
+		}
+		timeout, err := time.ParseDuration(d)
+		if err != nil {
+			return err
+		}
+		t.retry.ActionTimeouts[action] = timeout
+		return nil
+	})
+}
+
+// proxy is the HTTP client of -proxy or the proxy setting, commandContext
+// makes the library use it
+var proxy *http.Client
+
+// setProxy makes descriptions and SOAP actions go through the proxy at
+// rawurl, an empty one removes it
+func setProxy(rawurl string) error {
+	if rawurl == "" {
+		proxy = nil
+		return nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	hc, err := portmapping.NewProxyHTTPClient(u)
+	if err != nil {
+		return err
+	}
+	proxy = hc
+	return nil
+}
+
+// source is the local end of -interface and -source, commandContext makes
+// the library use it
+var source portmapping.Source
+
+// setInterface makes searches and device connections use the interface
+// name, and its address unless -source sets one
+func setInterface(name string) error {
+	src, err := portmapping.InterfaceSource(name, false)
+	if err != nil {
+		// An IPv6-only interface still selects the groups searched
+		if src, err = portmapping.InterfaceSource(name, true); err != nil {
+			return err
+		}
+	}
+	source.Interface = src.Interface
+	if source.IP == nil {
+		source.IP = src.IP
+	}
+	return nil
+}
+
+// setSource binds searches and device connections to the address s
+func setSource(s string) error {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return fmt.Errorf("%q is not an IP address", s)
+	}
+	source.IP = ip
+	return nil
+}
+
+// registerSearch adds the SSDP tuning flags
+func registerSearch(fs *flag.FlagSet, o *portmapping.SearchOptions, wait time.Duration) {
+	fs.DurationVar(&o.Wait, "ssdp-wait", wait, "How long SSDP responses are collected")
+	fs.IntVar(&o.Retries, "ssdp-retries", 2, "How many times the SSDP search is sent")
+	fs.IntVar(&o.MX, "mx", 0, "Maximum response delay asked from devices in seconds (0 derives it from -ssdp-wait)")
+	fs.Func("st", "SSDP search target to send instead of "+strings.Join(portmapping.DefaultSearchTargets, ", ")+" (repeatable)", func(st string) error {
+		if st == "" {
+			return errors.New("empty search target")
+		}
+		o.SearchTargets = append(o.SearchTargets, st)
+		return nil
+	})
+}
+
+// mappers returns the port mapping backends of the target
+func (t *targetFlags) mappers(ctx context.Context) ([]portmapping.PortMapper, error) {
+	mappers, err := t.discover(ctx)
+	if err != nil {
+		return mappers, err
+	}
+
+	for _, m := range mappers {
+		if c, ok := m.(*portmapping.Client); ok {
+			c.SetRetryPolicy(t.retry)
+			if t.trace {
+				c.Trace(os.Stderr)
+			}
+		}
+	}
+	return mappers, nil
+}
+
+// searchHost returns the host the search is sent to
+func (t *targetFlags) searchHost() (string, error) {
+	host := t.host
+
+	if t.gateway && host == "" {
+		gw, err := portmapping.DefaultGateway()
+		if err != nil {
+			return "", err
+		}
+		slog.Info("using default gateway", "gateway", gw)
+		host = gw.String()
+	}
+
+	if t.ipv6 && host == "" {
+		host = "::"
+	}
+
+	return host, nil
+}
+
+// locations returns the device description URLs of the target
+func (t *targetFlags) locations(ctx context.Context) ([]*url.URL, error) {
+	if t.location != "" {
+		loc, err := url.Parse(t.location)
+		if err != nil {
+			return nil, err
+		}
+		return []*url.URL{loc}, nil
+	}
+
+	host, err := t.searchHost()
+	if err != nil {
+		return nil, err
+	}
+
+	locs, err := portmapping.LocateAll(ctx, host, t.port, &t.search)
+	if err != nil && t.tcpScan {
+		if scanned, serr := t.scanLocations(ctx, host); serr == nil {
+			return scanned, nil
+		}
+	}
+	return locs, err
+}
+
+// gatewayHost returns host, or the default gateway if it is empty or a
+// multicast search address
+func gatewayHost(host string) (string, error) {
+	if ip := net.ParseIP(strings.Split(host, "%")[0]); host != "" && (ip == nil || !(ip.IsMulticast() || ip.IsUnspecified())) {
+		return host, nil
+	}
+	gw, err := portmapping.DefaultGateway()
+	if err != nil {
+		return "", err
+	}
+	return gw.String(), nil
+}
+
+// scanLocations looks for descriptions on the UPnP TCP ports of host, the
+// default gateway if it is empty or multicast
+func (t *targetFlags) scanLocations(ctx context.Context, host string) ([]*url.URL, error) {
+	host, err := gatewayHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("no SSDP answer, scanning UPnP TCP ports", "host", host)
+	locs, err := portmapping.FindDescriptions(ctx, host, nil)
+	if err != nil {
+		slog.Warn("scanning UPnP TCP ports", "err", err)
+	}
+	return locs, err
+}
+
+// scanClients returns the clients of the descriptions scanLocations finds
+func (t *targetFlags) scanClients(ctx context.Context, host string) ([]*portmapping.Client, error) {
+	locs, err := t.scanLocations(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []*portmapping.Client
+	for _, loc := range locs {
+		cs, err := portmapping.NewClientsByURL(ctx, loc)
+		if err != nil {
+			slog.Warn("skipping device", "location", loc, "err", err)
+			continue
+		}
+		clients = append(clients, cs...)
+	}
+	if len(clients) == 0 {
+		return nil, portmapping.ErrNoServices
+	}
+	return clients, nil
+}
+
+func (t *targetFlags) discover(ctx context.Context) ([]portmapping.PortMapper, error) {
+	host, err := t.searchHost()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.natpmp || t.pcp {
+		gw, err := gatewayHost(host)
+		if err != nil {
+			return nil, err
+		}
+		if t.natpmp {
+			return []portmapping.PortMapper{portmapping.NewNATPMPClient(gw)}, nil
+		}
+		return []portmapping.PortMapper{portmapping.NewPCPClient(gw)}, nil
+	}
+
+	if t.location == "" {
+		if clients := t.cachedClients(ctx, host); clients != nil {
+			return upnpMappers(clients), nil
+		}
+
+		mappers, err := portmapping.DiscoverMappers(ctx, host, t.port, &t.search)
+
+		var clients []*portmapping.Client
+		for _, m := range mappers {
+			if c, ok := m.(*portmapping.Client); ok {
+				clients = append(clients, c)
+			}
+		}
+		// A NAT-PMP fallback is kept if no UPnP description turns up
+		if len(clients) == 0 && t.tcpScan {
+			if scanned, serr := t.scanClients(ctx, host); serr == nil {
+				clients, mappers, err = scanned, upnpMappers(scanned), nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		t.cacheClients(host, clients)
+		return mappers, nil
+	}
+
+	loc, err := url.Parse(t.location)
+	if err != nil {
+		return nil, err
+	}
+
+	clients, err := portmapping.NewClientsByURL(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	return upnpMappers(clients), nil
+}
+
+func upnpMappers(clients []*portmapping.Client) []portmapping.PortMapper {
+	mappers := make([]portmapping.PortMapper, 0, len(clients))
+	for _, c := range clients {
+		mappers = append(mappers, c)
+	}
+	return mappers
+}
+
+// selfOnly reports whether the target protocol maps ports of this host only
+func (t *targetFlags) selfOnly() bool {
+	return t.natpmp || t.pcp
+}
+
+// upnpSearch reports whether the target is found with an SSDP search
+func (t *targetFlags) upnpSearch() bool {
+	return t.location == "" && !t.selfOnly()
+}
+
+// mapper returns the first port mapping backend of the target
+func (t *targetFlags) mapper(ctx context.Context) (portmapping.PortMapper, error) {
+	mappers, err := t.mappers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(mappers) == 0 {
+		return nil, portmapping.ErrNoServices
+	}
+
+	return mappers[0], nil
+}
+
+// minExpiry is the earliest expiry of devices rediscovered when their SSDP
+// answers run out, so a tiny max-age doesn't make a search loop
+const minExpiry = time.Minute
+
+// expiry returns when the first SSDP answer of the UPnP mappers runs out,
+// the zero time if none has a max-age
+func expiry(mappers []portmapping.PortMapper) time.Time {
+	var first time.Time
+	for _, m := range mappers {
+		c, ok := m.(*portmapping.Client)
+		if !ok || c.Expires.IsZero() {
+			continue
+		}
+		if first.IsZero() || c.Expires.Before(first) {
+			first = c.Expires
+		}
+	}
+	if soon := time.Now().Add(minExpiry); !first.IsZero() && first.Before(soon) {
+		return soon
+	}
+	return first
+}
+
+// externalIP returns the external address of m or nil, logging the failure
+func externalIP(ctx context.Context, m portmapping.PortMapper) net.IP {
+	ip, err := m.ExternalIP(ctx)
+	if err != nil {
+		slog.Warn("getting external IP", "device", m.String(), "err", err)
+		return nil
+	}
+	warnNAT(m, ip)
+	return ip
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tlsFlags select the certificate of the serve command
+type tlsFlags struct {
+	cert       string
+	key        string
+	selfSigned bool
+}
+
+func (t *tlsFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.cert, "tls-cert", "", "PEM certificate to serve HTTPS with")
+	fs.StringVar(&t.key, "tls-key", "", "PEM private key of -tls-cert")
+	fs.BoolVar(&t.selfSigned, "tls-self-signed", false, "Serve HTTPS with a self-signed certificate, generated on first run, when -tls-cert is not given")
+}
+
+func (t *tlsFlags) enabled() bool {
+	return t.cert != "" || t.key != "" || t.selfSigned
+}
+
+// config returns the TLS config of the server, generating the self-signed
+// certificate if needed
+func (t *tlsFlags) config(listen string) (*tls.Config, error) {
+	cert, key := t.cert, t.key
+	if (cert == "") != (key == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+
+	if cert == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(dir, "portmapping", "tls")
+		cert, key = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+		if _, err := os.Stat(cert); errors.Is(err, os.ErrNotExist) {
+			if err := generateCert(cert, key, listen); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(pair.Certificate[0])
+	slog.Info("serving TLS", "cert", cert, "sha256", hex.EncodeToString(sum[:]))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// generateCert writes a self-signed certificate valid for the host names
+// and addresses the server is likely reached at
+func generateCert(certPath, keyPath, listen string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "portmapping"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(2, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+	}
+	if name, err := os.Hostname(); err == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, name)
+	}
+	if host, _, err := net.SplitHostPort(listen); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if host != "" && ip == nil && host != "localhost" {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ipnet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+
+	slog.Info("generated self-signed certificate", "cert", certPath)
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// wanCheckURL returns the WAN exposure endpoint of the agent serving the
+// reachability checks at checkURL
+func wanCheckURL(checkURL string) (string, error) {
+	u, err := url.Parse(checkURL)
+	if err != nil {
+		return "", err
+	}
+	return u.ResolveReference(&url.URL{Path: "wan"}).String(), nil
+}
+
+func runWANCheck(args []string) error {
+	var (
+		target  targetFlags
+		check   verifyFlags
+		jsonOut bool
+	)
+
+	fs := newFlagSet("wan-check")
+	target.register(fs)
+	check.register(fs)
+	fs.BoolVar(&jsonOut, "json", false, "Print the result as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := check.validate(); err != nil {
+		return err
+	}
+	wanURL, err := wanCheckURL(check.checkURL)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	ext, err := c.ExternalIP(ctx)
+	if err != nil {
+		return fmt.Errorf("getting external IP: %w", err)
+	}
+
+	var loc *url.URL
+	if uc, ok := c.(*portmapping.Client); ok {
+		loc = uc.Location
+	}
+
+	cctx, ccancel := context.WithTimeout(ctx, 2*check.timeout)
+	defer ccancel()
+	res, err := portmapping.CheckWANExposure(cctx, http.DefaultClient, wanURL, ext, loc)
+	if err != nil {
+		return err
+	}
+
+	if jsonOut {
+		if err := json.NewEncoder(os.Stdout).Encode(res); err != nil {
+			return err
+		}
+	} else {
+		switch {
+		case res.Description:
+			fmt.Printf("CRITICAL %s exposes its UPnP device description on the WAN at %s, anyone can add mappings\n", ext, res.DescriptionURL)
+		case res.SSDP:
+			fmt.Printf("CRITICAL %s answers SSDP on the WAN (%s), it can be used for reflection attacks\n", ext, res.SSDPServer)
+		default:
+			fmt.Printf("OK %s doesn't answer UPnP on the WAN (%s)\n", ext, res.Detail)
+		}
+	}
+
+	if res.Exposed() {
+		return errViolations
+	}
+	return nil
+}
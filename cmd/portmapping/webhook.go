@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+const webhookSignatureHeader = "X-Portmapping-Signature"
+
+// webhook posts mapping changes as JSON
+type webhook struct {
+	url     string
+	secret  string
+	retries int
+	client  http.Client
+}
+
+type webhookPayload struct {
+	Device  string                      `json:"device"`
+	Time    string                      `json:"time"`
+	Changes []portmapping.MappingChange `json:"changes"`
+}
+
+func (h *webhook) register(fs *flag.FlagSet) {
+	fs.StringVar(&h.url, "webhook", "", "URL to POST mapping changes to as JSON")
+	fs.StringVar(&h.secret, "webhook-secret", "", "Sign webhook bodies with HMAC-SHA256 in the "+webhookSignatureHeader+" header")
+	fs.IntVar(&h.retries, "webhook-retries", 3, "How many times a failed webhook delivery is retried")
+	h.client.Timeout = 10 * time.Second
+}
+
+// send delivers the changes, retrying with exponential backoff
+func (h *webhook) send(ctx context.Context, device string, changes []portmapping.MappingChange) error {
+	if h.url == "" || len(changes) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(webhookPayload{Device: device, Time: time.Now().Format(time.RFC3339), Changes: changes})
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = h.post(ctx, body)
+		if err == nil || attempt >= h.retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (h *webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if h.secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: got HTTP %s", resp.Status)
+	}
+
+	return nil
+}
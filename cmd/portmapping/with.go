@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilyaglow/portmapping"
+)
+
+// cleanupTimeout bounds deleting the mappings once the command exited
+const cleanupTimeout = 10 * time.Second
+
+// portPairs is a repeatable "ext[:int]" flag
+type portPairs [][2]uint16
+
+func (p *portPairs) String() string {
+	var s []string
+	for _, pair := range *p {
+		s = append(s, fmt.Sprintf("%d:%d", pair[0], pair[1]))
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *portPairs) Set(v string) error {
+	ext, in, found := strings.Cut(v, ":")
+	if !found {
+		in = ext
+	}
+
+	e, err := strconv.ParseUint(ext, 10, 16)
+	if err != nil || e == 0 {
+		return fmt.Errorf("invalid external port %q", ext)
+	}
+	i, err := strconv.ParseUint(in, 10, 16)
+	if err != nil || i == 0 {
+		return fmt.Errorf("invalid internal port %q", in)
+	}
+
+	*p = append(*p, [2]uint16{uint16(e), uint16(i)})
+	return nil
+}
+
+func runWith(args []string) error {
+	var (
+		target   targetFlags
+		tcp, udp portPairs
+		client   string
+		desc     string
+		lease    time.Duration
+		keep     bool
+	)
+
+	fs := newFlagSet("with")
+	target.register(fs)
+	fs.Var(&tcp, "tcp", "TCP mapping as ext[:int], may be repeated")
+	fs.Var(&udp, "udp", "UDP mapping as ext[:int], may be repeated")
+	fs.StringVar(&client, "client", "", "Internal client address (defaults to the address the gateway reaches this host at)")
+	fs.StringVar(&desc, "desc", "portmapping", "Description of the mappings, tagged with the pm:<hostname>: owner prefix")
+	fs.DurationVar(&lease, "lease", time.Hour, "Lease of the mappings, renewed while the command runs")
+	registerKeep(fs, &keep)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return errors.New("a command to run is required after the flags")
+	}
+	if len(tcp)+len(udp) == 0 {
+		return errors.New("at least one -tcp or -udp mapping is required")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	c, err := target.mapper(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("using device", "device", c.String())
+
+	if client == "" {
+		if client, err = localClient(c); err != nil {
+			return err
+		}
+	}
+	reqs := pairRequests(tcp, udp, client, desc, lease)
+
+	keepCtx, stopKeeping := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		stopKeeping()
+		wg.Wait()
+		if !keep {
+			unmap(c, reqs)
+		}
+	}()
+
+	if err := keepAll(keepCtx, &wg, c, reqs); err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, fs.Arg(0), fs.Args()[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// Let the command shut down on its own before it is killed
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = cleanupTimeout
+
+	return cmd.Run()
+}
+
+// localClient returns the address the gateway of m reaches this host at
+func localClient(m portmapping.PortMapper) (string, error) {
+	uc, ok := m.(*portmapping.Client)
+	if !ok {
+		return "", errors.New("-client is required")
+	}
+	ip, err := uc.LocalIP()
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// pairRequests returns the requests of the -tcp and -udp pairs
+func pairRequests(tcp, udp portPairs, client, desc string, lease time.Duration) []portmapping.MappingRequest {
+	var reqs []portmapping.MappingRequest
+	for i, pairs := range []portPairs{tcp, udp} {
+		for _, pair := range pairs {
+			reqs = append(reqs, portmapping.MappingRequest{
+				ExternalPort:   pair[0],
+				Protocol:       []string{"TCP", "UDP"}[i],
+				InternalPort:   pair[1],
+				InternalClient: client,
+				Description:    tagDescription(desc),
+				Lease:          lease,
+			})
+		}
+	}
+	return reqs
+}
+
+// keepAll keeps every mapping alive in the background and returns once each
+// was added, or with the first error
+func keepAll(ctx context.Context, wg *sync.WaitGroup, m portmapping.PortMapper, reqs []portmapping.MappingRequest) error {
+	added := make(chan error, len(reqs))
+
+	for _, r := range reqs {
+		wg.Add(1)
+		go func(r portmapping.MappingRequest) {
+			defer wg.Done()
+
+			var once sync.Once
+			err := portmapping.KeepMapping(ctx, m, r, func(err error) {
+				if err != nil {
+					slog.Warn("renewing mapping", "protocol", r.Protocol, "external_port", r.ExternalPort, "err", err)
+				}
+				once.Do(func() { added <- err })
+			})
+			once.Do(func() { added <- err })
+		}(r)
+	}
+
+	for range reqs {
+		if err := <-added; err != nil {
+			return err
+		}
+	}
+
+	for _, r := range reqs {
+		slog.Info("added mapping", "protocol", r.Protocol, "external_port", r.ExternalPort, "internal_client", r.InternalClient, "internal_port", r.InternalPort)
+	}
+	return nil
+}
+
+// registerKeep adds -keep to the commands deleting the mappings they added
+// when they exit
+func registerKeep(fs *flag.FlagSet, keep *bool) {
+	fs.BoolVar(keep, "keep", false, "Leave the mappings in place on exit instead of deleting them")
+}
+
+// unmap deletes the mappings this process added, ignoring the already
+// cancelled command context
+func unmap(m portmapping.PortMapper, reqs []portmapping.MappingRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	for _, r := range reqs {
+		unmapOwned(ctx, m, r)
+	}
+}
+
+// unmapOwned deletes the mapping of r, unless another client or tool took
+// the port over meanwhile: the mapping no longer points to the client of r
+// or has another description. Devices truncating descriptions keep a
+// prefix of it.
+func unmapOwned(ctx context.Context, m portmapping.PortMapper, r portmapping.MappingRequest) {
+	pme, err := m.GetSpecificPortMappingEntry(ctx, "", r.ExternalPort, r.Protocol)
+	switch {
+	case errors.Is(err, portmapping.ErrNoSuchEntry):
+		return
+	case err == nil && (pme.NewInternalClient != r.InternalClient || !strings.HasPrefix(r.Description, pme.NewPortMappingDescription)):
+		slog.Info("not deleting mapping of another owner", "mapping", describeMapping(pme))
+		return
+	}
+	if err := m.DeletePortMapping(ctx, "", r.ExternalPort, r.Protocol); err != nil {
+		slog.Warn("deleting mapping", "protocol", r.Protocol, "external_port", r.ExternalPort, "err", err)
+		return
+	}
+	slog.Info("deleted mapping", "protocol", r.Protocol, "external_port", r.ExternalPort)
+}
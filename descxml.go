@@ -0,0 +1,231 @@
+package portmapping
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/scpd"
+)
+
+const (
+	// maxXMLSize bounds the description and SCPD documents read from a
+	// device
+	maxXMLSize = 1 << 20
+	// xmlTimeout bounds fetching a single document like goupnp does
+	xmlTimeout = 3 * time.Second
+)
+
+// fetchXML returns the raw document at rawurl
+func fetchXML(ctx context.Context, rawurl string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, xmlTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient(ctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got response status %s from %q", resp.Status, rawurl)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxXMLSize))
+}
+
+// DeviceByURL is goupnp.DeviceByURLCtx tolerating the malformed XML of
+// broken firmware, see decodeXML
+func DeviceByURL(ctx context.Context, loc *url.URL) (*goupnp.RootDevice, error) {
+	body, err := fetchXML(ctx, loc.String())
+	if err != nil {
+		return nil, fmt.Errorf("requesting root device details from %q: %w", loc, err)
+	}
+	return parseRootDevice(body, loc)
+}
+
+// RequestSCPD is srv.RequestSCPDCtx tolerating malformed XML like
+// DeviceByURL
+func RequestSCPD(ctx context.Context, srv *goupnp.Service) (*scpd.SCPD, error) {
+	if !srv.SCPDURL.Ok {
+		return nil, errors.New("bad/missing SCPD URL, or no URLBase has been set")
+	}
+	body, err := fetchXML(ctx, srv.SCPDURL.URL.String())
+	if err != nil {
+		return nil, err
+	}
+	doc := new(scpd.SCPD)
+	if err := decodeXML(body, scpd.SCPDXMLNamespace, doc); err != nil {
+		return nil, fmt.Errorf("decoding SCPD from %q: %w", srv.SCPDURL.Str, err)
+	}
+	return doc, nil
+}
+
+// parseRootDevice decodes the device description body fetched from loc
+// like goupnp.DeviceByURLCtx does
+func parseRootDevice(body []byte, loc *url.URL) (*goupnp.RootDevice, error) {
+	root := new(goupnp.RootDevice)
+	if err := decodeXML(body, goupnp.DeviceXMLNamespace, root); err != nil {
+		return nil, fmt.Errorf("decoding device description from %q: %w", loc, err)
+	}
+
+	urlBase := loc
+	if root.URLBaseStr != "" {
+		u, err := url.Parse(root.URLBaseStr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing URLBase %q: %w", root.URLBaseStr, err)
+		}
+		urlBase = u
+	}
+	root.SetURLBase(urlBase)
+	return root, nil
+}
+
+// decodeXML decodes body into v. A document the strict decoder rejects is
+// sanitized and decoded again leniently, as plenty of routers serve
+// unescaped ampersands, HTML entities, control characters or Latin-1 text
+// declared or defaulting as UTF-8.
+func decodeXML(body []byte, space string, v any) error {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.DefaultSpace = space
+	decoder.CharsetReader = goupnp.CharsetReaderDefault
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	slog.Debug("malformed XML, retrying leniently", "err", err)
+	decoder = xml.NewDecoder(bytes.NewReader(sanitizeXML(body)))
+	decoder.DefaultSpace = space
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	if lerr := decoder.Decode(v); lerr != nil {
+		// The strict error names the actual defect
+		return err
+	}
+	return nil
+}
+
+var (
+	// xmlEncodingDecl is the encoding of an XML declaration
+	xmlEncodingDecl = regexp.MustCompile(`^(\s*<\?xml[^>]*?)\s+encoding\s*=\s*["'][^"']*["']`)
+	// strayAmpersand is an & not starting an entity or character reference
+	strayAmpersand = regexp.MustCompile(`&([^A-Za-z#]|#[^0-9x]|[A-Za-z][A-Za-z0-9]*[^A-Za-z0-9;]|$)`)
+)
+
+// sanitizeXML fixes the defects of body decodeXML knows
+func sanitizeXML(body []byte) []byte {
+	// Text that isn't UTF-8 is nearly always Latin-1 whatever is declared,
+	// once converted the declared encoding is wrong either way
+	if !utf8.Valid(body) {
+		var b strings.Builder
+		for _, c := range body {
+			b.WriteRune(rune(c))
+		}
+		body = []byte(b.String())
+	}
+	body = xmlEncodingDecl.ReplaceAll(body, []byte("$1"))
+
+	body = bytes.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, body)
+
+	// The match can end with the character following a short name, the
+	// replacement keeps it; two passes catch "&&"
+	for i := 0; i < 2; i++ {
+		body = strayAmpersand.ReplaceAllFunc(body, func(m []byte) []byte {
+			return append([]byte("&amp;"), m[1:]...)
+		})
+	}
+	return body
+}
+
+// unsafeFileChars are replaced in file names derived from UDNs and IDs
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// xmlFileName returns a file name for the document of udn, and of the
+// service id if not empty
+func xmlFileName(udn, id string) string {
+	name := unsafeFileChars.ReplaceAllString(strings.TrimPrefix(udn, "uuid:"), "-")
+	if name == "" {
+		name = "device"
+	}
+	if id != "" {
+		// urn:upnp-org:serviceId:WANIPConn1
+		id = id[strings.LastIndex(id, ":")+1:]
+		name += "_" + unsafeFileChars.ReplaceAllString(id, "-")
+	}
+	return name + ".xml"
+}
+
+// SaveXML writes the raw device description at loc and the SCPDs of all
+// its services to dir, so they can be analysed offline or kept as
+// evidence. The description is named after the UDN of the root device and
+// each SCPD after the UDN of its device and the service ID. The written
+// paths are returned, SCPDs that can't be fetched are skipped with an
+// error that is returned at the end.
+func SaveXML(ctx context.Context, loc *url.URL, dir string) ([]string, error) {
+	body, err := fetchXML(ctx, loc.String())
+	if err != nil {
+		return nil, err
+	}
+	root, err := parseRootDevice(body, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	var paths []string
+	write := func(name string, b []byte) error {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	}
+
+	if err := write(xmlFileName(root.Device.UDN, ""), body); err != nil {
+		return paths, err
+	}
+
+	var firstErr error
+	root.Device.VisitDevices(func(d *goupnp.Device) {
+		for i := range d.Services {
+			srv := &d.Services[i]
+			if !srv.SCPDURL.Ok {
+				continue
+			}
+			b, err := fetchXML(ctx, srv.SCPDURL.URL.String())
+			if err == nil {
+				err = write(xmlFileName(d.UDN, srv.ServiceId), b)
+			}
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("saving SCPD of %s: %w", srv.ServiceId, err)
+			}
+		}
+	})
+
+	return paths, firstErr
+}
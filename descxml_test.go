@@ -0,0 +1,46 @@
+package portmapping
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+func TestSanitizeXML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"well formed", `<a>x &amp; y &#38; &#x26; &lt;</a>`, `<a>x &amp; y &#38; &#x26; &lt;</a>`},
+		{"stray ampersand", `<a>Tom & Jerry</a>`, `<a>Tom &amp; Jerry</a>`},
+		{"double ampersand", `<a>a&&b</a>`, `<a>a&amp;&amp;b</a>`},
+		{"ampersand at the end", `<a>R&`, `<a>R&amp;`},
+		{"name without semicolon", `<a>AT&T router</a>`, `<a>AT&amp;T router</a>`},
+		{"bad character reference", `<a>&#z;</a>`, `<a>&amp;#z;</a>`},
+		{"HTML entity kept", `<a>&nbsp;</a>`, `<a>&nbsp;</a>`},
+		{"control characters", "<a>x\x00y\x1bz\tw\r\n</a>", "<a>xyz\tw\r\n</a>"},
+		{"Latin-1", "<?xml version=\"1.0\" encoding=\"UTF-8\"?><a>Fritz\xe9</a>", `<?xml version="1.0"?><a>Fritzé</a>`},
+		{"declared encoding dropped", `<?xml version="1.0" encoding='ISO-8859-1'?><a/>`, `<?xml version="1.0"?><a/>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(sanitizeXML([]byte(tt.in))); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeXML(t *testing.T) {
+	var v struct {
+		XMLName      xml.Name `xml:"root"`
+		FriendlyName string   `xml:"device>friendlyName"`
+	}
+	body := "<?xml version=\"1.0\" encoding=\"UTF-8\"?><root xmlns=\"urn:schemas-upnp-org:device-1-0\"><device><friendlyName>Caf\xe9 AT&T&nbsp;Box</friendlyName></device></root>"
+	if err := decodeXML([]byte(body), "urn:schemas-upnp-org:device-1-0", &v); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Café AT&T\u00a0Box"; v.FriendlyName != want {
+		t.Errorf("got %q, want %q", v.FriendlyName, want)
+	}
+}
@@ -0,0 +1,91 @@
+package portmapping
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// Mapping is a PortMappingEntry with Go types
+type Mapping struct {
+	// RemoteHost is nil for mappings of every remote host
+	RemoteHost     net.IP
+	ExternalPort   uint16
+	Protocol       string
+	InternalPort   uint16
+	InternalClient net.IP
+	Enabled        bool
+	Description    string
+	// Lease is the remaining lease, zero for permanent mappings
+	Lease time.Duration
+}
+
+// Mapping parses the entry
+func (pme *PortMappingEntry) Mapping() (*Mapping, error) {
+	m := &Mapping{
+		Protocol:    strings.ToUpper(pme.NewProtocol),
+		Description: pme.NewPortMappingDescription,
+	}
+
+	var err error
+	if host := strings.TrimSpace(pme.NewRemoteHost); host != "" {
+		if m.RemoteHost = net.ParseIP(host); m.RemoteHost == nil {
+			return nil, fmt.Errorf("invalid remote host %q", pme.NewRemoteHost)
+		}
+	}
+	if m.ExternalPort, err = soap.UnmarshalUi2(pme.NewExternalPort); err != nil {
+		return nil, fmt.Errorf("external port %q: %w", pme.NewExternalPort, err)
+	}
+	if m.InternalPort, err = soap.UnmarshalUi2(pme.NewInternalPort); err != nil {
+		return nil, fmt.Errorf("internal port %q: %w", pme.NewInternalPort, err)
+	}
+	if m.InternalClient = net.ParseIP(strings.TrimSpace(pme.NewInternalClient)); m.InternalClient == nil {
+		return nil, fmt.Errorf("invalid internal client %q", pme.NewInternalClient)
+	}
+	m.Enabled = pme.IsEnabled()
+	if pme.NewLeaseDuration != "" {
+		lease, err := soap.UnmarshalUi4(pme.NewLeaseDuration)
+		if err != nil {
+			return nil, fmt.Errorf("lease duration %q: %w", pme.NewLeaseDuration, err)
+		}
+		m.Lease = time.Duration(lease) * time.Second
+	}
+
+	return m, nil
+}
+
+// Entry returns the mapping in SOAP form
+func (m *Mapping) Entry() *PortMappingEntry {
+	pme := &PortMappingEntry{
+		NewProtocol:               m.Protocol,
+		NewInternalClient:         m.InternalClient.String(),
+		NewPortMappingDescription: m.Description,
+	}
+	if m.RemoteHost != nil {
+		pme.NewRemoteHost = m.RemoteHost.String()
+	}
+
+	// Marshaling integers and booleans can't fail
+	pme.NewExternalPort, _ = soap.MarshalUi2(m.ExternalPort)
+	pme.NewInternalPort, _ = soap.MarshalUi2(m.InternalPort)
+	pme.NewEnabled, _ = soap.MarshalBoolean(m.Enabled)
+	pme.NewLeaseDuration, _ = soap.MarshalUi4(uint32(m.Lease / time.Second))
+
+	return pme
+}
+
+// Mappings parses every entry
+func Mappings(entries []*PortMappingEntry) ([]*Mapping, error) {
+	mappings := make([]*Mapping, 0, len(entries))
+	for _, pme := range entries {
+		m, err := pme.Mapping()
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
@@ -0,0 +1,110 @@
+package portmapping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// Errors matching the UPnP faults of the IGD spec with errors.Is
+var (
+	ErrInvalidAction                = errors.New("the device does not support the action")
+	ErrInvalidArgs                  = errors.New("the device rejected the arguments")
+	ErrActionFailed                 = errors.New("the device failed to perform the action")
+	ErrActionNotAuthorized          = errors.New("the device does not allow the action")
+	ErrArrayIndexInvalid            = errors.New("the mapping index is past the last entry")
+	ErrWildcardNotPermitted         = errors.New("the device does not allow wildcards in the source IP or external port")
+	ErrMappingConflict              = errors.New("the mapping conflicts with a mapping of another client")
+	ErrSamePortValuesRequired       = errors.New("the device requires the same internal and external port")
+	ErrOnlyPermanentLeases          = errors.New("the device only supports permanent leases")
+	ErrRemoteHostWildcardRequired   = errors.New("the device requires a wildcard remote host")
+	ErrExternalPortWildcardRequired = errors.New("the device requires a wildcard external port")
+	ErrNoPortMapsAvailable          = errors.New("the device has no free mapping slots")
+	ErrConflictWithOtherMechanisms  = errors.New("the mapping conflicts with one set up by another mechanism")
+	ErrPortMappingNotFound          = errors.New("no mapping in the requested range")
+)
+
+const (
+	errCodeMappingConflict    = 718
+	errCodeOnlyPermanentLease = 725
+)
+
+// upnpErrors maps UPnP error codes to their errors
+var upnpErrors = map[int]error{
+	401:                       ErrInvalidAction,
+	402:                       ErrInvalidArgs,
+	501:                       ErrActionFailed,
+	606:                       ErrActionNotAuthorized,
+	errCodeArrayIndexInvalid:  ErrArrayIndexInvalid,
+	errCodeNoSuchEntry:        ErrNoSuchEntry,
+	715:                       ErrWildcardNotPermitted,
+	716:                       ErrWildcardNotPermitted,
+	errCodeMappingConflict:    ErrMappingConflict,
+	724:                       ErrSamePortValuesRequired,
+	errCodeOnlyPermanentLease: ErrOnlyPermanentLeases,
+	726:                       ErrRemoteHostWildcardRequired,
+	727:                       ErrExternalPortWildcardRequired,
+	728:                       ErrNoPortMapsAvailable,
+	729:                       ErrConflictWithOtherMechanisms,
+	errCodeNoMappingInRange:   ErrPortMappingNotFound,
+}
+
+// UPnPError is a fault returned by a UPnP action. It matches the error of
+// its code with errors.Is and unwraps to the SOAP fault.
+type UPnPError struct {
+	Action      string
+	Code        int
+	Description string
+	fault       *soap.SOAPFaultError
+}
+
+func (e *UPnPError) Error() string {
+	msg := e.Description
+	if err, ok := upnpErrors[e.Code]; ok {
+		msg = err.Error()
+	}
+	if e.Description != "" && msg != e.Description {
+		return fmt.Sprintf("%s: %s (%d %s)", e.Action, msg, e.Code, e.Description)
+	}
+	return fmt.Sprintf("%s: %s (%d)", e.Action, msg, e.Code)
+}
+
+// Is reports whether target is the error of the fault code
+func (e *UPnPError) Is(target error) bool {
+	err, ok := upnpErrors[e.Code]
+	return ok && err == target
+}
+
+// Unwrap returns the SOAP fault
+func (e *UPnPError) Unwrap() error {
+	return e.fault
+}
+
+// upnpError turns the SOAP fault of action into a UPnPError
+func upnpError(action string, err error) error {
+	var fault *soap.SOAPFaultError
+	if !errors.As(err, &fault) {
+		return err
+	}
+
+	return &UPnPError{
+		Action:      action,
+		Code:        fault.Detail.UPnPError.Errorcode,
+		Description: fault.Detail.UPnPError.ErrorDescription,
+		fault:       fault,
+	}
+}
+
+// perform runs action on the WAN connection service
+func (c *Client) perform(ctx context.Context, action string, in, out interface{}) error {
+	return c.performURN(ctx, c.urn, action, in, out)
+}
+
+// performURN runs action of the service type urn under the retry policy
+func (c *Client) performURN(ctx context.Context, urn string, action string, in, out interface{}) error {
+	return upnpError(action, c.retryPolicy().do(ctx, action, func(ctx context.Context) error {
+		return c.SOAPClient.PerformActionCtx(ctx, urn, action, in, out)
+	}))
+}
@@ -0,0 +1,73 @@
+package portmapping
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// soapFault returns the fault of a device answering code and desc
+func soapFault(code int, desc string) *soap.SOAPFaultError {
+	fault := &soap.SOAPFaultError{FaultCode: "s:Client", FaultString: "UPnPError"}
+	fault.Detail.UPnPError.Errorcode = code
+	fault.Detail.UPnPError.ErrorDescription = desc
+	return fault
+}
+
+func TestUPnPError(t *testing.T) {
+	tests := []struct {
+		code    int
+		desc    string
+		want    error
+		wantMsg string
+	}{
+		{402, "Invalid Args", ErrInvalidArgs, "AddPortMapping: the device rejected the arguments (402 Invalid Args)"},
+		{501, "", ErrActionFailed, "AddPortMapping: the device failed to perform the action (501)"},
+		{713, "SpecifiedArrayIndexInvalid", ErrArrayIndexInvalid, "AddPortMapping: the mapping index is past the last entry (713 SpecifiedArrayIndexInvalid)"},
+		{714, "NoSuchEntryInArray", ErrNoSuchEntry, ""},
+		{716, "WildCardNotPermittedInExtPort", ErrWildcardNotPermitted, ""},
+		{718, "ConflictInMappingEntry", ErrMappingConflict, ""},
+		{725, "OnlyPermanentLeasesSupported", ErrOnlyPermanentLeases, ""},
+		{728, "NoPortMapsAvailable", ErrNoPortMapsAvailable, ""},
+		{730, "PortMappingNotFound", ErrPortMappingNotFound, ""},
+		{899, "Vendor Specific", nil, "AddPortMapping: Vendor Specific (899)"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.code), func(t *testing.T) {
+			fault := soapFault(tt.code, tt.desc)
+			err := upnpError("AddPortMapping", fmt.Errorf("wrapped: %w", fault))
+
+			var ue *UPnPError
+			if !errors.As(err, &ue) {
+				t.Fatalf("got %T, want a *UPnPError", err)
+			}
+			if ue.Code != tt.code || ue.Description != tt.desc {
+				t.Errorf("got code %d %q, want %d %q", ue.Code, ue.Description, tt.code, tt.desc)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("%v is not %v", err, tt.want)
+			}
+			if errors.Is(err, ErrInvalidAction) && tt.want != ErrInvalidAction {
+				t.Errorf("%v matches ErrInvalidAction", err)
+			}
+			if !errors.Is(err, fault) {
+				t.Errorf("%v doesn't unwrap to the SOAP fault", err)
+			}
+			if tt.wantMsg != "" && err.Error() != tt.wantMsg {
+				t.Errorf("got %q, want %q", err.Error(), tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestUPnPErrorPassesOtherErrors(t *testing.T) {
+	if err := upnpError("GetExternalIPAddress", nil); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	other := errors.New("connection refused")
+	if err := upnpError("GetExternalIPAddress", other); err != other {
+		t.Errorf("got %v, want the error as it is", err)
+	}
+}
@@ -0,0 +1,247 @@
+package portmapping
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	genaTimeout        = 1800
+	genaNT             = "upnp:event"
+	genaCallbackPath   = "/portmapping/event"
+	varNumberOfEntries = "PortMappingNumberOfEntries"
+)
+
+// Event is a GENA notification of changed state variables
+type Event struct {
+	SEQ       uint32
+	Variables map[string]string
+}
+
+type propertySet struct {
+	Properties []struct {
+		Vars []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"property"`
+}
+
+// Subscribe subscribes to the GENA eventing of the service and calls fn for
+// every notification until ctx is done. Notifications are received on a
+// listener bound to listen, ":0" when empty. The subscription is renewed
+// before it expires and cancelled on return.
+func (c *Client) Subscribe(ctx context.Context, listen string, fn func(Event)) error {
+	if !c.Service.EventSubURL.Ok {
+		return ErrNotSupported
+	}
+	eventURL := c.Service.EventSubURL.URL.String()
+
+	if listen == "" {
+		listen = ":0"
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+
+	callback, err := callbackURL(c.Service.EventSubURL.URL.Host, c.source, ln.Addr())
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(genaCallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "NOTIFY" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ev, err := parseEvent(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fn(ev)
+	})
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	sid, timeout, err := c.gena(ctx, "SUBSCRIBE", eventURL, http.Header{
+		"CALLBACK": []string{"<" + callback + ">"},
+		"NT":       []string{genaNT},
+		"TIMEOUT":  []string{"Second-" + strconv.Itoa(genaTimeout)},
+	})
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		uctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.gena(uctx, "UNSUBSCRIBE", eventURL, http.Header{"SID": []string{sid}})
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(timeout / 2):
+		}
+
+		_, renewed, err := c.gena(ctx, "SUBSCRIBE", eventURL, http.Header{
+			"SID":     []string{sid},
+			"TIMEOUT": []string{"Second-" + strconv.Itoa(genaTimeout)},
+		})
+		if err != nil {
+			return fmt.Errorf("gena: renewing subscription: %w", err)
+		}
+		timeout = renewed
+	}
+}
+
+// gena performs a GENA request and returns the subscription ID and timeout
+func (c *Client) gena(ctx context.Context, method string, eventURL string, header http.Header) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, method, eventURL, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	// Assigned directly to keep the upper case header names
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.SOAPClient.HTTPClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("gena: %s got HTTP %s", method, resp.Status)
+	}
+
+	timeout := time.Duration(genaTimeout) * time.Second
+	if t := resp.Header.Get("TIMEOUT"); strings.HasPrefix(t, "Second-") {
+		if secs, err := strconv.Atoi(strings.TrimPrefix(t, "Second-")); err == nil && secs > 0 {
+			timeout = time.Duration(secs) * time.Second
+		}
+	}
+
+	// Renewals may omit the SID they were sent with
+	sid := resp.Header.Get("SID")
+	if sid == "" && len(header["SID"]) > 0 {
+		sid = header["SID"][0]
+	}
+	if sid == "" && method == "SUBSCRIBE" {
+		return "", 0, errors.New("gena: no SID in subscription response")
+	}
+
+	return sid, timeout, nil
+}
+
+// callbackURL returns the URL the device reaches the listener at, using
+// source or else the local address routed towards deviceHost
+func callbackURL(deviceHost string, source net.IP, addr net.Addr) (string, error) {
+	local := &net.UDPAddr{IP: source}
+	if source == nil {
+		var err error
+		if local, err = routedAddr(deviceHost); err != nil {
+			return "", err
+		}
+	}
+	port := addr.(*net.TCPAddr).Port
+
+	ip := local.IP.String()
+	if local.Zone != "" {
+		ip += "%25" + local.Zone
+	}
+
+	return "http://" + net.JoinHostPort(ip, strconv.Itoa(port)) + genaCallbackPath, nil
+}
+
+// routedAddr returns the local address of the route towards deviceHost
+func routedAddr(deviceHost string) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(deviceHost); err != nil {
+		deviceHost = net.JoinHostPort(deviceHost, "80")
+	}
+
+	conn, err := net.Dial("udp", deviceHost)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr), nil
+}
+
+func parseEvent(r *http.Request) (Event, error) {
+	ev := Event{Variables: make(map[string]string)}
+
+	if seq := r.Header.Get("SEQ"); seq != "" {
+		n, err := strconv.ParseUint(seq, 10, 32)
+		if err != nil {
+			return ev, err
+		}
+		ev.SEQ = uint32(n)
+	}
+
+	var ps propertySet
+	if err := xml.NewDecoder(r.Body).Decode(&ps); err != nil {
+		return ev, err
+	}
+
+	for _, p := range ps.Properties {
+		for _, v := range p.Vars {
+			ev.Variables[v.XMLName.Local] = strings.TrimSpace(v.Value)
+		}
+	}
+
+	return ev, nil
+}
+
+// WatchEvents is Watch driven by PortMappingNumberOfEntries notifications
+// of the service instead of polling
+func WatchEvents(ctx context.Context, c *Client, listen string, fn WatchFunc) error {
+	w := &watcher{m: c, fn: fn}
+	if err := w.snapshot(ctx); err != nil {
+		return err
+	}
+
+	changed := make(chan struct{}, 1)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.Subscribe(ctx, listen, func(ev Event) {
+			if _, ok := ev.Variables[varNumberOfEntries]; !ok {
+				return
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	}()
+
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-changed:
+			if err := w.snapshot(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
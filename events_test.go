@@ -0,0 +1,66 @@
+package portmapping
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		seq     string
+		body    string
+		want    Event
+		wantErr bool
+	}{
+		{
+			name: "variables",
+			seq:  "3",
+			body: `<?xml version="1.0"?>
+<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">
+<e:property><PortMappingNumberOfEntries>4</PortMappingNumberOfEntries></e:property>
+<e:property><ExternalIPAddress> 203.0.113.7
+</ExternalIPAddress></e:property>
+</e:propertyset>`,
+			want: Event{SEQ: 3, Variables: map[string]string{"PortMappingNumberOfEntries": "4", "ExternalIPAddress": "203.0.113.7"}},
+		},
+		{
+			name: "several variables in a property",
+			body: `<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0"><e:property><A>1</A><B>2</B></e:property></e:propertyset>`,
+			want: Event{Variables: map[string]string{"A": "1", "B": "2"}},
+		},
+		{
+			name: "empty",
+			seq:  "0",
+			body: `<e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0"></e:propertyset>`,
+			want: Event{Variables: map[string]string{}},
+		},
+		{name: "bad seq", seq: "x", body: `<e:propertyset/>`, wantErr: true},
+		{name: "seq out of range", seq: "4294967296", body: `<e:propertyset/>`, wantErr: true},
+		{name: "not XML", body: "NOTIFY", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("NOTIFY", "/", strings.NewReader(tt.body))
+			if tt.seq != "" {
+				r.Header.Set("SEQ", tt.seq)
+			}
+
+			got, err := parseEvent(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package portmapping
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// WANExposure tells whether a gateway answers UPnP on its external address,
+// which lets anyone on the internet add mappings and is how routers get
+// turned into proxies
+type WANExposure struct {
+	// SSDP is set when a unicast M-SEARCH to port 1900 was answered
+	SSDP       bool   `json:"ssdp"`
+	SSDPServer string `json:"ssdp_server,omitempty"`
+	// Description is set when the device description, and with it the
+	// SOAP control URLs, could be fetched
+	Description    bool   `json:"description"`
+	DescriptionURL string `json:"description_url,omitempty"`
+	Detail         string `json:"detail,omitempty"`
+}
+
+// Exposed reports whether any UPnP service answered
+func (e WANExposure) Exposed() bool {
+	return e.SSDP || e.Description
+}
+
+// ProbeWANExposure probes host, the external address of a gateway, from
+// this host, which must be outside the gateway. The description is looked
+// for at the location of the SSDP answer, or at port and path, the ones of
+// the location seen on the LAN, when SSDP stays silent.
+func ProbeWANExposure(ctx context.Context, host, port, path string, timeout time.Duration) WANExposure {
+	var (
+		e      WANExposure
+		detail []string
+	)
+
+	responders, err := SearchResponders(ctx, host, "1900", &SearchOptions{Wait: timeout, Retries: 1})
+	if err == nil && len(responders) > 0 {
+		e.SSDP, e.SSDPServer = true, responders[0].Server
+		port, path = responders[0].Location.Port(), responders[0].Location.Path
+	} else {
+		detail = append(detail, "no SSDP answer")
+	}
+
+	if port == "" {
+		e.Detail = strings.Join(append(detail, "no description port to try"), ", ")
+		return e
+	}
+
+	desc := &url.URL{Scheme: "http", Host: net.JoinHostPort(host, port), Path: path}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, desc.String(), nil)
+	if err != nil {
+		e.Detail = err.Error()
+		return e
+	}
+	resp, err := httpClient(ctx).Do(req)
+	if err != nil {
+		detail = append(detail, "description not reachable")
+		e.Detail = strings.Join(detail, ", ")
+		return e
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode == http.StatusOK && strings.Contains(string(body), "<device") {
+		e.Description, e.DescriptionURL = true, desc.String()
+	} else {
+		detail = append(detail, fmt.Sprintf("%s answered %s without a device description", desc, resp.Status))
+	}
+	e.Detail = strings.Join(detail, ", ")
+	return e
+}
+
+// requesterOnly reports whether host is the address r comes from
+func requesterOnly(r *http.Request, host string) bool {
+	remote, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(net.ParseIP(remote))
+}
+
+// WANExposureHandler serves ProbeWANExposure like ReachHandler serves
+// ProbeReach:
+//
+//	GET ?addr=203.0.113.7&port=5000&path=/rootDesc.xml
+func WANExposureHandler(timeout time.Duration, anyTarget bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		host := q.Get("addr")
+		if net.ParseIP(host) == nil {
+			http.Error(w, "addr must be an IP address", http.StatusBadRequest)
+			return
+		}
+		if !anyTarget && !requesterOnly(r, host) {
+			http.Error(w, "only the address of the requester may be probed", http.StatusForbidden)
+			return
+		}
+
+		res := ProbeWANExposure(r.Context(), host, q.Get("port"), q.Get("path"), timeout)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+}
+
+// CheckWANExposure asks the WANExposureHandler at checkURL to probe the
+// external address ip of a gateway whose description is at loc on the LAN
+func CheckWANExposure(ctx context.Context, client *http.Client, checkURL string, ip net.IP, loc *url.URL) (WANExposure, error) {
+	u, err := url.Parse(checkURL)
+	if err != nil {
+		return WANExposure{}, err
+	}
+	q := u.Query()
+	q.Set("addr", ip.String())
+	if loc != nil {
+		q.Set("port", loc.Port())
+		q.Set("path", loc.Path)
+	}
+	u.RawQuery = q.Encode()
+
+	var res WANExposure
+	if err := getJSON(ctx, client, u.String(), &res); err != nil {
+		return WANExposure{}, fmt.Errorf("check service: %w", err)
+	}
+	return res, nil
+}
+
+// getJSON decodes the JSON answer of an agent to a GET of rawurl
+func getJSON(ctx context.Context, client *http.Client, rawurl string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return err
+	}
+	return nil
+}
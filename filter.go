@@ -0,0 +1,218 @@
+package portmapping
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MappingFilter selects mappings, zero fields match everything
+type MappingFilter struct {
+	// Protocol matches case-insensitively
+	Protocol       string
+	InternalClient string
+	ExternalPort   uint16
+	// DescriptionMatch is a shell pattern as understood by path.Match
+	DescriptionMatch    string
+	DescriptionContains string
+	// DescriptionPrefix matches the descriptions starting with it, like the
+	// owner tag of the mappings a tool added
+	DescriptionPrefix string
+	EnabledOnly       bool
+	// ExpiringWithin matches finite leases with at most this much left
+	ExpiringWithin time.Duration
+}
+
+// Empty reports whether f matches every mapping
+func (f *MappingFilter) Empty() bool {
+	return *f == MappingFilter{}
+}
+
+// Match reports whether pme passes every set field of f
+func (f *MappingFilter) Match(pme *PortMappingEntry) bool {
+	if f.Protocol != "" && !strings.EqualFold(f.Protocol, pme.NewProtocol) {
+		return false
+	}
+	if f.InternalClient != "" && f.InternalClient != pme.NewInternalClient {
+		return false
+	}
+	if f.ExternalPort != 0 && strconv.Itoa(int(f.ExternalPort)) != pme.NewExternalPort {
+		return false
+	}
+	if f.DescriptionContains != "" && !strings.Contains(pme.NewPortMappingDescription, f.DescriptionContains) {
+		return false
+	}
+	if f.DescriptionPrefix != "" && !strings.HasPrefix(pme.NewPortMappingDescription, f.DescriptionPrefix) {
+		return false
+	}
+	if f.EnabledOnly && !pme.IsEnabled() {
+		return false
+	}
+	if f.ExpiringWithin > 0 {
+		if left := leaseLeft(pme); left == math.MaxUint64 || time.Duration(left)*time.Second > f.ExpiringWithin {
+			return false
+		}
+	}
+	if f.DescriptionMatch != "" {
+		if ok, _ := path.Match(f.DescriptionMatch, pme.NewPortMappingDescription); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterMappings returns the mappings matching f
+func FilterMappings(mappings []*PortMappingEntry, f *MappingFilter) []*PortMappingEntry {
+	var matched []*PortMappingEntry
+	for _, pme := range mappings {
+		if f.Match(pme) {
+			matched = append(matched, pme)
+		}
+	}
+	return matched
+}
+
+// Expires returns when the lease of pme runs out if it was read at read,
+// false for permanent mappings
+func (pme *PortMappingEntry) Expires(read time.Time) (time.Time, bool) {
+	left := leaseLeft(pme)
+	if left == math.MaxUint64 {
+		return time.Time{}, false
+	}
+	return read.Add(time.Duration(left) * time.Second), true
+}
+
+// IsEnabled reports whether the device reports the mapping as enabled
+func (pme *PortMappingEntry) IsEnabled() bool {
+	return pme.NewEnabled == "1" || strings.EqualFold(pme.NewEnabled, "true")
+}
+
+// The orders of SortMappings
+const (
+	SortExternalPort   = "external-port"
+	SortInternalClient = "internal-client"
+	SortLease          = "lease"
+	SortDescription    = "description"
+)
+
+// SortKeys are the orders SortMappings knows
+var SortKeys = []string{SortExternalPort, SortInternalClient, SortLease, SortDescription}
+
+// SortMappings sorts mappings in place by one of SortKeys. Ports and
+// clients sort numerically, ties by protocol and port. Leases sort by the
+// time left with the permanent ones last, so what expires soonest comes
+// first.
+func SortMappings(mappings []*PortMappingEntry, key string) error {
+	var less func(a, b *PortMappingEntry) bool
+	switch key {
+	case SortExternalPort:
+		less = func(a, b *PortMappingEntry) bool {
+			return lessPort(a, b)
+		}
+	case SortInternalClient:
+		less = func(a, b *PortMappingEntry) bool {
+			if c := compareClients(a.NewInternalClient, b.NewInternalClient); c != 0 {
+				return c < 0
+			}
+			if pa, pb := portNumber(a.NewInternalPort), portNumber(b.NewInternalPort); pa != pb {
+				return pa < pb
+			}
+			return lessPort(a, b)
+		}
+	case SortLease:
+		less = func(a, b *PortMappingEntry) bool {
+			if la, lb := leaseLeft(a), leaseLeft(b); la != lb {
+				return la < lb
+			}
+			return lessPort(a, b)
+		}
+	case SortDescription:
+		less = func(a, b *PortMappingEntry) bool {
+			if a.NewPortMappingDescription != b.NewPortMappingDescription {
+				return a.NewPortMappingDescription < b.NewPortMappingDescription
+			}
+			return lessPort(a, b)
+		}
+	default:
+		return fmt.Errorf("unknown sort order %q, want one of %s", key, strings.Join(SortKeys, ", "))
+	}
+
+	sort.SliceStable(mappings, func(i, j int) bool { return less(mappings[i], mappings[j]) })
+	return nil
+}
+
+// lessPort orders mappings by external port and protocol
+func lessPort(a, b *PortMappingEntry) bool {
+	if pa, pb := portNumber(a.NewExternalPort), portNumber(b.NewExternalPort); pa != pb {
+		return pa < pb
+	}
+	return strings.ToUpper(a.NewProtocol) < strings.ToUpper(b.NewProtocol)
+}
+
+// portNumber returns a SOAP port as a number, invalid ones after the
+// others
+func portNumber(s string) int {
+	p, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil {
+		return math.MaxUint16 + 1
+	}
+	return int(p)
+}
+
+// compareClients compares internal clients by address, clients that
+// aren't addresses by name after them
+func compareClients(a, b string) int {
+	aa, aerr := netip.ParseAddr(a)
+	ba, berr := netip.ParseAddr(b)
+	switch {
+	case aerr == nil && berr == nil:
+		return aa.Compare(ba)
+	case aerr == nil:
+		return -1
+	case berr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// leaseLeft returns the seconds left of a mapping, permanent and invalid
+// leases last
+func leaseLeft(pme *PortMappingEntry) uint64 {
+	n, err := strconv.ParseUint(strings.TrimSpace(pme.NewLeaseDuration), 10, 32)
+	if err != nil || n == 0 {
+		return math.MaxUint64
+	}
+	return n
+}
+
+// MappingGroup is the mappings of an internal client
+type MappingGroup struct {
+	InternalClient string
+	Mappings       []*PortMappingEntry
+}
+
+// GroupMappings splits mappings by internal client, ordered like
+// SortMappings does, keeping the order of the mappings of each client
+func GroupMappings(mappings []*PortMappingEntry) []*MappingGroup {
+	var groups []*MappingGroup
+	byClient := make(map[string]*MappingGroup)
+	for _, pme := range mappings {
+		g := byClient[pme.NewInternalClient]
+		if g == nil {
+			g = &MappingGroup{InternalClient: pme.NewInternalClient}
+			byClient[pme.NewInternalClient] = g
+			groups = append(groups, g)
+		}
+		g.Mappings = append(g.Mappings, pme)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return compareClients(groups[i].InternalClient, groups[j].InternalClient) < 0
+	})
+	return groups
+}
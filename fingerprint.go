@@ -0,0 +1,161 @@
+package portmapping
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Fingerprint identifies the UPnP stack and model of a device
+type Fingerprint struct {
+	// Server is the SERVER header, "OS/version UPnP/1.0 product/version"
+	Server       string `json:"server,omitempty"`
+	OS           string `json:"os,omitempty"`
+	UPnPVersion  string `json:"upnp_version,omitempty"`
+	Stack        string `json:"stack,omitempty"`
+	StackVersion string `json:"stack_version,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+	// Firmware is the model number, where vendors usually put it
+	Firmware string `json:"firmware,omitempty"`
+
+	Vulnerabilities []Vulnerability `json:"vulnerabilities,omitempty"`
+}
+
+// Vulnerability is a known flaw of a UPnP stack
+type Vulnerability struct {
+	ID       string `json:"id"`
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	// FixedIn is the first version without it, empty if every version
+	// is affected
+	FixedIn string `json:"fixed_in,omitempty"`
+
+	stack string
+}
+
+// knownStacks map a product token of the SERVER header to a stack name
+var knownStacks = []struct {
+	match, name string
+}{
+	{"miniupnpd", "MiniUPnPd"},
+	{"portable sdk for upnp devices", "libupnp"},
+	{"intel sdk for upnp devices", "Intel UPnP SDK"},
+	{"broadcom upnp", "Broadcom UPnP"},
+	{"realtek", "Realtek SDK"},
+	{"allegro-software-romupnp", "Allegro RomUpnp"},
+}
+
+// knownVulnerabilities is the bundled list Fingerprint matches stacks with
+var knownVulnerabilities = []Vulnerability{
+	{stack: "libupnp", ID: "CVE-2012-5958", Severity: "critical", FixedIn: "1.6.18",
+		Summary: "Stack buffer overflows parsing SSDP requests allow remote code execution"},
+	{stack: "libupnp", ID: "CVE-2016-8863", Severity: "high", FixedIn: "1.6.21",
+		Summary: "Heap buffer overflow in create_url_list through SUBSCRIBE callbacks"},
+	{stack: "libupnp", ID: "CVE-2016-6255", Severity: "medium", FixedIn: "1.6.21",
+		Summary: "Unauthenticated POST requests write arbitrary files to the web root"},
+	{stack: "Intel UPnP SDK", ID: "CVE-2012-5958", Severity: "critical",
+		Summary: "The unmaintained ancestor of libupnp shares its SSDP stack buffer overflows"},
+	{stack: "MiniUPnPd", ID: "CVE-2013-0230", Severity: "critical", FixedIn: "1.4",
+		Summary: "Stack buffer overflow handling SOAP actions allows remote code execution"},
+	{stack: "MiniUPnPd", ID: "CVE-2013-0229", Severity: "medium", FixedIn: "1.4",
+		Summary: "Crafted SSDP requests crash the daemon"},
+	{stack: "MiniUPnPd", ID: "CVE-2017-1000494", Severity: "medium", FixedIn: "2.1",
+		Summary: "Uninitialized stack variable in the XML parser can crash the daemon"},
+	{stack: "MiniUPnPd", ID: "CVE-2020-12695", Severity: "high", FixedIn: "2.2.0",
+		Summary: "CallStranger: SUBSCRIBE callbacks to arbitrary hosts allow DDoS amplification and data exfiltration"},
+	{stack: "Realtek SDK", ID: "CVE-2014-8361", Severity: "critical",
+		Summary: "Command injection through NewInternalClient of the miniigd SOAP service"},
+}
+
+// FingerprintDevice identifies the stack from the SERVER header server and
+// the model from info, which may be nil, and matches them with the known
+// vulnerabilities
+func FingerprintDevice(server string, info *DeviceInfo) *Fingerprint {
+	fp := &Fingerprint{Server: strings.TrimSpace(server)}
+	if info != nil {
+		fp.Manufacturer = info.Manufacturer
+		fp.Model = strings.TrimSpace(info.ModelName)
+		fp.Firmware = info.ModelNumber
+	}
+
+	osPart, rest, found := strings.Cut(fp.Server, "UPnP/")
+	if !found {
+		rest = fp.Server
+	} else {
+		fp.OS = strings.Trim(osPart, " ,")
+		version, products, _ := strings.Cut(rest, " ")
+		fp.UPnPVersion = strings.Trim(version, " ,")
+		rest = products
+	}
+	product := strings.Trim(rest, " ,")
+
+	lower := strings.ToLower(product)
+	for _, s := range knownStacks {
+		i := strings.Index(lower, s.match)
+		if i < 0 {
+			continue
+		}
+		fp.Stack = s.name
+		// The version follows the product name: name/1.2.3
+		if v, ok := strings.CutPrefix(product[i+len(s.match):], "/"); ok {
+			fp.StackVersion, _, _ = strings.Cut(v, " ")
+		}
+		break
+	}
+	if fp.Stack == "" {
+		fp.Stack = product
+	}
+
+	for _, v := range knownVulnerabilities {
+		if v.stack != fp.Stack {
+			continue
+		}
+		// Without a version only flaws of every version are certain
+		if v.FixedIn == "" || (fp.StackVersion != "" && compareVersions(fp.StackVersion, v.FixedIn) < 0) {
+			fp.Vulnerabilities = append(fp.Vulnerabilities, v)
+		}
+	}
+
+	return fp
+}
+
+// compareVersions compares dotted versions numerically, fields that are not
+// numbers compare as zero
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(strings.TrimLeft(as[i], "v"))
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// DescriptionServer returns the Server header the device description at
+// loc is served with, which names the UPnP stack like the SSDP SERVER
+// header does
+func DescriptionServer(ctx context.Context, loc *url.URL) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, loc.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient(ctx).Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Server"), nil
+}
@@ -0,0 +1,9 @@
+package portmapping
+
+import "errors"
+
+// ErrNoGateway is returned when the routing table has no IPv4 default route
+var ErrNoGateway = errors.New("no default gateway found")
+
+// ErrNoNeighbor is returned when the hardware address of a host is unknown
+var ErrNoNeighbor = errors.New("no neighbor cache entry found")
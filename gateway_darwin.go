@@ -0,0 +1,31 @@
+package portmapping
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// DefaultGateway returns the IPv4 default gateway as reported by route(8)
+func DefaultGateway() (net.IP, error) {
+	out, err := exec.Command("route", "-n", "get", "default").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "gateway:" {
+			continue
+		}
+
+		if ip := net.ParseIP(fields[1]); ip != nil && ip.To4() != nil {
+			return ip, nil
+		}
+	}
+
+	return nil, ErrNoGateway
+}
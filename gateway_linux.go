@@ -0,0 +1,51 @@
+package portmapping
+
+import (
+	"net"
+	"syscall"
+)
+
+// rtmsg field offsets, see rtnetlink(7)
+const (
+	rtmDstLen = 1
+	rtmTable  = 4
+)
+
+// DefaultGateway returns the IPv4 default gateway from the main routing
+// table, read over netlink
+func DefaultGateway() (net.IP, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_INET)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range msgs {
+		if m.Header.Type == syscall.NLMSG_DONE {
+			break
+		}
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		if m.Data[rtmDstLen] != 0 || m.Data[rtmTable] != syscall.RT_TABLE_MAIN {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range attrs {
+			if a.Attr.Type == syscall.RTA_GATEWAY && len(a.Value) == net.IPv4len {
+				return net.IPv4(a.Value[0], a.Value[1], a.Value[2], a.Value[3]), nil
+			}
+		}
+	}
+
+	return nil, ErrNoGateway
+}
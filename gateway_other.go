@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package portmapping
+
+import "net"
+
+// DefaultGateway is not implemented on this platform
+func DefaultGateway() (net.IP, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,64 @@
+package portmapping
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	errInsufficientBuffer = 122
+	// MIB_IPFORWARDROW is 14 DWORDs
+	ipForwardRowSize = 14 * 4
+)
+
+var procGetIpForwardTable = syscall.NewLazyDLL("iphlpapi.dll").NewProc("GetIpForwardTable")
+
+// DefaultGateway returns the IPv4 default gateway with the lowest metric
+// from GetIpForwardTable
+func DefaultGateway() (net.IP, error) {
+	var size uint32
+	r, _, _ := procGetIpForwardTable.Call(0, uintptr(unsafe.Pointer(&size)), 0)
+	if r != errInsufficientBuffer {
+		return nil, syscall.Errno(r)
+	}
+
+	buf := make([]byte, size)
+	r, _, _ = procGetIpForwardTable.Call(uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if r != 0 {
+		return nil, syscall.Errno(r)
+	}
+
+	var (
+		gw     net.IP
+		metric uint32
+	)
+
+	n := binary.LittleEndian.Uint32(buf)
+	for i := uint32(0); i < n; i++ {
+		off := 4 + int(i)*ipForwardRowSize
+		if off+ipForwardRowSize > len(buf) {
+			break
+		}
+		row := buf[off : off+ipForwardRowSize]
+
+		// dwForwardDest and dwForwardMask are zero for the default route.
+		// Addresses are stored in network byte order.
+		if binary.LittleEndian.Uint32(row[0:]) != 0 || binary.LittleEndian.Uint32(row[4:]) != 0 {
+			continue
+		}
+
+		m := binary.LittleEndian.Uint32(row[36:])
+		if gw == nil || m < metric {
+			gw = net.IPv4(row[12], row[13], row[14], row[15])
+			metric = m
+		}
+	}
+
+	if gw == nil {
+		return nil, ErrNoGateway
+	}
+
+	return gw, nil
+}
@@ -0,0 +1,298 @@
+package portmapping
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker starts the metadata at the end of a MaxMind DB
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// errInvalidGeoDB is returned for data past the end of the database
+var errInvalidGeoDB = errors.New("invalid MaxMind DB")
+
+// GeoDB is a MaxMind DB file like the GeoLite2 Country, City and ASN ones,
+// read into memory
+type GeoDB struct {
+	// Type is the database_type of its metadata, like GeoLite2-ASN
+	Type string
+
+	tree       []byte
+	data       []byte
+	nodeCount  uint32
+	recordSize int
+	ipv4Start  uint32
+}
+
+// GeoInfo is what GeoDBs know of an address
+type GeoInfo struct {
+	// Country is the ISO 3166 code of the country of the address
+	Country string `json:"country,omitempty"`
+	// ASN and Organization are of the autonomous system announcing it
+	ASN          uint64 `json:"asn,omitempty"`
+	Organization string `json:"as_org,omitempty"`
+}
+
+// OpenGeoDB reads the MaxMind DB at path
+func OpenGeoDB(path string) (*GeoDB, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := ParseGeoDB(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return db, nil
+}
+
+// ParseGeoDB parses a MaxMind DB
+func ParseGeoDB(b []byte) (*GeoDB, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("no MaxMind DB metadata")
+	}
+	meta := b[i+len(mmdbMetadataMarker):]
+	v, _, err := decodeMMDB(meta, 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+
+	db := &GeoDB{}
+	db.Type, _ = m["database_type"].(string)
+	nodes, _ := m["node_count"].(uint64)
+	size, _ := m["record_size"].(uint64)
+	version, _ := m["ip_version"].(uint64)
+	if size != 24 && size != 28 && size != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", size)
+	}
+	db.nodeCount, db.recordSize = uint32(nodes), int(size)
+
+	treeSize := int(nodes) * int(size) / 4
+	// The tree and the data section are separated by 16 zero bytes
+	if treeSize+16 > i {
+		return nil, errInvalidGeoDB
+	}
+	db.tree, db.data = b[:treeSize], b[treeSize+16:i]
+
+	// IPv4 addresses are ::a.b.c.d in IPv6 trees
+	if version == 6 {
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			if db.ipv4Start, err = db.record(db.ipv4Start, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return db, nil
+}
+
+// record returns the left (bit 0) or right record of node
+func (db *GeoDB) record(node uint32, bit byte) (uint32, error) {
+	off := int(node) * db.recordSize / 4
+	if off+db.recordSize/4 > len(db.tree) {
+		return 0, errInvalidGeoDB
+	}
+	b := db.tree[off:]
+
+	switch db.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]), nil
+		}
+		return uint32(b[3])<<16 | uint32(b[4])<<8 | uint32(b[5]), nil
+	case 28:
+		if bit == 0 {
+			return uint32(b[3]&0xf0)<<20 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]), nil
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6]), nil
+	}
+	if bit == 0 {
+		return binary.BigEndian.Uint32(b), nil
+	}
+	return binary.BigEndian.Uint32(b[4:]), nil
+}
+
+// Lookup returns the record of ip, nil if the database has none
+func (db *GeoDB) Lookup(ip net.IP) (map[string]interface{}, error) {
+	node, addr := uint32(0), ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		node, addr = db.ipv4Start, ip4
+	}
+	if addr == nil {
+		return nil, fmt.Errorf("invalid IP address %v", ip)
+	}
+
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		var err error
+		if node, err = db.record(node, addr[i/8]>>(7-i%8)&1); err != nil {
+			return nil, err
+		}
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+
+	v, _, err := decodeMMDB(db.data, int(node-db.nodeCount-16))
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]interface{})
+	return m, nil
+}
+
+// Geo returns the country and autonomous system of ip the databases know
+func Geo(dbs []*GeoDB, ip net.IP) GeoInfo {
+	var info GeoInfo
+	for _, db := range dbs {
+		m, err := db.Lookup(ip)
+		if err != nil || m == nil {
+			continue
+		}
+		for _, key := range []string{"country", "registered_country"} {
+			if c, ok := m[key].(map[string]interface{}); ok && info.Country == "" {
+				info.Country, _ = c["iso_code"].(string)
+			}
+		}
+		if asn, ok := m["autonomous_system_number"].(uint64); ok {
+			info.ASN = asn
+			info.Organization, _ = m["autonomous_system_organization"].(string)
+		}
+	}
+	return info
+}
+
+// decodeMMDB decodes the value of the data section b at off and returns
+// the offset after it
+func decodeMMDB(b []byte, off int) (interface{}, int, error) {
+	if off < 0 || off >= len(b) {
+		return nil, 0, errInvalidGeoDB
+	}
+	ctrl := b[off]
+	off++
+	typ := int(ctrl >> 5)
+
+	// Pointers size themselves, the value pointed to follows the pointer
+	if typ == 1 {
+		n := int(ctrl>>3&3) + 1
+		if off+n > len(b) {
+			return nil, 0, errInvalidGeoDB
+		}
+		var p int
+		switch n {
+		case 1:
+			p = int(ctrl&7)<<8 | int(b[off])
+		case 2:
+			p = (int(ctrl&7)<<16 | int(b[off])<<8 | int(b[off+1])) + 2048
+		case 3:
+			p = (int(ctrl&7)<<24 | int(b[off])<<16 | int(b[off+1])<<8 | int(b[off+2])) + 526336
+		default:
+			p = int(binary.BigEndian.Uint32(b[off:]))
+		}
+		v, _, err := decodeMMDB(b, p)
+		return v, off + n, err
+	}
+
+	if typ == 0 {
+		if off >= len(b) {
+			return nil, 0, errInvalidGeoDB
+		}
+		typ = 7 + int(b[off])
+		off++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > len(b) {
+			return nil, 0, errInvalidGeoDB
+		}
+		var ext int
+		for _, c := range b[off : off+n] {
+			ext = ext<<8 | int(c)
+		}
+		off += n
+		size = []int{29, 285, 65821}[n-1] + ext
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			k, next, err := decodeMMDB(b, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			v, next, err := decodeMMDB(b, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], off = v, next
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			v, next, err := decodeMMDB(b, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, off = append(a, v), next
+		}
+		return a, off, nil
+	case 14: // boolean, the size is the value
+		return size != 0, off, nil
+	}
+
+	if off+size > len(b) {
+		return nil, 0, errInvalidGeoDB
+	}
+	v := b[off : off+size]
+	off += size
+
+	switch typ {
+	case 2: // UTF-8 string
+		return string(v), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errInvalidGeoDB
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(v)), off, nil
+	case 4: // bytes
+		return append([]byte(nil), v...), off, nil
+	case 5, 6, 9: // unsigned integers of up to 2, 4 and 8 bytes
+		var n uint64
+		for _, c := range v {
+			n = n<<8 | uint64(c)
+		}
+		return n, off, nil
+	case 8: // int32
+		var n uint32
+		for _, c := range v {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), off, nil
+	case 10: // uint128, kept as bytes
+		return append([]byte(nil), v...), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errInvalidGeoDB
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(v))), off, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", typ)
+}
@@ -0,0 +1,65 @@
+package portmapping
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// httpClientKey is the context key of the client set by WithHTTPClient
+type httpClientKey struct{}
+
+// WithHTTPClient returns a copy of ctx making the functions it is passed
+// to talk HTTP to devices with hc, for proxies, mTLS, instrumentation or
+// test doubles. It is used for device descriptions and SCPDs and is the
+// SOAP client of the Clients and PinholeClients created with the context.
+// Without it descriptions are fetched with http.DefaultClient and the
+// services of each device share a keep-alive client of their own.
+func WithHTTPClient(ctx context.Context, hc *http.Client) context.Context {
+	return context.WithValue(ctx, httpClientKey{}, hc)
+}
+
+// contextHTTPClient returns the client set by WithHTTPClient, nil if none is
+func contextHTTPClient(ctx context.Context) *http.Client {
+	hc, _ := ctx.Value(httpClientKey{}).(*http.Client)
+	return hc
+}
+
+// httpClient returns the client documents are fetched from devices with
+func httpClient(ctx context.Context) *http.Client {
+	if hc := contextHTTPClient(ctx); hc != nil {
+		return hc
+	}
+	return http.DefaultClient
+}
+
+// soapHTTPClient returns the client the SOAP services of a device found
+// with ctx share
+func soapHTTPClient(ctx context.Context) http.Client {
+	if hc := contextHTTPClient(ctx); hc != nil {
+		return *hc
+	}
+	return newDeviceHTTPClient(nil)
+}
+
+// SetHTTPClient makes the SOAP actions of c use hc
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	c.SOAPClient.HTTPClient = *hc
+}
+
+// NewProxyHTTPClient returns a keep-alive client for WithHTTPClient sending
+// every request through proxy, an http, https, socks5 or socks5h URL. Host
+// names are resolved by the proxy with socks5 just like socks5h. SSDP is
+// UDP multicast and can't be proxied, the locations have to be known or
+// found by an agent.
+func NewProxyHTTPClient(proxy *url.URL) (*http.Client, error) {
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, want http, https, socks5 or socks5h", proxy.Scheme)
+	}
+
+	hc := newDeviceHTTPClient(proxy)
+	return &hc, nil
+}
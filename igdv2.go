@@ -0,0 +1,163 @@
+package portmapping
+
+import (
+	"context"
+	"encoding/xml"
+	"math"
+	"strings"
+
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/huin/goupnp/soap"
+)
+
+// errCodeNoMappingInRange is returned by GetListOfPortMappings when no
+// mapping is in the requested range
+const errCodeNoMappingInRange = 730
+
+type listPortMappingsRequest struct {
+	NewStartPort     string
+	NewEndPort       string
+	NewProtocol      string
+	NewManage        string
+	NewNumberOfPorts string
+}
+
+type listPortMappingsResponse struct {
+	NewPortListing string
+}
+
+type addAnyPortMappingResponse struct {
+	NewReservedPort string
+}
+
+// portMappingList is the XML document carried in NewPortListing
+type portMappingList struct {
+	Entries []struct {
+		NewRemoteHost     string
+		NewExternalPort   string
+		NewProtocol       string
+		NewInternalPort   string
+		NewInternalClient string
+		NewEnabled        string
+		NewDescription    string
+		NewLeaseTime      string
+	} `xml:"PortMappingEntry"`
+}
+
+// IsV2 reports whether the client talks to a WANIPConnection:2 service
+func (c *Client) IsV2() bool {
+	return c.urn == internetgateway2.URN_WANIPConnection_2
+}
+
+// AddAnyPortMapping is like AddPortMapping but lets the device pick another
+// external port when the requested one is taken. It returns the reserved
+// external port and needs a WANIPConnection:2 service.
+func (c *Client) AddAnyPortMapping(ctx context.Context, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) (uint16, error) {
+	if !c.IsV2() {
+		return 0, ErrNotSupported
+	}
+
+	pme, err := newPortMappingEntry(externalPort, protocol, internalPort, internalClient, description, leaseDuration)
+	if err != nil {
+		return 0, err
+	}
+
+	resp := &addAnyPortMappingResponse{}
+	if err := c.performAdd(ctx, "AddAnyPortMapping", pme, resp); err != nil {
+		return 0, err
+	}
+
+	return soap.UnmarshalUi2(resp.NewReservedPort)
+}
+
+// GetListOfPortMappings returns up to number mappings of protocol with
+// external ports in the startPort-endPort range in a single call. It needs a
+// WANIPConnection:2 service.
+func (c *Client) GetListOfPortMappings(ctx context.Context, startPort, endPort uint16, protocol string, number uint16) ([]*PortMappingEntry, error) {
+	if !c.IsV2() {
+		return nil, ErrNotSupported
+	}
+
+	req := &listPortMappingsRequest{NewProtocol: protocol}
+
+	var err error
+	if req.NewStartPort, err = soap.MarshalUi2(startPort); err != nil {
+		return nil, err
+	}
+	if req.NewEndPort, err = soap.MarshalUi2(endPort); err != nil {
+		return nil, err
+	}
+	if req.NewManage, err = soap.MarshalBoolean(false); err != nil {
+		return nil, err
+	}
+	if req.NewNumberOfPorts, err = soap.MarshalUi2(number); err != nil {
+		return nil, err
+	}
+
+	resp := &listPortMappingsResponse{}
+	if err := c.perform(ctx, "GetListOfPortMappings", req, resp); err != nil {
+		return nil, err
+	}
+
+	var list portMappingList
+	if err := xml.NewDecoder(strings.NewReader(resp.NewPortListing)).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*PortMappingEntry, 0, len(list.Entries))
+	for _, e := range list.Entries {
+		entries = append(entries, &PortMappingEntry{
+			NewRemoteHost:             e.NewRemoteHost,
+			NewExternalPort:           e.NewExternalPort,
+			NewProtocol:               e.NewProtocol,
+			NewInternalPort:           e.NewInternalPort,
+			NewInternalClient:         e.NewInternalClient,
+			NewEnabled:                e.NewEnabled,
+			NewPortMappingDescription: e.NewDescription,
+			NewLeaseDuration:          e.NewLeaseTime,
+		})
+	}
+
+	return entries, nil
+}
+
+// listAllV2 reads the whole table with GetListOfPortMappings, a range at a
+// time in case the device truncates the listing
+func (c *Client) listAllV2(ctx context.Context, each func(*PortMappingEntry), fn func(done, total int), total int) ([]*PortMappingEntry, error) {
+	var entries []*PortMappingEntry
+
+	for _, proto := range []string{"TCP", "UDP"} {
+		start := 0
+		for start <= math.MaxUint16 {
+			batch, err := c.GetListOfPortMappings(ctx, uint16(start), math.MaxUint16, proto, 0)
+			if hasFault(err, errCodeNoMappingInRange, "PortMappingNotFound") {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			last := start
+			for _, pme := range batch {
+				if p, err := soap.UnmarshalUi2(pme.NewExternalPort); err == nil && int(p) > last {
+					last = int(p)
+				}
+			}
+			entries = append(entries, batch...)
+			if each != nil {
+				for _, pme := range batch {
+					each(pme)
+				}
+			}
+			if fn != nil {
+				fn(len(entries), total)
+			}
+			start = last + 1
+		}
+	}
+
+	return entries, nil
+}
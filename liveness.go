@@ -0,0 +1,157 @@
+package portmapping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LivenessState tells whether the internal client of a mapping still
+// serves it
+type LivenessState string
+
+const (
+	// LivenessListening is a client accepting connections or answering
+	// datagrams on the internal port
+	LivenessListening LivenessState = "listening"
+	// LivenessClosed is a client rejecting the internal port
+	LivenessClosed LivenessState = "closed"
+	// LivenessUp is a client that is present but whose port is filtered
+	// or silent
+	LivenessUp LivenessState = "up"
+	// LivenessGone is a client of a local network that doesn't answer
+	// ARP anymore
+	LivenessGone LivenessState = "gone"
+	// LivenessUnknown is a client that can't be checked from this host
+	LivenessUnknown LivenessState = "unknown"
+)
+
+// Liveness is the result of probing the internal client of a mapping
+type Liveness struct {
+	State  LivenessState `json:"state"`
+	Detail string        `json:"detail,omitempty"`
+}
+
+// Stale reports whether the mapping points at a host that no longer exists
+// or no longer listens on the internal port
+func (l Liveness) Stale() bool {
+	return l.State == LivenessClosed || l.State == LivenessGone
+}
+
+// CheckLiveness probes the internal client of pme. TCP ports are connected
+// to; UDP ports of other hosts get an empty datagram, which a closed port
+// answers with ICMP port unreachable. A client that stays silent is looked
+// up in the ARP cache if it is on a local network. Only this host can tell
+// whether its own UDP port is bound.
+func CheckLiveness(ctx context.Context, pme *PortMappingEntry, timeout time.Duration) Liveness {
+	ip := net.ParseIP(strings.TrimSpace(pme.NewInternalClient))
+	if ip == nil {
+		return Liveness{State: LivenessUnknown, Detail: "internal client is not an IP address"}
+	}
+	port, err := strconv.ParseUint(pme.NewInternalPort, 10, 16)
+	if err != nil {
+		return Liveness{State: LivenessUnknown, Detail: fmt.Sprintf("invalid internal port %q", pme.NewInternalPort)}
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	local, onLink := localNetwork(ip)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch strings.ToUpper(pme.NewProtocol) {
+	case "TCP":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+			return Liveness{State: LivenessListening}
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return Liveness{State: LivenessClosed, Detail: "connection refused"}
+		}
+	case "UDP":
+		if local {
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				return Liveness{State: LivenessListening, Detail: "port is bound on this host"}
+			}
+			conn.Close()
+			return Liveness{State: LivenessClosed, Detail: "nothing is bound to the port on this host"}
+		}
+		if state, ok := probeUDP(ctx, addr); ok {
+			return state
+		}
+	default:
+		return Liveness{State: LivenessUnknown, Detail: fmt.Sprintf("unknown protocol %q", pme.NewProtocol)}
+	}
+
+	switch {
+	case local:
+		return Liveness{State: LivenessUp, Detail: "port of this host is filtered"}
+	case !onLink:
+		return Liveness{State: LivenessUnknown, Detail: "no answer and the client is not on a local network"}
+	}
+
+	_, err = NeighborMAC(ip)
+	switch {
+	case err == nil:
+		return Liveness{State: LivenessUp, Detail: "host answers ARP but the port is filtered or silent"}
+	case errors.Is(err, ErrNoNeighbor):
+		return Liveness{State: LivenessGone, Detail: "no answer and no ARP entry"}
+	}
+	return Liveness{State: LivenessUnknown, Detail: err.Error()}
+}
+
+// probeUDP sends an empty datagram to addr, ok is false if nothing came back
+func probeUDP(ctx context.Context, addr string) (Liveness, bool) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return Liveness{}, false
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(nil); err != nil {
+		return Liveness{}, false
+	}
+
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	switch {
+	case err == nil:
+		return Liveness{State: LivenessListening, Detail: "port answered"}, true
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return Liveness{State: LivenessClosed, Detail: "port unreachable"}, true
+	}
+	return Liveness{}, false
+}
+
+// localNetwork reports whether ip is an address of this host and whether it
+// is on one of its networks
+func localNetwork(ip net.IP) (local, onLink bool) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, false
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.Equal(ip) {
+			return true, true
+		}
+		if ipnet.Contains(ip) {
+			onLink = true
+		}
+	}
+	return false, onLink
+}
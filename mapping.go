@@ -0,0 +1,354 @@
+package portmapping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// urnControl is the namespace of the UPnP control actions every service has
+const urnControl = "urn:schemas-upnp-org:control-1-0"
+
+const (
+	// errCodeArrayIndexInvalid is the UPnP error returned past the last entry
+	errCodeArrayIndexInvalid = 713
+	// errCodeNoSuchEntry is the UPnP error returned for an unknown mapping
+	errCodeNoSuchEntry = 714
+)
+
+// ErrNoSuchEntry is returned when the requested mapping does not exist
+var ErrNoSuchEntry = errors.New("no such port mapping entry")
+
+// PortMappingEntry represents a NAT port mapping entry
+type PortMappingEntry struct {
+	NewRemoteHost             string `json:"remote_host"`
+	NewExternalPort           string `json:"external_port"`
+	NewProtocol               string `json:"protocol"`
+	NewInternalPort           string `json:"internal_port"`
+	NewInternalClient         string `json:"internal_client"`
+	NewEnabled                string `json:"enabled"`
+	NewPortMappingDescription string `json:"description"`
+	NewLeaseDuration          string `json:"lease_duration"`
+}
+
+type portMappingRequest struct {
+	NewPortMappingIndex string
+}
+
+type specificPortMappingRequest struct {
+	NewRemoteHost   string
+	NewExternalPort string
+	NewProtocol     string
+}
+
+type externalIPResponse struct {
+	NewExternalIPAddress string
+}
+
+// queryStateVariableRequest uses the deprecated UPnP control action to read
+// a state variable that has no getter action
+type queryStateVariableRequest struct {
+	VarName string `soap:"varName"`
+}
+
+type queryStateVariableResponse struct {
+	Return string `xml:"return"`
+}
+
+type deletePortMappingRequest struct {
+	NewRemoteHost   string
+	NewExternalPort string
+	NewProtocol     string
+}
+
+// MappingList is the result of enumerating one PortMapper
+type MappingList struct {
+	Mapper   PortMapper
+	Mappings []*PortMappingEntry
+	Err      error
+}
+
+// ListAllMappings enumerates the mappings of every mapper concurrently, at
+// most workers at a time. The results are in the order of mappers.
+func ListAllMappings(ctx context.Context, mappers []PortMapper, workers int) []*MappingList {
+	return ListAllMappingsProgress(ctx, mappers, workers, nil)
+}
+
+// ListAllMappingsProgress is ListAllMappings calling fn with the index of
+// the mapper as the entries of UPnP services are read, like
+// ListMappingsProgress does. fn is called from the listing goroutines.
+func ListAllMappingsProgress(ctx context.Context, mappers []PortMapper, workers int, fn func(i, done, total int)) []*MappingList {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	lists := make([]*MappingList, len(mappers))
+	sem := make(chan struct{}, workers)
+
+	var wg sync.WaitGroup
+	for i, m := range mappers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, m PortMapper) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			var (
+				entries []*PortMappingEntry
+				err     error
+			)
+			if c, ok := m.(*Client); ok && fn != nil {
+				entries, err = c.ListMappingsProgress(ctx, func(done, total int) { fn(i, done, total) })
+			} else {
+				entries, err = m.ListMappings(ctx)
+			}
+			lists[i] = &MappingList{Mapper: m, Mappings: entries, Err: err}
+		}(i, m)
+	}
+	wg.Wait()
+
+	return lists
+}
+
+// ExternalIP returns the external address of the WAN connection
+func (c *Client) ExternalIP(ctx context.Context) (net.IP, error) {
+	resp := &externalIPResponse{}
+	if err := c.perform(ctx, "GetExternalIPAddress", nil, resp); err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(resp.NewExternalIPAddress))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid external IP address %q", resp.NewExternalIPAddress)
+	}
+
+	return ip, nil
+}
+
+// CountMappings returns the PortMappingNumberOfEntries state variable.
+// Devices without QueryStateVariable support return an error.
+func (c *Client) CountMappings(ctx context.Context) (uint16, error) {
+	req := &queryStateVariableRequest{VarName: varNumberOfEntries}
+	resp := &queryStateVariableResponse{}
+	if err := c.performURN(ctx, urnControl, "QueryStateVariable", req, resp); err != nil {
+		return 0, err
+	}
+
+	return soap.UnmarshalUi2(strings.TrimSpace(resp.Return))
+}
+
+// ListMappings returns the port mapping entries of the service. Enumeration
+// stops when the device reports there are no more entries.
+func (c *Client) ListMappings(ctx context.Context) ([]*PortMappingEntry, error) {
+	return c.ListMappingsProgress(ctx, nil)
+}
+
+// ListMappingsProgress is ListMappings calling fn as entries are read with
+// the number read so far and the total, or -1 when the device can't tell.
+// The total is only for progress, devices miscounting their table are still
+// read to the end. WANIPConnection:2 services are listed with GetListOfPortMappings,
+// falling back to one call per entry if that fails.
+func (c *Client) ListMappingsProgress(ctx context.Context, fn func(done, total int)) ([]*PortMappingEntry, error) {
+	return c.ListMappingsStream(ctx, nil, fn)
+}
+
+// ListMappingsStream is ListMappingsProgress also calling each with every
+// entry as soon as it is read. Entries read before GetListOfPortMappings
+// failed aren't passed again by the fallback.
+func (c *Client) ListMappingsStream(ctx context.Context, each func(*PortMappingEntry), fn func(done, total int)) ([]*PortMappingEntry, error) {
+	total := -1
+	if n, err := c.CountMappings(ctx); err == nil {
+		total = int(n)
+	}
+
+	// seen are the entries passed to each by a failed listAllV2
+	var seen map[string]bool
+	if c.IsV2() {
+		var streamed []*PortMappingEntry
+		v2each := each
+		if each != nil {
+			v2each = func(pme *PortMappingEntry) {
+				streamed = append(streamed, pme)
+				each(pme)
+			}
+		}
+
+		// Fetch the table in a few calls when the device can, else walk it
+		entries, err := c.listAllV2(ctx, v2each, fn, total)
+		if err == nil || ctx.Err() != nil {
+			return entries, err
+		}
+		for _, pme := range streamed {
+			if seen == nil {
+				seen = make(map[string]bool)
+			}
+			seen[pme.Key()] = true
+		}
+	}
+
+	entries := make([]*PortMappingEntry, 0, max(total, 0))
+	for i := 0; i <= math.MaxUint16; i++ {
+		pme, err := c.mappingByIdx(ctx, uint16(i))
+		if isArrayIndexInvalid(err) {
+			break
+		}
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, pme)
+		if each != nil && !seen[pme.Key()] {
+			each(pme)
+		}
+		// The device undercounted, the total left is unknown
+		if total >= 0 && len(entries) > total {
+			total = -1
+		}
+		if fn != nil {
+			fn(len(entries), total)
+		}
+	}
+
+	return entries, nil
+}
+
+func (c *Client) mappingByIdx(ctx context.Context, index uint16) (*PortMappingEntry, error) {
+	var (
+		si  string
+		err error
+	)
+
+	if si, err = soap.MarshalUi2(index); err != nil {
+		return nil, err
+	}
+
+	pmr := &portMappingRequest{si}
+
+	pme := &PortMappingEntry{}
+	if err := c.perform(ctx, "GetGenericPortMappingEntry", pmr, pme); err != nil {
+		return nil, err
+	}
+
+	return pme, nil
+}
+
+// AddPortMapping forwards externalPort/protocol to internalClient:internalPort.
+// A zero leaseDuration requests a permanent mapping, which is also used when
+// the device rejects a finite lease.
+func (c *Client) AddPortMapping(ctx context.Context, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) error {
+	pme, err := newPortMappingEntry(externalPort, protocol, internalPort, internalClient, description, leaseDuration)
+	if err != nil {
+		return err
+	}
+
+	return c.performAdd(ctx, "AddPortMapping", pme, nil)
+}
+
+// AddPortMappingEntry adds the mapping of pme as it is, like one limited to
+// a remote host or disabled, which AddPortMapping can't add
+func (c *Client) AddPortMappingEntry(ctx context.Context, pme *PortMappingEntry) error {
+	add := *pme
+	return c.performAdd(ctx, "AddPortMapping", &add, nil)
+}
+
+// performAdd runs an add action, retrying with a permanent lease on devices
+// that only support those
+func (c *Client) performAdd(ctx context.Context, action string, pme *PortMappingEntry, out interface{}) error {
+	err := c.perform(ctx, action, pme, out)
+	if !errors.Is(err, ErrOnlyPermanentLeases) || pme.NewLeaseDuration == "0" {
+		return err
+	}
+
+	slog.Warn("device only supports permanent leases, retrying without a lease", "device", c.String(), "action", action, "lease", pme.NewLeaseDuration)
+	pme.NewLeaseDuration = "0"
+	return c.perform(ctx, action, pme, out)
+}
+
+// newPortMappingEntry returns an enabled wildcard entry in SOAP form
+func newPortMappingEntry(externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) (*PortMappingEntry, error) {
+	pme := &PortMappingEntry{
+		NewProtocol:               protocol,
+		NewInternalClient:         internalClient,
+		NewPortMappingDescription: description,
+	}
+
+	var err error
+	if pme.NewExternalPort, err = soap.MarshalUi2(externalPort); err != nil {
+		return nil, err
+	}
+	if pme.NewInternalPort, err = soap.MarshalUi2(internalPort); err != nil {
+		return nil, err
+	}
+	if pme.NewEnabled, err = soap.MarshalBoolean(true); err != nil {
+		return nil, err
+	}
+	if pme.NewLeaseDuration, err = soap.MarshalUi4(leaseDuration); err != nil {
+		return nil, err
+	}
+
+	return pme, nil
+}
+
+// DeletePortMapping removes the mapping of externalPort/protocol. An empty
+// remoteHost matches the wildcard mapping.
+func (c *Client) DeletePortMapping(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error {
+	ep, err := soap.MarshalUi2(externalPort)
+	if err != nil {
+		return err
+	}
+
+	dpr := &deletePortMappingRequest{remoteHost, ep, protocol}
+
+	return c.perform(ctx, "DeletePortMapping", dpr, nil)
+}
+
+// GetSpecificPortMappingEntry returns the mapping of externalPort/protocol,
+// or ErrNoSuchEntry if there is none
+func (c *Client) GetSpecificPortMappingEntry(ctx context.Context, remoteHost string, externalPort uint16, protocol string) (*PortMappingEntry, error) {
+	ep, err := soap.MarshalUi2(externalPort)
+	if err != nil {
+		return nil, err
+	}
+
+	spr := &specificPortMappingRequest{remoteHost, ep, protocol}
+
+	pme := &PortMappingEntry{}
+	if err := c.perform(ctx, "GetSpecificPortMappingEntry", spr, pme); err != nil {
+		if hasFault(err, errCodeNoSuchEntry, "NoSuchEntryInArray") {
+			return nil, ErrNoSuchEntry
+		}
+		return nil, err
+	}
+
+	pme.NewRemoteHost = remoteHost
+	pme.NewExternalPort = ep
+	pme.NewProtocol = protocol
+
+	return pme, nil
+}
+
+// isArrayIndexInvalid reports whether err is the SpecifiedArrayIndexInvalid
+// fault signalling the end of the mapping table
+func isArrayIndexInvalid(err error) bool {
+	return hasFault(err, errCodeArrayIndexInvalid, "SpecifiedArrayIndexInvalid")
+}
+
+// hasFault reports whether err is a UPnP fault with code or description
+func hasFault(err error, code int, description string) bool {
+	var fault *soap.SOAPFaultError
+	if !errors.As(err, &fault) {
+		return false
+	}
+
+	return fault.Detail.UPnPError.Errorcode == code ||
+		strings.Contains(fault.Detail.UPnPError.ErrorDescription, description)
+}
@@ -0,0 +1,88 @@
+package portmapping
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// cgnatRange is the shared address space of RFC 6598 carrier-grade NATs
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// NATKind tells what an external address says about the network in front
+// of the gateway
+type NATKind string
+
+const (
+	// NATNone is a public external address, mappings can be reached
+	NATNone NATKind = ""
+	// NATCarrierGrade is an address of the RFC 6598 shared space, the ISP
+	// runs a NAT in front of the gateway
+	NATCarrierGrade NATKind = "cgnat"
+	// NATDouble is a private address, another router is in front of the
+	// gateway
+	NATDouble NATKind = "double-nat"
+)
+
+// ClassifyExternalIP returns the NAT in front of a gateway with the
+// external address ip. Mappings on a gateway behind another NAT are not
+// reachable from the internet.
+func ClassifyExternalIP(ip net.IP) NATKind {
+	switch {
+	case ip == nil:
+		return NATNone
+	case cgnatRange.Contains(ip):
+		return NATCarrierGrade
+	case ip.IsPrivate(), ip.IsLinkLocalUnicast():
+		return NATDouble
+	}
+	return NATNone
+}
+
+// UpstreamCandidates returns the addresses a router in front of a gateway
+// with the private external address ip usually has, the first and last
+// host of its /24
+func UpstreamCandidates(ip net.IP) []net.IP {
+	v4 := ip.To4()
+	if v4 == nil {
+		return nil
+	}
+
+	var candidates []net.IP
+	for _, last := range []byte{1, 254} {
+		c := net.IPv4(v4[0], v4[1], v4[2], last).To4()
+		if !c.Equal(v4) {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
+
+// DiscoverUpstream looks for port mapping services in front of a gateway
+// with the external address external. The candidates of UpstreamCandidates
+// are probed through the gateway like Detect does; the ones answering are
+// returned in candidate order.
+func DiscoverUpstream(ctx context.Context, external net.IP, port string, opts *SearchOptions) []PortMapper {
+	candidates := UpstreamCandidates(external)
+	found := make([]PortMapper, len(candidates))
+
+	var wg sync.WaitGroup
+	for i, c := range candidates {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			if m, err := Detect(ctx, host, port, opts); err == nil {
+				found[i] = m
+			}
+		}(i, c.String())
+	}
+	wg.Wait()
+
+	var mappers []PortMapper
+	for _, m := range found {
+		if m != nil {
+			mappers = append(mappers, m)
+		}
+	}
+	return mappers
+}
@@ -0,0 +1,227 @@
+package portmapping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	natpmpPort         = "5351"
+	natpmpVersion      = 0
+	natpmpOpExternal   = 0
+	natpmpOpMapUDP     = 1
+	natpmpOpMapTCP     = 2
+	natpmpTries        = 4
+	natpmpInitialWait  = 250 * time.Millisecond
+	natpmpDefaultLease = 7200
+)
+
+// ErrNotSupported is returned by backends lacking the requested operation
+var ErrNotSupported = errors.New("operation is not supported by the protocol")
+
+var natpmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized/refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// NATPMPClient talks to a NAT-PMP (RFC 6886) gateway. Mappings are always
+// created for the host running the client.
+type NATPMPClient struct {
+	gateway string
+	ports   pmpPorts
+}
+
+// pmpPorts remembers the internal ports of the mappings a NAT-PMP or PCP
+// client added, both protocols delete a mapping by its internal port
+type pmpPorts struct {
+	mu       sync.Mutex
+	internal map[string]uint16
+}
+
+func pmpPortKey(protocol string, externalPort uint16) string {
+	return fmt.Sprintf("%s/%d", strings.ToUpper(protocol), externalPort)
+}
+
+func (p *pmpPorts) add(protocol string, externalPort, internalPort uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.internal == nil {
+		p.internal = make(map[string]uint16)
+	}
+	p.internal[pmpPortKey(protocol, externalPort)] = internalPort
+}
+
+// remove forgets the mapping of externalPort and returns its internal port.
+// Mappings added by another client are assumed to map the same port.
+func (p *pmpPorts) remove(protocol string, externalPort uint16) uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := pmpPortKey(protocol, externalPort)
+	if internal, ok := p.internal[key]; ok {
+		delete(p.internal, key)
+		return internal
+	}
+	return externalPort
+}
+
+// NewNATPMPClient returns a NAT-PMP client for the gateway address
+func NewNATPMPClient(gateway string) *NATPMPClient {
+	return &NATPMPClient{gateway: gateway}
+}
+
+// String returns a short gateway summary
+func (c *NATPMPClient) String() string {
+	return c.gateway + " :: NAT-PMP"
+}
+
+// ExternalIP returns the external address of the gateway
+func (c *NATPMPClient) ExternalIP(ctx context.Context) (net.IP, error) {
+	resp, err := c.request(ctx, []byte{natpmpVersion, natpmpOpExternal}, 12)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// ListMappings is not available in NAT-PMP
+func (c *NATPMPClient) ListMappings(ctx context.Context) ([]*PortMappingEntry, error) {
+	return nil, ErrNotSupported
+}
+
+// GetSpecificPortMappingEntry is not available in NAT-PMP
+func (c *NATPMPClient) GetSpecificPortMappingEntry(ctx context.Context, remoteHost string, externalPort uint16, protocol string) (*PortMappingEntry, error) {
+	return nil, ErrNotSupported
+}
+
+// AddPortMapping maps externalPort/protocol to internalPort of this host.
+// internalClient and description are not transmitted by NAT-PMP. A zero
+// leaseDuration requests the recommended lease of two hours.
+func (c *NATPMPClient) AddPortMapping(ctx context.Context, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) error {
+	if leaseDuration == 0 {
+		leaseDuration = natpmpDefaultLease
+	}
+
+	assigned, err := c.mapPort(ctx, protocol, internalPort, externalPort, leaseDuration)
+	if err != nil {
+		return err
+	}
+	c.ports.add(protocol, assigned, internalPort)
+	return nil
+}
+
+// DeletePortMapping removes the mapping of this host for externalPort.
+// NAT-PMP identifies mappings by their internal port, the one of the
+// mapping added by this client, or externalPort for mappings it didn't add.
+func (c *NATPMPClient) DeletePortMapping(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error {
+	_, err := c.mapPort(ctx, protocol, c.ports.remove(protocol, externalPort), 0, 0)
+	return err
+}
+
+// mapPort returns the external port assigned by the gateway
+func (c *NATPMPClient) mapPort(ctx context.Context, protocol string, internalPort, externalPort uint16, lifetime uint32) (uint16, error) {
+	var op byte
+	switch strings.ToUpper(protocol) {
+	case "UDP":
+		op = natpmpOpMapUDP
+	case "TCP":
+		op = natpmpOpMapTCP
+	default:
+		return 0, fmt.Errorf("natpmp: unknown protocol %q", protocol)
+	}
+
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], internalPort)
+	binary.BigEndian.PutUint16(req[6:], externalPort)
+	binary.BigEndian.PutUint32(req[8:], lifetime)
+
+	resp, err := c.request(ctx, req, 16)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint16(resp[10:]), nil
+}
+
+// request sends req to the gateway, retrying with a doubling timeout, and
+// returns a validated response of at least size bytes
+func (c *NATPMPClient) request(ctx context.Context, req []byte, size int) ([]byte, error) {
+	if c.gateway == "" {
+		return nil, errors.New("natpmp: gateway address is required")
+	}
+
+	resp, err := udpExchange(ctx, net.JoinHostPort(c.gateway, natpmpPort), req, 16, func(resp []byte) bool {
+		return len(resp) >= size && resp[0] == natpmpVersion && resp[1] == req[1]|0x80
+	})
+	if err != nil {
+		return nil, fmt.Errorf("natpmp: %w", err)
+	}
+
+	if code := binary.BigEndian.Uint16(resp[2:]); code != 0 {
+		if msg, ok := natpmpResults[code]; ok {
+			return nil, fmt.Errorf("natpmp: %s", msg)
+		}
+		return nil, fmt.Errorf("natpmp: result code %d", code)
+	}
+
+	return resp, nil
+}
+
+// errNoResponse is returned when a UDP gateway never answers
+var errNoResponse = errors.New("no response from gateway")
+
+// udpExchange sends req to addr, retrying with a doubling timeout, until a
+// response read into a buffer of size bytes passes accept
+func udpExchange(ctx context.Context, addr string, req []byte, size int, accept func([]byte) bool) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, size)
+	wait := natpmpInitialWait
+	for i := 0; i < natpmpTries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(wait)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		wait *= 2
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				continue
+			}
+			return nil, err
+		}
+
+		if accept(buf[:n]) {
+			return buf[:n], nil
+		}
+	}
+
+	return nil, errNoResponse
+}
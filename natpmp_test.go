@@ -0,0 +1,160 @@
+package portmapping
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+)
+
+// pmpServer serves NAT-PMP and PCP on 127.0.0.1 with answer, which returns
+// the response to a request or nil to ignore it. The requests are recorded
+// in order.
+type pmpServer struct {
+	mu       sync.Mutex
+	requests [][]byte
+}
+
+func newPMPServer(t *testing.T, answer func(req []byte) []byte) *pmpServer {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", natpmpPort))
+	if err != nil {
+		t.Skipf("can't serve NAT-PMP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	s := &pmpServer{}
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := append([]byte(nil), buf[:n]...)
+			s.mu.Lock()
+			s.requests = append(s.requests, req)
+			s.mu.Unlock()
+			if resp := answer(req); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return s
+}
+
+func (s *pmpServer) received() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// natpmpAnswer answers like a NAT-PMP gateway with result code, mapping
+// requests to external port 40000
+func natpmpAnswer(code uint16) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		if req[0] != natpmpVersion {
+			return []byte{natpmpVersion, req[1] | 0x80, 0, 1}
+		}
+		resp := make([]byte, 16)
+		resp[1] = req[1] | 0x80
+		binary.BigEndian.PutUint16(resp[2:], code)
+		binary.BigEndian.PutUint32(resp[4:], 1234)
+		if req[1] == natpmpOpExternal {
+			copy(resp[8:], []byte{203, 0, 113, 7})
+			return resp[:12]
+		}
+		copy(resp[8:10], req[4:6])
+		binary.BigEndian.PutUint16(resp[10:], 40000)
+		copy(resp[12:], req[8:12])
+		return resp
+	}
+}
+
+func TestNATPMPExternalIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    uint16
+		want    string
+		wantErr string
+	}{
+		{"address", 0, "203.0.113.7", ""},
+		{"refused", 2, "", "natpmp: not authorized/refused"},
+		{"unknown result", 42, "", "natpmp: result code 42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newPMPServer(t, natpmpAnswer(tt.code))
+
+			ip, err := NewNATPMPClient("127.0.0.1").ExternalIP(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip.String() != tt.want {
+				t.Errorf("got %s, want %s", ip, tt.want)
+			}
+			if reqs := s.received(); len(reqs) != 1 || string(reqs[0]) != "\x00\x00" {
+				t.Errorf("got requests %x, want 0000", reqs)
+			}
+		})
+	}
+}
+
+func TestNATPMPMapping(t *testing.T) {
+	tests := []struct {
+		proto    string
+		lease    uint32
+		wantOp   byte
+		wantTime uint32
+	}{
+		{"TCP", 3600, natpmpOpMapTCP, 3600},
+		{"udp", 0, natpmpOpMapUDP, natpmpDefaultLease},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			s := newPMPServer(t, natpmpAnswer(0))
+			c := NewNATPMPClient("127.0.0.1")
+			ctx := context.Background()
+
+			if err := c.AddPortMapping(ctx, 8080, tt.proto, 80, "192.168.1.10", "web", tt.lease); err != nil {
+				t.Fatal(err)
+			}
+			// The gateway assigned 40000, deleting it sends internal port 80
+			if err := c.DeletePortMapping(ctx, "", 40000, tt.proto); err != nil {
+				t.Fatal(err)
+			}
+
+			reqs := s.received()
+			if len(reqs) != 2 {
+				t.Fatalf("got %d requests, want 2", len(reqs))
+			}
+			for i, want := range []struct {
+				internal, external uint16
+				lifetime           uint32
+			}{{80, 8080, tt.wantTime}, {80, 0, 0}} {
+				req := reqs[i]
+				if len(req) != 12 || req[0] != natpmpVersion || req[1] != tt.wantOp {
+					t.Fatalf("request %d is %x, want a 12 byte op %d request", i, req, tt.wantOp)
+				}
+				internal, external := binary.BigEndian.Uint16(req[4:]), binary.BigEndian.Uint16(req[6:])
+				lifetime := binary.BigEndian.Uint32(req[8:])
+				if internal != want.internal || external != want.external || lifetime != want.lifetime {
+					t.Errorf("request %d maps %d to %d for %ds, want %d to %d for %ds", i, external, internal, lifetime, want.external, want.internal, want.lifetime)
+				}
+			}
+		})
+	}
+}
+
+func TestNATPMPUnknownProtocol(t *testing.T) {
+	err := NewNATPMPClient("127.0.0.1").AddPortMapping(context.Background(), 80, "SCTP", 80, "", "", 0)
+	if err == nil || err.Error() != `natpmp: unknown protocol "SCTP"` {
+		t.Errorf("got %v, want the protocol rejected", err)
+	}
+}
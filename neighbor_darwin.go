@@ -0,0 +1,47 @@
+package portmapping
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// NeighborMAC returns the hardware address of ip as reported by arp(8)
+func NeighborMAC(ip net.IP) (net.HardwareAddr, error) {
+	out, err := exec.Command("arp", "-n", ip.String()).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// arp(8) fails for hosts without an entry
+		return nil, ErrNoNeighbor
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// ? (192.168.1.1) at 0:11:22:33:44:55 on en0 ifscope [ethernet]
+	fields := strings.Fields(string(out))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] != "at" {
+			continue
+		}
+		mac, err := net.ParseMAC(padMAC(fields[i+1]))
+		if err != nil {
+			return nil, ErrNoNeighbor
+		}
+		return mac, nil
+	}
+
+	return nil, ErrNoNeighbor
+}
+
+// padMAC restores the leading zeros arp(8) leaves out of each octet
+func padMAC(s string) string {
+	octets := strings.Split(s, ":")
+	for i, o := range octets {
+		if len(o) == 1 {
+			octets[i] = "0" + o
+		}
+	}
+	return strings.Join(octets, ":")
+}
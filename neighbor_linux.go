@@ -0,0 +1,40 @@
+package portmapping
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+// NeighborMAC returns the hardware address of ip from the ARP cache
+func NeighborMAC(ip net.IP) (net.HardwareAddr, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// IP address, HW type, Flags, HW address, Mask, Device
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !ip.Equal(net.ParseIP(fields[0])) {
+			continue
+		}
+		// Incomplete entries stay around for hosts that didn't answer
+		if fields[2] == "0x0" {
+			break
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		return mac, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, ErrNoNeighbor
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package portmapping
+
+import "net"
+
+// NeighborMAC is not implemented on this platform
+func NeighborMAC(ip net.IP) (net.HardwareAddr, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,153 @@
+package portmapping
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notifyGroups are the SSDP groups devices multicast their NOTIFY
+// announcements to
+var notifyGroups = []struct{ network, addr string }{
+	{"udp4", ssdpMulticast + ":1900"},
+	{"udp6", "[ff02::c]:1900"},
+}
+
+// NotifyKind is the NTS of a NOTIFY announcement without the ssdp: prefix
+type NotifyKind string
+
+const (
+	// NotifyAlive announces a device joining the network or renewing
+	// its advertisement
+	NotifyAlive NotifyKind = "alive"
+	// NotifyByeBye announces a device leaving the network
+	NotifyByeBye NotifyKind = "byebye"
+	// NotifyUpdate announces a new BOOTID of a UPnP 1.1 device
+	NotifyUpdate NotifyKind = "update"
+)
+
+// Notification is an SSDP NOTIFY announcement a device multicasts
+// unsolicited
+type Notification struct {
+	Time     time.Time  `json:"time"`
+	From     net.IP     `json:"from"`
+	Kind     NotifyKind `json:"kind"`
+	NT       string     `json:"nt"`
+	USN      string     `json:"usn"`
+	Location string     `json:"location,omitempty"`
+	Server   string     `json:"server,omitempty"`
+	// MaxAge is how long an alive announcement is valid
+	MaxAge time.Duration `json:"max_age,omitempty"`
+	BootID string        `json:"boot_id,omitempty"`
+}
+
+// UDN returns the unique device name the USN starts with
+func (n Notification) UDN() string {
+	udn, _, _ := strings.Cut(n.USN, "::")
+	return udn
+}
+
+// ListenNotify joins the SSDP multicast groups and calls fn with every
+// NOTIFY announcement until ctx is done. Nothing is sent, so devices are
+// only seen when they announce themselves, usually every few minutes.
+func ListenNotify(ctx context.Context, fn func(Notification)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var conns []*net.UDPConn
+	for _, g := range notifyGroups {
+		addr, err := net.ResolveUDPAddr(g.network, g.addr)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenMulticastUDP(g.network, nil, addr)
+		if err != nil {
+			slog.Debug("joining SSDP group", "group", g.addr, "err", err)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return errors.New("can't join any SSDP multicast group")
+	}
+
+	go func() {
+		<-ctx.Done()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	notes := make(chan Notification)
+	errc := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn *net.UDPConn) {
+			buf := make([]byte, 2048)
+			for {
+				n, src, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					errc <- err
+					return
+				}
+
+				note, ok := parseNotify(buf[:n])
+				if !ok {
+					continue
+				}
+				note.Time, note.From = time.Now(), src.IP
+				select {
+				case notes <- note:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(conn)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		case note := <-notes:
+			slog.Debug("ssdp: notify", "from", note.From, "kind", note.Kind, "usn", note.USN)
+			fn(note)
+		}
+	}
+}
+
+// parseNotify decodes a NOTIFY request, M-SEARCH requests of other hosts
+// share the groups and are ignored
+func parseNotify(b []byte) (Notification, bool) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil || req.Method != "NOTIFY" {
+		return Notification{}, false
+	}
+
+	kind, ok := strings.CutPrefix(req.Header.Get("NTS"), "ssdp:")
+	if !ok {
+		return Notification{}, false
+	}
+	note := Notification{
+		Kind:     NotifyKind(kind),
+		NT:       req.Header.Get("NT"),
+		USN:      req.Header.Get("USN"),
+		Location: req.Header.Get("Location"),
+		Server:   req.Header.Get("Server"),
+		BootID:   req.Header.Get("BOOTID.UPNP.ORG"),
+	}
+
+	note.MaxAge = maxAge(req.Header.Get("Cache-Control"))
+
+	return note, true
+}
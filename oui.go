@@ -0,0 +1,133 @@
+package portmapping
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// OUI maps the organizationally unique identifiers of hardware addresses,
+// their first three octets in upper case hex like "00000C", to vendors
+type OUI map[string]string
+
+// DefaultOUI is a handful of vendors common on home and office networks.
+// ParseOUI reads the full IEEE registry.
+var DefaultOUI = OUI{
+	"00000C": "Cisco",
+	"000393": "Apple",
+	"000A95": "Apple",
+	"001B63": "Apple",
+	"0050F2": "Microsoft",
+	"00155D": "Microsoft Hyper-V",
+	"005056": "VMware",
+	"000C29": "VMware",
+	"000569": "VMware",
+	"080027": "VirtualBox",
+	"525400": "QEMU",
+	"B827EB": "Raspberry Pi",
+	"DCA632": "Raspberry Pi",
+	"E45F01": "Raspberry Pi",
+	"001A11": "Google",
+	"F4F5D8": "Google",
+	"18B430": "Nest Labs",
+	"001788": "Philips Hue",
+	"000D4B": "Roku",
+	"000E58": "Sonos",
+	"5CAAFD": "Sonos",
+	"44650D": "Amazon",
+	"FC65DE": "Amazon",
+	"001132": "Synology",
+	"245EBE": "QNAP",
+	"0090A9": "Western Digital",
+	"00040E": "AVM",
+	"001F33": "Netgear",
+	"00095B": "Netgear",
+	"00146C": "Netgear",
+	"50C7BF": "TP-Link",
+	"000F66": "Linksys",
+	"001CDF": "Belkin",
+	"00E04C": "Realtek",
+	"001B21": "Intel",
+	"001422": "Dell",
+	"002590": "Supermicro",
+	"000B82": "Grandstream",
+	"0004F2": "Polycom",
+	"008077": "Brother",
+	"000048": "Epson",
+	"0018DD": "SiliconDust",
+	"240AC4": "Espressif",
+	"30AEA4": "Espressif",
+	"5CCF7F": "Espressif",
+	"CC50E3": "Espressif",
+}
+
+// Vendor returns the vendor of mac, "locally administered" for the
+// random addresses of phones and most containers, or "" if it is unknown
+func (o OUI) Vendor(mac net.HardwareAddr) string {
+	if len(mac) < 3 {
+		return ""
+	}
+	if v, ok := o[hexOctets(mac[:3])]; ok {
+		return v
+	}
+	if mac[0]&0x02 != 0 {
+		return "locally administered"
+	}
+	return ""
+}
+
+// hexOctets returns b in hex without separators
+func hexOctets(b []byte) string {
+	const digits = "0123456789ABCDEF"
+	s := make([]byte, 0, 2*len(b))
+	for _, c := range b {
+		s = append(s, digits[c>>4], digits[c&0xf])
+	}
+	return string(s)
+}
+
+// ParseOUI reads the IEEE MA-L registry, oui.txt, or the manuf file of
+// Wireshark. Longer prefixes of the manuf file are skipped.
+func ParseOUI(r io.Reader) (OUI, error) {
+	o := make(OUI)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// 00-00-0C   (hex)		Cisco Systems, Inc
+		if prefix, vendor, ok := strings.Cut(line, "(hex)"); ok {
+			if id := strings.ReplaceAll(strings.TrimSpace(prefix), "-", ""); len(id) == 6 {
+				o[strings.ToUpper(id)] = strings.TrimSpace(vendor)
+			}
+			continue
+		}
+
+		// 00:00:0C	Cisco	Cisco Systems, Inc
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || strings.Contains(fields[0], "/") {
+			continue
+		}
+		id := strings.NewReplacer(":", "", "-", "").Replace(strings.TrimSpace(fields[0]))
+		if len(id) != 6 {
+			continue
+		}
+		vendor := fields[1]
+		if len(fields) > 2 && fields[2] != "" {
+			vendor = fields[2]
+		}
+		o[strings.ToUpper(id)] = strings.TrimSpace(vendor)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(o) == 0 {
+		return nil, errors.New("no OUI entries found")
+	}
+	return o, nil
+}
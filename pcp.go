@@ -0,0 +1,278 @@
+package portmapping
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	pcpVersion      = 2
+	pcpOpAnnounce   = 0
+	pcpOpMap        = 1
+	pcpProtoTCP     = 6
+	pcpProtoUDP     = 17
+	pcpHeaderSize   = 24
+	pcpMapSize      = pcpHeaderSize + 36
+	pcpDefaultLease = 7200
+	pcpProbeLease   = 2
+	// pcpProbePorts is the first of the dynamic ports probe mappings of
+	// ExternalIP are picked among
+	pcpProbePorts = 49152
+)
+
+var pcpResults = map[byte]string{
+	1:  "unsupported version",
+	2:  "not authorized",
+	3:  "malformed request",
+	4:  "unsupported opcode",
+	5:  "unsupported option",
+	6:  "malformed option",
+	7:  "network failure",
+	8:  "no resources",
+	9:  "unsupported protocol",
+	10: "user exceeded quota",
+	11: "cannot provide external address",
+	12: "address mismatch",
+	13: "excessive remote peers",
+}
+
+// PCPClient talks to a Port Control Protocol (RFC 6887) server on the
+// gateway. Like NAT-PMP, mappings are always created for the host running
+// the client.
+type PCPClient struct {
+	gateway string
+	ports   pmpPorts
+}
+
+// NewPCPClient returns a PCP client for the gateway address
+func NewPCPClient(gateway string) *PCPClient {
+	return &PCPClient{gateway: gateway}
+}
+
+// String returns a short gateway summary
+func (c *PCPClient) String() string {
+	return c.gateway + " :: PCP"
+}
+
+// pcpMapping is the result of a MAP request
+type pcpMapping struct {
+	epoch        uint32
+	lifetime     uint32
+	externalPort uint16
+	externalIP   net.IP
+}
+
+// ExternalIP returns the external address of the gateway. PCP only reports
+// it for a mapping, so as a side effect a UDP mapping of a random dynamic
+// port is created for two seconds and removed again. It replaces a mapping
+// of this host for the same internal port, if there is one.
+func (c *PCPClient) ExternalIP(ctx context.Context) (net.IP, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	port := pcpProbePorts + binary.BigEndian.Uint16(b[:])%(65536-pcpProbePorts)
+
+	m, err := c.mapPort(ctx, "UDP", port, 0, pcpProbeLease)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.mapPort(ctx, "UDP", port, 0, 0); err != nil {
+		return nil, err
+	}
+
+	return m.externalIP, nil
+}
+
+// ListMappings is not available in PCP
+func (c *PCPClient) ListMappings(ctx context.Context) ([]*PortMappingEntry, error) {
+	return nil, ErrNotSupported
+}
+
+// GetSpecificPortMappingEntry is not available in PCP
+func (c *PCPClient) GetSpecificPortMappingEntry(ctx context.Context, remoteHost string, externalPort uint16, protocol string) (*PortMappingEntry, error) {
+	return nil, ErrNotSupported
+}
+
+// AddPortMapping maps externalPort/protocol to internalPort of this host.
+// internalClient and description are not transmitted by PCP. A zero
+// leaseDuration requests a lease of two hours.
+func (c *PCPClient) AddPortMapping(ctx context.Context, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) error {
+	_, err := c.AddAnyPortMapping(ctx, externalPort, protocol, internalPort, internalClient, description, leaseDuration)
+	return err
+}
+
+// AddAnyPortMapping is AddPortMapping returning the external port the
+// gateway assigned, which may differ from the suggested externalPort
+func (c *PCPClient) AddAnyPortMapping(ctx context.Context, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) (uint16, error) {
+	if leaseDuration == 0 {
+		leaseDuration = pcpDefaultLease
+	}
+
+	m, err := c.mapPort(ctx, protocol, internalPort, externalPort, leaseDuration)
+	if err != nil {
+		return 0, err
+	}
+	c.ports.add(protocol, m.externalPort, internalPort)
+
+	return m.externalPort, nil
+}
+
+// DeletePortMapping removes the mapping of this host for externalPort. PCP
+// identifies mappings by their internal port and nonce, the internal port
+// is the one of the mapping added by this client, or externalPort for
+// mappings it didn't add.
+func (c *PCPClient) DeletePortMapping(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error {
+	_, err := c.mapPort(ctx, protocol, c.ports.remove(protocol, externalPort), 0, 0)
+	return err
+}
+
+// announce checks that the gateway speaks PCP and returns its epoch
+func (c *PCPClient) announce(ctx context.Context) (uint32, error) {
+	client, err := c.clientIP()
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.request(ctx, pcpHeader(pcpOpAnnounce, 0, client), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(resp[8:]), nil
+}
+
+// mapPort requests a mapping of internalPort, a zero lifetime deletes it
+func (c *PCPClient) mapPort(ctx context.Context, protocol string, internalPort, externalPort uint16, lifetime uint32) (*pcpMapping, error) {
+	var proto byte
+	switch strings.ToUpper(protocol) {
+	case "UDP":
+		proto = pcpProtoUDP
+	case "TCP":
+		proto = pcpProtoTCP
+	default:
+		return nil, fmt.Errorf("pcp: unknown protocol %q", protocol)
+	}
+
+	client, err := c.clientIP()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := pcpNonce(client, proto, internalPort)
+	req := append(pcpHeader(pcpOpMap, lifetime, client), make([]byte, pcpMapSize-pcpHeaderSize)...)
+	copy(req[24:], nonce)
+	req[36] = proto
+	binary.BigEndian.PutUint16(req[40:], internalPort)
+	binary.BigEndian.PutUint16(req[42:], externalPort)
+	if client.To4() != nil {
+		copy(req[44:], net.IPv4zero.To16())
+	}
+
+	resp, err := c.request(ctx, req, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pcpMapping{
+		lifetime:     binary.BigEndian.Uint32(resp[4:]),
+		epoch:        binary.BigEndian.Uint32(resp[8:]),
+		externalPort: binary.BigEndian.Uint16(resp[42:]),
+		externalIP:   net.IP(bytes.Clone(resp[44:60])),
+	}, nil
+}
+
+// clientIP returns the address of this host the gateway sees requests from
+func (c *PCPClient) clientIP() (net.IP, error) {
+	if c.gateway == "" {
+		return nil, errors.New("pcp: gateway address is required")
+	}
+
+	local, err := routedAddr(net.JoinHostPort(c.gateway, natpmpPort))
+	if err != nil {
+		return nil, fmt.Errorf("pcp: %w", err)
+	}
+
+	return local.IP, nil
+}
+
+// request sends req to the gateway and returns the successful response.
+// MAP responses must echo nonce.
+func (c *PCPClient) request(ctx context.Context, req []byte, nonce []byte) ([]byte, error) {
+	resp, err := udpExchange(ctx, net.JoinHostPort(c.gateway, natpmpPort), req, 1100, func(resp []byte) bool {
+		if len(resp) >= 4 && resp[0] == natpmpVersion {
+			// a NAT-PMP only gateway rejecting the version
+			return true
+		}
+		if len(resp) < pcpHeaderSize || resp[0] != pcpVersion || resp[1] != req[1]|0x80 {
+			return false
+		}
+		return nonce == nil || resp[3] != 0 || len(resp) >= pcpMapSize && bytes.Equal(resp[24:36], nonce)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pcp: %w", err)
+	}
+
+	if resp[0] != pcpVersion {
+		return nil, errors.New("pcp: unsupported version")
+	}
+	if code := resp[3]; code != 0 {
+		if msg, ok := pcpResults[code]; ok {
+			return nil, fmt.Errorf("pcp: %s", msg)
+		}
+		return nil, fmt.Errorf("pcp: result code %d", code)
+	}
+
+	return resp, nil
+}
+
+// pcpHeader returns a request header for op from the client address
+func pcpHeader(op byte, lifetime uint32, client net.IP) []byte {
+	h := make([]byte, pcpHeaderSize)
+	h[0] = pcpVersion
+	h[1] = op
+	binary.BigEndian.PutUint32(h[4:], lifetime)
+	copy(h[8:], client.To16())
+	return h
+}
+
+// pcpNonce derives the mapping nonce from what identifies the mapping, so
+// renewals and deletes from another process are accepted by the gateway
+func pcpNonce(client net.IP, proto byte, internalPort uint16) []byte {
+	h := sha256.New()
+	h.Write(client.To16())
+	h.Write([]byte{proto, byte(internalPort >> 8), byte(internalPort)})
+	return h.Sum(nil)[:12]
+}
+
+// detectPMP probes gateway for PCP and NAT-PMP at once and returns the
+// client of the protocol answering, preferring PCP
+func detectPMP(ctx context.Context, gateway string) (PortMapper, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	pcp, pmp := NewPCPClient(gateway), NewNATPMPClient(gateway)
+	pcpErr := make(chan error, 1)
+	go func() {
+		_, err := pcp.announce(ctx)
+		pcpErr <- err
+	}()
+
+	_, err := pmp.ExternalIP(ctx)
+	if perr := <-pcpErr; perr == nil {
+		return pcp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pmp, nil
+}
@@ -0,0 +1,160 @@
+package portmapping
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// pcpAnswer answers like a PCP gateway with result code, mapping requests
+// to external port 40000 of 203.0.113.7
+func pcpAnswer(code byte) func(req []byte) []byte {
+	return func(req []byte) []byte {
+		resp := make([]byte, len(req))
+		copy(resp, req)
+		resp[1] |= 0x80
+		resp[3] = code
+		binary.BigEndian.PutUint32(resp[8:], 1234)
+		if req[1] == pcpOpMap {
+			binary.BigEndian.PutUint16(resp[42:], 40000)
+			copy(resp[44:], net.ParseIP("203.0.113.7").To16())
+		}
+		return resp
+	}
+}
+
+func TestPCPHeader(t *testing.T) {
+	h := pcpHeader(pcpOpMap, 3600, net.ParseIP("192.168.1.10"))
+
+	want := make([]byte, pcpHeaderSize)
+	want[0], want[1] = pcpVersion, pcpOpMap
+	binary.BigEndian.PutUint32(want[4:], 3600)
+	copy(want[8:], []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 168, 1, 10})
+	if !bytes.Equal(h, want) {
+		t.Errorf("got %x, want %x", h, want)
+	}
+}
+
+func TestPCPNonce(t *testing.T) {
+	client := net.ParseIP("192.168.1.10")
+	nonce := pcpNonce(client, pcpProtoTCP, 80)
+	if len(nonce) != 12 {
+		t.Fatalf("got %d bytes, want 12", len(nonce))
+	}
+	if !bytes.Equal(nonce, pcpNonce(client.To4(), pcpProtoTCP, 80)) {
+		t.Error("the nonce depends on the form of the address")
+	}
+	for _, other := range [][]byte{
+		pcpNonce(client, pcpProtoUDP, 80),
+		pcpNonce(client, pcpProtoTCP, 81),
+		pcpNonce(net.ParseIP("192.168.1.11"), pcpProtoTCP, 80),
+	} {
+		if bytes.Equal(nonce, other) {
+			t.Error("another mapping has the same nonce")
+		}
+	}
+}
+
+func TestPCPMapping(t *testing.T) {
+	tests := []struct {
+		proto     string
+		lease     uint32
+		wantProto byte
+		wantTime  uint32
+	}{
+		{"TCP", 3600, pcpProtoTCP, 3600},
+		{"udp", 0, pcpProtoUDP, pcpDefaultLease},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			s := newPMPServer(t, pcpAnswer(0))
+			c := NewPCPClient("127.0.0.1")
+			ctx := context.Background()
+
+			port, err := c.AddAnyPortMapping(ctx, 8080, tt.proto, 80, "", "web", tt.lease)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != 40000 {
+				t.Errorf("got external port %d, want 40000", port)
+			}
+			if err := c.DeletePortMapping(ctx, "", port, tt.proto); err != nil {
+				t.Fatal(err)
+			}
+
+			reqs := s.received()
+			if len(reqs) != 2 {
+				t.Fatalf("got %d requests, want 2", len(reqs))
+			}
+			client := net.ParseIP("127.0.0.1")
+			for i, want := range []struct {
+				external uint16
+				lifetime uint32
+			}{{8080, tt.wantTime}, {0, 0}} {
+				req := reqs[i]
+				if len(req) != pcpMapSize {
+					t.Fatalf("request %d has %d bytes, want %d", i, len(req), pcpMapSize)
+				}
+				if !bytes.Equal(req[:pcpHeaderSize], pcpHeader(pcpOpMap, want.lifetime, client)) {
+					t.Errorf("request %d header is %x", i, req[:pcpHeaderSize])
+				}
+				if !bytes.Equal(req[24:36], pcpNonce(client, tt.wantProto, 80)) {
+					t.Errorf("request %d nonce is %x", i, req[24:36])
+				}
+				if req[36] != tt.wantProto {
+					t.Errorf("request %d protocol is %d, want %d", i, req[36], tt.wantProto)
+				}
+				internal, external := binary.BigEndian.Uint16(req[40:]), binary.BigEndian.Uint16(req[42:])
+				if internal != 80 || external != want.external {
+					t.Errorf("request %d maps %d to %d, want %d to 80", i, external, internal, want.external)
+				}
+				if !net.IP(req[44:60]).Equal(net.IPv4zero) {
+					t.Errorf("request %d suggests external address %s, want 0.0.0.0", i, net.IP(req[44:60]))
+				}
+			}
+		})
+	}
+}
+
+func TestPCPExternalIP(t *testing.T) {
+	newPMPServer(t, pcpAnswer(0))
+
+	ip, err := NewPCPClient("127.0.0.1").ExternalIP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "203.0.113.7" {
+		t.Errorf("got %s, want 203.0.113.7", ip)
+	}
+}
+
+func TestPCPResultCodes(t *testing.T) {
+	tests := []struct {
+		code byte
+		want string
+	}{
+		{2, "pcp: not authorized"},
+		{8, "pcp: no resources"},
+		{99, "pcp: result code 99"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			newPMPServer(t, pcpAnswer(tt.code))
+
+			_, err := NewPCPClient("127.0.0.1").AddAnyPortMapping(context.Background(), 8080, "TCP", 80, "", "", 0)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPCPNATPMPOnlyGateway(t *testing.T) {
+	newPMPServer(t, natpmpAnswer(0))
+
+	if _, err := NewPCPClient("127.0.0.1").announce(context.Background()); err == nil || err.Error() != "pcp: unsupported version" {
+		t.Errorf("got %v, want the version rejected", err)
+	}
+}
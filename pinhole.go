@@ -0,0 +1,223 @@
+package portmapping
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/huin/goupnp/soap"
+)
+
+// protocolAny is the IANA protocol number WANIPv6FirewallControl uses for
+// pinholes of every protocol
+const protocolAny = 65535
+
+type pinholeRequest struct {
+	RemoteHost     string
+	RemotePort     string
+	InternalClient string
+	InternalPort   string
+	Protocol       string
+}
+
+// addPinholeRequest repeats the pinholeRequest fields as soap only encodes
+// flat structs
+type addPinholeRequest struct {
+	RemoteHost     string
+	RemotePort     string
+	InternalClient string
+	InternalPort   string
+	Protocol       string
+	LeaseTime      string
+}
+
+type addPinholeResponse struct {
+	UniqueID string
+}
+
+type updatePinholeRequest struct {
+	UniqueID     string
+	NewLeaseTime string
+}
+
+type deletePinholeRequest struct {
+	UniqueID string
+}
+
+type outboundPinholeTimeoutResponse struct {
+	OutboundPinholeTimeout string
+}
+
+type firewallStatusResponse struct {
+	FirewallEnabled       string
+	InboundPinholeAllowed string
+}
+
+// PinholeClient opens IPv6 firewall pinholes through a
+// WANIPv6FirewallControl:1 service
+type PinholeClient struct {
+	goupnp.ServiceClient
+}
+
+// Pinhole describes inbound IPv6 traffic to let through. Empty hosts and zero
+// ports are wildcards.
+type Pinhole struct {
+	RemoteHost     string
+	RemotePort     uint16
+	InternalClient string
+	InternalPort   uint16
+	// Protocol is TCP, UDP, an IANA protocol number or empty for any
+	Protocol string
+}
+
+// NewPinholeClientsByURL returns clients for the WANIPv6FirewallControl
+// services of the device described at loc
+func NewPinholeClientsByURL(ctx context.Context, loc *url.URL) ([]*PinholeClient, error) {
+	root, err := DeviceByURL(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+	scs, err := goupnp.NewServiceClientsFromRootDevice(root, loc, internetgateway2.URN_WANIPv6FirewallControl_1)
+	if err != nil {
+		return nil, err
+	}
+
+	hc := soapHTTPClient(ctx)
+	clients := make([]*PinholeClient, 0, len(scs))
+	for _, sc := range scs {
+		sc.SOAPClient.HTTPClient = hc
+		clients = append(clients, &PinholeClient{ServiceClient: sc})
+	}
+	return clients, nil
+}
+
+func (p *PinholeClient) String() string {
+	return fmt.Sprintf("%s :: %s", p.RootDevice.Device.FriendlyName, p.Service.ServiceType)
+}
+
+func (p *PinholeClient) perform(ctx context.Context, action string, in, out interface{}) error {
+	return upnpError(action, p.SOAPClient.PerformActionCtx(ctx, internetgateway2.URN_WANIPv6FirewallControl_1, action, in, out))
+}
+
+// FirewallStatus reports whether the firewall is on and allows pinholes
+func (p *PinholeClient) FirewallStatus(ctx context.Context) (enabled bool, inboundAllowed bool, err error) {
+	resp := &firewallStatusResponse{}
+	if err := p.perform(ctx, "GetFirewallStatus", nil, resp); err != nil {
+		return false, false, err
+	}
+
+	if enabled, err = soap.UnmarshalBoolean(strings.TrimSpace(resp.FirewallEnabled)); err != nil {
+		return false, false, err
+	}
+	if inboundAllowed, err = soap.UnmarshalBoolean(strings.TrimSpace(resp.InboundPinholeAllowed)); err != nil {
+		return false, false, err
+	}
+	return enabled, inboundAllowed, nil
+}
+
+// AddPinhole opens the pinhole for leaseTime seconds and returns its ID
+func (p *PinholeClient) AddPinhole(ctx context.Context, ph Pinhole, leaseTime uint32) (uint16, error) {
+	r, err := ph.request()
+	if err != nil {
+		return 0, err
+	}
+
+	req := &addPinholeRequest{
+		RemoteHost:     r.RemoteHost,
+		RemotePort:     r.RemotePort,
+		InternalClient: r.InternalClient,
+		InternalPort:   r.InternalPort,
+		Protocol:       r.Protocol,
+	}
+	if req.LeaseTime, err = soap.MarshalUi4(leaseTime); err != nil {
+		return 0, err
+	}
+
+	resp := &addPinholeResponse{}
+	if err := p.perform(ctx, "AddPinhole", req, resp); err != nil {
+		return 0, err
+	}
+
+	return soap.UnmarshalUi2(strings.TrimSpace(resp.UniqueID))
+}
+
+// UpdatePinhole sets a new lease for the pinhole
+func (p *PinholeClient) UpdatePinhole(ctx context.Context, id uint16, leaseTime uint32) error {
+	req := &updatePinholeRequest{}
+
+	var err error
+	if req.UniqueID, err = soap.MarshalUi2(id); err != nil {
+		return err
+	}
+	if req.NewLeaseTime, err = soap.MarshalUi4(leaseTime); err != nil {
+		return err
+	}
+
+	return p.perform(ctx, "UpdatePinhole", req, nil)
+}
+
+// DeletePinhole closes the pinhole
+func (p *PinholeClient) DeletePinhole(ctx context.Context, id uint16) error {
+	uid, err := soap.MarshalUi2(id)
+	if err != nil {
+		return err
+	}
+
+	return p.perform(ctx, "DeletePinhole", &deletePinholeRequest{uid}, nil)
+}
+
+// PinholeTimeout returns how long the firewall keeps an idle outbound
+// connection matching ph open, in seconds
+func (p *PinholeClient) PinholeTimeout(ctx context.Context, ph Pinhole) (uint32, error) {
+	req, err := ph.request()
+	if err != nil {
+		return 0, err
+	}
+
+	resp := &outboundPinholeTimeoutResponse{}
+	if err := p.perform(ctx, "GetOutboundPinholeTimeout", &req, resp); err != nil {
+		return 0, err
+	}
+
+	return soap.UnmarshalUi4(strings.TrimSpace(resp.OutboundPinholeTimeout))
+}
+
+// request returns ph in SOAP form
+func (ph *Pinhole) request() (pinholeRequest, error) {
+	req := pinholeRequest{
+		RemoteHost:     ph.RemoteHost,
+		InternalClient: ph.InternalClient,
+	}
+
+	proto := protocolAny
+	switch strings.ToUpper(ph.Protocol) {
+	case "":
+	case "TCP":
+		proto = 6
+	case "UDP":
+		proto = 17
+	default:
+		n, err := strconv.ParseUint(ph.Protocol, 10, 16)
+		if err != nil {
+			return req, fmt.Errorf("unknown protocol %q", ph.Protocol)
+		}
+		proto = int(n)
+	}
+
+	var err error
+	if req.RemotePort, err = soap.MarshalUi2(ph.RemotePort); err != nil {
+		return req, err
+	}
+	if req.InternalPort, err = soap.MarshalUi2(ph.InternalPort); err != nil {
+		return req, err
+	}
+	if req.Protocol, err = soap.MarshalUi2(uint16(proto)); err != nil {
+		return req, err
+	}
+
+	return req, nil
+}
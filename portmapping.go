@@ -0,0 +1,285 @@
+// Package portmapping discovers UPnP Internet Gateway Devices, PCP and
+// NAT-PMP gateways and manages their NAT port mappings.
+package portmapping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/huin/goupnp/dcps/internetgateway2"
+)
+
+// LevelTrace is the slog level of the raw protocol messages, below Debug
+const LevelTrace = slog.LevelDebug - 4
+
+// ErrNoServices is returned when a device has no WAN connection service
+var ErrNoServices = errors.New("no WAN connection services found")
+
+// PortMapper is implemented by every port mapping protocol backend
+type PortMapper interface {
+	fmt.Stringer
+	ExternalIP(ctx context.Context) (net.IP, error)
+	ListMappings(ctx context.Context) ([]*PortMappingEntry, error)
+	GetSpecificPortMappingEntry(ctx context.Context, remoteHost string, externalPort uint16, protocol string) (*PortMappingEntry, error)
+	AddPortMapping(ctx context.Context, externalPort uint16, protocol string, internalPort uint16, internalClient string, description string, leaseDuration uint32) error
+	DeletePortMapping(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error
+}
+
+// Client talks to a single WAN connection service of an IGD
+type Client struct {
+	goupnp.ServiceClient
+	// Interface is the one a multicast search found the device on, empty
+	// if it wasn't found that way
+	Interface string
+	// Expires is when the SSDP answer the device was found with runs out
+	// by its max-age, the zero time if unknown. A device that doesn't
+	// announce itself again before may be gone or have moved.
+	Expires time.Time
+
+	urn    string
+	policy *RetryPolicy
+	// source is the address of WithSource the client was created with
+	source net.IP
+}
+
+// urnWANPPPConnection2 is not part of the published IGD specs but is
+// announced by some DSL modems
+const urnWANPPPConnection2 = "urn:schemas-upnp-org:service:WANPPPConnection:2"
+
+// wanServiceURNs lists the WAN connection service types in order of
+// preference within each family
+var wanServiceURNs = [][]string{
+	{internetgateway2.URN_WANIPConnection_2, internetgateway1.URN_WANIPConnection_1},
+	{urnWANPPPConnection2, internetgateway1.URN_WANPPPConnection_1},
+}
+
+// NewClientsByURL returns clients for the WANIPConnection and
+// WANPPPConnection services of the device described at loc. Within each
+// family the newest service version the device has is used. The HTTP
+// client can be set with WithHTTPClient.
+func NewClientsByURL(ctx context.Context, loc *url.URL) ([]*Client, error) {
+	root, err := DeviceByURL(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	// The services of the device share its connections
+	hc := soapHTTPClient(ctx)
+
+	var clients []*Client
+	for _, urns := range wanServiceURNs {
+		for _, urn := range urns {
+			if len(root.Device.FindService(urn)) == 0 {
+				continue
+			}
+
+			srvclients, err := goupnp.NewServiceClientsFromRootDevice(root, loc, urn)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, sc := range srvclients {
+				sc.SOAPClient.HTTPClient = hc
+				clients = append(clients, &Client{ServiceClient: sc, urn: urn, source: contextSource(ctx).IP})
+			}
+			break
+		}
+	}
+
+	if len(clients) == 0 {
+		return nil, ErrNoServices
+	}
+
+	return clients, nil
+}
+
+// Discover locates every UPnP daemon answering at host and returns clients
+// for their WAN connection services. Responders without such services are
+// skipped.
+func Discover(ctx context.Context, host string, port string, opts *SearchOptions) ([]*Client, error) {
+	responders, err := SearchResponders(ctx, host, port, opts)
+	if err != nil {
+		return nil, err
+	}
+	found := time.Now()
+
+	var (
+		clients  []*Client
+		firstErr error
+	)
+	for _, r := range responders {
+		cs, err := NewClientsByURL(ctx, r.Location)
+		if err != nil {
+			if !errors.Is(err, ErrNoServices) {
+				slog.Warn("skipping device", "location", r.Location, "err", err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, c := range cs {
+			c.Interface, c.Expires = r.Interface, r.Expires(found)
+		}
+		clients = append(clients, cs...)
+	}
+
+	if len(clients) == 0 {
+		return nil, firstErr
+	}
+
+	return clients, nil
+}
+
+// String returns a short device and service summary
+func (c *Client) String() string {
+	return c.RootDevice.Device.FriendlyName + " :: " + c.Service.String()
+}
+
+// DiscoverMappers returns UPnP clients of the device at host or, when no
+// UPnP daemon answers, a PCP or NAT-PMP client if host speaks either
+func DiscoverMappers(ctx context.Context, host string, port string, opts *SearchOptions) ([]PortMapper, error) {
+	clients, err := Discover(ctx, host, port, opts)
+	if err == nil && len(clients) > 0 {
+		return upnpMappers(clients), nil
+	}
+
+	gateway, gerr := pmpGateway(host)
+	if gerr != nil {
+		if err == nil {
+			err = gerr
+		}
+		return nil, err
+	}
+	pm, perr := detectPMP(ctx, gateway)
+	if perr != nil {
+		if err == nil {
+			err = ErrNoServices
+		}
+		return nil, err
+	}
+
+	return []PortMapper{pm}, nil
+}
+
+// Detect probes host for UPnP, PCP and NAT-PMP in parallel and returns the
+// best backend answering. UPnP is preferred as the only protocol able to
+// list mappings, then PCP over its predecessor NAT-PMP. An empty host
+// searches UPnP via multicast and probes the default gateway.
+func Detect(ctx context.Context, host string, port string, opts *SearchOptions) (PortMapper, error) {
+	type result struct {
+		m   PortMapper
+		err error
+	}
+	// Without a gateway to probe only UPnP is searched
+	pmpc := make(chan result, 1)
+	gateway, gerr := pmpGateway(host)
+	if gerr != nil {
+		pmpc <- result{nil, gerr}
+	} else {
+		go func() {
+			m, err := detectPMP(ctx, gateway)
+			pmpc <- result{m, err}
+		}()
+	}
+
+	clients, err := Discover(ctx, host, port, opts)
+	pmp := <-pmpc
+	if err == nil && len(clients) > 0 {
+		return clients[0], nil
+	}
+	if pmp.err == nil {
+		return pmp.m, nil
+	}
+	if err == nil {
+		err = gerr
+	}
+	if err == nil {
+		err = ErrNoServices
+	}
+
+	return nil, err
+}
+
+// pmpGateway returns the PCP and NAT-PMP server to probe for host, the
+// default gateway when host is empty or a multicast search address
+func pmpGateway(host string) (string, error) {
+	if host != "" && host != "::" && !isMulticast(host) {
+		return host, nil
+	}
+
+	gw, err := DefaultGateway()
+	if err != nil {
+		return "", err
+	}
+	return gw.String(), nil
+}
+
+func upnpMappers(clients []*Client) []PortMapper {
+	mappers := make([]PortMapper, 0, len(clients))
+	for _, c := range clients {
+		mappers = append(mappers, c)
+	}
+	return mappers
+}
+
+// LocalIP returns the address of this host the device reaches it at, the
+// usual internal client of a mapping for a local service
+func (c *Client) LocalIP() (net.IP, error) {
+	if c.source != nil {
+		return c.source, nil
+	}
+	if c.Location == nil {
+		return nil, errors.New("client has no device location")
+	}
+
+	local, err := routedAddr(c.Location.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return local.IP, nil
+}
+
+// DeviceInfo is the inventory data of the root device description
+type DeviceInfo struct {
+	FriendlyName     string `json:"friendly_name"`
+	Manufacturer     string `json:"manufacturer,omitempty"`
+	ManufacturerURL  string `json:"manufacturer_url,omitempty"`
+	ModelName        string `json:"model_name,omitempty"`
+	ModelNumber      string `json:"model_number,omitempty"`
+	ModelDescription string `json:"model_description,omitempty"`
+	SerialNumber     string `json:"serial_number,omitempty"`
+	UPC              string `json:"upc,omitempty"`
+	PresentationURL  string `json:"presentation_url,omitempty"`
+	UDN              string `json:"udn"`
+}
+
+// DeviceInfo returns the inventory data of the gateway. UPnP has no firmware
+// field, vendors usually put the version in the model number or description.
+func (c *Client) DeviceInfo() *DeviceInfo {
+	d := &c.RootDevice.Device
+	info := &DeviceInfo{
+		FriendlyName:     d.FriendlyName,
+		Manufacturer:     d.Manufacturer,
+		ManufacturerURL:  d.ManufacturerURL.Str,
+		ModelName:        d.ModelName,
+		ModelNumber:      d.ModelNumber,
+		ModelDescription: d.ModelDescription,
+		SerialNumber:     d.SerialNumber,
+		UPC:              d.UPC,
+		UDN:              d.UDN,
+	}
+	if d.PresentationURL.Ok {
+		info.PresentationURL = d.PresentationURL.URL.String()
+	}
+
+	return info
+}
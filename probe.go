@@ -0,0 +1,139 @@
+package portmapping
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/huin/goupnp"
+)
+
+// ProbeResult tells whether a gateway answers a port mapping protocol
+type ProbeResult struct {
+	Protocol string   `json:"protocol"`
+	Enabled  bool     `json:"enabled"`
+	Versions []string `json:"versions,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Probe tries UPnP, NAT-PMP and PCP against host at the same time and
+// reports for each one whether it is enabled. UPnP versions are the device
+// and service types found, an empty host searches them via multicast and
+// probes the default gateway for the others.
+func Probe(ctx context.Context, host string, port string, opts *SearchOptions) []ProbeResult {
+	results := make([]ProbeResult, 3)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		results[0] = probeUPnP(ctx, host, port, opts)
+	}()
+
+	gateway, gwErr := pmpGateway(host)
+	go func() {
+		defer wg.Done()
+		results[1] = ProbeResult{Protocol: "NAT-PMP"}
+		detail, err := probeNATPMP(ctx, gateway, gwErr)
+		results[1].probed(strconv.Itoa(natpmpVersion), detail, err)
+	}()
+	go func() {
+		defer wg.Done()
+		results[2] = ProbeResult{Protocol: "PCP"}
+		detail, err := probePCP(ctx, gateway, gwErr)
+		results[2].probed(strconv.Itoa(pcpVersion), detail, err)
+	}()
+	wg.Wait()
+
+	return results
+}
+
+// probed records the outcome of a probe of the protocol version
+func (r *ProbeResult) probed(version string, detail string, err error) {
+	if err != nil {
+		r.Error = err.Error()
+		return
+	}
+	r.Enabled = true
+	r.Versions = []string{version}
+	r.Detail = detail
+}
+
+func probeUPnP(ctx context.Context, host string, port string, opts *SearchOptions) ProbeResult {
+	res := ProbeResult{Protocol: "UPnP"}
+
+	locs, err := LocateAll(ctx, host, port, opts)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Enabled = true
+
+	var (
+		names []string
+		seen  = make(map[string]bool)
+	)
+	add := func(typ string) {
+		if v := shortType(typ); !seen[v] {
+			seen[v] = true
+			res.Versions = append(res.Versions, v)
+		}
+	}
+	for _, loc := range locs {
+		root, err := DeviceByURL(ctx, loc)
+		if err != nil {
+			names = append(names, loc.Host+": "+err.Error())
+			continue
+		}
+
+		names = append(names, root.Device.FriendlyName)
+		add(root.Device.DeviceType)
+		root.Device.VisitServices(func(srv *goupnp.Service) {
+			add(srv.ServiceType)
+		})
+	}
+	res.Detail = strings.Join(names, ", ")
+
+	return res
+}
+
+func probeNATPMP(ctx context.Context, gateway string, gwErr error) (string, error) {
+	if gwErr != nil {
+		return "", gwErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ip, err := NewNATPMPClient(gateway).ExternalIP(ctx)
+	if err != nil {
+		return "", err
+	}
+	return "external IP " + ip.String(), nil
+}
+
+func probePCP(ctx context.Context, gateway string, gwErr error) (string, error) {
+	if gwErr != nil {
+		return "", gwErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	epoch, err := NewPCPClient(gateway).announce(ctx)
+	if err != nil {
+		return "", err
+	}
+	return "epoch " + strconv.FormatUint(uint64(epoch), 10), nil
+}
+
+// shortType strips the schema prefix of a UPnP device or service type,
+// leaving e.g. WANIPConnection:2
+func shortType(typ string) string {
+	parts := strings.Split(typ, ":")
+	if len(parts) < 2 {
+		return typ
+	}
+	return strings.Join(parts[len(parts)-2:], ":")
+}
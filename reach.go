@@ -0,0 +1,139 @@
+package portmapping
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ReachState is how a mapped port looks from outside the gateway
+type ReachState string
+
+const (
+	// ReachOpen is a port that was connected to or answered. With a
+	// token, the answer came from the listener expecting it.
+	ReachOpen ReachState = "open"
+	// ReachClosed is a port that was actively refused
+	ReachClosed ReachState = "closed"
+	// ReachFiltered is a port that stayed silent
+	ReachFiltered ReachState = "filtered"
+)
+
+// Reachability is the result of probing a port from a vantage point
+type Reachability struct {
+	State  ReachState `json:"state"`
+	Detail string     `json:"detail,omitempty"`
+}
+
+// ProbeReach probes protocol addr from this host. A TCP port is connected
+// to and, with a token, must send the token back. A UDP port is sent the
+// token and must echo it, a port staying silent counts as filtered.
+func ProbeReach(ctx context.Context, protocol, addr, token string, timeout time.Duration) Reachability {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	network := strings.ToLower(protocol)
+	if network != "tcp" && network != "udp" {
+		return Reachability{State: ReachFiltered, Detail: fmt.Sprintf("unknown protocol %q", protocol)}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return reachError(err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" && token == "" {
+		return Reachability{State: ReachOpen}
+	}
+	if network == "udp" {
+		if _, err := conn.Write([]byte(token)); err != nil {
+			return reachError(err)
+		}
+	}
+
+	buf := make([]byte, len(token)+1)
+	n, err := io.ReadAtLeast(conn, buf, max(len(token), 1))
+	switch {
+	case err != nil && n == 0:
+		if network == "tcp" {
+			return Reachability{State: ReachOpen, Detail: "connected but the token wasn't sent"}
+		}
+		return reachError(err)
+	case token != "" && string(buf[:len(token)]) != token:
+		return Reachability{State: ReachOpen, Detail: "answered by another service than the listener"}
+	}
+	return Reachability{State: ReachOpen}
+}
+
+func reachError(err error) Reachability {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return Reachability{State: ReachClosed, Detail: "refused"}
+	case errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, context.DeadlineExceeded):
+		return Reachability{State: ReachFiltered, Detail: "no answer"}
+	}
+	return Reachability{State: ReachFiltered, Detail: err.Error()}
+}
+
+// ReachHandler serves ProbeReach to check a mapping from this vantage
+// point:
+//
+//	GET ?protocol=tcp&addr=203.0.113.7:8080&token=...
+//
+// The answer is a JSON Reachability. Unless anyTarget is set only the
+// address the request comes from may be probed, which behind the gateway
+// is its external address, so the handler can't be used to scan others.
+func ReachHandler(timeout time.Duration, anyTarget bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		addr := q.Get("addr")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			http.Error(w, "addr must be host:port", http.StatusBadRequest)
+			return
+		}
+		if !anyTarget && !requesterOnly(r, host) {
+			http.Error(w, "only the address of the requester may be probed", http.StatusForbidden)
+			return
+		}
+
+		res := ProbeReach(r.Context(), q.Get("protocol"), addr, q.Get("token"), timeout)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+}
+
+// CheckReach asks the ReachHandler at checkURL to probe protocol addr
+func CheckReach(ctx context.Context, client *http.Client, checkURL, protocol, addr, token string) (Reachability, error) {
+	u, err := url.Parse(checkURL)
+	if err != nil {
+		return Reachability{}, err
+	}
+	q := u.Query()
+	q.Set("protocol", strings.ToLower(protocol))
+	q.Set("addr", addr)
+	if token != "" {
+		q.Set("token", token)
+	}
+	u.RawQuery = q.Encode()
+
+	var res Reachability
+	if err := getJSON(ctx, client, u.String(), &res); err != nil {
+		return Reachability{}, fmt.Errorf("check service: %w", err)
+	}
+	return res, nil
+}
@@ -0,0 +1,205 @@
+package portmapping
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// relayResponder is a Responder on the wire
+type relayResponder struct {
+	Location string `json:"location"`
+	USN      string `json:"usn,omitempty"`
+	BootID   string `json:"boot_id,omitempty"`
+	ConfigID string `json:"config_id,omitempty"`
+	Server   string `json:"server,omitempty"`
+	// Interface is the one of the agent the responder answered on
+	Interface string `json:"interface,omitempty"`
+	// MaxAge is in seconds
+	MaxAge int `json:"max_age,omitempty"`
+}
+
+// RelayHandler serves an agent inside a LAN for a CLI that can't reach it
+// directly. It runs SSDP searches for it:
+//
+//	GET /ssdp?host=&port=1900&wait=5s&retries=2&mx=0&st=upnp:rootdevice
+//
+// answering with the JSON responders found, and it is an HTTP proxy for
+// the descriptions and SOAP actions. Unless anyTarget is set only private
+// and link-local addresses can be proxied to, so the agent can't be used to
+// reach the internet or services of its own host.
+func RelayHandler(anyTarget bool) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		// The request of a proxy client already has the target URL
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.Host = r.In.Host
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.IsAbs() {
+			if !anyTarget && !relayAllowed(r.URL.Hostname()) {
+				http.Error(w, "only private addresses of other hosts may be relayed to", http.StatusForbidden)
+				return
+			}
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path != "/ssdp" {
+			http.NotFound(w, r)
+			return
+		}
+
+		q := r.URL.Query()
+		opts := &SearchOptions{}
+		if v := q.Get("wait"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, "wait must be a duration", http.StatusBadRequest)
+				return
+			}
+			opts.Wait = d
+		}
+		opts.Retries, _ = strconv.Atoi(q.Get("retries"))
+		opts.MX, _ = strconv.Atoi(q.Get("mx"))
+		opts.SearchTargets = q["st"]
+		port := q.Get("port")
+		if port == "" {
+			port = "1900"
+		}
+
+		// The agent searches itself, not through a relay of its own
+		responders, err := searchResponders(r.Context(), q.Get("host"), port, opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		out := make([]relayResponder, 0, len(responders))
+		for _, res := range responders {
+			out = append(out, relayResponder{
+				Location:  res.Location.String(),
+				USN:       res.USN,
+				BootID:    res.BootID,
+				ConfigID:  res.ConfigID,
+				Server:    res.Server,
+				Interface: res.Interface,
+				MaxAge:    int(res.MaxAge / time.Second),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+}
+
+// relayAllowed reports whether host is a private or link-local address of
+// another host than the agent
+func relayAllowed(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil || !(ip.IsPrivate() || ip.IsLinkLocalUnicast()) {
+		return false
+	}
+
+	// Without its addresses no target can be told apart from the agent
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Relay is an agent serving RelayHandler that SSDP searches and device
+// HTTP go through
+type Relay struct {
+	// URL is the RelayHandler of the agent
+	URL *url.URL
+	// Client talks to the agent, with the agent as its proxy
+	Client *http.Client
+}
+
+// NewRelay returns the relay of the agent at agentURL. A nil dial connects
+// to the agent host, else every connection to the agent is made by dial,
+// like one running the agent over SSH.
+func NewRelay(agentURL *url.URL, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *Relay {
+	t := deviceTransport()
+	// Requests to the agent itself, like searches, aren't proxied
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		if req.URL.Host == agentURL.Host {
+			return nil, nil
+		}
+		return agentURL, nil
+	}
+	if dial != nil {
+		t.DialContext = dial
+	}
+	return &Relay{URL: agentURL, Client: &http.Client{Transport: &keepAliveTransport{next: t}}}
+}
+
+// contextRelay returns the relay set by WithRelay, nil if none is
+func contextRelay(ctx context.Context) *Relay {
+	r, _ := ctx.Value(relayKey{}).(*Relay)
+	return r
+}
+
+// relayKey is the context key of the relay set by WithRelay
+type relayKey struct{}
+
+// WithRelay returns a copy of ctx making the functions it is passed to
+// search and talk HTTP through r, as WithHTTPClient does with r.Client.
+// NAT-PMP, PCP and the raw SSDP of SearchGatewayAnswers aren't relayed.
+func WithRelay(ctx context.Context, r *Relay) context.Context {
+	return context.WithValue(WithHTTPClient(ctx, r.Client), relayKey{}, r)
+}
+
+// search asks the agent for the responders of an SSDP search
+func (r *Relay) search(ctx context.Context, host string, port string, o *SearchOptions) ([]Responder, error) {
+	q := url.Values{}
+	q.Set("host", host)
+	q.Set("port", port)
+	q.Set("wait", o.Wait.String())
+	q.Set("retries", strconv.Itoa(o.Retries))
+	q.Set("mx", strconv.Itoa(o.MX))
+	q["st"] = o.SearchTargets
+	u := r.URL.ResolveReference(&url.URL{Path: "/ssdp", RawQuery: q.Encode()})
+
+	// The search takes the whole wait on the agent
+	ctx, cancel := context.WithTimeout(ctx, o.Wait+30*time.Second)
+	defer cancel()
+
+	var out []relayResponder
+	if err := getJSON(ctx, r.Client, u.String(), &out); err != nil {
+		return nil, fmt.Errorf("relay: %w", err)
+	}
+
+	responders := make([]Responder, 0, len(out))
+	for _, res := range out {
+		loc, err := url.Parse(res.Location)
+		if err != nil {
+			continue
+		}
+		responders = append(responders, Responder{
+			Location:  loc,
+			USN:       res.USN,
+			BootID:    res.BootID,
+			ConfigID:  res.ConfigID,
+			Server:    res.Server,
+			Interface: res.Interface,
+			MaxAge:    time.Duration(res.MaxAge) * time.Second,
+		})
+	}
+	if len(responders) == 0 {
+		return nil, errors.New("relay: No SSDP response avaiable")
+	}
+	return responders, nil
+}
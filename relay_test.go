@@ -0,0 +1,47 @@
+package portmapping
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRelayAllowed(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"192.168.1.1", true},
+		{"10.0.0.1", true},
+		{"172.16.0.1", true},
+		{"fd00::1", true},
+		{"169.254.1.1", true},
+		{"fe80::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"203.0.113.7", false},
+		{"8.8.8.8", false},
+		{"router.lan", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := relayAllowed(tt.host); got != tt.want {
+			t.Errorf("relayAllowed(%q) = %t, want %t", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRelayAllowedOwnAddresses(t *testing.T) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || !(n.IP.IsPrivate() || n.IP.IsLinkLocalUnicast()) {
+			continue
+		}
+		if relayAllowed(n.IP.String()) {
+			t.Errorf("relayAllowed(%q) = true for an address of this host", n.IP)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package portmapping
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	minRenewInterval = time.Second
+	maxRetryInterval = 30 * time.Second
+)
+
+// MappingRequest describes a mapping to create
+type MappingRequest struct {
+	// RemoteHost limits the mapping to a remote host, empty for every host
+	RemoteHost     string
+	ExternalPort   uint16
+	Protocol       string
+	InternalPort   uint16
+	InternalClient string
+	Description    string
+	// Lease is the requested lease, rounded down to seconds
+	Lease time.Duration
+	// Disabled adds the mapping disabled
+	Disabled bool
+}
+
+// Add creates the mapping on m
+func (r *MappingRequest) Add(ctx context.Context, m PortMapper) error {
+	if r.RemoteHost != "" || r.Disabled {
+		pme, err := r.Entry()
+		if err != nil {
+			return err
+		}
+		return addEntry(ctx, m, pme)
+	}
+	return m.AddPortMapping(ctx, r.ExternalPort, r.Protocol, r.InternalPort, r.InternalClient, r.Description, uint32(r.Lease/time.Second))
+}
+
+// AddResolvingConflicts adds the mapping and returns the external port it
+// got. When the port is taken by another client a WANIPConnection:2 device
+// picks a free one with AddAnyPortMapping, other mappers are asked for up to
+// attempts following ports.
+func (r *MappingRequest) AddResolvingConflicts(ctx context.Context, m PortMapper, attempts int) (uint16, error) {
+	err := r.Add(ctx, m)
+	if !errors.Is(err, ErrMappingConflict) {
+		return r.ExternalPort, err
+	}
+
+	if c, ok := m.(*Client); ok && c.IsV2() {
+		return c.AddAnyPortMapping(ctx, r.ExternalPort, r.Protocol, r.InternalPort, r.InternalClient, r.Description, uint32(r.Lease/time.Second))
+	}
+
+	next := *r
+	for i := 0; i < attempts && next.ExternalPort < math.MaxUint16; i++ {
+		next.ExternalPort++
+		err = next.Add(ctx, m)
+		if !errors.Is(err, ErrMappingConflict) {
+			return next.ExternalPort, err
+		}
+	}
+
+	return 0, err
+}
+
+// KeepMapping adds the mapping and adds it again halfway through every
+// lease until ctx is done, so it survives lease expiry and gateway reboots.
+// NAT-PMP and PCP mappings are also added again right away when the gateway
+// announces a restart or address change. fn, if not nil, is called with the
+// result of every attempt; failed attempts are retried sooner. The mapping
+// is left in place on return.
+func KeepMapping(ctx context.Context, m PortMapper, r MappingRequest, fn func(error)) error {
+	if r.Lease < 2*minRenewInterval {
+		return errors.New("a lease of at least 2s is needed to renew a mapping")
+	}
+
+	renew := r.Lease / 2
+	retry := renew / 2
+	if retry > maxRetryInterval {
+		retry = maxRetryInterval
+	}
+	if retry < minRenewInterval {
+		retry = minRenewInterval
+	}
+
+	restarted := announcements(ctx, m)
+	for {
+		err := r.Add(ctx, m)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if fn != nil {
+			fn(err)
+		}
+
+		wait := renew
+		if err != nil {
+			wait = retry
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		case <-restarted:
+		}
+	}
+}
+
+// EnsureMapping checks every interval until ctx is done that m has the
+// mapping of r pointing to its internal client and port. A missing mapping
+// is added again and one pointing elsewhere is replaced, whether the
+// device lost it in a reboot or another client took the port. Finite
+// leases are renewed once half of them is gone. fn, if not nil, is called
+// after every check with the repair, an added or changed mapping, nil if
+// there was nothing to repair, or the error of the check. Mappers that
+// can't look a mapping up have it added at every check.
+func EnsureMapping(ctx context.Context, m PortMapper, r MappingRequest, interval time.Duration, fn func(*MappingChange, error)) error {
+	if interval < minRenewInterval {
+		return errors.New("a check interval of at least 1s is needed")
+	}
+	desired, err := r.Entry()
+	if err != nil {
+		return err
+	}
+
+	for {
+		change, err := ensureMapping(ctx, m, &r, desired)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if fn != nil {
+			fn(change, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ensureMapping checks the mapping of r once and repairs it, returning the
+// repair if there was one
+func ensureMapping(ctx context.Context, m PortMapper, r *MappingRequest, desired *PortMappingEntry) (*MappingChange, error) {
+	found, err := m.GetSpecificPortMappingEntry(ctx, "", r.ExternalPort, r.Protocol)
+	switch {
+	case errors.Is(err, ErrNotSupported):
+		return nil, r.Add(ctx, m)
+	case errors.Is(err, ErrNoSuchEntry):
+		if err := r.Add(ctx, m); err != nil {
+			return nil, err
+		}
+		return &MappingChange{Kind: MappingAdded, New: desired}, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if found.NewInternalClient != desired.NewInternalClient || found.NewInternalPort != desired.NewInternalPort || !found.IsEnabled() {
+		change := MappingChange{Kind: MappingChanged, Old: found, New: desired}
+		if err := ApplyChanges(ctx, m, []MappingChange{change}); err != nil {
+			return nil, err
+		}
+		return &change, nil
+	}
+
+	if left := leaseLeft(found); r.Lease > 0 && left != math.MaxUint64 && time.Duration(left)*time.Second < r.Lease/2 {
+		return nil, r.Add(ctx, m)
+	}
+	return nil, nil
+}
@@ -0,0 +1,97 @@
+package portmapping
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// RetryPolicy bounds the SOAP actions of a Client. Loaded devices can take
+// many seconds to answer and goupnp's HTTP client never gives up, so every
+// attempt gets a timeout and failed attempts are retried with exponential
+// backoff. UPnP faults are answers and never retried.
+type RetryPolicy struct {
+	// Timeout bounds a single attempt of an action, 0 is no limit
+	Timeout time.Duration
+	// ActionTimeouts override Timeout for the named actions, like
+	// GetGenericPortMappingEntry
+	ActionTimeouts map[string]time.Duration
+	// Retries is how many times an attempt that timed out or failed
+	// without an answer is repeated
+	Retries int
+	// Backoff is the wait before the first retry, it doubles for every
+	// further one up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the policy of new clients
+var DefaultRetryPolicy = RetryPolicy{
+	Timeout:    30 * time.Second,
+	Retries:    2,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 8 * time.Second,
+}
+
+// timeout returns the attempt timeout of action
+func (p *RetryPolicy) timeout(action string) time.Duration {
+	if d, ok := p.ActionTimeouts[action]; ok {
+		return d
+	}
+	return p.Timeout
+}
+
+// do runs the attempts of action until one gets an answer
+func (p *RetryPolicy) do(ctx context.Context, action string, attempt func(ctx context.Context) error) error {
+	backoff := p.Backoff
+	for i := 0; ; i++ {
+		err := p.try(ctx, action, attempt)
+		if err == nil || i >= p.Retries || !retryable(ctx, err) {
+			return err
+		}
+
+		slog.Debug("retrying SOAP action", "action", action, "attempt", i+1, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+func (p *RetryPolicy) try(ctx context.Context, action string, attempt func(ctx context.Context) error) error {
+	if d := p.timeout(action); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return attempt(ctx)
+}
+
+// retryable reports whether the failed attempt err is worth repeating:
+// the device didn't answer it and ctx, the one of the whole action, is
+// still live
+func retryable(ctx context.Context, err error) bool {
+	var fault *soap.SOAPFaultError
+	return ctx.Err() == nil && !errors.As(err, &fault)
+}
+
+// SetRetryPolicy replaces the DefaultRetryPolicy of c
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.policy = &p
+}
+
+// retryPolicy returns the policy of c
+func (c *Client) retryPolicy() *RetryPolicy {
+	if c.policy == nil {
+		return &DefaultRetryPolicy
+	}
+	return c.policy
+}
@@ -0,0 +1,291 @@
+package portmapping
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gatewayTargets are the search targets an InternetGatewayDevice answers
+var gatewayTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+}
+
+// SSDPAnswer is a single response to an SSDP search and the address it was
+// sent from
+type SSDPAnswer struct {
+	From net.IP `json:"from"`
+	// Interface is the one a multicast search got the answer on
+	Interface string `json:"interface,omitempty"`
+	Location  string `json:"location"`
+	ST        string `json:"st"`
+	USN       string `json:"usn"`
+	Server    string `json:"server,omitempty"`
+}
+
+// UDN returns the unique device name the USN starts with
+func (a SSDPAnswer) UDN() string {
+	udn, _, _ := strings.Cut(a.USN, "::")
+	return udn
+}
+
+// LocationIP returns the address of the location host, nil if it's a name
+func (a SSDPAnswer) LocationIP() net.IP {
+	u, err := url.Parse(a.Location)
+	if err != nil {
+		return nil
+	}
+	host := u.Hostname()
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+// SearchGatewayAnswers searches host like SearchResponders does for the
+// InternetGatewayDevice:1 and :2 targets and returns every answer along
+// with its sender, without merging answers of the same device
+func SearchGatewayAnswers(ctx context.Context, host string, port string, opts *SearchOptions) ([]SSDPAnswer, error) {
+	o := opts.withDefaults()
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	port = strings.TrimPrefix(port, ":")
+	targets := ssdpTargets(host, port, contextSource(ctx))
+	if len(targets) == 0 {
+		return nil, errors.New("No SSDP search target available")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, o.Wait+100*time.Millisecond)
+	defer cancel()
+
+	// Targets are searched concurrently, every one from its own socket
+	// so answers are told apart by interface
+	results := make([][]SSDPAnswer, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t ssdpTarget) {
+			defer wg.Done()
+			results[i], errs[i] = searchGatewayTarget(ctx, t, &o)
+		}(i, t)
+	}
+	wg.Wait()
+
+	// Retries and the two targets make a device answer several times,
+	// only answers differing in sender, USN or location are kept
+	seen := make(map[string]bool)
+	var answers []SSDPAnswer
+	for _, as := range results {
+		for _, a := range as {
+			key := a.Interface + " " + a.From.String() + " " + a.UDN() + " " + a.Location
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			answers = append(answers, a)
+		}
+	}
+
+	if len(answers) == 0 {
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return nil, errors.New("No SSDP response avaiable")
+	}
+	return answers, nil
+}
+
+// searchGatewayTarget sends the gateway searches to t and collects the
+// answers until ctx is done
+func searchGatewayTarget(ctx context.Context, t ssdpTarget, o *SearchOptions) ([]SSDPAnswer, error) {
+	addr := ":0"
+	if ip := t.bindAddr(ctx); ip != nil {
+		addr = net.JoinHostPort(ip.String(), "0")
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now().Add(-time.Second))
+	}()
+
+	dst, err := net.ResolveUDPAddr("udp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	hostHeader := t.addr
+	if i := strings.Index(hostHeader, "%"); i >= 0 {
+		hostHeader = hostHeader[:i] + hostHeader[strings.Index(hostHeader, "]"):]
+	}
+	for _, st := range gatewayTargets {
+		req := fmt.Sprintf("%s * HTTP/1.1\r\nHOST: %s\r\nMAN: \"%s\"\r\nMX: %d\r\nST: %s\r\n\r\n",
+			methodSearch, hostHeader, ssdpDiscover, o.MX, st)
+		for i := 0; i < o.Retries; i++ {
+			if _, err := conn.WriteTo([]byte(req), dst); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var answers []SSDPAnswer
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return answers, nil
+			}
+			return nil, err
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			slog.Debug("ssdp: discarding search response", "from", from, "err", err)
+			continue
+		}
+		loc, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || loc.Host == "" {
+			slog.Debug("ssdp: discarding search response without usable location", "from", from)
+			continue
+		}
+
+		answers = append(answers, SSDPAnswer{
+			From:      from.(*net.UDPAddr).IP,
+			Interface: t.iface,
+			Location:  loc.String(),
+			ST:        resp.Header.Get("ST"),
+			USN:       resp.Header.Get("USN"),
+			Server:    resp.Header.Get("SERVER"),
+		})
+	}
+}
+
+// RogueKind is the way SSDP answers look spoofed
+type RogueKind string
+
+const (
+	// RogueLocation is an answer pointing to a description on another
+	// host than its sender, which is how a spoofer redirects clients
+	RogueLocation RogueKind = "location-mismatch"
+	// RogueGateways is more than one device claiming to be the gateway
+	RogueGateways RogueKind = "multiple-gateways"
+	// RogueSenders is a device answering from more than one address
+	RogueSenders RogueKind = "multiple-senders"
+)
+
+// RogueFinding is a suspicious set of SSDP answers
+type RogueFinding struct {
+	Kind    RogueKind    `json:"kind"`
+	Detail  string       `json:"detail"`
+	Answers []SSDPAnswer `json:"answers"`
+}
+
+// CheckRogueResponders looks for signs of SSDP spoofing in answers: a
+// location on another host than the sender, several devices claiming to be
+// the gateway and a device answering from several addresses. More than one
+// gateway is legitimate with mesh systems or double NAT, so the findings
+// are for a human to judge.
+func CheckRogueResponders(answers []SSDPAnswer) []RogueFinding {
+	var findings []RogueFinding
+
+	byUDN := make(map[string][]SSDPAnswer)
+	var udns []string
+	for _, a := range answers {
+		if ip := a.LocationIP(); ip != nil && !ip.Equal(a.From) {
+			findings = append(findings, RogueFinding{
+				Kind:    RogueLocation,
+				Detail:  fmt.Sprintf("%s answered with a location on %s", a.From, a.LocationIP()),
+				Answers: []SSDPAnswer{a},
+			})
+		}
+
+		udn := a.UDN()
+		if udn == "" {
+			udn = a.Location
+		}
+		if _, ok := byUDN[udn]; !ok {
+			udns = append(udns, udn)
+		}
+		byUDN[udn] = append(byUDN[udn], a)
+	}
+
+	for _, udn := range udns {
+		senders := make(map[string]bool)
+		for _, a := range byUDN[udn] {
+			senders[a.From.String()] = true
+		}
+		if len(senders) > 1 {
+			findings = append(findings, RogueFinding{
+				Kind:    RogueSenders,
+				Detail:  fmt.Sprintf("%s answered from %s", udn, strings.Join(sortedKeys(senders), ", ")),
+				Answers: byUDN[udn],
+			})
+		}
+	}
+
+	// A host on several networks sees one gateway on each
+	byIface := make(map[string]map[string]SSDPAnswer)
+	for _, udn := range udns {
+		for _, a := range byUDN[udn] {
+			if byIface[a.Interface] == nil {
+				byIface[a.Interface] = make(map[string]SSDPAnswer)
+			}
+			if _, ok := byIface[a.Interface][udn]; !ok {
+				byIface[a.Interface][udn] = a
+			}
+		}
+	}
+	ifaces := make(map[string]bool, len(byIface))
+	for iface := range byIface {
+		ifaces[iface] = true
+	}
+	for _, iface := range sortedKeys(ifaces) {
+		gateways := byIface[iface]
+		if len(gateways) < 2 {
+			continue
+		}
+		var all []SSDPAnswer
+		for _, udn := range udns {
+			if a, ok := gateways[udn]; ok {
+				all = append(all, a)
+			}
+		}
+		detail := fmt.Sprintf("%d devices claim to be the InternetGatewayDevice", len(gateways))
+		if iface != "" {
+			detail += " on " + iface
+		}
+		findings = append(findings, RogueFinding{Kind: RogueGateways, Detail: detail, Answers: all})
+	}
+
+	return findings
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,345 @@
+package portmapping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultScanWorkers = 32
+	defaultScanWait    = 2 * time.Second
+	defaultTCPTimeout  = time.Second
+	maxScanHosts       = 1 << 24
+)
+
+// ScanOptions configure Scan
+type ScanOptions struct {
+	// Workers is the number of hosts probed concurrently
+	Workers int
+	// Rate limits the probes started per second, zero is unlimited
+	Rate int
+	// Port is the SSDP port in ":1900" form
+	Port string
+	// SearchOptions apply to the search of each host, Wait defaults to 2s
+	SearchOptions
+	// TCPPorts, when set, are checked first and only hosts with one of
+	// them open are searched
+	TCPPorts []int
+	// Progress is called as hosts are probed with the number probed so
+	// far and the hosts of the prefix, from the scanning goroutines
+	Progress func(done, total int)
+	// Events is called with every service as soon as its host answers and
+	// with its mappings as they are read, from the scanning goroutines.
+	// The ScanResult of the host follows its events.
+	Events func(ScanEvent)
+}
+
+// ScanEvent is a service found by Scan, or one of its mappings when
+// Mapping is set
+type ScanEvent struct {
+	Host    string
+	Client  *Client
+	Mapping *PortMappingEntry
+}
+
+// ScanService is a WAN connection service found by Scan and its mappings
+type ScanService struct {
+	Client   *Client
+	Mappings []*PortMappingEntry
+	Err      error
+}
+
+// ScanResult is a host that answered the SSDP search
+type ScanResult struct {
+	Host      string
+	Locations []*url.URL
+	OpenTCP   []int
+	Services  []*ScanService
+	Err       error
+}
+
+// Scan searches every host of the CIDR prefix for a UPnP daemon and
+// enumerates the mappings of the gateways found. Results are sent on the
+// returned channel, which is closed when the scan is done.
+func Scan(ctx context.Context, prefix string, opts *ScanOptions) (<-chan *ScanResult, error) {
+	hosts, err := prefixHosts(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	o := ScanOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Workers <= 0 {
+		o.Workers = defaultScanWorkers
+	}
+	if o.Port == "" {
+		o.Port = ":1900"
+	}
+	if o.Wait <= 0 {
+		o.Wait = defaultScanWait
+	}
+
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if o.Rate > 0 {
+		ticker = time.NewTicker(time.Second / time.Duration(o.Rate))
+		tick = ticker.C
+	}
+
+	jobs := make(chan string)
+	results := make(chan *ScanResult)
+
+	var (
+		wg     sync.WaitGroup
+		probed atomic.Int64
+	)
+	for i := 0; i < o.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range jobs {
+				r := scanHost(ctx, host, &o)
+				if o.Progress != nil {
+					o.Progress(int(probed.Add(1)), len(hosts))
+				}
+				if r != nil {
+					select {
+					case results <- r:
+					case <-ctx.Done():
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+	feed:
+		for _, host := range hosts {
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					break feed
+				}
+			}
+			select {
+			case jobs <- host:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		if ticker != nil {
+			ticker.Stop()
+		}
+		close(results)
+	}()
+
+	return results, nil
+}
+
+// scanHost returns nil when host does not answer
+func scanHost(ctx context.Context, host string, o *ScanOptions) *ScanResult {
+	r := &ScanResult{Host: host}
+
+	if len(o.TCPPorts) > 0 {
+		for _, p := range o.TCPPorts {
+			d := net.Dialer{Timeout: defaultTCPTimeout}
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(p)))
+			if err != nil {
+				continue
+			}
+			conn.Close()
+			r.OpenTCP = append(r.OpenTCP, p)
+		}
+		if len(r.OpenTCP) == 0 {
+			return nil
+		}
+	}
+
+	locs, err := LocateAll(ctx, host, o.Port, &o.SearchOptions)
+	if err != nil {
+		if len(r.OpenTCP) == 0 {
+			return nil
+		}
+		r.Err = err
+		return r
+	}
+	r.Locations = locs
+
+	var clients []*Client
+	for _, loc := range locs {
+		cs, err := NewClientsByURL(ctx, loc)
+		if err != nil {
+			r.Err = err
+			continue
+		}
+		clients = append(clients, cs...)
+	}
+	if len(clients) > 0 {
+		r.Err = nil
+	}
+
+	if o.Events != nil {
+		r.Services = streamServices(ctx, host, clients, o.Events)
+		return r
+	}
+
+	mappers := make([]PortMapper, 0, len(clients))
+	for _, c := range clients {
+		mappers = append(mappers, c)
+	}
+
+	for i, l := range ListAllMappings(ctx, mappers, len(mappers)) {
+		r.Services = append(r.Services, &ScanService{Client: clients[i], Mappings: l.Mappings, Err: l.Err})
+	}
+
+	return r
+}
+
+// streamServices lists the mappings of the clients of host concurrently,
+// sending events as they are found
+func streamServices(ctx context.Context, host string, clients []*Client, events func(ScanEvent)) []*ScanService {
+	services := make([]*ScanService, len(clients))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		events(ScanEvent{Host: host, Client: c})
+
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+			entries, err := c.ListMappingsStream(ctx, func(pme *PortMappingEntry) {
+				events(ScanEvent{Host: host, Client: c, Mapping: pme})
+			}, nil)
+			services[i] = &ScanService{Client: c, Mappings: entries, Err: err}
+		}(i, c)
+	}
+	wg.Wait()
+
+	return services
+}
+
+// prefixHosts returns the host addresses of a CIDR prefix or single address
+func prefixHosts(prefix string) ([]string, error) {
+	if !strings.Contains(prefix, "/") {
+		addr, err := netip.ParseAddr(prefix)
+		if err != nil {
+			return nil, err
+		}
+		return []string{addr.String()}, nil
+	}
+
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	p = p.Masked()
+
+	size := p.Addr().BitLen() - p.Bits()
+	if size > 24 {
+		return nil, fmt.Errorf("prefix %s has more than %d addresses", p, maxScanHosts)
+	}
+
+	var hosts []string
+	for a := p.Addr(); p.Contains(a); a = a.Next() {
+		hosts = append(hosts, a.String())
+	}
+
+	// Skip the network and broadcast addresses of IPv4 subnets
+	if p.Addr().Is4() && len(hosts) > 2 {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+
+	if len(hosts) == 0 {
+		return nil, errors.New("prefix has no host addresses")
+	}
+
+	return hosts, nil
+}
+
+// DefaultDescriptionPorts are the TCP ports UPnP stacks commonly serve
+// their device description on: miniupnpd, Windows, libupnp, Huawei and
+// Realtek
+var DefaultDescriptionPorts = []int{5000, 2869, 49152, 49153, 49154, 49155, 49156, 37215, 52869}
+
+// descriptionPaths are the usual paths of root device descriptions
+var descriptionPaths = []string{
+	"/rootDesc.xml",
+	"/description.xml",
+	"/gatedesc.xml",
+	"/igd.xml",
+	"/picsdesc.xml",
+	"/upnp/IGD.xml",
+	"/DeviceDescription.xml",
+	"/devicedesc.xml",
+}
+
+// FindDescriptions looks for root device descriptions on the TCP ports of
+// host, DefaultDescriptionPorts if ports is empty, for networks dropping
+// SSDP. Ports are probed concurrently, the descriptions found are
+// returned in port order.
+func FindDescriptions(ctx context.Context, host string, ports []int) ([]*url.URL, error) {
+	if len(ports) == 0 {
+		ports = DefaultDescriptionPorts
+	}
+
+	found := make([]*url.URL, len(ports))
+	var wg sync.WaitGroup
+	for i, p := range ports {
+		wg.Add(1)
+		go func(i int, p int) {
+			defer wg.Done()
+			found[i] = findDescription(ctx, net.JoinHostPort(host, strconv.Itoa(p)))
+		}(i, p)
+	}
+	wg.Wait()
+
+	var locs []*url.URL
+	for _, loc := range found {
+		if loc != nil {
+			locs = append(locs, loc)
+		}
+	}
+	if len(locs) == 0 {
+		return nil, fmt.Errorf("no device description on TCP ports %v of %s", ports, host)
+	}
+	return locs, nil
+}
+
+// findDescription returns the first description path answering on addr,
+// nil if there is none or nothing listens
+func findDescription(ctx context.Context, addr string) *url.URL {
+	for _, path := range descriptionPaths {
+		loc := &url.URL{Scheme: "http", Host: addr, Path: path}
+
+		body, err := fetchXML(ctx, loc.String())
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			// Closed, filtered or not HTTP, the other paths won't do better
+			return nil
+		}
+		if err != nil {
+			continue
+		}
+		if _, err := parseRootDevice(body, loc); err != nil {
+			continue
+		}
+
+		slog.Info("device description found", "location", loc)
+		return loc
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package portmapping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Source is the local end of SSDP searches and device connections, for
+// multi-homed hosts where the default route isn't the audited network
+type Source struct {
+	// IP is the address the SSDP sockets and the HTTP connections to
+	// devices are bound to, nil leaves the choice to the routing table.
+	// Searches of the other address family aren't bound.
+	IP net.IP
+	// Interface limits IPv6 multicast searches to the named interface
+	Interface string
+}
+
+// sourceKey is the context key of the source set by WithSource
+type sourceKey struct{}
+
+// WithSource returns a copy of ctx making the functions it is passed to
+// search and talk to devices from src. Its HTTP client is set like
+// WithHTTPClient, so a client set after WithSource replaces it.
+func WithSource(ctx context.Context, src Source) context.Context {
+	if src.IP != nil {
+		hc := newSourceHTTPClient(src.IP)
+		ctx = WithHTTPClient(ctx, &hc)
+	}
+	return context.WithValue(ctx, sourceKey{}, src)
+}
+
+// contextSource returns the source set by WithSource, the zero one if none
+// is
+func contextSource(ctx context.Context) Source {
+	src, _ := ctx.Value(sourceKey{}).(Source)
+	return src
+}
+
+// newSourceHTTPClient returns a keep-alive device client connecting from
+// ip to devices of its address family
+func newSourceHTTPClient(ip net.IP) http.Client {
+	t := deviceTransport()
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		if sameFamily(ip, addr) {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+	return http.Client{Transport: &keepAliveTransport{next: t}}
+}
+
+// InterfaceSource returns the source of the named interface: its first
+// IPv4 address, or with ipv6 its first global or unique local IPv6 one.
+// Link-local IPv6 addresses need a zone the SSDP client can't bind, without
+// another one the interface only selects the IPv6 groups searched.
+func InterfaceSource(name string, ipv6 bool) (Source, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return Source{}, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return Source{}, err
+	}
+
+	src := Source{Interface: iface.Name}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if is4 := ipnet.IP.To4() != nil; is4 == ipv6 {
+			continue
+		}
+		if ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		src.IP = ipnet.IP
+		return src, nil
+	}
+	if ipv6 {
+		return src, nil
+	}
+	return Source{}, fmt.Errorf("interface %s has no IPv4 address", name)
+}
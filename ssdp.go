@@ -0,0 +1,531 @@
+package portmapping
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/huin/goupnp/httpu"
+)
+
+const (
+	maxWaitSeconds = 5
+	methodSearch   = "M-SEARCH"
+	ssdpDiscover   = "ssdp:discover"
+	numSends       = 2
+	ssdpMulticast  = "239.255.255.250"
+)
+
+// SearchOptions tune the SSDP search. Zero fields use the defaults.
+type SearchOptions struct {
+	// Wait is how long responses are collected, 5s by default
+	Wait time.Duration
+	// Retries is how many times the M-SEARCH is sent, 2 by default
+	Retries int
+	// MX is the maximum response delay asked from devices in seconds,
+	// derived from Wait by default
+	MX int
+	// SearchTargets are the ST headers searched for concurrently,
+	// DefaultSearchTargets by default
+	SearchTargets []string
+}
+
+// DefaultSearchTargets are searched for unless SearchOptions name others.
+// Some gateways ignore upnp:rootdevice and only answer their own device
+// type, the answers to all of them are merged.
+var DefaultSearchTargets = []string{
+	"upnp:rootdevice",
+	"ssdp:all",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+}
+
+// withDefaults returns o with zero fields set to the defaults
+func (o *SearchOptions) withDefaults() SearchOptions {
+	r := SearchOptions{}
+	if o != nil {
+		r = *o
+	}
+	if r.Wait <= 0 {
+		r.Wait = time.Duration(maxWaitSeconds) * time.Second
+	}
+	if r.Retries <= 0 {
+		r.Retries = numSends
+	}
+	if r.MX <= 0 {
+		r.MX = mx(r.Wait)
+	}
+	if len(r.SearchTargets) == 0 {
+		r.SearchTargets = DefaultSearchTargets
+	}
+	return r
+}
+
+// ssdpMulticast6 are the link-local and site-local IPv6 SSDP groups
+var ssdpMulticast6 = []string{"ff02::c", "ff05::c"}
+
+// ssdpTarget is an address to send an M-SEARCH to and the IPv6 zone to use
+// for link-local locations found through it. Multicast targets are sent
+// from iface, bound to its address bind for IPv4.
+type ssdpTarget struct {
+	addr  string
+	zone  string
+	iface string
+	bind  net.IP
+}
+
+// Locate returns a URL address of the UPnP daemon. It is LocateAll
+// returning only the first responder.
+func Locate(ctx context.Context, host string, port string, opts *SearchOptions) (*url.URL, error) {
+	locs, err := LocateAll(ctx, host, port, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return locs[0], nil
+}
+
+// LocateAll returns the URL addresses of every UPnP daemon answering the
+// search. An empty host sends the search to the IPv4 SSDP multicast group
+// and "::" to the IPv6 groups, both on every interface concurrently unless
+// WithSource selects one. IPv6 literals, including
+// multicast groups and zones like fe80::1%eth0, are accepted as host.
+// A nil opts uses the default search options.
+func LocateAll(ctx context.Context, host string, port string, opts *SearchOptions) ([]*url.URL, error) {
+	responders, err := SearchResponders(ctx, host, port, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	locs := make([]*url.URL, 0, len(responders))
+	for _, r := range responders {
+		locs = append(locs, r.Location)
+	}
+
+	return locs, nil
+}
+
+// Responder is a root device answering an SSDP search
+type Responder struct {
+	Location *url.URL
+	USN      string
+	// BootID and ConfigID are the BOOTID.UPNP.ORG and CONFIGID.UPNP.ORG
+	// headers of UPnP 1.1 devices, empty for older ones. BootID changes
+	// when the device reboots, ConfigID when its description does.
+	BootID   string
+	ConfigID string
+	// Server is the SERVER header naming the OS and UPnP stack
+	Server string
+	// Interface is the one a multicast search found the device on, empty
+	// for unicast searches
+	Interface string
+	// MaxAge is how long the answer is valid by its CACHE-CONTROL header,
+	// zero if it has none
+	MaxAge time.Duration
+}
+
+// Expires returns when the answer received at t runs out, the zero time
+// without a max-age
+func (r Responder) Expires(t time.Time) time.Time {
+	if r.MaxAge <= 0 {
+		return time.Time{}
+	}
+	return t.Add(r.MaxAge)
+}
+
+// maxAge returns the max-age directive of a CACHE-CONTROL header like
+// "max-age=1800", zero if there is none
+func maxAge(cacheControl string) time.Duration {
+	for _, d := range strings.Split(cacheControl, ",") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(d), "max-age"); ok {
+			v, ok = strings.CutPrefix(strings.TrimSpace(v), "=")
+			if secs, err := strconv.Atoi(strings.TrimSpace(v)); ok && err == nil && secs > 0 {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return 0
+}
+
+// SearchResponders is LocateAll returning the SSDP details of the
+// responders along with their locations. With a relay set by WithRelay the
+// agent searches its LAN instead.
+func SearchResponders(ctx context.Context, host string, port string, opts *SearchOptions) ([]Responder, error) {
+	if r := contextRelay(ctx); r != nil {
+		o := opts.withDefaults()
+		return r.search(ctx, host, strings.TrimPrefix(port, ":"), &o)
+	}
+	return searchResponders(ctx, host, port, opts)
+}
+
+func searchResponders(ctx context.Context, host string, port string, opts *SearchOptions) ([]Responder, error) {
+	o := opts.withDefaults()
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	port = strings.TrimPrefix(port, ":")
+
+	responses, err := searchTargets(ctx, ssdpTargets(host, port, contextSource(ctx)), &o)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var responders []Responder
+	for _, r := range responses {
+		rawurl := r.resp.Header.Get("Location")
+
+		loc, err := url.Parse(rawurl)
+		if err != nil {
+			slog.Debug("ssdp: discarding invalid location", "location", rawurl, "err", err)
+			continue
+		}
+		slog.Info("UPnP daemon found", "location", rawurl)
+
+		if host == "" || host == "::" || isMulticast(host) {
+			if ip := net.ParseIP(loc.Hostname()); ip != nil && ip.IsLinkLocalUnicast() && ip.To4() == nil && r.zone != "" {
+				loc.Host = joinHostPort(loc.Hostname()+"%"+r.zone, loc.Port())
+			}
+		} else {
+			loc.Host = joinHostPort(host, loc.Port())
+		}
+
+		if !seen[loc.String()] {
+			seen[loc.String()] = true
+			responders = append(responders, Responder{
+				Location:  loc,
+				USN:       r.resp.Header.Get("USN"),
+				BootID:    r.resp.Header.Get("BOOTID.UPNP.ORG"),
+				ConfigID:  r.resp.Header.Get("CONFIGID.UPNP.ORG"),
+				Server:    r.resp.Header.Get("SERVER"),
+				Interface: r.iface,
+				MaxAge:    maxAge(r.resp.Header.Get("CACHE-CONTROL")),
+			})
+		}
+	}
+
+	if len(responders) == 0 {
+		return nil, errors.New("No SSDP response avaiable")
+	}
+
+	return responders, nil
+}
+
+// ssdpTargets expands host into the addresses the search is sent to.
+// Multicast groups are searched on every interface, or only on the one of
+// src. An IPv4 source address without an interface is a single search
+// bound to it.
+func ssdpTargets(host string, port string, src Source) []ssdpTarget {
+	switch {
+	case host == "" && src.IP != nil && src.Interface == "":
+		return []ssdpTarget{{addr: net.JoinHostPort(ssdpMulticast, port)}}
+	case host == "":
+		targets := multicast4Targets(port, src.Interface)
+		if len(targets) == 0 {
+			// Let the routing table pick one
+			return []ssdpTarget{{addr: net.JoinHostPort(ssdpMulticast, port), iface: src.Interface}}
+		}
+		return targets
+	case host == "::":
+		var targets []ssdpTarget
+		for _, group := range ssdpMulticast6 {
+			targets = append(targets, multicast6Targets(group, port, src.Interface)...)
+		}
+		return targets
+	case isMulticast(host) && !strings.Contains(host, "%") && strings.Contains(host, ":"):
+		return multicast6Targets(host, port, src.Interface)
+	}
+
+	zone := ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		zone = host[i+1:]
+	}
+
+	return []ssdpTarget{{addr: net.JoinHostPort(host, port), zone: zone}}
+}
+
+// multicast4Targets returns the IPv4 group on every up, multicast capable,
+// non-loopback interface with an IPv4 address, or only on the one named
+// only if it isn't empty. Without a bound address the group would only be
+// searched on the interface of the default route.
+func multicast4Targets(port string, only string) []ssdpTarget {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		slog.Warn("ssdp: listing interfaces", "err", err)
+		return nil
+	}
+
+	var targets []ssdpTarget
+	for _, iface := range ifaces {
+		if only != "" && iface.Name != only {
+			continue
+		}
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ip := interfaceIPv4(iface)
+		if ip == nil {
+			continue
+		}
+
+		targets = append(targets, ssdpTarget{
+			addr:  net.JoinHostPort(ssdpMulticast, port),
+			iface: iface.Name,
+			bind:  ip,
+		})
+	}
+
+	return targets
+}
+
+// interfaceIPv4 returns the first IPv4 address of iface, nil if it has none
+func interfaceIPv4(iface net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP
+		}
+	}
+
+	return nil
+}
+
+// multicast6Targets returns group on every up, multicast capable, IPv6
+// enabled interface, or only on the one named only if it isn't empty
+func multicast6Targets(group string, port string, only string) []ssdpTarget {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		slog.Warn("ssdp: listing interfaces", "err", err)
+		return nil
+	}
+
+	var targets []ssdpTarget
+	for _, iface := range ifaces {
+		if only != "" && iface.Name != only {
+			continue
+		}
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if !hasIPv6(iface) {
+			continue
+		}
+
+		targets = append(targets, ssdpTarget{
+			addr:  net.JoinHostPort(group+"%"+iface.Name, port),
+			zone:  iface.Name,
+			iface: iface.Name,
+		})
+	}
+
+	return targets
+}
+
+func hasIPv6(iface net.Interface) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isMulticast(host string) bool {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsMulticast()
+}
+
+// joinHostPort is net.JoinHostPort that leaves out an empty port
+func joinHostPort(host string, port string) string {
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// ssdpResponse is a search response and the zone and interface of the
+// target it answered
+type ssdpResponse struct {
+	resp  *http.Response
+	zone  string
+	iface string
+}
+
+// searchTargets searches all targets for every search target of o
+// concurrently and returns the responses with unique USNs in target and
+// search target order
+func searchTargets(ctx context.Context, targets []ssdpTarget, o *SearchOptions) ([]ssdpResponse, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("No SSDP search target available")
+	}
+
+	type result struct {
+		target ssdpTarget
+		resps  []*http.Response
+		err    error
+	}
+
+	// Every search has its own socket, an HTTPU client does one at a time
+	results := make([]result, len(targets)*len(o.SearchTargets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		for j, st := range o.SearchTargets {
+			wg.Add(1)
+			go func(r *result, t ssdpTarget, st string) {
+				defer wg.Done()
+				r.target = t
+
+				udpcl, err := newHTTPUClient(ctx, t)
+				if err != nil {
+					r.err = err
+					return
+				}
+				defer udpcl.Close()
+
+				r.resps, r.err = ssdpRawSearch(ctx, udpcl, t.addr, st, o)
+			}(&results[i*len(o.SearchTargets)+j], t, st)
+		}
+	}
+	wg.Wait()
+
+	seenUsns := make(map[string]bool)
+	var responses []ssdpResponse
+	for _, r := range results {
+		for _, resp := range r.resps {
+			usn := resp.Header.Get("USN")
+			if usn != "" && seenUsns[usn] {
+				continue
+			}
+			seenUsns[usn] = true
+			responses = append(responses, ssdpResponse{resp: resp, zone: r.target.zone, iface: r.target.iface})
+		}
+	}
+
+	if len(responses) == 0 {
+		return nil, results[0].err
+	}
+
+	return responses, nil
+}
+
+// newHTTPUClient returns an SSDP client for t bound to the source of ctx,
+// if it is of the same address family, or else to its interface address
+func newHTTPUClient(ctx context.Context, t ssdpTarget) (*httpu.HTTPUClient, error) {
+	if ip := t.bindAddr(ctx); ip != nil {
+		return httpu.NewHTTPUClientAddr(ip.String())
+	}
+	return httpu.NewHTTPUClient()
+}
+
+// bindAddr returns the local address the search of t is sent from, nil
+// for any
+func (t ssdpTarget) bindAddr(ctx context.Context) net.IP {
+	if ip := contextSource(ctx).IP; ip != nil && sameFamily(ip, t.addr) {
+		return ip
+	}
+	return t.bind
+}
+
+// sameFamily reports whether ip and the host of addr are both IPv4 or both
+// IPv6
+func sameFamily(ip net.IP, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return (ip.To4() != nil) == !strings.Contains(host, ":")
+}
+
+func ssdpRawSearch(ctx context.Context, httpu *httpu.HTTPUClient, host string, st string, o *SearchOptions) ([]*http.Response, error) {
+	seenUsns := make(map[string]bool)
+	var responses []*http.Response
+
+	// The zone only selects the outgoing interface and is not sent
+	hostHeader := host
+	if i := strings.Index(host, "%"); i >= 0 {
+		hostHeader = host[:i] + host[strings.Index(host, "]"):]
+	}
+
+	req := http.Request{
+		Method: methodSearch,
+		Host:   host,
+		URL:    &url.URL{Opaque: "*"},
+		Header: http.Header{
+			// Putting headers in here avoids them being title-cased.
+			// (The UPnP discovery protocol uses case-sensitive headers)
+			"HOST": []string{hostHeader},
+			"MX":   []string{strconv.FormatInt(int64(o.MX), 10)},
+			"MAN":  []string{ssdpDiscover},
+			"ST":   []string{st},
+		},
+	}
+	allResponses, err := httpu.Do(req.WithContext(ctx), o.Wait+100*time.Millisecond, o.Retries)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, response := range allResponses {
+		slog.Log(ctx, LevelTrace, "ssdp: search response", "target", host, "st", st, "status", response.Status, "headers", response.Header)
+
+		if response.StatusCode != 200 {
+			slog.Debug("ssdp: discarding search response", "status", response.Status)
+			continue
+		}
+
+		location, err := response.Location()
+		if err != nil {
+			slog.Debug("ssdp: discarding search response without usable location", "err", err)
+			continue
+		}
+
+		usn := response.Header.Get("USN")
+		if usn == "" {
+			slog.Debug("ssdp: search response without USN, using location instead", "location", location)
+			usn = location.String()
+		}
+		if _, alreadySeen := seenUsns[usn]; !alreadySeen {
+			seenUsns[usn] = true
+			responses = append(responses, response)
+		}
+	}
+
+	if len(responses) == 0 {
+		return nil, errors.New("No SSDP response avaiable")
+	}
+
+	return responses, nil
+}
+
+// mx returns the MX header value for a search waiting wait
+func mx(wait time.Duration) int {
+	secs := int((wait + time.Second - 1) / time.Second)
+	if secs < 1 {
+		return 1
+	}
+	if secs > maxWaitSeconds {
+		return maxWaitSeconds
+	}
+	return secs
+}
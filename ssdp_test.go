@@ -0,0 +1,41 @@
+package portmapping
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxAge(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"max-age=1800", 1800 * time.Second},
+		{"max-age = 120", 120 * time.Second},
+		{"no-cache, max-age=60", time.Minute},
+		{`max-age=60, no-cache="Ext"`, time.Minute},
+		{"MAX-AGE=60", 0},
+		{"max-age", 0},
+		{"max-age=", 0},
+		{"max-age=0", 0},
+		{"max-age=-5", 0},
+		{"max-age=soon", 0},
+		{"max-agent=60", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := maxAge(tt.header); got != tt.want {
+			t.Errorf("maxAge(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestResponderExpires(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if got := (Responder{MaxAge: time.Minute}).Expires(at); !got.Equal(at.Add(time.Minute)) {
+		t.Errorf("got %s, want a minute later", got)
+	}
+	if got := (Responder{}).Expires(at); !got.IsZero() {
+		t.Errorf("got %s without a max-age, want the zero time", got)
+	}
+}
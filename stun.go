@@ -0,0 +1,108 @@
+package portmapping
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112a442
+	stunHeaderSize      = 20
+
+	stunMappedAddress    = 0x0001
+	stunXorMappedAddress = 0x0020
+)
+
+// DefaultSTUNServer is a public STUN server answering binding requests
+const DefaultSTUNServer = "stun.l.google.com:19302"
+
+// STUNAddress returns the public address and port the STUN server at
+// server (host:port) sees the binding request of this host come from
+func STUNAddress(ctx context.Context, server string) (net.IP, uint16, error) {
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := udpExchange(ctx, server, req, 1500, func(b []byte) bool {
+		return len(b) >= stunHeaderSize &&
+			binary.BigEndian.Uint16(b[0:]) == stunBindingResponse &&
+			bytes.Equal(b[4:20], req[4:20])
+	})
+	if errors.Is(err, errNoResponse) {
+		return nil, 0, fmt.Errorf("%s: no response from STUN server", server)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip, port, ok := parseSTUNAddress(resp)
+	if !ok {
+		return nil, 0, fmt.Errorf("%s: no mapped address in the STUN response", server)
+	}
+	return ip, port, nil
+}
+
+// parseSTUNAddress returns the XOR-MAPPED-ADDRESS of a binding response,
+// or the MAPPED-ADDRESS of servers predating RFC 5389
+func parseSTUNAddress(resp []byte) (net.IP, uint16, bool) {
+	length := int(binary.BigEndian.Uint16(resp[2:]))
+	attrs := resp[stunHeaderSize:]
+	if length < len(attrs) {
+		attrs = attrs[:length]
+	}
+
+	var (
+		ip    net.IP
+		port  uint16
+		found bool
+	)
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		n := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+n > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+n]
+		// Attributes are padded to 4 bytes
+		attrs = attrs[min(len(attrs), 4+(n+3)&^3):]
+
+		if (typ != stunXorMappedAddress && typ != stunMappedAddress) || len(value) < 8 {
+			continue
+		}
+		family := value[1]
+		size := map[byte]int{1: net.IPv4len, 2: net.IPv6len}[family]
+		if size == 0 || len(value) < 4+size {
+			continue
+		}
+
+		p := binary.BigEndian.Uint16(value[2:])
+		addr := make(net.IP, size)
+		copy(addr, value[4:4+size])
+		if typ == stunXorMappedAddress {
+			p ^= stunMagicCookie >> 16
+			// IPv4 addresses are XORed with the cookie, IPv6 ones with
+			// the cookie and transaction ID
+			key := resp[4:20]
+			for i := range addr {
+				addr[i] ^= key[i%len(key)]
+			}
+		}
+		ip, port, found = addr, p, true
+		// The XOR-MAPPED-ADDRESS wins, NATs rewriting addresses in
+		// payloads may have altered the MAPPED-ADDRESS
+		if typ == stunXorMappedAddress {
+			break
+		}
+	}
+	return ip, port, found
+}
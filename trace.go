@@ -0,0 +1,63 @@
+package portmapping
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+
+	"github.com/huin/goupnp/soap"
+)
+
+// traceTransport dumps every HTTP exchange to w
+type traceTransport struct {
+	next http.RoundTripper
+	mu   *sync.Mutex
+	w    io.Writer
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqDump, err := httputil.DumpRequestOut(req, true)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(t.w, ">>> %s\n%s\n", req.URL, reqDump)
+	if err != nil {
+		fmt.Fprintf(t.w, "<<< %s\n%v\n\n", req.URL, err)
+		return nil, err
+	}
+
+	respDump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(t.w, "<<< %s\n%s\n\n", req.URL, respDump)
+
+	return resp, nil
+}
+
+// traceMu serializes the dumps of every traced client
+var traceMu sync.Mutex
+
+// Trace dumps the full HTTP requests and responses of every SOAP action of
+// c to w
+func (c *Client) Trace(w io.Writer) {
+	TraceSOAP(c.SOAPClient, w)
+}
+
+// TraceSOAP dumps the full HTTP requests and responses of sc to w
+func TraceSOAP(sc *soap.SOAPClient, w io.Writer) {
+	next := sc.HTTPClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	sc.HTTPClient.Transport = &traceTransport{next: next, mu: &traceMu, w: w}
+}
@@ -0,0 +1,65 @@
+package portmapping
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// maxIdleConnsPerDevice is how many idle connections to a device are
+	// kept, enough for the services of a device listed concurrently
+	maxIdleConnsPerDevice = 4
+	// maxDrain is how much of an unread response is read to keep its
+	// connection, longer rests are cheaper to close
+	maxDrain = 64 << 10
+)
+
+// newDeviceHTTPClient returns the client the SOAP services of a device
+// share. Its own pool keeps connections to the device alive between
+// actions instead of competing with every other host for the two idle
+// connections of http.DefaultTransport. Requests go through proxy, or the
+// one of the environment if it is nil.
+func newDeviceHTTPClient(proxy *url.URL) http.Client {
+	t := deviceTransport()
+	if proxy != nil {
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	return http.Client{Transport: &keepAliveTransport{next: t}}
+}
+
+// deviceTransport returns the transport of newDeviceHTTPClient
+func deviceTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = maxIdleConnsPerDevice
+	t.IdleConnTimeout = 30 * time.Second
+	return t
+}
+
+// keepAliveTransport makes SOAP exchanges reuse their connection. goupnp
+// stops reading a response at the end of the envelope, so whatever follows,
+// a trailing newline or the last chunk of a chunked response, is left
+// unread and net/http has no choice but to close the connection.
+type keepAliveTransport struct {
+	next http.RoundTripper
+}
+
+func (t *keepAliveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = drainingBody{resp.Body}
+	return resp, nil
+}
+
+// drainingBody reads the rest of a response before closing it
+type drainingBody struct {
+	io.ReadCloser
+}
+
+func (b drainingBody) Close() error {
+	io.Copy(io.Discard, io.LimitReader(b.ReadCloser, maxDrain))
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,92 @@
+package portmapping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/huin/goupnp/soap"
+)
+
+// externalIPServer answers GetExternalIPAddress like devices do, with a
+// newline after the envelope, counting the connections in conns
+func externalIPServer(tb testing.TB, conns *atomic.Int32) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:GetExternalIPAddressResponse xmlns:u="%s"><NewExternalIPAddress>203.0.113.7</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>
+`, internetgateway1.URN_WANIPConnection_1)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+func testClient(tb testing.TB, rawurl string) *Client {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &Client{
+		ServiceClient: goupnp.ServiceClient{SOAPClient: soap.NewSOAPClient(*u)},
+		urn:           internetgateway1.URN_WANIPConnection_1,
+	}
+}
+
+func TestKeepAliveTransport(t *testing.T) {
+	var conns atomic.Int32
+	srv := externalIPServer(t, &conns)
+
+	c := testClient(t, srv.URL)
+	c.SOAPClient.HTTPClient = newDeviceHTTPClient(nil)
+	for i := 0; i < 5; i++ {
+		ip, err := c.ExternalIP(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.String() != "203.0.113.7" {
+			t.Fatalf("got %s, want 203.0.113.7", ip)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("got %d connections, want 1", n)
+	}
+}
+
+func BenchmarkSOAPAction(b *testing.B) {
+	var conns atomic.Int32
+	srv := externalIPServer(b, &conns)
+	ctx := context.Background()
+
+	b.Run("fresh", func(b *testing.B) {
+		c := testClient(b, srv.URL)
+		for i := 0; i < b.N; i++ {
+			c.SOAPClient.HTTPClient = http.Client{Transport: deviceTransport()}
+			if _, err := c.ExternalIP(ctx); err != nil {
+				b.Fatal(err)
+			}
+			c.SOAPClient.HTTPClient.CloseIdleConnections()
+		}
+	})
+	b.Run("shared", func(b *testing.B) {
+		c := testClient(b, srv.URL)
+		c.SOAPClient.HTTPClient = newDeviceHTTPClient(nil)
+		for i := 0; i < b.N; i++ {
+			if _, err := c.ExternalIP(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package portmapping
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// eternalSilenceDescription is the description of the mappings injected by
+// the EternalSilence campaign into routers exposing UPnP on their WAN side
+const eternalSilenceDescription = "galleta silenciosa"
+
+// ProxyCheck finds mappings that look injected to relay traffic through the
+// gateway, the UPnProxy pattern of compromised routers. Legitimate
+// applications map ports to hosts of the LAN for every remote host.
+type ProxyCheck struct {
+	// LAN are networks the internal clients may be in besides the
+	// private, unique local and link-local ranges
+	LAN []*net.IPNet
+	// RemoteHosts are the remote hosts mappings may be restricted to
+	RemoteHosts []*net.IPNet
+}
+
+// Reason returns why pme looks injected, empty if it doesn't
+func (c *ProxyCheck) Reason(pme *PortMappingEntry) string {
+	if strings.EqualFold(strings.TrimSpace(pme.NewPortMappingDescription), eternalSilenceDescription) {
+		return fmt.Sprintf("description %q is the marker of the EternalSilence campaign", pme.NewPortMappingDescription)
+	}
+
+	if client := net.ParseIP(strings.TrimSpace(pme.NewInternalClient)); client != nil {
+		switch {
+		case client.IsLoopback():
+			return fmt.Sprintf("internal client %s is the gateway itself, exposing its local services", client)
+		case !client.IsPrivate() && !client.IsLinkLocalUnicast() && !inNets(c.LAN, client):
+			return fmt.Sprintf("internal client %s is not a LAN address, the gateway relays the traffic to it", client)
+		}
+	}
+
+	if host := strings.TrimSpace(pme.NewRemoteHost); host != "" {
+		remote := net.ParseIP(host)
+		if remote == nil || (!remote.IsPrivate() && !inNets(c.RemoteHosts, remote)) {
+			return fmt.Sprintf("only forwards traffic from the unexpected remote host %s", host)
+		}
+	}
+
+	return ""
+}
+
+// ProxyFinding is a mapping that looks injected and why
+type ProxyFinding struct {
+	Mapping *PortMappingEntry `json:"mapping"`
+	Reason  string            `json:"reason"`
+}
+
+// Check returns the mappings of entries that look injected
+func (c *ProxyCheck) Check(entries []*PortMappingEntry) []ProxyFinding {
+	var findings []ProxyFinding
+	for _, pme := range entries {
+		if reason := c.Reason(pme); reason != "" {
+			findings = append(findings, ProxyFinding{Mapping: pme, Reason: reason})
+		}
+	}
+	return findings
+}
+
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package portmapping
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/huin/goupnp/soap"
+)
+
+type statusInfoResponse struct {
+	NewConnectionStatus    string
+	NewLastConnectionError string
+	NewUptime              string
+}
+
+type natRSIPStatusResponse struct {
+	NewRSIPAvailable string
+	NewNATEnabled    string
+}
+
+type connectionTypeInfoResponse struct {
+	NewConnectionType          string
+	NewPossibleConnectionTypes string
+}
+
+// StatusInfo is the state of the WAN connection
+type StatusInfo struct {
+	// ConnectionStatus is Connected, Disconnected, Connecting and the like
+	ConnectionStatus    string
+	LastConnectionError string
+	Uptime              time.Duration
+}
+
+// StatusInfo returns the state and uptime of the WAN connection
+func (c *Client) StatusInfo(ctx context.Context) (*StatusInfo, error) {
+	resp := &statusInfoResponse{}
+	if err := c.perform(ctx, "GetStatusInfo", nil, resp); err != nil {
+		return nil, err
+	}
+
+	uptime, err := soap.UnmarshalUi4(strings.TrimSpace(resp.NewUptime))
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatusInfo{
+		ConnectionStatus:    resp.NewConnectionStatus,
+		LastConnectionError: resp.NewLastConnectionError,
+		Uptime:              time.Duration(uptime) * time.Second,
+	}, nil
+}
+
+// NATRSIPStatus reports whether the connection does NAT and supports Realm
+// Specific IP
+func (c *Client) NATRSIPStatus(ctx context.Context) (natEnabled bool, rsipAvailable bool, err error) {
+	resp := &natRSIPStatusResponse{}
+	if err := c.perform(ctx, "GetNATRSIPStatus", nil, resp); err != nil {
+		return false, false, err
+	}
+
+	if natEnabled, err = soap.UnmarshalBoolean(strings.TrimSpace(resp.NewNATEnabled)); err != nil {
+		return false, false, err
+	}
+	if rsipAvailable, err = soap.UnmarshalBoolean(strings.TrimSpace(resp.NewRSIPAvailable)); err != nil {
+		return false, false, err
+	}
+
+	return natEnabled, rsipAvailable, nil
+}
+
+// ConnectionTypeInfo returns the connection type, like IP_Routed, and the
+// types the connection can be set to
+func (c *Client) ConnectionTypeInfo(ctx context.Context) (connectionType string, possible []string, err error) {
+	resp := &connectionTypeInfoResponse{}
+	if err := c.perform(ctx, "GetConnectionTypeInfo", nil, resp); err != nil {
+		return "", nil, err
+	}
+
+	return resp.NewConnectionType, strings.Split(resp.NewPossibleConnectionTypes, ","), nil
+}
+
+type commonLinkPropertiesResponse struct {
+	NewWANAccessType              string
+	NewLayer1UpstreamMaxBitRate   string
+	NewLayer1DownstreamMaxBitRate string
+	NewPhysicalLinkStatus         string
+}
+
+// LinkProperties describe the physical WAN link
+type LinkProperties struct {
+	// AccessType is DSL, Cable, Ethernet or POTS
+	AccessType           string
+	UpstreamMaxBitRate   uint32
+	DownstreamMaxBitRate uint32
+	// PhysicalLinkStatus is Up, Down, Initializing or Unavailable
+	PhysicalLinkStatus string
+}
+
+// TrafficCounters are the totals of the WAN interface. The IGD:1 counters
+// are 32 bits and wrap around.
+type TrafficCounters struct {
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+}
+
+// commonInterfaceConfig returns a SOAP client of the WANCommonInterfaceConfig
+// service of the WAN device c belongs to
+func (c *Client) commonInterfaceConfig() (*soap.SOAPClient, error) {
+	var found *goupnp.Service
+	c.RootDevice.Device.VisitDevices(func(d *goupnp.Device) {
+		var common *goupnp.Service
+		owns := false
+		for i := range d.Services {
+			if d.Services[i].ServiceType == internetgateway1.URN_WANCommonInterfaceConfig_1 {
+				common = &d.Services[i]
+			}
+		}
+		if common == nil {
+			return
+		}
+		d.VisitServices(func(s *goupnp.Service) {
+			owns = owns || s == c.Service
+		})
+		if found == nil || owns {
+			found = common
+		}
+	})
+	if found == nil {
+		return nil, ErrNotSupported
+	}
+
+	sc := found.NewSOAPClient()
+	// Keep the transport, which may trace
+	sc.HTTPClient = c.SOAPClient.HTTPClient
+	return sc, nil
+}
+
+// LinkProperties returns the type and maximum bit rates of the WAN link
+func (c *Client) LinkProperties(ctx context.Context) (*LinkProperties, error) {
+	sc, err := c.commonInterfaceConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &commonLinkPropertiesResponse{}
+	if err := sc.PerformActionCtx(ctx, internetgateway1.URN_WANCommonInterfaceConfig_1, "GetCommonLinkProperties", nil, resp); err != nil {
+		return nil, upnpError("GetCommonLinkProperties", err)
+	}
+
+	lp := &LinkProperties{
+		AccessType:         resp.NewWANAccessType,
+		PhysicalLinkStatus: resp.NewPhysicalLinkStatus,
+	}
+	if lp.UpstreamMaxBitRate, err = soap.UnmarshalUi4(strings.TrimSpace(resp.NewLayer1UpstreamMaxBitRate)); err != nil {
+		return nil, err
+	}
+	if lp.DownstreamMaxBitRate, err = soap.UnmarshalUi4(strings.TrimSpace(resp.NewLayer1DownstreamMaxBitRate)); err != nil {
+		return nil, err
+	}
+
+	return lp, nil
+}
+
+// TrafficCounters returns the byte and packet totals of the WAN interface
+func (c *Client) TrafficCounters(ctx context.Context) (*TrafficCounters, error) {
+	sc, err := c.commonInterfaceConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &TrafficCounters{}
+	for _, counter := range []struct {
+		action string
+		value  *uint64
+	}{
+		{"GetTotalBytesSent", &tc.BytesSent},
+		{"GetTotalBytesReceived", &tc.BytesReceived},
+		{"GetTotalPacketsSent", &tc.PacketsSent},
+		{"GetTotalPacketsReceived", &tc.PacketsReceived},
+	} {
+		var out argList
+		if err := sc.PerformActionCtx(ctx, internetgateway1.URN_WANCommonInterfaceConfig_1, counter.action, nil, &out); err != nil {
+			return nil, upnpError(counter.action, err)
+		}
+		if len(out) != 1 {
+			return nil, fmt.Errorf("%s: expected one value, got %d", counter.action, len(out))
+		}
+
+		// Parsed as 64 bits, some devices send more than the ui4 of the spec
+		if *counter.value, err = strconv.ParseUint(out[0].Value, 10, 64); err != nil {
+			return nil, fmt.Errorf("%s: %w", counter.action, err)
+		}
+	}
+
+	return tc, nil
+}
@@ -0,0 +1,164 @@
+package portmapping
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChangeKind tells how a mapping changed between two snapshots
+type ChangeKind string
+
+// Mapping change kinds
+const (
+	MappingAdded   ChangeKind = "added"
+	MappingRemoved ChangeKind = "removed"
+	MappingChanged ChangeKind = "changed"
+)
+
+// MappingChange is a difference between two mapping snapshots. Old is nil
+// for added and New is nil for removed mappings.
+type MappingChange struct {
+	Kind ChangeKind        `json:"kind"`
+	Old  *PortMappingEntry `json:"old,omitempty"`
+	New  *PortMappingEntry `json:"new,omitempty"`
+}
+
+// Key identifies a mapping by remote host, external port and protocol
+func (pme *PortMappingEntry) Key() string {
+	return pme.NewRemoteHost + "|" + pme.NewExternalPort + "|" + strings.ToUpper(pme.NewProtocol)
+}
+
+// sameMapping compares everything but the lease, which counts down.
+// Devices answer enabled as 1 or true.
+func sameMapping(a, b *PortMappingEntry) bool {
+	return a.NewInternalPort == b.NewInternalPort &&
+		a.NewInternalClient == b.NewInternalClient &&
+		a.IsEnabled() == b.IsEnabled() &&
+		a.NewPortMappingDescription == b.NewPortMappingDescription
+}
+
+// DiffMappings returns the changes from old to new ordered by key
+func DiffMappings(old, new []*PortMappingEntry) []MappingChange {
+	before := make(map[string]*PortMappingEntry, len(old))
+	for _, pme := range old {
+		before[pme.Key()] = pme
+	}
+	after := make(map[string]*PortMappingEntry, len(new))
+	for _, pme := range new {
+		after[pme.Key()] = pme
+	}
+
+	var changes []MappingChange
+	for k, n := range after {
+		o, ok := before[k]
+		switch {
+		case !ok:
+			changes = append(changes, MappingChange{Kind: MappingAdded, New: n})
+		case !sameMapping(o, n):
+			changes = append(changes, MappingChange{Kind: MappingChanged, Old: o, New: n})
+		}
+	}
+	for k, o := range before {
+		if _, ok := after[k]; !ok {
+			changes = append(changes, MappingChange{Kind: MappingRemoved, Old: o})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].entry().Key() < changes[j].entry().Key()
+	})
+
+	return changes
+}
+
+// entry returns the current entry of the change, or the removed one
+func (mc MappingChange) entry() *PortMappingEntry {
+	if mc.New != nil {
+		return mc.New
+	}
+	return mc.Old
+}
+
+// WatchFunc receives every snapshot taken by Watch with the changes since
+// the previous one. changes is nil for the first snapshot.
+type WatchFunc func(entries []*PortMappingEntry, changes []MappingChange, err error)
+
+// watcher turns enumerations into WatchFunc calls
+type watcher struct {
+	m    PortMapper
+	fn   WatchFunc
+	prev []*PortMappingEntry
+	have bool
+}
+
+// snapshot enumerates the mappings and reports them to fn
+func (w *watcher) snapshot(ctx context.Context) error {
+	entries, err := w.m.ListMappings(ctx)
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err != nil:
+		w.fn(nil, nil, err)
+	case !w.have:
+		w.fn(entries, nil, nil)
+		w.prev, w.have = entries, true
+	default:
+		w.fn(entries, DiffMappings(w.prev, entries), nil)
+		w.prev = entries
+	}
+
+	return nil
+}
+
+// Watch enumerates the mappings of m every interval and calls fn until ctx
+// is done. Failed enumerations are reported to fn and don't replace the
+// previous snapshot.
+func Watch(ctx context.Context, m PortMapper, interval time.Duration, fn WatchFunc) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	w := &watcher{m: m, fn: fn}
+	for {
+		if err := w.snapshot(ctx); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// WatchExternalIP asks m for its external address every interval and calls
+// fn until ctx is done: with the first address and a nil old one, then
+// whenever it changes. Failed requests are reported to fn and don't
+// replace the previous address.
+func WatchExternalIP(ctx context.Context, m PortMapper, interval time.Duration, fn func(old, new net.IP, err error)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prev net.IP
+	for {
+		ip, err := m.ExternalIP(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			fn(nil, nil, err)
+		case prev == nil || !ip.Equal(prev):
+			fn(prev, ip, nil)
+			prev = ip
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
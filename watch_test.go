@@ -0,0 +1,112 @@
+package portmapping
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testEntry returns an enabled wildcard mapping of port to 192.168.1.10
+func testEntry(port, proto, desc string) *PortMappingEntry {
+	return &PortMappingEntry{
+		NewExternalPort:           port,
+		NewProtocol:               proto,
+		NewInternalPort:           port,
+		NewInternalClient:         "192.168.1.10",
+		NewEnabled:                "1",
+		NewPortMappingDescription: desc,
+		NewLeaseDuration:          "0",
+	}
+}
+
+// with returns a copy of pme changed by fn
+func with(pme *PortMappingEntry, fn func(*PortMappingEntry)) *PortMappingEntry {
+	c := *pme
+	fn(&c)
+	return &c
+}
+
+// changeKinds returns the kinds and keys of changes, for comparisons
+func changeKinds(changes []MappingChange) []string {
+	var out []string
+	for _, c := range changes {
+		pme := c.New
+		if pme == nil {
+			pme = c.Old
+		}
+		out = append(out, string(c.Kind)+" "+pme.Key())
+	}
+	return out
+}
+
+func TestDiffMappings(t *testing.T) {
+	web := testEntry("80", "TCP", "web")
+	dns := testEntry("53", "UDP", "dns")
+
+	tests := []struct {
+		name     string
+		old, new []*PortMappingEntry
+		want     []string
+	}{
+		{"none", nil, nil, nil},
+		{"same", []*PortMappingEntry{web, dns}, []*PortMappingEntry{dns, web}, nil},
+		{"added", []*PortMappingEntry{web}, []*PortMappingEntry{web, dns}, []string{"added |53|UDP"}},
+		{"removed", []*PortMappingEntry{web, dns}, []*PortMappingEntry{dns}, []string{"removed |80|TCP"}},
+		{
+			"lease counting down",
+			[]*PortMappingEntry{web},
+			[]*PortMappingEntry{with(web, func(p *PortMappingEntry) { p.NewLeaseDuration = "3599" })},
+			nil,
+		},
+		{
+			"enabled spelled true",
+			[]*PortMappingEntry{web},
+			[]*PortMappingEntry{with(web, func(p *PortMappingEntry) { p.NewEnabled = "true" })},
+			nil,
+		},
+		{
+			"disabled",
+			[]*PortMappingEntry{web},
+			[]*PortMappingEntry{with(web, func(p *PortMappingEntry) { p.NewEnabled = "0" })},
+			[]string{"changed |80|TCP"},
+		},
+		{
+			"other client",
+			[]*PortMappingEntry{web},
+			[]*PortMappingEntry{with(web, func(p *PortMappingEntry) { p.NewInternalClient = "192.168.1.11" })},
+			[]string{"changed |80|TCP"},
+		},
+		{
+			"protocol case",
+			[]*PortMappingEntry{web},
+			[]*PortMappingEntry{with(web, func(p *PortMappingEntry) { p.NewProtocol = "tcp" })},
+			nil,
+		},
+		{
+			"remote host is another mapping",
+			[]*PortMappingEntry{web},
+			[]*PortMappingEntry{web, with(web, func(p *PortMappingEntry) { p.NewRemoteHost = "198.51.100.4" })},
+			[]string{"added 198.51.100.4|80|TCP"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := changeKinds(DiffMappings(tt.old, tt.new))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffMappingsChanged(t *testing.T) {
+	old := testEntry("80", "TCP", "web")
+	new := with(old, func(p *PortMappingEntry) { p.NewInternalPort = "8080" })
+
+	changes := DiffMappings([]*PortMappingEntry{old}, []*PortMappingEntry{new})
+	if len(changes) != 1 {
+		t.Fatalf("got %d changes, want 1", len(changes))
+	}
+	if changes[0].Old != old || changes[0].New != new {
+		t.Errorf("got %+v, want the old and new entries", changes[0])
+	}
+}